@@ -0,0 +1,823 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// azureAPIVersion is the Blob service REST API version requests are made with
+const azureAPIVersion = "2021-08-06"
+
+// Multipart uploads have no direct Azure equivalent. Each upload is recorded
+// by a marker blob under azureUploadsPrefix whose metadata holds the target
+// key and content type, and parts are staged as uncommitted blocks on the
+// target blob. Block IDs encode the upload ID, part number and the part's
+// MD5, so CompleteMultipartUpload can recover part ETags from Get Block List
+// before committing the blocks with Put Block List.
+//
+// Committing a block list discards every other uncommitted block of the
+// blob, so concurrent multipart uploads to the same key are not supported.
+const azureUploadsPrefix = ".s3proxy/uploads/"
+
+func init() {
+	RegisterBackend("azure", validateAzureSite, func(s Site) (S3Proxy, error) {
+		return NewAzureProxy(*s.Azure, s.AWSBucket)
+	})
+}
+
+// AzureConfig configures the Azure Blob Storage backend. Either AccountKey
+// (Shared Key) or SASToken authenticates requests. Endpoint defaults to the
+// public blob endpoint of the account; set it for sovereign clouds or local
+// emulators such as Azurite ("http://127.0.0.1:10000/devstoreaccount1").
+type AzureConfig struct {
+	Account    string         `json:"account" yaml:"account"`
+	AccountKey string         `json:"accountKey,omitempty" yaml:"accountKey,omitempty"`
+	SASToken   string         `json:"sasToken,omitempty" yaml:"sasToken,omitempty"`
+	Container  string         `json:"container,omitempty" yaml:"container,omitempty"`
+	Endpoint   string         `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	Website    *WebsiteConfig `json:"website,omitempty" yaml:"website,omitempty"`
+}
+
+func validateAzureSite(s Site) error {
+	if s.Azure == nil || s.Azure.Account == "" {
+		return errors.New("Azure account not specified")
+	}
+
+	if s.Azure.AccountKey == "" && s.Azure.SASToken == "" {
+		return errors.New("Azure accountKey or sasToken not specified")
+	}
+
+	if s.Azure.AccountKey != "" {
+		if _, err := base64.StdEncoding.DecodeString(s.Azure.AccountKey); err != nil {
+			return errors.New("Azure accountKey is not valid base64")
+		}
+	}
+
+	if s.Azure.Container == "" && s.AWSBucket == "" {
+		return errors.New("Azure container not specified")
+	}
+
+	return nil
+}
+
+// AzureProxy is an S3Proxy backed by an Azure Blob Storage container
+type AzureProxy struct {
+	client    *http.Client
+	account   string
+	key       []byte
+	sas       url.Values
+	endpoint  *url.URL
+	container string
+	website   *WebsiteConfig
+}
+
+// NewAzureProxy creates a backend for the configured container, falling back
+// to bucketName when no container is set
+func NewAzureProxy(cfg AzureConfig, bucketName string) (*AzureProxy, error) {
+	p := &AzureProxy{
+		client:    http.DefaultClient,
+		account:   cfg.Account,
+		container: cfg.Container,
+		website:   cfg.Website,
+	}
+
+	if p.container == "" {
+		p.container = bucketName
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + cfg.Account + ".blob.core.windows.net"
+	}
+
+	var err error
+	if p.endpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/")); err != nil {
+		return nil, fmt.Errorf("Invalid Azure endpoint: %v", err)
+	}
+
+	if cfg.AccountKey != "" {
+		if p.key, err = base64.StdEncoding.DecodeString(cfg.AccountKey); err != nil {
+			return nil, errors.New("Azure accountKey is not valid base64")
+		}
+	} else if p.sas, err = url.ParseQuery(strings.TrimPrefix(cfg.SASToken, "?")); err != nil {
+		return nil, fmt.Errorf("Invalid Azure sasToken: %v", err)
+	}
+
+	return p, nil
+}
+
+// blobURL returns the URL of a blob, or of the container when key is empty.
+// Keys are escaped per component so that "/" keeps separating path segments.
+func (p *AzureProxy) blobURL(key string, query url.Values) *url.URL {
+	u := *p.endpoint
+	u.RawPath = u.EscapedPath() + "/" + url.PathEscape(p.container)
+	if key != "" {
+		u.RawPath += "/" + escapeKey(key)
+	}
+	u.Path, _ = url.PathUnescape(u.RawPath)
+
+	q := url.Values{}
+	for k, v := range p.sas {
+		q[k] = v
+	}
+	for k, v := range query {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	return &u
+}
+
+// do sends a request, signing it with Shared Key when an account key is
+// configured, and converts Azure error responses into S3 errors
+func (p *AzureProxy) do(method string, key string, query url.Values, header http.Header, body io.ReadSeeker) (*http.Response, error) {
+	var length int64
+	if body != nil {
+		var err error
+		if length, err = body.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+		if _, err = body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, p.blobURL(key, query).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Azure requires a Content-Length on writes, so empty bodies are sent
+	// as http.NoBody rather than with chunked encoding
+	if length > 0 {
+		req.Body = io.NopCloser(body)
+		req.ContentLength = length
+	} else if method == http.MethodPut {
+		req.Body = http.NoBody
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+
+	if p.key != nil {
+		req.Header.Set("Authorization", "SharedKey "+p.account+":"+azureSignature(p.key, p.account, req))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, azureError(resp, key)
+	}
+
+	return resp, nil
+}
+
+// azureSignature computes the Shared Key signature of a request
+func azureSignature(key []byte, account string, req *http.Request) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var b strings.Builder
+	b.WriteString(req.Method + "\n")
+	for _, h := range []string{"Content-Encoding", "Content-Language"} {
+		b.WriteString(req.Header.Get(h) + "\n")
+	}
+	b.WriteString(length + "\n")
+	for _, h := range []string{"Content-MD5", "Content-Type", "Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		b.WriteString(req.Header.Get(h) + "\n")
+	}
+
+	var msHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower)
+		}
+	}
+	sort.Strings(msHeaders)
+	for _, name := range msHeaders {
+		b.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	b.WriteString("/" + account + req.URL.EscapedPath())
+
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// azureError maps an Azure error response to the error S3 would return
+func azureError(resp *http.Response, key string) error {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(resp.Body).Decode(&body)
+
+	// HEAD responses carry the code in a header only
+	if body.Code == "" {
+		body.Code = resp.Header.Get("x-ms-error-code")
+	}
+
+	requestId := resp.Header.Get("x-ms-request-id")
+	switch body.Code {
+	case "BlobNotFound":
+		return errNoSuchKey(key)
+	case "ContainerNotFound":
+		return awserr.NewRequestFailure(
+			awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil),
+			http.StatusNotFound, requestId)
+	case "BlobArchived":
+		return awserr.NewRequestFailure(
+			awserr.New(s3.ErrCodeInvalidObjectState, "The operation is not valid for the object's storage class", nil),
+			http.StatusForbidden, requestId)
+	case "InvalidRange":
+		return awserr.NewRequestFailure(
+			awserr.New("InvalidRange", "The requested range is not satisfiable", nil),
+			http.StatusRequestedRangeNotSatisfiable, requestId)
+	case "ConditionNotMet":
+		return awserr.NewRequestFailure(
+			awserr.New("PreconditionFailed", "At least one of the preconditions you specified did not hold", nil),
+			http.StatusPreconditionFailed, requestId)
+	case "AuthenticationFailed":
+		return awserr.NewRequestFailure(
+			awserr.New("SignatureDoesNotMatch", body.Message, nil),
+			http.StatusForbidden, requestId)
+	}
+
+	if body.Code == "" {
+		if resp.StatusCode == http.StatusNotFound {
+			return errNoSuchKey(key)
+		}
+		body.Code = http.StatusText(resp.StatusCode)
+	}
+
+	return awserr.NewRequestFailure(awserr.New(body.Code, body.Message, nil), resp.StatusCode, requestId)
+}
+
+// azureETag returns an Azure ETag in the quoted form S3 uses
+func azureETag(etag string) string {
+	return `"` + strings.Trim(etag, `"`) + `"`
+}
+
+// azureStorageClass maps an Azure access tier to the closest S3 storage class
+func azureStorageClass(tier string) string {
+	switch strings.ToLower(tier) {
+	case "cool", "cold":
+		return s3.StorageClassStandardIa
+	case "archive":
+		return s3.StorageClassGlacier
+	}
+	return s3.StorageClassStandard
+}
+
+// azureRestore maps a rehydration status to an x-amz-restore header value
+func azureRestore(archiveStatus string) *string {
+	if strings.HasPrefix(archiveStatus, "rehydrate-pending") {
+		return aws.String(`ongoing-request="true"`)
+	}
+	return nil
+}
+
+func azureMetadata(header http.Header) map[string]*string {
+	var meta map[string]*string
+	for name := range header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-ms-meta-") {
+			if meta == nil {
+				meta = make(map[string]*string)
+			}
+			meta[strings.TrimPrefix(lower, "x-ms-meta-")] = aws.String(header.Get(name))
+		}
+	}
+	return meta
+}
+
+func parseLength(value string) int64 {
+	n, _ := strconv.ParseInt(value, 10, 64)
+	return n
+}
+
+func parseHTTPTime(value string) *time.Time {
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// escapeKey percent-encodes each "/" separated component of a key
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func (p *AzureProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	header := http.Header{}
+	if rangeHeader != "" {
+		header.Set("x-ms-range", rangeHeader)
+	}
+
+	resp, err := p.do(http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &s3.GetObjectOutput{
+		AcceptRanges:       aws.String("bytes"),
+		Body:               resp.Body,
+		CacheControl:       aws.String(resp.Header.Get("Cache-Control")),
+		ContentDisposition: aws.String(resp.Header.Get("Content-Disposition")),
+		ContentEncoding:    aws.String(resp.Header.Get("Content-Encoding")),
+		ContentLanguage:    aws.String(resp.Header.Get("Content-Language")),
+		ContentLength:      aws.Int64(parseLength(resp.Header.Get("Content-Length"))),
+		ContentType:        aws.String(resp.Header.Get("Content-Type")),
+		ETag:               aws.String(azureETag(resp.Header.Get("ETag"))),
+		LastModified:       parseHTTPTime(resp.Header.Get("Last-Modified")),
+		Metadata:           azureMetadata(resp.Header),
+		StorageClass:       aws.String(azureStorageClass(resp.Header.Get("x-ms-access-tier"))),
+		Restore:            azureRestore(resp.Header.Get("x-ms-archive-status")),
+	}
+
+	if cr := resp.Header.Get("Content-Range"); cr != "" && resp.StatusCode == http.StatusPartialContent {
+		out.ContentRange = aws.String(cr)
+	}
+
+	return out, nil
+}
+
+func (p *AzureProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	resp, err := p.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &s3.HeadObjectOutput{
+		AcceptRanges:       aws.String("bytes"),
+		CacheControl:       aws.String(resp.Header.Get("Cache-Control")),
+		ContentDisposition: aws.String(resp.Header.Get("Content-Disposition")),
+		ContentEncoding:    aws.String(resp.Header.Get("Content-Encoding")),
+		ContentLanguage:    aws.String(resp.Header.Get("Content-Language")),
+		ContentLength:      aws.Int64(parseLength(resp.Header.Get("Content-Length"))),
+		ContentType:        aws.String(resp.Header.Get("Content-Type")),
+		ETag:               aws.String(azureETag(resp.Header.Get("ETag"))),
+		LastModified:       parseHTTPTime(resp.Header.Get("Last-Modified")),
+		Metadata:           azureMetadata(resp.Header),
+		StorageClass:       aws.String(azureStorageClass(resp.Header.Get("x-ms-access-tier"))),
+		Restore:            azureRestore(resp.Header.Get("x-ms-archive-status")),
+	}, nil
+}
+
+func (p *AzureProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	if strings.HasPrefix(key, azureUploadsPrefix) {
+		return nil, errInvalidArgument("Keys under " + azureUploadsPrefix + " are reserved")
+	}
+
+	header := http.Header{}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("Content-Type", contentType)
+
+	resp, err := p.do(http.MethodPut, key, nil, header, body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &s3.PutObjectOutput{ETag: aws.String(azureETag(resp.Header.Get("ETag")))}, nil
+}
+
+func (p *AzureProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	resp, err := p.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		// S3 deletes are idempotent
+		if isNotFound(err) {
+			return &s3.DeleteObjectOutput{}, nil
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+type azureBlob struct {
+	Name       string `xml:"Name"`
+	Properties struct {
+		LastModified  string `xml:"Last-Modified"`
+		ETag          string `xml:"Etag"`
+		ContentLength int64  `xml:"Content-Length"`
+		AccessTier    string `xml:"AccessTier"`
+	} `xml:"Properties"`
+	Metadata struct {
+		Key         string `xml:"key"`
+		ContentType string `xml:"contenttype"`
+		Initiated   string `xml:"initiated"`
+	} `xml:"Metadata"`
+}
+
+type azureListResult struct {
+	Blobs struct {
+		Blob       []azureBlob `xml:"Blob"`
+		BlobPrefix []struct {
+			Name string `xml:"Name"`
+		} `xml:"BlobPrefix"`
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (p *AzureProxy) listBlobs(query url.Values) (*azureListResult, error) {
+	query.Set("restype", "container")
+	query.Set("comp", "list")
+
+	resp, err := p.do(http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result azureListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding Azure blob list: %v", err)
+	}
+
+	return &result, nil
+}
+
+func (p *AzureProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	if maxKeys <= 0 || maxKeys > defaultMaxKeys {
+		maxKeys = defaultMaxKeys
+	}
+
+	query := url.Values{}
+	query.Set("maxresults", strconv.FormatInt(maxKeys, 10))
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	// Azure markers are opaque, so they are passed through as tokens
+	if continuationToken != "" {
+		query.Set("marker", continuationToken)
+	}
+
+	result, err := p.listBlobs(query)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &s3.ListObjectsV2Output{
+		Prefix:      aws.String(prefix),
+		MaxKeys:     aws.Int64(maxKeys),
+		IsTruncated: aws.Bool(result.NextMarker != ""),
+	}
+	if result.NextMarker != "" {
+		out.NextContinuationToken = aws.String(result.NextMarker)
+	}
+
+	// Upload markers are an implementation detail and never listed
+	for _, blob := range result.Blobs.Blob {
+		if strings.HasPrefix(blob.Name, azureUploadsPrefix) {
+			continue
+		}
+
+		out.Contents = append(out.Contents, &s3.Object{
+			Key:          aws.String(blob.Name),
+			ETag:         aws.String(azureETag(blob.Properties.ETag)),
+			Size:         aws.Int64(blob.Properties.ContentLength),
+			LastModified: parseHTTPTime(blob.Properties.LastModified),
+			StorageClass: aws.String(azureStorageClass(blob.Properties.AccessTier)),
+		})
+	}
+	for _, bp := range result.Blobs.BlobPrefix {
+		if strings.HasPrefix(azureUploadsPrefix, bp.Name) {
+			continue
+		}
+		out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(bp.Name)})
+	}
+	out.KeyCount = aws.Int64(int64(len(out.Contents) + len(out.CommonPrefixes)))
+
+	return out, nil
+}
+
+func (p *AzureProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	uploadId := newUploadID()
+
+	header := http.Header{}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("x-ms-meta-key", url.PathEscape(key))
+	header.Set("x-ms-meta-contenttype", url.PathEscape(contentType))
+	header.Set("x-ms-meta-initiated", time.Now().UTC().Format(time.RFC3339))
+
+	resp, err := p.do(http.MethodPut, azureUploadsPrefix+uploadId, nil, header, bytes.NewReader(nil))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &s3.CreateMultipartUploadOutput{
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}, nil
+}
+
+// upload returns the target key and content type of an in-progress upload
+func (p *AzureProxy) upload(key string, uploadId string) (string, error) {
+	if _, err := hex.DecodeString(uploadId); err != nil || uploadId == "" {
+		return "", errNoSuchUpload(uploadId)
+	}
+
+	resp, err := p.do(http.MethodHead, azureUploadsPrefix+uploadId, nil, nil, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return "", errNoSuchUpload(uploadId)
+		}
+		return "", err
+	}
+	resp.Body.Close()
+
+	if target, _ := url.PathUnescape(resp.Header.Get("x-ms-meta-key")); target != key {
+		return "", errNoSuchUpload(uploadId)
+	}
+
+	contentType, _ := url.PathUnescape(resp.Header.Get("x-ms-meta-contenttype"))
+	return contentType, nil
+}
+
+// azureBlockIDSize is the length of a block ID before encoding: the upload
+// ID, a two byte part number and the part's MD5. Azure allows at most 64
+// bytes.
+const azureBlockIDSize = 16 + 2 + md5.Size
+
+// azureBlockID encodes a part as a block ID. All IDs of a blob must have the
+// same length, which the fixed-width binary fields guarantee.
+func azureBlockID(uploadId string, partNumber int64, sum []byte) string {
+	raw, _ := hex.DecodeString(uploadId)
+	raw = binary.BigEndian.AppendUint16(raw, uint16(partNumber))
+	raw = append(raw, sum...)
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// parseAzureBlockID is the inverse of azureBlockID
+func parseAzureBlockID(id string) (uploadId string, partNumber int64, etag string, ok bool) {
+	raw, err := base64.StdEncoding.DecodeString(id)
+	if err != nil || len(raw) != azureBlockIDSize {
+		return "", 0, "", false
+	}
+
+	partNumber = int64(binary.BigEndian.Uint16(raw[16:18]))
+	return hex.EncodeToString(raw[:16]), partNumber, quoteETag(raw[18:]), true
+}
+
+func (p *AzureProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	if partNumber < 1 || partNumber > 10000 {
+		return nil, errInvalidArgument("Part number must be an integer between 1 and 10000, inclusive")
+	}
+
+	if _, err := p.upload(key, uploadId); err != nil {
+		return nil, err
+	}
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return nil, err
+	}
+	sum := hash.Sum(nil)
+
+	query := url.Values{}
+	query.Set("comp", "block")
+	query.Set("blockid", azureBlockID(uploadId, partNumber, sum))
+
+	resp, err := p.do(http.MethodPut, key, query, nil, body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &s3.UploadPartOutput{ETag: aws.String(quoteETag(sum))}, nil
+}
+
+func (p *AzureProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	contentType, err := p.upload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("comp", "blocklist")
+	query.Set("blocklisttype", "uncommitted")
+
+	resp, err := p.do(http.MethodGet, key, query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var blockList struct {
+		Blocks []struct {
+			Name string `xml:"Name"`
+		} `xml:"UncommittedBlocks>Block"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&blockList)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("decoding Azure block list: %v", err)
+	}
+
+	// A part number may have been uploaded more than once; the ETag in the
+	// completion request selects which upload of it is used
+	staged := make(map[int64]map[string]string)
+	for _, block := range blockList.Blocks {
+		id, n, etag, ok := parseAzureBlockID(block.Name)
+		if !ok || id != uploadId {
+			continue
+		}
+		if staged[n] == nil {
+			staged[n] = make(map[string]string)
+		}
+		staged[n][etag] = block.Name
+	}
+
+	uploaded := make(map[int64]string, len(parts))
+	for _, part := range parts {
+		n := aws.Int64Value(part.PartNumber)
+		etag := `"` + strings.Trim(aws.StringValue(part.ETag), `"`) + `"`
+		if _, ok := staged[n][etag]; ok {
+			uploaded[n] = etag
+		}
+	}
+
+	if err := checkCompletedParts(parts, uploaded); err != nil {
+		return nil, err
+	}
+
+	type BlockList struct {
+		XMLName     xml.Name `xml:"BlockList"`
+		Uncommitted []string `xml:"Uncommitted"`
+	}
+
+	commit := BlockList{}
+	sums := make([][]byte, 0, len(parts))
+	for _, part := range parts {
+		n := aws.Int64Value(part.PartNumber)
+		commit.Uncommitted = append(commit.Uncommitted, staged[n][uploaded[n]])
+		sum, _ := hex.DecodeString(strings.Trim(uploaded[n], `"`))
+		sums = append(sums, sum)
+	}
+
+	body, err := xml.Marshal(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("x-ms-blob-content-type", contentType)
+
+	query = url.Values{}
+	query.Set("comp", "blocklist")
+
+	resp, err = p.do(http.MethodPut, key, query, header, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if _, err := p.AbortMultipartUpload(key, uploadId); err != nil && !isNotFound(err) {
+		return nil, err
+	}
+
+	// Report the S3 multipart ETag for the completion; later reads return
+	// the ETag Azure assigned to the committed blob
+	return &s3.CompleteMultipartUploadOutput{
+		Key:  aws.String(key),
+		ETag: aws.String(multipartETag(sums)),
+	}, nil
+}
+
+func (p *AzureProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	if _, err := p.upload(key, uploadId); err != nil {
+		return nil, err
+	}
+
+	// Uncommitted blocks are garbage collected by Azure after a week
+	resp, err := p.do(http.MethodDelete, azureUploadsPrefix+uploadId, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (p *AzureProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	var uploads []*s3.MultipartUpload
+
+	query := url.Values{}
+	query.Set("prefix", azureUploadsPrefix)
+	query.Set("include", "metadata")
+	for {
+		result, err := p.listBlobs(query)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, blob := range result.Blobs.Blob {
+			key, _ := url.PathUnescape(blob.Metadata.Key)
+			initiated, _ := time.Parse(time.RFC3339, blob.Metadata.Initiated)
+			uploads = append(uploads, &s3.MultipartUpload{
+				Key:          aws.String(key),
+				UploadId:     aws.String(strings.TrimPrefix(blob.Name, azureUploadsPrefix)),
+				Initiated:    aws.Time(initiated),
+				StorageClass: aws.String(s3.StorageClassStandard),
+			})
+		}
+
+		if result.NextMarker == "" {
+			break
+		}
+		query.Set("marker", result.NextMarker)
+	}
+
+	out := listUploads(uploads, prefix, delimiter, maxUploads)
+	out.Prefix = aws.String(prefix)
+	return out, nil
+}
+
+func (p *AzureProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	return p.website.output()
+}
+
+// RestoreObject rehydrates an archived blob to the hot tier. Azure keeps
+// rehydrated blobs in the hot tier, so days is not used.
+func (p *AzureProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	head, err := p.Head(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if aws.StringValue(head.StorageClass) != s3.StorageClassGlacier {
+		return nil, errObjectAlreadyInActiveTier()
+	}
+
+	priority := "Standard"
+	if tier == s3.TierExpedited {
+		priority = "High"
+	}
+
+	header := http.Header{}
+	header.Set("x-ms-access-tier", "Hot")
+	header.Set("x-ms-rehydrate-priority", priority)
+
+	query := url.Values{}
+	query.Set("comp", "tier")
+
+	resp, err := p.do(http.MethodPut, key, query, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &s3.RestoreObjectOutput{}, nil
+}
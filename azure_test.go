@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The well-known development storage credentials used by Azurite
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+type fakeBlob struct {
+	data        []byte
+	contentType string
+	etag        string
+	meta        map[string]string
+}
+
+// fakeAzure is a minimal Azurite-style stand-in for the Blob REST API. It
+// checks Shared Key signatures, or the SAS token when sas is set.
+type fakeAzure struct {
+	sas string
+
+	mu       sync.Mutex
+	blobs    map[string]*fakeBlob
+	blocks   map[string]map[string][]byte
+	versions int
+}
+
+func newFakeAzure() *fakeAzure {
+	return &fakeAzure{
+		blobs:  make(map[string]*fakeBlob),
+		blocks: make(map[string]map[string][]byte),
+	}
+}
+
+func (f *fakeAzure) fail(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.sas != "" {
+		if r.URL.Query().Get("sig") != f.sas || r.Header.Get("Authorization") != "" {
+			f.fail(w, r, http.StatusForbidden, "AuthenticationFailed")
+			return
+		}
+	} else {
+		key, _ := base64.StdEncoding.DecodeString(azuriteKey)
+		want := "SharedKey " + azuriteAccount + ":" + azureSignature(key, azuriteAccount, r)
+		if r.Header.Get("Authorization") != want {
+			f.fail(w, r, http.StatusForbidden, "AuthenticationFailed")
+			return
+		}
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"+azuriteAccount+"/"), "/", 2)
+	if parts[0] != "container" {
+		f.fail(w, r, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	if len(parts) == 1 {
+		f.list(w, query)
+		return
+	}
+	name := parts[1]
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		// Azure limits block IDs to 64 bytes before encoding
+		if id, err := base64.StdEncoding.DecodeString(query.Get("blockid")); err != nil || len(id) > 64 {
+			f.fail(w, r, http.StatusBadRequest, "InvalidQueryParameterValue")
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		if f.blocks[name] == nil {
+			f.blocks[name] = make(map[string][]byte)
+		}
+		f.blocks[name][query.Get("blockid")] = data
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Uncommitted []string `xml:"Uncommitted"`
+		}
+		xml.NewDecoder(r.Body).Decode(&list)
+
+		var data []byte
+		for _, id := range list.Uncommitted {
+			block, ok := f.blocks[name][id]
+			if !ok {
+				f.fail(w, r, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		delete(f.blocks, name)
+		f.store(w, name, data, r.Header.Get("x-ms-blob-content-type"), nil)
+
+	case r.Method == http.MethodGet && query.Get("comp") == "blocklist":
+		ids := make([]string, 0, len(f.blocks[name]))
+		for id := range f.blocks[name] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		fmt.Fprint(w, "<BlockList><UncommittedBlocks>")
+		for _, id := range ids {
+			fmt.Fprintf(w, "<Block><Name>%s</Name><Size>%d</Size></Block>", id, len(f.blocks[name][id]))
+		}
+		fmt.Fprint(w, "</UncommittedBlocks></BlockList>")
+
+	case r.Method == http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" || r.ContentLength < 0 {
+			f.fail(w, r, http.StatusBadRequest, "InvalidHeaderValue")
+			return
+		}
+		meta := make(map[string]string)
+		for k := range r.Header {
+			if lower := strings.ToLower(k); strings.HasPrefix(lower, "x-ms-meta-") {
+				meta[strings.TrimPrefix(lower, "x-ms-meta-")] = r.Header.Get(k)
+			}
+		}
+		data, _ := io.ReadAll(r.Body)
+		f.store(w, name, data, r.Header.Get("Content-Type"), meta)
+
+	case r.Method == http.MethodDelete:
+		if _, ok := f.blobs[name]; !ok {
+			f.fail(w, r, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		blob, ok := f.blobs[name]
+		if !ok {
+			f.fail(w, r, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+
+		data, status := blob.data, http.StatusOK
+		if rng := r.Header.Get("x-ms-range"); rng != "" {
+			start, end, err := parseByteRange(rng, int64(len(data)))
+			if err != nil {
+				f.fail(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			w.Header().Set("Content-Range", contentRange(start, end, int64(len(data))))
+			data, status = data[start:end+1], http.StatusPartialContent
+		}
+
+		for k, v := range blob.meta {
+			w.Header().Set("x-ms-meta-"+k, v)
+		}
+		w.Header().Set("Content-Type", blob.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("ETag", blob.etag)
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		w.Header().Set("x-ms-access-tier", "Hot")
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	default:
+		f.fail(w, r, http.StatusMethodNotAllowed, "UnsupportedHttpVerb")
+	}
+}
+
+func (f *fakeAzure) store(w http.ResponseWriter, name string, data []byte, contentType string, meta map[string]string) {
+	f.versions++
+	blob := &fakeBlob{
+		data:        data,
+		contentType: contentType,
+		etag:        fmt.Sprintf(`"0x8D%014X"`, f.versions),
+		meta:        meta,
+	}
+	f.blobs[name] = blob
+	w.Header().Set("ETag", blob.etag)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeAzure) list(w http.ResponseWriter, query url.Values) {
+	prefix, delimiter, marker := query.Get("prefix"), query.Get("delimiter"), query.Get("marker")
+	max, _ := strconv.Atoi(query.Get("maxresults"))
+	if max <= 0 {
+		max = 5000
+	}
+
+	names := make([]string, 0, len(f.blobs))
+	for name := range f.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var entries []string
+	next := ""
+	lastPrefix := ""
+	for _, name := range names {
+		if name < marker {
+			continue
+		}
+
+		entry := ""
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				cp := name[:len(prefix)+i+len(delimiter)]
+				if cp == lastPrefix || cp < marker {
+					continue
+				}
+				lastPrefix = cp
+				entry = "<BlobPrefix><Name>" + cp + "</Name></BlobPrefix>"
+			}
+		}
+
+		if len(entries) == max {
+			next = name
+			if lastPrefix != "" && strings.HasPrefix(name, lastPrefix) {
+				next = lastPrefix
+			}
+			break
+		}
+
+		if entry == "" {
+			blob := f.blobs[name]
+			entry = fmt.Sprintf("<Blob><Name>%s</Name><Properties><Last-Modified>Mon, 01 Jan 2024 00:00:00 GMT</Last-Modified>"+
+				"<Etag>%s</Etag><Content-Length>%d</Content-Length><AccessTier>Hot</AccessTier></Properties><Metadata>",
+				name, blob.etag, len(blob.data))
+			if query.Get("include") == "metadata" {
+				for k, v := range blob.meta {
+					entry += "<" + k + ">" + v + "</" + k + ">"
+				}
+			}
+			entry += "</Metadata></Blob>"
+		}
+		entries = append(entries, entry)
+	}
+
+	fmt.Fprintf(w, "<EnumerationResults><Blobs>%s</Blobs><NextMarker>%s</NextMarker></EnumerationResults>",
+		strings.Join(entries, ""), next)
+}
+
+func newTestAzureProxy(t *testing.T, fake *fakeAzure) *AzureProxy {
+	t.Helper()
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	cfg := AzureConfig{
+		Account:  azuriteAccount,
+		Endpoint: server.URL + "/" + azuriteAccount,
+	}
+	if fake.sas != "" {
+		cfg.SASToken = "?sv=2021-08-06&sp=rwdl&sig=" + fake.sas
+	} else {
+		cfg.AccountKey = azuriteKey
+	}
+
+	p, err := NewAzureProxy(cfg, "container")
+	if err != nil {
+		t.Fatalf("NewAzureProxy() error = %v", err)
+	}
+	return p
+}
+
+func TestAzureProxy_PutGetDelete(t *testing.T) {
+	p := newTestAzureProxy(t, newFakeAzure())
+
+	putString(t, p, "dir/hello world.txt", "hello world")
+
+	if got := getString(t, p, "dir/hello world.txt", ""); got != "hello world" {
+		t.Errorf("Get() = %q, want %q", got, "hello world")
+	}
+	if got := getString(t, p, "dir/hello world.txt", "bytes=6-"); got != "world" {
+		t.Errorf("Get() with range = %q, want %q", got, "world")
+	}
+
+	head, err := p.Head("dir/hello world.txt")
+	if err != nil {
+		t.Fatalf("Head() error = %v", err)
+	}
+	if aws.Int64Value(head.ContentLength) != 11 || aws.StringValue(head.ContentType) != "text/plain" {
+		t.Errorf("Head() = %v", head)
+	}
+	if etag := aws.StringValue(head.ETag); !strings.HasPrefix(etag, `"0x8D`) {
+		t.Errorf("Head() ETag = %s, want quoted Azure ETag", etag)
+	}
+
+	if _, err := p.Get("dir/hello world.txt", "bytes=50-"); err == nil {
+		t.Error("Get() with unsatisfiable range should fail")
+	}
+
+	if _, err := p.Delete("dir/hello world.txt"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := p.Head("dir/hello world.txt"); !isNotFound(err) {
+		t.Errorf("Head() after delete error = %v, want not found", err)
+	}
+	if _, err := p.Delete("dir/hello world.txt"); err != nil {
+		t.Errorf("Delete() of missing key error = %v, want nil", err)
+	}
+}
+
+func TestAzureProxy_ListObjects(t *testing.T) {
+	p := newTestAzureProxy(t, newFakeAzure())
+
+	for _, key := range []string{"a/b", "a-c", "a/d/e", "b", "a"} {
+		putString(t, p, key, key)
+	}
+	if _, err := p.CreateMultipartUpload("pending", "text/plain"); err != nil {
+		t.Fatalf("CreateMultipartUpload() error = %v", err)
+	}
+
+	keys, prefixes := listAll(t, p, "", "/", 2)
+	if want := []string{"a", "a-c", "b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+	if want := []string{"a/"}; !reflect.DeepEqual(prefixes, want) {
+		t.Errorf("prefixes = %v, want %v", prefixes, want)
+	}
+
+	keys, _ = listAll(t, p, "", "", 1)
+	if want := []string{"a", "a-c", "a/b", "a/d/e", "b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+}
+
+func TestAzureProxy_Multipart(t *testing.T) {
+	p := newTestAzureProxy(t, newFakeAzure())
+
+	created, err := p.CreateMultipartUpload("big/object", "application/zip")
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload() error = %v", err)
+	}
+	uploadId := aws.StringValue(created.UploadId)
+
+	// A retried part leaves a stale block behind that must not be committed
+	if _, err := p.UploadPart("big/object", uploadId, 1, strings.NewReader("stale")); err != nil {
+		t.Fatalf("UploadPart() error = %v", err)
+	}
+
+	var parts []*s3.CompletedPart
+	for i, body := range []string{"part one ", "part two"} {
+		out, err := p.UploadPart("big/object", uploadId, int64(i+1), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("UploadPart() error = %v", err)
+		}
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(int64(i + 1)), ETag: out.ETag})
+	}
+
+	uploads, err := p.ListMultipartUploads("big/", "", 0)
+	if err != nil || len(uploads.Uploads) != 1 || aws.StringValue(uploads.Uploads[0].Key) != "big/object" {
+		t.Fatalf("ListMultipartUploads() = %v, %v, want one upload", uploads, err)
+	}
+
+	bad := []*s3.CompletedPart{{PartNumber: aws.Int64(1), ETag: aws.String(`"nope"`)}}
+	if _, err := p.CompleteMultipartUpload("big/object", uploadId, bad); err == nil {
+		t.Error("CompleteMultipartUpload() with wrong ETag should fail")
+	}
+
+	done, err := p.CompleteMultipartUpload("big/object", uploadId, parts)
+	if err != nil {
+		t.Fatalf("CompleteMultipartUpload() error = %v", err)
+	}
+	if !strings.HasSuffix(aws.StringValue(done.ETag), `-2"`) {
+		t.Errorf("CompleteMultipartUpload() ETag = %s, want multipart ETag", aws.StringValue(done.ETag))
+	}
+
+	if got := getString(t, p, "big/object", ""); got != "part one part two" {
+		t.Errorf("Get() = %q", got)
+	}
+	head, _ := p.Head("big/object")
+	if aws.StringValue(head.ContentType) != "application/zip" {
+		t.Errorf("Head() ContentType = %q, want application/zip", aws.StringValue(head.ContentType))
+	}
+
+	if _, err := p.UploadPart("big/object", uploadId, 3, strings.NewReader("x")); !isNotFound(err) {
+		t.Errorf("UploadPart() after completion error = %v, want NoSuchUpload", err)
+	}
+}
+
+func TestAzureProxy_SAS(t *testing.T) {
+	fake := newFakeAzure()
+	fake.sas = "c2lnbmF0dXJl"
+	p := newTestAzureProxy(t, fake)
+
+	putString(t, p, "key", "value")
+	if got := getString(t, p, "key", ""); got != "value" {
+		t.Errorf("Get() = %q, want %q", got, "value")
+	}
+
+	p.sas.Set("sig", "wrong")
+	if _, err := p.Head("key"); err == nil || isNotFound(err) {
+		t.Errorf("Head() with bad SAS error = %v, want auth failure", err)
+	}
+}
+
+func TestValidateSite_Azure(t *testing.T) {
+	tests := []struct {
+		name    string
+		site    Site
+		wantErr bool
+	}{
+		{name: "shared key", site: Site{Azure: &AzureConfig{Account: "acct", AccountKey: azuriteKey}, AWSBucket: "b"}},
+		{name: "sas", site: Site{Azure: &AzureConfig{Account: "acct", SASToken: "sv=x&sig=y", Container: "c"}}},
+		{name: "no settings", site: Site{AWSBucket: "b"}, wantErr: true},
+		{name: "no credentials", site: Site{Azure: &AzureConfig{Account: "acct"}, AWSBucket: "b"}, wantErr: true},
+		{name: "bad key", site: Site{Azure: &AzureConfig{Account: "acct", AccountKey: "not base64!"}, AWSBucket: "b"}, wantErr: true},
+		{name: "no container", site: Site{Azure: &AzureConfig{Account: "acct", AccountKey: azuriteKey}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.site.Type = "azure"
+			if err := tt.site.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// defaultBackendType is used for sites that do not set a type
+const defaultBackendType = "s3"
+
+// BackendFactory creates the storage backend for a site
+type BackendFactory func(s Site) (S3Proxy, error)
+
+// BackendValidator checks the backend specific settings of a site
+type BackendValidator func(s Site) error
+
+type backendRegistration struct {
+	validate BackendValidator
+	create   BackendFactory
+}
+
+var backends = make(map[string]backendRegistration)
+
+// RegisterBackend makes a storage backend available under the given site
+// type. It is intended to be called from init functions and panics on
+// duplicate registrations.
+func RegisterBackend(name string, validate BackendValidator, create BackendFactory) {
+	if _, ok := backends[name]; ok {
+		panic("backend type registered twice: " + name)
+	}
+
+	backends[name] = backendRegistration{
+		validate: validate,
+		create:   create,
+	}
+}
+
+// NewBackend creates the storage backend configured for a site
+func NewBackend(s Site) (S3Proxy, error) {
+	b, err := lookupBackend(s)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := b.create(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.ParallelGet != nil {
+		proxy = NewParallelGetProxy(proxy, s.ParallelGet.PartSize, s.ParallelGet.Parallelism, s.ParallelGet.MaxMemory)
+	}
+
+	if s.Failover != nil {
+		if proxy, err = newFailoverBackend(proxy, s); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Replication != nil {
+		if proxy, err = newReplicatedBackend(proxy, *s.Replication); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.DiskCache != nil {
+		if proxy, err = newDiskCacheBackend(proxy, *s.DiskCache); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.MemoryCache != nil {
+		proxy = newMemoryCacheBackend(proxy, *s.MemoryCache)
+	}
+
+	if s.Coalesce != nil {
+		proxy = NewCoalescingProxy(proxy, s.Coalesce.MaxSize)
+	}
+
+	if s.ReadAhead != nil {
+		proxy = NewReadAheadProxy(proxy, s.ReadAhead.MinWindow, s.ReadAhead.MaxWindow, s.ReadAhead.MaxSize)
+	}
+
+	if s.MultipartPut != nil {
+		proxy = NewMultipartPutProxy(proxy, s.MultipartPut.Threshold, s.MultipartPut.PartSize, s.MultipartPut.Parallelism)
+	}
+
+	if s.WriteBack != nil {
+		if proxy, err = newWriteBackBackend(proxy, *s.WriteBack); err != nil {
+			return nil, err
+		}
+	}
+
+	return proxy, nil
+}
+
+func lookupBackend(s Site) (backendRegistration, error) {
+	b, ok := backends[s.backendType()]
+	if !ok {
+		names := make([]string, 0, len(backends))
+		for name := range backends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		msg := fmt.Sprintf("Unknown backend type %q (available: %s)", s.Type, strings.Join(names, ", "))
+		return backendRegistration{}, errors.New(msg)
+	}
+
+	return b, nil
+}
+
+func (s Site) backendType() string {
+	if s.Type == "" {
+		return defaultBackendType
+	}
+
+	return strings.ToLower(s.Type)
+}
+
+// ConditionalPutter is implemented by backends that can create an object
+// only if its key does not exist yet in a single atomic request. handlePut
+// uses it for If-None-Match: * so concurrent writers cannot both succeed.
+type ConditionalPutter interface {
+	PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error)
+}
+
+// StreamPutter is implemented by backends that can store a body as it
+// arrives rather than from memory. handlePut uses it for writes other than
+// create-only ones; size is -1 when the client sent no Content-Length.
+type StreamPutter interface {
+	PutStream(key string, body io.Reader, size int64, contentType string) (*s3.PutObjectOutput, error)
+}
+
+// ClientGetter is implemented by backends that follow the reads of each
+// client separately, such as read-ahead. handleGet passes the client's IP
+// address.
+type ClientGetter interface {
+	GetForClient(client string, key string, rangeHeader string) (*s3.GetObjectOutput, error)
+}
+
+// PartSizer is implemented by backends that can tell the size of the parts
+// an object was uploaded in, or 0 if it was uploaded whole. Parallel GETs
+// use it to split objects on part boundaries.
+type PartSizer interface {
+	PartSize(key string) (int64, error)
+}
+
+// CachePurger is implemented by backends keeping copies of objects, such as
+// the caches, so copies of objects changed directly in the backend can be
+// dropped. PurgeCache drops the copies of key, or of every key starting with
+// it when prefix is set, and returns the number of entries dropped. Proxies
+// wrapping a cache pass purges on to it. HasCache reports whether there is a
+// cache behind the proxy at all, for warm-ups to fill.
+type CachePurger interface {
+	PurgeCache(key string, prefix bool) int
+	HasCache() bool
+}
+
+// purgeCache purges the caches of a backend, if it has any
+func purgeCache(backend S3Proxy, key string, prefix bool) int {
+	if cp, ok := backend.(CachePurger); ok {
+		return cp.PurgeCache(key, prefix)
+	}
+	return 0
+}
+
+// hasCache reports whether a backend is or wraps a cache
+func hasCache(backend S3Proxy) bool {
+	cp, ok := backend.(CachePurger)
+	return ok && cp.HasCache()
+}
+
+// purgeMatches reports whether a purge of key, or of the keys starting with
+// it, covers a cached key
+func purgeMatches(cached, key string, prefix bool) bool {
+	if prefix {
+		return strings.HasPrefix(cached, key)
+	}
+	return cached == key
+}
+
+// MigrationReporter is implemented by backends copying a bucket in the
+// background. Its status is served at GET /?migration. Proxies wrapping a
+// backend pass the call on to it and report false when it is not migrating.
+type MigrationReporter interface {
+	MigrationStatus() (MigrationStatus, bool)
+}
+
+// migrationStatus returns the progress of a backend's migration, if it has one
+func migrationStatus(backend S3Proxy) (MigrationStatus, bool) {
+	if mr, ok := backend.(MigrationReporter); ok {
+		return mr.MigrationStatus()
+	}
+	return MigrationStatus{}, false
+}
+
+// The helpers below build the errors backends return so that handleS3Error
+// maps them to the same status codes S3 itself would use.
+
+func errNoSuchKey(key string) error {
+	return awserr.NewRequestFailure(
+		awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist: "+key, nil),
+		http.StatusNotFound, "")
+}
+
+func errNoSuchUpload(uploadId string) error {
+	return awserr.NewRequestFailure(
+		awserr.New(s3.ErrCodeNoSuchUpload, "The specified multipart upload does not exist: "+uploadId, nil),
+		http.StatusNotFound, "")
+}
+
+func errInvalidPart(message string) error {
+	return awserr.NewRequestFailure(
+		awserr.New("InvalidPart", message, nil),
+		http.StatusBadRequest, "")
+}
+
+func errNoSuchWebsiteConfiguration() error {
+	return awserr.NewRequestFailure(
+		awserr.New("NoSuchWebsiteConfiguration", "The specified bucket does not have a website configuration", nil),
+		http.StatusNotFound, "")
+}
+
+func errNotImplemented(operation string) error {
+	return awserr.NewRequestFailure(
+		awserr.New("NotImplemented", operation+" is not supported by this backend", nil),
+		http.StatusNotImplemented, "")
+}
+
+// errPreconditionFailed is returned for create-only writes of existing keys
+func errPreconditionFailed() error {
+	return awserr.NewRequestFailure(
+		awserr.New("PreconditionFailed", "At least one of the preconditions you specified did not hold", nil),
+		http.StatusPreconditionFailed, "")
+}
+
+// errMethodNotAllowed is returned for writes against read-only backends
+func errMethodNotAllowed() error {
+	return awserr.NewRequestFailure(
+		awserr.New("MethodNotAllowed", "The specified method is not allowed against this resource", nil),
+		http.StatusMethodNotAllowed, "")
+}
+
+func errInvalidArgument(message string) error {
+	return awserr.NewRequestFailure(
+		awserr.New("InvalidArgument", message, nil),
+		http.StatusBadRequest, "")
+}
+
+// errIncompleteBody is returned when a client's body ends before its
+// Content-Length, or cannot be read
+func errIncompleteBody() error {
+	return awserr.NewRequestFailure(
+		awserr.New("IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header", nil),
+		http.StatusBadRequest, "")
+}
+
+// errObjectAlreadyInActiveTier is returned by RestoreObject on backends
+// without archive storage classes, where every object is always readable
+func errObjectAlreadyInActiveTier() error {
+	return awserr.NewRequestFailure(
+		awserr.New(s3.ErrCodeObjectAlreadyInActiveTierError, "This operation is not allowed against this storage tier", nil),
+		http.StatusForbidden, "")
+}
+
+// isNotImplemented reports whether err is a backend's NotImplemented error
+func isNotImplemented(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() == http.StatusNotImplemented
+}
+
+// isNotFound reports whether a backend error means the key does not exist
+func isNotFound(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+
+	return false
+}
+
+// WebsiteConfig is the static website configuration for backends that have
+// no bucket-level website configuration of their own
+type WebsiteConfig struct {
+	IndexDocument string `json:"indexDocument" yaml:"indexDocument"`
+	ErrorDocument string `json:"errorDocument,omitempty" yaml:"errorDocument,omitempty"`
+}
+
+func (c *WebsiteConfig) output() (*s3.GetBucketWebsiteOutput, error) {
+	if c == nil || c.IndexDocument == "" {
+		return nil, errNoSuchWebsiteConfiguration()
+	}
+
+	out := &s3.GetBucketWebsiteOutput{
+		IndexDocument: &s3.IndexDocument{Suffix: aws.String(c.IndexDocument)},
+	}
+	if c.ErrorDocument != "" {
+		out.ErrorDocument = &s3.ErrorDocument{Key: aws.String(c.ErrorDocument)}
+	}
+
+	return out, nil
+}
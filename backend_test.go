@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func init() {
+	RegisterBackend("stub", func(s Site) error {
+		if s.AWSBucket == "" {
+			return errors.New("bucket not specified")
+		}
+		return nil
+	}, func(s Site) (S3Proxy, error) {
+		return &getStub{objects: map[string][]byte{"hello.txt": []byte("hello")}}, nil
+	})
+}
+
+func TestRegisterBackend_Duplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("RegisterBackend() should panic for a duplicate type")
+		}
+	}()
+
+	RegisterBackend("stub", nil, nil)
+}
+
+func TestNewBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		site    Site
+		wantErr bool
+	}{
+		{
+			name: "default type is s3",
+			site: Site{AWSKey: "k", AWSSecret: "s", AWSRegion: "us-east-1", AWSBucket: "b"},
+		},
+		{
+			name: "registered type",
+			site: Site{Type: "stub", AWSBucket: "b"},
+		},
+		{
+			name: "type is case-insensitive",
+			site: Site{Type: "STUB", AWSBucket: "b"},
+		},
+		{
+			name:    "unknown type",
+			site:    Site{Type: "tape"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := NewBackend(tt.site)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewBackend() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && proxy == nil {
+				t.Error("NewBackend() returned nil proxy")
+			}
+		})
+	}
+}
+
+func TestValidateSite_BackendType(t *testing.T) {
+	tests := []struct {
+		name    string
+		site    Site
+		wantErr bool
+	}{
+		{name: "backend validation passes", site: Site{Type: "stub", AWSBucket: "b"}},
+		{name: "backend validation fails", site: Site{Type: "stub"}, wantErr: true},
+		{name: "s3 settings not required for other types", site: Site{Type: "stub", AWSBucket: "b"}},
+		{name: "unknown type", site: Site{Type: "tape", AWSBucket: "b"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.site.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateSiteHandler_Backend(t *testing.T) {
+	handler, err := createSiteHandler(Site{Type: "stub", AWSBucket: "bucket"})
+	if err != nil {
+		t.Fatalf("createSiteHandler() error = %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/bucket/hello.txt", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "hello" {
+		t.Errorf("GET returned %v %q, want 200 %q", rr.Code, rr.Body.String(), "hello")
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const (
+	// cacheWarmParallelism is the number of keys a warm-up reads at once
+	cacheWarmParallelism = 4
+	// cacheWarmMaxKeys is the most keys a warm-up reads
+	cacheWarmMaxKeys = 10000
+)
+
+// WarmStatus reports the progress of a site's cache warm-up. It is served
+// at GET /?warm.
+type WarmStatus struct {
+	Running bool `json:"running"`
+	Done    bool `json:"done"`
+	// Listed is set once every key to warm is known, so Total is final
+	Listed bool `json:"listed"`
+	// Truncated is set when the prefix holds more than cacheWarmMaxKeys
+	// keys, of which only the first are warmed
+	Truncated bool      `json:"truncated,omitempty"`
+	Total     int64     `json:"total"`
+	Warmed    int64     `json:"warmed"`
+	Failed    int64     `json:"failed"`
+	Bytes     int64     `json:"bytes"`
+	Started   time.Time `json:"started"`
+	Updated   time.Time `json:"updated"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// cacheWarmer fills a site's caches by reading keys through its backend,
+// one warm-up at a time. A site keeps its warmer across configuration
+// reloads, so a running warm-up carries on through the new backend.
+type cacheWarmer struct {
+	mu      sync.Mutex
+	proxy   S3Proxy
+	uses    int // configurations that started using the warmer
+	status  WarmStatus
+	removed bool // the site is gone, so warm-ups stop
+}
+
+// cacheWarmers maps the host of each site to its warmer
+var cacheWarmers = struct {
+	sync.Mutex
+	m map[string]*cacheWarmer
+}{m: make(map[string]*cacheWarmer)}
+
+// siteWarmer returns the warmer of the site served at host, which reads
+// through proxy once the configuration being built starts
+func siteWarmer(host string, proxy S3Proxy) *cacheWarmer {
+	cacheWarmers.Lock()
+	cw, ok := cacheWarmers.m[host]
+	if !ok {
+		cw = &cacheWarmer{proxy: proxy}
+		cacheWarmers.m[host] = cw
+	}
+	cacheWarmers.Unlock()
+
+	var use int
+	onStart(func() { use = cw.use(proxy) })
+	onStop(func() { dropWarmer(host, cw, use) })
+	return cw
+}
+
+// dropWarmer forgets the warmer of the site served at host, stopping its
+// warm-up, when a reload replaces the configuration of the given use with
+// one that does not serve the site
+func dropWarmer(host string, cw *cacheWarmer, use int) {
+	cacheWarmers.Lock()
+	defer cacheWarmers.Unlock()
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if cw.uses != use {
+		// The new configuration kept the site
+		return
+	}
+	cw.removed = true
+	if cacheWarmers.m[host] == cw {
+		delete(cacheWarmers.m, host)
+	}
+}
+
+// use makes the warm-up read the keys left through proxy, returning the
+// number of configurations that used the warmer so far
+func (cw *cacheWarmer) use(proxy S3Proxy) int {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.proxy = proxy
+	cw.uses++
+	return cw.uses
+}
+
+func (cw *cacheWarmer) backend() S3Proxy {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.proxy
+}
+
+func (cw *cacheWarmer) stopped() bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.removed
+}
+
+// start begins warming keys, or the keys listed under prefix when list is
+// set. It returns false if a warm-up is already running.
+func (cw *cacheWarmer) start(keys []string, prefix string, list bool) bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if cw.status.Running {
+		return false
+	}
+
+	now := time.Now().UTC()
+	cw.status = WarmStatus{Running: true, Started: now, Updated: now}
+	if !list {
+		cw.status.Listed = true
+		cw.status.Total = int64(len(keys))
+	}
+
+	go cw.run(keys, prefix, list)
+	return true
+}
+
+func (cw *cacheWarmer) run(keys []string, prefix string, list bool) {
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < cacheWarmParallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				if cw.stopped() {
+					continue
+				}
+				n, err := cw.warm(key)
+				cw.record(key, n, err)
+			}
+		}()
+	}
+
+	if list {
+		if err := cw.list(prefix, queue); err != nil {
+			cw.mu.Lock()
+			cw.status.LastError = fmt.Sprintf("listing %s: %v", prefix, err)
+			cw.mu.Unlock()
+		}
+	} else {
+		for _, key := range keys {
+			queue <- key
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.status.Running = false
+	cw.status.Done = true
+	cw.status.Updated = time.Now().UTC()
+}
+
+// list queues the first cacheWarmMaxKeys keys under prefix
+func (cw *cacheWarmer) list(prefix string, queue chan<- string) error {
+	token := ""
+	listed := 0
+	truncated := false
+	for {
+		out, err := cw.backend().ListObjects(prefix, "", defaultMaxKeys, token)
+		if err != nil {
+			return err
+		}
+
+		keys := out.Contents
+		if left := cacheWarmMaxKeys - listed; len(keys) > left {
+			keys = keys[:left]
+			truncated = true
+		}
+		listed += len(keys)
+
+		cw.mu.Lock()
+		cw.status.Total += int64(len(keys))
+		cw.mu.Unlock()
+
+		for _, obj := range keys {
+			queue <- aws.StringValue(obj.Key)
+		}
+
+		if truncated || !aws.BoolValue(out.IsTruncated) || cw.stopped() {
+			break
+		}
+		token = aws.StringValue(out.NextContinuationToken)
+	}
+
+	cw.mu.Lock()
+	cw.status.Listed = true
+	cw.status.Truncated = truncated
+	cw.mu.Unlock()
+	return nil
+}
+
+// warm reads a key through the backend, returning the bytes read
+func (cw *cacheWarmer) warm(key string) (int64, error) {
+	out, err := cw.backend().Get(key, "")
+	if err != nil {
+		return 0, err
+	}
+	defer out.Body.Close()
+
+	return io.Copy(io.Discard, out.Body)
+}
+
+func (cw *cacheWarmer) record(key string, n int64, err error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if err != nil {
+		cw.status.Failed++
+		cw.status.LastError = fmt.Sprintf("%s: %v", key, err)
+	} else {
+		cw.status.Warmed++
+		cw.status.Bytes += n
+	}
+	cw.status.Updated = time.Now().UTC()
+}
+
+// Status returns the progress of the current or last warm-up
+func (cw *cacheWarmer) Status() WarmStatus {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.status
+}
+
+// NewCacheAdminHandler serves a site's cache administration requests on the
+// bucket, authenticated against the site's admins rather than its users:
+// POST with ?purge drops cached copies, POST with ?warm reads keys through
+// the caches, and GET with ?warm reports on the warm-up. Other requests go
+// to next.
+func NewCacheAdminHandler(admins []User, proxy S3Proxy, warmer *cacheWarmer, prefix string, bucketName string, next http.Handler) http.HandlerFunc {
+	admin := NewBasicAuthHandler(admins, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hasPurge := r.URL.Query()["purge"]
+		switch {
+		case hasPurge && r.Method == http.MethodPost:
+			handlePurge(proxy, prefix, w, r)
+		case !hasPurge && r.Method == http.MethodPost:
+			handleWarm(proxy, warmer, prefix, w, r)
+		case !hasPurge && r.Method == http.MethodGet:
+			handleWarmStatus(warmer, w)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		_, hasPurge := query["purge"]
+		_, hasWarm := query["warm"]
+		if (hasPurge || hasWarm) && extractKeyFromPath(r.URL.Path, bucketName) == "" {
+			admin.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// adminKey maps a key or prefix given to the cache endpoints to the
+// backend's, applying the site's prefix the way object requests do
+func adminKey(sitePrefix, key string) string {
+	if sitePrefix == "" {
+		return key
+	}
+	return sitePrefix + "/" + key
+}
+
+// handlePurge drops the cached copies of ?key, of every key starting with
+// ?prefix, or of every key of the site when neither is given
+func handlePurge(proxy S3Proxy, sitePrefix string, w http.ResponseWriter, r *http.Request) {
+	purger, ok := proxy.(CachePurger)
+	if !ok {
+		handleS3Error(w, errNotImplemented("Cache purging"))
+		return
+	}
+
+	query := r.URL.Query()
+	var purged int
+	switch {
+	case query.Has("key"):
+		if query.Get("key") == "" {
+			handleS3Error(w, errInvalidArgument("The key to purge must not be empty"))
+			return
+		}
+		purged = purger.PurgeCache(adminKey(sitePrefix, query.Get("key")), false)
+	case query.Has("prefix"):
+		purged = purger.PurgeCache(adminKey(sitePrefix, query.Get("prefix")), true)
+	default:
+		purged = purger.PurgeCache("", true)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Purged int `json:"purged"`
+	}{purged})
+}
+
+// handleWarm starts warming the site's caches with the keys listed under
+// ?prefix, or with the keys in the request body, one per line. A warm-up
+// reads at most cacheWarmMaxKeys keys.
+func handleWarm(proxy S3Proxy, warmer *cacheWarmer, sitePrefix string, w http.ResponseWriter, r *http.Request) {
+	// Proxies such as request coalescing pass purges on, but have nothing
+	// of their own for a warm-up to fill
+	if !hasCache(proxy) {
+		handleS3Error(w, errNotImplemented("Cache warm-up"))
+		return
+	}
+
+	query := r.URL.Query()
+	var keys []string
+	list := query.Has("prefix")
+	if !list {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if key := strings.TrimSpace(scanner.Text()); key != "" {
+				keys = append(keys, adminKey(sitePrefix, key))
+			}
+			if len(keys) > cacheWarmMaxKeys {
+				handleS3Error(w, errInvalidArgument(fmt.Sprintf("A warm-up reads at most %d keys", cacheWarmMaxKeys)))
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if len(keys) == 0 {
+			handleS3Error(w, errInvalidArgument("A warm-up needs a prefix or a list of keys"))
+			return
+		}
+	}
+
+	if !warmer.start(keys, adminKey(sitePrefix, query.Get("prefix")), list) {
+		writeS3Error(w, "OperationAborted", "A cache warm-up is already running for this site", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(warmer.Status())
+}
+
+func handleWarmStatus(warmer *cacheWarmer, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(warmer.Status())
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAdminHandler serves proxy as a site whose cache administration
+// takes the admin user
+func newTestAdminHandler(proxy S3Proxy, prefix string) http.Handler {
+	admins := []User{{Name: "admin", Password: "secret"}}
+	return NewCacheAdminHandler(admins, proxy, &cacheWarmer{proxy: proxy}, prefix, "bucket", NewProxyHandler(proxy, prefix, "bucket"))
+}
+
+// adminRequest sends a cache administration request to a site's handler
+// as the admin user
+func adminRequest(t *testing.T, handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.SetBasicAuth("admin", "secret")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	return rr
+}
+
+func TestCacheAdminHandler_Auth(t *testing.T) {
+	backend := newFakeProxy()
+	putString(t, backend, "key", "content")
+	handler := newTestAdminHandler(NewMemoryCacheProxy(backend, 1<<20, 0, time.Minute, 0), "")
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		user     string
+		password string
+		want     int
+	}{
+		{name: "purge without credentials", method: http.MethodPost, target: "/bucket?purge", want: http.StatusUnauthorized},
+		{name: "purge as a site user", method: http.MethodPost, target: "/bucket?purge", user: "user", password: "password", want: http.StatusUnauthorized},
+		{name: "warm without credentials", method: http.MethodPost, target: "/bucket?warm&prefix=", want: http.StatusUnauthorized},
+		{name: "warm status without credentials", method: http.MethodGet, target: "/bucket?warm", want: http.StatusUnauthorized},
+		{name: "purge as admin", method: http.MethodPost, target: "/bucket?purge", user: "admin", password: "secret", want: http.StatusOK},
+		{name: "object", method: http.MethodGet, target: "/bucket/key", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			if rr.Code != tt.want {
+				t.Errorf("%s %s returned %d, want %d", tt.method, tt.target, rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlePurge(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantPurged int
+		wantCached []string
+	}{
+		{name: "key", query: "&key=dir/a", wantPurged: 1, wantCached: []string{"dir/b", "other"}},
+		{name: "prefix", query: "&prefix=dir/", wantPurged: 2, wantCached: []string{"other"}},
+		{name: "site", wantPurged: 3},
+		{name: "missing key", query: "&key=missing", wantCached: []string{"dir/a", "dir/b", "other"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newFakeProxy()
+			p := NewMemoryCacheProxy(backend, 1<<20, 0, time.Minute, 0)
+			for _, key := range []string{"dir/a", "dir/b", "other"} {
+				putString(t, backend, key, key)
+				getString(t, p, key, "")
+			}
+			backend.reads()
+
+			rr := adminRequest(t, newTestAdminHandler(p, ""), http.MethodPost, "/bucket?purge"+tt.query, "")
+			var got struct{ Purged int }
+			if err := json.NewDecoder(rr.Body).Decode(&got); err != nil || rr.Code != http.StatusOK {
+				t.Fatalf("POST ?purge returned %d: %v", rr.Code, err)
+			}
+			if got.Purged != tt.wantPurged {
+				t.Errorf("purged %d entries, want %d", got.Purged, tt.wantPurged)
+			}
+
+			for _, key := range tt.wantCached {
+				getString(t, p, key, "")
+			}
+			if reads := backend.reads(); len(reads) != 0 {
+				t.Errorf("keys still cached were read from the backend %d times", len(reads))
+			}
+		})
+	}
+}
+
+func TestHandlePurge_SitePrefix(t *testing.T) {
+	backend := newFakeProxy()
+	putString(t, backend, "snapshots/a", "a")
+	p := NewMemoryCacheProxy(backend, 1<<20, 0, time.Minute, 0)
+	getString(t, p, "snapshots/a", "")
+
+	rr := adminRequest(t, newTestAdminHandler(p, "snapshots"), http.MethodPost, "/bucket?purge&key=a", "")
+	if !strings.Contains(rr.Body.String(), `"purged":1`) {
+		t.Errorf("POST ?purge returned %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHandleWarm(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		body       string
+		wantWarmed []string
+	}{
+		{name: "keys", body: "dir/a\n\nother\n", wantWarmed: []string{"dir/a", "other"}},
+		{name: "prefix", query: "&prefix=dir/", wantWarmed: []string{"dir/a", "dir/b"}},
+		{name: "site", query: "&prefix=", wantWarmed: []string{"dir/a", "dir/b", "other"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newFakeProxy()
+			for _, key := range []string{"dir/a", "dir/b", "other"} {
+				putString(t, backend, key, key)
+			}
+			p := NewMemoryCacheProxy(backend, 1<<20, 0, time.Minute, 0)
+			handler := newTestAdminHandler(p, "")
+
+			if rr := adminRequest(t, handler, http.MethodPost, "/bucket?warm"+tt.query, tt.body); rr.Code != http.StatusAccepted {
+				t.Fatalf("POST ?warm returned %d: %s", rr.Code, rr.Body.String())
+			}
+
+			var status WarmStatus
+			waitFor(t, "the warm-up to finish", func() bool {
+				rr := adminRequest(t, handler, http.MethodGet, "/bucket?warm", "")
+				json.NewDecoder(rr.Body).Decode(&status)
+				return status.Done
+			})
+			if status.Warmed != int64(len(tt.wantWarmed)) || status.Total != status.Warmed || status.Failed != 0 || !status.Listed {
+				t.Errorf("status = %+v", status)
+			}
+			backend.reads()
+
+			for _, key := range tt.wantWarmed {
+				getString(t, p, key, "")
+			}
+			if reads := backend.reads(); len(reads) != 0 {
+				t.Errorf("warmed keys were read from the backend %d times", len(reads))
+			}
+		})
+	}
+}
+
+func TestHandleWarm_Errors(t *testing.T) {
+	backend := newFakeProxy()
+	backend.holdReads()
+	putString(t, backend, "key", "content")
+	cached := NewMemoryCacheProxy(backend, 1<<20, 0, time.Minute, 0)
+	handler := newTestAdminHandler(cached, "")
+
+	if rr := adminRequest(t, handler, http.MethodPost, "/bucket?warm", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("POST ?warm without keys returned %d", rr.Code)
+	}
+
+	if rr := adminRequest(t, handler, http.MethodPost, "/bucket?warm", "key"); rr.Code != http.StatusAccepted {
+		t.Fatalf("POST ?warm returned %d", rr.Code)
+	}
+	waitFor(t, "the warm-up to read the key", func() bool { return backend.started() == 1 })
+	if rr := adminRequest(t, handler, http.MethodPost, "/bucket?warm", "key"); rr.Code != http.StatusConflict {
+		t.Errorf("POST ?warm during a warm-up returned %d", rr.Code)
+	}
+	backend.releaseReads()
+
+	// Sites without caches have nothing to purge or warm
+	uncached := newTestAdminHandler(NewMemoryProxy(0, 0, nil), "")
+	if rr := adminRequest(t, uncached, http.MethodPost, "/bucket?purge", ""); rr.Code != http.StatusNotImplemented {
+		t.Errorf("POST ?purge returned %d", rr.Code)
+	}
+	if rr := adminRequest(t, uncached, http.MethodPost, "/bucket?warm", "key"); rr.Code != http.StatusNotImplemented {
+		t.Errorf("POST ?warm returned %d", rr.Code)
+	}
+
+	// Nor do those whose only layers pass purges on
+	coalesced := newTestAdminHandler(NewCoalescingProxy(NewMemoryProxy(0, 0, nil), 0), "")
+	if rr := adminRequest(t, coalesced, http.MethodPost, "/bucket?warm", "key"); rr.Code != http.StatusNotImplemented {
+		t.Errorf("POST ?warm without a cache layer returned %d", rr.Code)
+	}
+}
+
+func TestHandleWarm_Limits(t *testing.T) {
+	backend := newFakeProxy()
+	for i := 0; i <= cacheWarmMaxKeys; i++ {
+		putString(t, backend, fmt.Sprintf("key%05d", i), "")
+	}
+	handler := newTestAdminHandler(NewMemoryCacheProxy(backend, 1<<20, 0, time.Minute, 0), "")
+
+	keys := strings.Repeat("key\n", cacheWarmMaxKeys+1)
+	if rr := adminRequest(t, handler, http.MethodPost, "/bucket?warm", keys); rr.Code != http.StatusBadRequest {
+		t.Errorf("POST ?warm with %d keys returned %d", cacheWarmMaxKeys+1, rr.Code)
+	}
+
+	// Prefixes holding more keys are warmed up to the limit
+	if rr := adminRequest(t, handler, http.MethodPost, "/bucket?warm&prefix=", ""); rr.Code != http.StatusAccepted {
+		t.Fatalf("POST ?warm returned %d", rr.Code)
+	}
+	var status WarmStatus
+	waitFor(t, "the warm-up to finish", func() bool {
+		rr := adminRequest(t, handler, http.MethodGet, "/bucket?warm", "")
+		json.NewDecoder(rr.Body).Decode(&status)
+		return status.Done
+	})
+	if status.Total != cacheWarmMaxKeys || status.Warmed != cacheWarmMaxKeys || !status.Truncated {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestSiteWarmer_Reload(t *testing.T) {
+	first := newFakeProxy()
+	first.holdReads()
+	second := newFakeProxy()
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	for _, key := range keys {
+		putString(t, first, key, key)
+		putString(t, second, key, key)
+	}
+
+	warmer := siteWarmer("warm.example.com", first)
+	if !warmer.start(keys, "", false) {
+		t.Fatal("start() = false")
+	}
+	waitFor(t, "the warm-up to read", func() bool { return first.started() == cacheWarmParallelism })
+
+	// A reload keeps the site's warmer, which reads the keys left through
+	// the new backend once the configuration starts
+	group, err := buildWorkers(func() error {
+		if siteWarmer("warm.example.com", second) != warmer {
+			t.Error("reload created a new warmer")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warmer.backend() != S3Proxy(first) {
+		t.Error("warmer switched backends before the configuration started")
+	}
+	group.start()
+	first.releaseReads()
+
+	waitFor(t, "the warm-up to finish", func() bool { return warmer.Status().Done })
+	if reads := second.reads(); len(reads) != len(keys)-cacheWarmParallelism {
+		t.Errorf("new backend read %d keys, want %d", len(reads), len(keys)-cacheWarmParallelism)
+	}
+}
+
+func TestSiteWarmer_RemovedSite(t *testing.T) {
+	gone, kept := newFakeProxy(), newFakeProxy()
+	gone.holdReads()
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	for _, key := range keys {
+		putString(t, gone, key, key)
+	}
+
+	var goneWarmer, keptWarmer *cacheWarmer
+	first, err := buildWorkers(func() error {
+		goneWarmer = siteWarmer("gone.example.com", gone)
+		keptWarmer = siteWarmer("kept.example.com", kept)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.start()
+	if !goneWarmer.start(keys, "", false) {
+		t.Fatal("start() = false")
+	}
+	waitFor(t, "the warm-up to read", func() bool { return gone.started() == cacheWarmParallelism })
+
+	// The reload drops the removed site's warmer and stops its warm-up
+	second, err := buildWorkers(func() error {
+		siteWarmer("kept.example.com", kept)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.start()
+	first.stop()
+	t.Cleanup(second.stop)
+	gone.releaseReads()
+
+	waitFor(t, "the warm-up to finish", func() bool { return goneWarmer.Status().Done })
+	if reads := gone.reads(); len(reads) != cacheWarmParallelism {
+		t.Errorf("removed site read %d keys, want the %d already started", len(reads), cacheWarmParallelism)
+	}
+
+	cacheWarmers.Lock()
+	defer cacheWarmers.Unlock()
+	if _, ok := cacheWarmers.m["gone.example.com"]; ok {
+		t.Error("removed site's warmer kept")
+	}
+	if cacheWarmers.m["kept.example.com"] != keptWarmer {
+		t.Error("kept site's warmer dropped")
+	}
+}
+
+func TestPurgeCache_Layers(t *testing.T) {
+	backend := newFakeProxy()
+	putString(t, backend, "key", "content")
+
+	cache, err := openDiskCache(t.TempDir(), 1<<20, 16, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p S3Proxy = NewDiskCacheProxy(backend, cache, time.Minute)
+	p = NewMemoryCacheProxy(p, 1<<20, 0, time.Minute, 0)
+	p = NewCoalescingProxy(p, 0)
+	getString(t, p, "key", "")
+
+	// The purge reaches both caches through the coalescing proxy
+	if n := p.(CachePurger).PurgeCache("k", true); n != 2 {
+		t.Errorf("PurgeCache() = %d, want 2", n)
+	}
+	backend.reads()
+	getString(t, p, "key", "")
+	if reads := backend.reads(); len(reads) == 0 {
+		t.Error("purged key was not read from the backend")
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultCoalesceMaxSize = 8 << 20
+	coalesceReadSize       = 32 << 10
+)
+
+// CoalesceConfig makes concurrent reads of the same key share one backend
+// request. GETs join a request in flight for the same range or one
+// containing theirs, and receive its body as it arrives. Responses over
+// MaxSize bytes (default 8 MiB) are not shared, since their body is held
+// in memory until the slowest client has read it.
+type CoalesceConfig struct {
+	MaxSize int64 `json:"maxSize,omitempty" yaml:"maxSize,omitempty"`
+}
+
+func (c *CoalesceConfig) validate() error {
+	if c.MaxSize < 0 {
+		return errors.New("Coalesce maxSize must not be negative")
+	}
+	return nil
+}
+
+// getFlight is a backend GET shared by the clients that joined it. Its
+// body is read into memory by one goroutine, and each client reads its
+// part of it at its own pace.
+type getFlight struct {
+	key         string
+	rangeHeader string
+	ready       chan struct{} // closed once out and err are set
+
+	// Set before ready is closed
+	out    *s3.GetObjectOutput
+	err    error
+	shared bool
+	start  int64 // object offsets of the first and last byte of the body
+	end    int64
+	total  int64
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	data    []byte
+	done    bool
+	readErr error
+	readers int
+	aborted bool
+}
+
+// parseSimpleRange returns the offsets of a "bytes=a-b" range header
+func parseSimpleRange(header string) (int64, int64, bool) {
+	m := byteRangePattern.FindStringSubmatch(strings.TrimSpace(header))
+	if m == nil || m[1] == "" || m[2] == "" {
+		return 0, 0, false
+	}
+
+	start, err1 := strconv.ParseInt(m[1], 10, 64)
+	end, err2 := strconv.ParseInt(m[2], 10, 64)
+	if err1 != nil || err2 != nil || start > end {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// join adds a reader for rangeHeader if the flight's response can serve
+// it. f.mu must not be held.
+func (f *getFlight) join(rangeHeader string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.aborted {
+		return false
+	}
+	select {
+	case <-f.ready:
+		if !f.shared {
+			return false
+		}
+	default:
+	}
+
+	ok := rangeHeader == f.rangeHeader || f.rangeHeader == ""
+	if !ok {
+		start, end, ok1 := parseSimpleRange(rangeHeader)
+		flightStart, flightEnd, ok2 := parseSimpleRange(f.rangeHeader)
+		ok = ok1 && ok2 && flightStart <= start && end <= flightEnd
+	}
+	if ok {
+		f.readers++
+	}
+	return ok
+}
+
+// release drops a reader, abandoning the backend read once no reader is
+// left
+func (f *getFlight) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.readers--
+	if f.readers == 0 && !f.done && f.shared {
+		f.aborted = true
+		// Unblocks the pump, which notices the flight was abandoned
+		go f.out.Body.Close()
+	}
+}
+
+// resolve records the backend's response, working out whether it can be
+// shared and which part of the object it holds
+func (f *getFlight) resolve(out *s3.GetObjectOutput, err error, maxSize int64) {
+	defer close(f.ready)
+
+	f.out, f.err = out, err
+	if err != nil || out.ContentLength == nil || aws.Int64Value(out.ContentLength) > maxSize {
+		return
+	}
+
+	length := aws.Int64Value(out.ContentLength)
+	if out.ContentRange == nil {
+		if f.rangeHeader != "" {
+			// The backend ignored the range
+			return
+		}
+		f.start, f.end, f.total = 0, length-1, length
+	} else {
+		var ok bool
+		f.start, f.end, f.total, ok = parseContentRange(aws.StringValue(out.ContentRange))
+		if !ok || f.end-f.start+1 != length {
+			return
+		}
+	}
+
+	f.shared = true
+	f.data = make([]byte, 0, length)
+}
+
+// pump reads the backend body into memory for the flight's readers
+func (f *getFlight) pump(remove func()) {
+	defer remove()
+	defer f.out.Body.Close()
+
+	length := f.end - f.start + 1
+	buf := make([]byte, coalesceReadSize)
+	for {
+		n, err := f.out.Body.Read(buf)
+
+		f.mu.Lock()
+		f.data = append(f.data, buf[:n]...)
+		if err == io.EOF && int64(len(f.data)) != length {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil || f.aborted {
+			f.done = true
+			if err != io.EOF {
+				f.readErr = err
+			}
+		}
+		done := f.done
+		f.cond.Broadcast()
+		f.mu.Unlock()
+
+		if done {
+			return
+		}
+	}
+}
+
+// output builds the response for a reader of object bytes start to end,
+// with the headers of the backend's response
+func (f *getFlight) output(rangeHeader string, start, end int64) *s3.GetObjectOutput {
+	out := *f.out
+	out.AcceptRanges = aws.String("bytes")
+	out.ContentLength = aws.Int64(end - start + 1)
+	out.ContentRange = nil
+	out.Body = &flightReader{f: f, pos: start - f.start, end: end - f.start}
+	if rangeHeader != "" {
+		out.ContentRange = aws.String(contentRange(start, end, f.total))
+	}
+	return &out
+}
+
+// flightReader reads part of a shared body. pos and end are offsets into
+// the flight's data.
+type flightReader struct {
+	f        *getFlight
+	pos, end int64
+	closed   bool
+}
+
+func (r *flightReader) Read(b []byte) (int, error) {
+	if r.pos > r.end {
+		return 0, io.EOF
+	}
+
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for int64(len(f.data)) <= r.pos && !f.done {
+		f.cond.Wait()
+	}
+
+	if int64(len(f.data)) <= r.pos {
+		if f.readErr != nil {
+			return 0, f.readErr
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	limit := int64(len(f.data))
+	if limit > r.end+1 {
+		limit = r.end + 1
+	}
+	n := copy(b, f.data[r.pos:limit])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *flightReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.f.release()
+	}
+	return nil
+}
+
+// headFlight is a backend HEAD shared by the clients that asked for it
+type headFlight struct {
+	done    chan struct{}
+	out     *s3.HeadObjectOutput
+	err     error
+	clients int
+}
+
+// CoalescingProxy shares backend reads between concurrent clients of the
+// same key. Writes through the proxy detach the reads in flight for their
+// key once they complete, so later clients make a new request; clients
+// already sharing a read may still receive the previous object.
+type CoalescingProxy struct {
+	S3Proxy
+	maxSize int64
+
+	mu    sync.Mutex
+	gets  map[string][]*getFlight
+	heads map[string]*headFlight
+}
+
+func NewCoalescingProxy(backend S3Proxy, maxSize int64) *CoalescingProxy {
+	if maxSize <= 0 {
+		maxSize = defaultCoalesceMaxSize
+	}
+
+	return &CoalescingProxy{
+		S3Proxy: backend,
+		maxSize: maxSize,
+		gets:    make(map[string][]*getFlight),
+		heads:   make(map[string]*headFlight),
+	}
+}
+
+func (p *CoalescingProxy) removeGet(f *getFlight) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	flights := p.gets[f.key]
+	for i, other := range flights {
+		if other == f {
+			flights = append(flights[:i], flights[i+1:]...)
+			break
+		}
+	}
+	if len(flights) == 0 {
+		delete(p.gets, f.key)
+	} else {
+		p.gets[f.key] = flights
+	}
+}
+
+func (p *CoalescingProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	p.mu.Lock()
+	for _, f := range p.gets[key] {
+		if f.join(rangeHeader) {
+			p.mu.Unlock()
+			return p.follow(f, key, rangeHeader)
+		}
+	}
+
+	f := &getFlight{key: key, rangeHeader: rangeHeader, ready: make(chan struct{}), readers: 1}
+	f.cond = sync.NewCond(&f.mu)
+	p.gets[key] = append(p.gets[key], f)
+	p.mu.Unlock()
+
+	out, err := p.S3Proxy.Get(key, rangeHeader)
+	f.resolve(out, err, p.maxSize)
+	if !f.shared {
+		p.removeGet(f)
+		return out, err
+	}
+
+	go f.pump(func() { p.removeGet(f) })
+	return f.output(rangeHeader, f.start, f.end), nil
+}
+
+// follow waits for the response of a flight the client joined. Clients
+// whose range the response turns out not to cover make their own request.
+func (p *CoalescingProxy) follow(f *getFlight, key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	<-f.ready
+
+	if f.err != nil {
+		f.release()
+		return nil, f.err
+	}
+
+	if f.shared {
+		start, end := f.start, f.end
+		var err error
+		if rangeHeader != f.rangeHeader {
+			start, end, err = parseByteRange(rangeHeader, f.total)
+		}
+		if err != nil {
+			f.release()
+			return nil, err
+		}
+		if f.start <= start && end <= f.end {
+			return f.output(rangeHeader, start, end), nil
+		}
+	}
+
+	f.release()
+	return p.S3Proxy.Get(key, rangeHeader)
+}
+
+func (p *CoalescingProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	p.mu.Lock()
+	f, ok := p.heads[key]
+	if !ok {
+		f = &headFlight{done: make(chan struct{})}
+		p.heads[key] = f
+	}
+	f.clients++
+	p.mu.Unlock()
+
+	if !ok {
+		f.out, f.err = p.S3Proxy.Head(key)
+
+		p.mu.Lock()
+		if p.heads[key] == f {
+			delete(p.heads, key)
+		}
+		p.mu.Unlock()
+		close(f.done)
+	} else {
+		<-f.done
+	}
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	out := *f.out
+	return &out, nil
+}
+
+// invalidate detaches the reads in flight for key, so that no client joins
+// them once the key was written
+func (p *CoalescingProxy) invalidate(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.gets, key)
+	delete(p.heads, key)
+}
+
+func (p *CoalescingProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	defer p.invalidate(key)
+	return p.S3Proxy.Put(key, body, contentType)
+}
+
+// PutIfAbsent uses the backend's atomic create, and is not implemented when
+// the backend has none
+func (p *CoalescingProxy) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	cp, ok := p.S3Proxy.(ConditionalPutter)
+	if !ok {
+		return nil, errNotImplemented("Atomic create")
+	}
+
+	defer p.invalidate(key)
+	return cp.PutIfAbsent(key, body, contentType)
+}
+
+func (p *CoalescingProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	defer p.invalidate(key)
+	return p.S3Proxy.Delete(key)
+}
+
+func (p *CoalescingProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	defer p.invalidate(key)
+	return p.S3Proxy.CompleteMultipartUpload(key, uploadId, parts)
+}
+
+// PurgeCache purges the caches behind the proxy
+func (p *CoalescingProxy) PurgeCache(key string, prefix bool) int {
+	return purgeCache(p.S3Proxy, key, prefix)
+}
+
+// HasCache reports whether there is a cache behind the proxy
+func (p *CoalescingProxy) HasCache() bool {
+	return hasCache(p.S3Proxy)
+}
+
+// MigrationStatus reports the migration of the backend behind the proxy
+func (p *CoalescingProxy) MigrationStatus() (MigrationStatus, bool) {
+	return migrationStatus(p.S3Proxy)
+}
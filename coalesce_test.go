@@ -0,0 +1,346 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// readers returns the number of clients sharing flights for key
+func readers(p *CoalescingProxy, key string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for _, f := range p.gets[key] {
+		f.mu.Lock()
+		n += f.readers
+		f.mu.Unlock()
+	}
+	return n
+}
+
+type coalescedRead struct {
+	body string
+	err  error
+}
+
+// startGet reads key in the background, sending the result on the
+// returned channel
+func startGet(p S3Proxy, key string, rangeHeader string) <-chan coalescedRead {
+	result := make(chan coalescedRead, 1)
+	go func() {
+		out, err := p.Get(key, rangeHeader)
+		if err != nil {
+			result <- coalescedRead{err: err}
+			return
+		}
+		defer out.Body.Close()
+
+		data, err := io.ReadAll(out.Body)
+		result <- coalescedRead{body: string(data), err: err}
+	}()
+	return result
+}
+
+func TestCoalescingProxy_Ranges(t *testing.T) {
+	content := testContent(100)
+
+	tests := []struct {
+		name      string
+		first     string
+		others    []string
+		want      []string
+		wantReads []string
+	}{
+		{
+			name:      "whole object",
+			others:    []string{"", "", "bytes=10-19", "bytes=-5"},
+			want:      []string{content, content, content, content[10:20], content[95:]},
+			wantReads: []string{""},
+		},
+		{
+			name:      "same range",
+			first:     "bytes=-10",
+			others:    []string{"bytes=-10"},
+			want:      []string{content[90:], content[90:]},
+			wantReads: []string{"bytes=-10"},
+		},
+		{
+			name:      "subset of a range",
+			first:     "bytes=0-49",
+			others:    []string{"bytes=10-19", "bytes=49-49"},
+			want:      []string{content[:50], content[10:20], content[49:50]},
+			wantReads: []string{"bytes=0-49"},
+		},
+		{
+			name:      "overlapping range",
+			first:     "bytes=0-49",
+			others:    []string{"bytes=40-59", "bytes=-5"},
+			want:      []string{content[:50], content[40:60], content[95:]},
+			wantReads: []string{"bytes=-5", "bytes=0-49", "bytes=40-59"},
+		},
+		{
+			name:      "subset past the end of the object",
+			first:     "bytes=90-199",
+			others:    []string{"bytes=95-150"},
+			want:      []string{content[90:], content[95:]},
+			wantReads: []string{"bytes=90-199"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newFakeProxy()
+			backend.holdReads()
+			putString(t, backend, "key", content)
+			p := NewCoalescingProxy(backend, 0)
+
+			results := []<-chan coalescedRead{startGet(p, "key", tt.first)}
+			waitFor(t, "the first read", func() bool { return backend.started() == 1 })
+			for _, rangeHeader := range tt.others {
+				results = append(results, startGet(p, "key", rangeHeader))
+			}
+			waitFor(t, "the other reads", func() bool { return readers(p, "key") == len(results) })
+			backend.releaseReads()
+
+			for i, result := range results {
+				if r := <-result; r.err != nil || r.body != tt.want[i] {
+					t.Errorf("read %d = %q, %v, want %q", i, r.body, r.err, tt.want[i])
+				}
+			}
+
+			reads := backend.reads()
+			sort.Strings(reads)
+			if !reflect.DeepEqual(reads, tt.wantReads) {
+				t.Errorf("backend reads = %v, want %v", reads, tt.wantReads)
+			}
+		})
+	}
+}
+
+func TestCoalescingProxy_Disconnect(t *testing.T) {
+	backend := newFakeProxy()
+	backend.holdReads()
+	content := testContent(100)
+	putString(t, backend, "key", content)
+	p := NewCoalescingProxy(backend, 0)
+
+	first := make(chan *s3.GetObjectOutput)
+	go func() {
+		out, _ := p.Get("key", "")
+		first <- out
+	}()
+	waitFor(t, "the first read", func() bool { return backend.started() == 1 })
+
+	second := startGet(p, "key", "")
+	waitFor(t, "the second read", func() bool { return readers(p, "key") == 2 })
+	backend.releaseReads()
+
+	// The first client going away leaves the fetch to the second
+	out := <-first
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(out.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	out.Body.Close()
+
+	if r := <-second; r.err != nil || r.body != content {
+		t.Errorf("second read = %q, %v", r.body, r.err)
+	}
+	if reads := backend.reads(); len(reads) != 1 {
+		t.Errorf("backend reads = %v, want one", reads)
+	}
+}
+
+func TestCoalescingProxy_Abandoned(t *testing.T) {
+	backend := newFakeProxy()
+	putString(t, backend, "key", testContent(100))
+	p := NewCoalescingProxy(backend, 0)
+
+	out, err := p.Get("key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Body.Close()
+
+	// Once its only client leaves, a flight no longer takes new readers
+	waitFor(t, "the flight to end", func() bool { return readers(p, "key") == 0 })
+	if got := getString(t, p, "key", "bytes=0-9"); got != testContent(10) {
+		t.Errorf("Get() = %q", got)
+	}
+	if reads := backend.reads(); len(reads) != 2 {
+		t.Errorf("backend reads = %v, want a new read", reads)
+	}
+}
+
+func TestCoalescingProxy_NotShared(t *testing.T) {
+	backend := newFakeProxy()
+	backend.holdReads()
+	content := testContent(100)
+	putString(t, backend, "key", content)
+	p := NewCoalescingProxy(backend, 50)
+
+	first := startGet(p, "key", "")
+	waitFor(t, "the first read", func() bool { return backend.started() == 1 })
+	second := startGet(p, "key", "bytes=0-9")
+	waitFor(t, "the second read", func() bool { return readers(p, "key") == 2 })
+	backend.releaseReads()
+
+	// Responses over maxSize are streamed to the client that asked for
+	// them, and the others make their own request
+	if r := <-first; r.err != nil || r.body != content {
+		t.Errorf("first read = %q, %v", r.body, r.err)
+	}
+	if r := <-second; r.err != nil || r.body != content[:10] {
+		t.Errorf("second read = %q, %v", r.body, r.err)
+	}
+	if reads := backend.reads(); len(reads) != 2 {
+		t.Errorf("backend reads = %v, want two", reads)
+	}
+}
+
+func TestCoalescingProxy_Writes(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(p S3Proxy) error
+		want  string
+	}{
+		{name: "put", write: func(p S3Proxy) error {
+			_, err := p.Put("key", strings.NewReader("new"), "text/plain")
+			return err
+		}, want: "new"},
+		{name: "put if absent", write: func(p S3Proxy) error {
+			p.Delete("key")
+			_, err := p.(ConditionalPutter).PutIfAbsent("key", strings.NewReader("new"), "text/plain")
+			return err
+		}, want: "new"},
+		{name: "delete", write: func(p S3Proxy) error {
+			_, err := p.Delete("key")
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newFakeProxy()
+			backend.holdReads()
+			putString(t, backend, "key", "old")
+			p := NewCoalescingProxy(&conditionalProxy{fakeProxy: backend}, 0)
+
+			first := startGet(p, "key", "")
+			waitFor(t, "the first read", func() bool { return backend.started() == 1 })
+			if err := tt.write(p); err != nil {
+				t.Fatal(err)
+			}
+
+			// Reads after the write do not join the one in flight
+			second := startGet(p, "key", "")
+			waitFor(t, "the second read", func() bool { return backend.started() == 2 })
+			backend.releaseReads()
+
+			if r := <-first; r.err != nil || r.body != "old" {
+				t.Errorf("read before the write = %q, %v", r.body, r.err)
+			}
+			r := <-second
+			if tt.want == "" && !isNotFound(r.err) {
+				t.Errorf("read after the delete = %q, %v, want not found", r.body, r.err)
+			} else if tt.want != "" && (r.err != nil || r.body != tt.want) {
+				t.Errorf("read after the write = %q, %v, want %q", r.body, r.err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoalescingProxy_PutIfAbsent(t *testing.T) {
+	backend := newFakeProxy()
+	p := NewCoalescingProxy(backend, 0)
+
+	checkNoAtomicCreate(t, p, backend)
+}
+
+func TestCoalescingProxy_Headers(t *testing.T) {
+	backend := newFakeProxy()
+	backend.archived = true
+	putString(t, backend, "key", testContent(100))
+	p := NewCoalescingProxy(backend, 0)
+
+	for _, rangeHeader := range []string{"", "bytes=2-3"} {
+		out, err := p.Get("key", rangeHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Body.Close()
+
+		if aws.StringValue(out.CacheControl) != "max-age=60" || aws.StringValue(out.ContentEncoding) != "gzip" ||
+			aws.StringValue(out.Metadata["Owner"]) != "alice" || aws.StringValue(out.Restore) != `ongoing-request="false"` ||
+			aws.StringValue(out.StorageClass) != s3.StorageClassGlacier || aws.StringValue(out.VersionId) != "v1" {
+			t.Errorf("shared Get(%q) lost the object's headers: %+v", rangeHeader, out)
+		}
+	}
+}
+
+func TestCoalescingProxy_Head(t *testing.T) {
+	backend := newFakeProxy()
+	backend.holdReads()
+	putString(t, backend, "key", "value")
+	p := NewCoalescingProxy(backend, 0)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.Head("key")
+			errs <- err
+		}()
+	}
+	waitFor(t, "the reads", func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.heads["key"] != nil && p.heads["key"].clients == 10
+	})
+	backend.releaseReads()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Head() error = %v", err)
+		}
+	}
+	if backend.heads != 1 {
+		t.Errorf("backend saw %d HEADs for 10 concurrent clients, want one", backend.heads)
+	}
+
+	if _, err := p.Head("missing"); !isNotFound(err) {
+		t.Errorf("Head() error = %v, want not found", err)
+	}
+}
+
+func TestCoalesceConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  CoalesceConfig
+		wantErr bool
+	}{
+		{name: "default", config: CoalesceConfig{}},
+		{name: "max size", config: CoalesceConfig{MaxSize: 1 << 20}},
+		{name: "negative max size", config: CoalesceConfig{MaxSize: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -20,7 +20,10 @@ const (
 	kAWSRegionName   = "S3PROXY_AWS_REGION"
 	kAWSBucketName   = "S3PROXY_AWS_BUCKET"
 	kAWSEndpointName = "S3PROXY_AWS_ENDPOINT"
+	kBackendTypeName = "S3PROXY_BACKEND_TYPE"
+	kFilesystemRoot  = "S3PROXY_FILESYSTEM_ROOT"
 	kUsersName       = "S3PROXY_USERS"
+	kAdminsName      = "S3PROXY_ADMINS"
 	kCORSKeyName     = "S3PROXY_OPTION_CORS"
 	kGzipKeyName     = "S3PROXY_OPTION_GZIP"
 	kWebsiteKeyName  = "S3PROXY_OPTION_WEBSITE"
@@ -54,16 +57,29 @@ func createMulti() (http.Handler, error) {
 
 	handler := NewHostDispatchingHandler()
 
-	for i, site := range cfg {
-		err = site.validateWithHost()
+	workers, err := buildWorkers(func() error {
+		for i, site := range cfg {
+			err := site.validateWithHost()
 
-		if err != nil {
-			msg := fmt.Sprintf("%v in configuration at position %d", err, i)
-			return nil, errors.New(msg)
-		}
+			if err != nil {
+				msg := fmt.Sprintf("%v in configuration at position %d", err, i)
+				return errors.New(msg)
+			}
+
+			siteHandler, err := createSiteHandler(site)
+			if err != nil {
+				msg := fmt.Sprintf("%v in configuration at position %d", err, i)
+				return errors.New(msg)
+			}
 
-		handler.HandleHost(site.Host, createSiteHandler(site))
+			handler.HandleHost(site.Host, siteHandler)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	workers.start()
 
 	return handler, nil
 }
@@ -74,6 +90,11 @@ func createSingle() (http.Handler, error) {
 		return nil, err
 	}
 
+	admins, err := parseUsers(os.Getenv(kAdminsName))
+	if err != nil {
+		return nil, err
+	}
+
 	opts := Options{
 		CORS:     os.Getenv(kCORSKeyName) == "true",
 		Gzip:     os.Getenv(kGzipKeyName) == "true",
@@ -84,6 +105,7 @@ func createSingle() (http.Handler, error) {
 	}
 
 	s := Site{
+		Type:        os.Getenv(kBackendTypeName),
 		AWSKey:      os.Getenv(kAWSKeyName),
 		AWSSecret:   os.Getenv(kAWSSecretName),
 		AWSRegion:   os.Getenv(kAWSRegionName),
@@ -91,21 +113,40 @@ func createSingle() (http.Handler, error) {
 		AWSEndpoint: os.Getenv(kAWSEndpointName),
 		Users:       users,
 		Options:     opts,
+		Admins:      admins,
+	}
+
+	if root := os.Getenv(kFilesystemRoot); root != "" {
+		s.Filesystem = &FilesystemConfig{Root: root}
 	}
 
 	err = s.validate()
 
 	if err != nil {
 		return nil, err
-	} else {
-		return createSiteHandler(s), nil
 	}
+
+	var handler http.Handler
+	workers, err := buildWorkers(func() (err error) {
+		handler, err = createSiteHandler(s)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	workers.start()
+
+	return handler, nil
 }
 
-func createSiteHandler(s Site) http.Handler {
+func createSiteHandler(s Site) (http.Handler, error) {
 	var handler http.Handler
 
-	proxy := NewS3Proxy(s.AWSKey, s.AWSSecret, s.AWSRegion, s.AWSBucket, s.AWSEndpoint)
+	proxy, err := NewBackend(s)
+	if err != nil {
+		return nil, err
+	}
+
 	handler = NewProxyHandler(proxy, s.Options.Prefix, s.AWSBucket)
 
 	if s.Options.Website {
@@ -133,6 +174,15 @@ func createSiteHandler(s Site) http.Handler {
 		fmt.Printf("warning: site for bucket %s has no configured users\n", s.AWSBucket)
 	}
 
+	// Browser form uploads authenticate with a signed policy instead of basic auth
+	handler = NewPostPolicyHandler(proxy, s.Users, s.Options.Prefix, s.AWSBucket, handler)
+
+	// Cache administration authenticates against the site's admins
+	if len(s.Admins) > 0 {
+		warmer := siteWarmer(s.Host, proxy)
+		handler = NewCacheAdminHandler(s.Admins, proxy, warmer, s.Options.Prefix, s.AWSBucket, handler)
+	}
+
 	if s.Options.ForceSSL {
 		handler = NewSSLRedirectHandler(handler)
 	}
@@ -141,7 +191,7 @@ func createSiteHandler(s Site) http.Handler {
 		handler = handlers.ProxyHeaders(handler)
 	}
 
-	return handler
+	return handler, nil
 }
 
 func corsHandler(next http.Handler) http.Handler {
@@ -185,20 +235,65 @@ func (s Site) validateWithHost() error {
 }
 
 func (s Site) validate() error {
-	if s.AWSKey == "" {
-		return errors.New("AWS Key not specified")
+	b, err := lookupBackend(s)
+	if err != nil {
+		return err
+	}
+
+	if err := b.validate(s); err != nil {
+		return err
+	}
+
+	if s.Failover != nil {
+		if err := validateFailover(s); err != nil {
+			return err
+		}
+	}
+
+	if s.Replication != nil {
+		if err := s.Replication.validate(); err != nil {
+			return err
+		}
+	}
+
+	if s.ParallelGet != nil {
+		if err := s.ParallelGet.validate(); err != nil {
+			return err
+		}
 	}
 
-	if s.AWSSecret == "" {
-		return errors.New("AWS Secret not specified")
+	if s.DiskCache != nil {
+		if err := s.DiskCache.validate(); err != nil {
+			return err
+		}
 	}
 
-	if s.AWSRegion == "" {
-		return errors.New("AWS Region not specified")
+	if s.MemoryCache != nil {
+		if err := s.MemoryCache.validate(); err != nil {
+			return err
+		}
+	}
+
+	if s.Coalesce != nil {
+		if err := s.Coalesce.validate(); err != nil {
+			return err
+		}
+	}
+
+	if s.ReadAhead != nil {
+		if err := s.ReadAhead.validate(); err != nil {
+			return err
+		}
+	}
+
+	if s.MultipartPut != nil {
+		if err := s.MultipartPut.validate(); err != nil {
+			return err
+		}
 	}
 
-	if s.AWSBucket == "" {
-		return errors.New("AWS Bucket not specified")
+	if s.WriteBack != nil {
+		return s.WriteBack.validate()
 	}
 
 	return nil
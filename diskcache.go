@@ -0,0 +1,737 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultDiskCacheBlockSize = 1 << 20
+	// diskCacheFetchBlocks is the most blocks a read fetches from the
+	// backend in one ranged request
+	diskCacheFetchBlocks = 16
+	// diskCacheLowWater is the fraction of maxSize eviction frees down to,
+	// so that it runs in batches rather than on every stored block
+	diskCacheLowWater = 0.9
+
+	diskCacheLRU = "lru"
+	diskCacheLFU = "lfu"
+)
+
+// DiskCacheConfig puts a read cache on local disk in front of the backend.
+// Objects are cached in blocks of BlockSize bytes (default 1 MiB), so range
+// requests only fetch the blocks not cached yet. MaxSize caps the bytes
+// cached in Dir, evicting the least recently ("lru", the default) or least
+// frequently ("lfu") used blocks.
+//
+// Cached objects are checked against the backend's ETag with a HEAD before
+// being served, or once per RevalidateAfter, a duration such as "1m", when
+// set. Writes through the proxy invalidate them immediately. Each site
+// needs a Dir of its own.
+type DiskCacheConfig struct {
+	Dir             string `json:"dir" yaml:"dir"`
+	MaxSize         int64  `json:"maxSize" yaml:"maxSize"`
+	BlockSize       int64  `json:"blockSize,omitempty" yaml:"blockSize,omitempty"`
+	Eviction        string `json:"eviction,omitempty" yaml:"eviction,omitempty"`
+	RevalidateAfter string `json:"revalidateAfter,omitempty" yaml:"revalidateAfter,omitempty"`
+}
+
+func (c *DiskCacheConfig) validate() error {
+	if c.Dir == "" {
+		return errors.New("Disk cache dir not specified")
+	}
+	if c.MaxSize <= 0 {
+		return errors.New("Disk cache maxSize must be positive")
+	}
+	if c.BlockSize < 0 {
+		return errors.New("Disk cache blockSize must not be negative")
+	}
+
+	switch strings.ToLower(c.Eviction) {
+	case "", diskCacheLRU, diskCacheLFU:
+	default:
+		return fmt.Errorf("Invalid disk cache eviction %q (expected lru or lfu)", c.Eviction)
+	}
+
+	if c.RevalidateAfter != "" {
+		if d, err := time.ParseDuration(c.RevalidateAfter); err != nil || d < 0 {
+			return fmt.Errorf("Invalid disk cache revalidateAfter %q", c.RevalidateAfter)
+		}
+	}
+
+	return nil
+}
+
+// newDiskCacheBackend puts a site's backend behind its disk cache
+func newDiskCacheBackend(backend S3Proxy, cfg DiskCacheConfig) (S3Proxy, error) {
+	var revalidateAfter time.Duration
+	if cfg.RevalidateAfter != "" {
+		revalidateAfter, _ = time.ParseDuration(cfg.RevalidateAfter)
+	}
+
+	cache, err := openDiskCache(cfg.Dir, cfg.MaxSize, cfg.BlockSize, strings.ToLower(cfg.Eviction))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDiskCacheProxy(backend, cache, revalidateAfter), nil
+}
+
+// diskCacheMeta is stored with an entry's blocks
+type diskCacheMeta struct {
+	Key          string    `json:"key"`
+	ETag         string    `json:"etag"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	BlockSize    int64     `json:"blockSize"`
+	// Head is the backend's HEAD of the object, whose headers GETs return
+	Head *s3.HeadObjectOutput `json:"head"`
+}
+
+// diskCacheEntry is one version of an object, identified by its ETag. Its
+// blocks live in a directory of their own, so blocks of a replaced version
+// can never be mistaken for the current one's.
+type diskCacheEntry struct {
+	dir     string
+	meta    diskCacheMeta
+	stored  bool // meta.json has been written
+	checked time.Time
+	blocks  map[int64]*diskCacheBlock
+}
+
+type diskCacheBlock struct {
+	entry *diskCacheEntry
+	index int64
+	size  int64
+	used  int64 // Unix nanoseconds
+	hits  int64
+}
+
+func (b *diskCacheBlock) path() string {
+	return filepath.Join(b.entry.dir, strconv.FormatInt(b.index, 10))
+}
+
+// diskCache is the index of a cache directory. It outlives configuration
+// reloads, so the index is only rebuilt from disk at startup.
+type diskCache struct {
+	dir string
+
+	mu        sync.Mutex
+	maxSize   int64
+	blockSize int64
+	eviction  string
+	size      int64
+	entries   map[string]*diskCacheEntry
+}
+
+var openDiskCaches = struct {
+	sync.Mutex
+	m map[string]*diskCache
+}{m: make(map[string]*diskCache)}
+
+// openDiskCache returns the cache for dir, loading what earlier runs stored
+// there. A cache already open for dir takes the new settings.
+func openDiskCache(dir string, maxSize, blockSize int64, eviction string) (*diskCache, error) {
+	if blockSize <= 0 {
+		blockSize = defaultDiskCacheBlockSize
+	}
+	if eviction == "" {
+		eviction = diskCacheLRU
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	openDiskCaches.Lock()
+	defer openDiskCaches.Unlock()
+
+	if c, ok := openDiskCaches.m[abs]; ok {
+		c.mu.Lock()
+		c.maxSize, c.blockSize, c.eviction = maxSize, blockSize, eviction
+		c.evictLocked()
+		c.mu.Unlock()
+		return c, nil
+	}
+
+	c := &diskCache{
+		dir:       abs,
+		maxSize:   maxSize,
+		blockSize: blockSize,
+		eviction:  eviction,
+		entries:   make(map[string]*diskCacheEntry),
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return nil, err
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	openDiskCaches.m[abs] = c
+	return c, nil
+}
+
+func hashHex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// entryDir is dir/<key hash prefix>/<key hash>/<ETag hash>
+func (c *diskCache) entryDir(key, etag string) string {
+	kh := hashHex(key)
+	return filepath.Join(c.dir, kh[:2], kh, hashHex(etag)[:16])
+}
+
+// load rebuilds the index from the cache directory. Access times come
+// from the block files' modification times; use counts start afresh.
+func (c *diskCache) load() error {
+	metas, err := filepath.Glob(filepath.Join(c.dir, "*", "*", "*", "meta.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range metas {
+		dir := filepath.Dir(path)
+
+		var meta diskCacheMeta
+		data, err := os.ReadFile(path)
+		if err != nil || json.Unmarshal(data, &meta) != nil || meta.BlockSize <= 0 || meta.Head == nil || c.entryDir(meta.Key, meta.ETag) != dir {
+			os.RemoveAll(dir)
+			continue
+		}
+
+		// Only one version of a key is kept
+		if prev, ok := c.entries[meta.Key]; ok {
+			if !meta.LastModified.After(prev.meta.LastModified) {
+				os.RemoveAll(dir)
+				continue
+			}
+			c.dropLocked(prev)
+		}
+
+		e := &diskCacheEntry{dir: dir, meta: meta, stored: true, blocks: make(map[int64]*diskCacheBlock)}
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			index, err := strconv.ParseInt(f.Name(), 10, 64)
+			if err != nil {
+				if f.Name() != "meta.json" {
+					// Left over from an interrupted write
+					os.Remove(filepath.Join(dir, f.Name()))
+				}
+				continue
+			}
+
+			info, err := f.Info()
+			if err != nil || info.Size() != e.blockLength(index) {
+				os.Remove(filepath.Join(dir, f.Name()))
+				continue
+			}
+
+			e.blocks[index] = &diskCacheBlock{entry: e, index: index, size: info.Size(), used: info.ModTime().UnixNano(), hits: 1}
+			c.size += info.Size()
+		}
+		c.entries[meta.Key] = e
+	}
+
+	c.evictLocked()
+	return nil
+}
+
+// blockLength returns the length of a block, shorter for the last one
+func (e *diskCacheEntry) blockLength(index int64) int64 {
+	start := index * e.meta.BlockSize
+	if start >= e.meta.Size {
+		return -1
+	}
+	if end := start + e.meta.BlockSize; end < e.meta.Size {
+		return e.meta.BlockSize
+	}
+	return e.meta.Size - start
+}
+
+// dropLocked removes an entry and its files. c.mu must be held.
+func (c *diskCache) dropLocked(e *diskCacheEntry) {
+	for _, b := range e.blocks {
+		c.size -= b.size
+	}
+	e.blocks = make(map[int64]*diskCacheBlock)
+	if c.entries[e.meta.Key] == e {
+		delete(c.entries, e.meta.Key)
+	}
+	os.RemoveAll(e.dir)
+}
+
+func (c *diskCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.dropLocked(e)
+	}
+}
+
+// purge drops the entries of the keys, returning how many it dropped
+func (c *diskCache) purge(key string, prefix bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for cached, e := range c.entries {
+		if purgeMatches(cached, key, prefix) {
+			c.dropLocked(e)
+			n++
+		}
+	}
+	return n
+}
+
+// evictLocked removes blocks until the cache fits its budget. c.mu must be
+// held.
+func (c *diskCache) evictLocked() {
+	if c.size <= c.maxSize {
+		return
+	}
+
+	var blocks []*diskCacheBlock
+	for _, e := range c.entries {
+		for _, b := range e.blocks {
+			blocks = append(blocks, b)
+		}
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		if c.eviction == diskCacheLFU && blocks[i].hits != blocks[j].hits {
+			return blocks[i].hits < blocks[j].hits
+		}
+		return blocks[i].used < blocks[j].used
+	})
+
+	target := int64(float64(c.maxSize) * diskCacheLowWater)
+	for _, b := range blocks {
+		if c.size <= target {
+			break
+		}
+
+		delete(b.entry.blocks, b.index)
+		c.size -= b.size
+		os.Remove(b.path())
+
+		if len(b.entry.blocks) == 0 {
+			c.dropLocked(b.entry)
+		}
+	}
+}
+
+// has reports whether a block is cached
+func (c *diskCache) has(e *diskCacheEntry, index int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := e.blocks[index]
+	return ok
+}
+
+// read returns a cached block, or nil if it is not cached
+func (c *diskCache) read(e *diskCacheEntry, index int64) []byte {
+	c.mu.Lock()
+	b, ok := e.blocks[index]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	b.used = now.UnixNano()
+	b.hits++
+	path := b.path()
+	c.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil || int64(len(data)) != b.size {
+		c.mu.Lock()
+		if e.blocks[index] == b {
+			delete(e.blocks, index)
+			c.size -= b.size
+		}
+		c.mu.Unlock()
+		return nil
+	}
+
+	// Keeps the access time for the index rebuilt after a restart
+	os.Chtimes(path, now, now)
+	return data
+}
+
+// store caches a block, unless its entry was replaced meanwhile
+func (c *diskCache) store(e *diskCacheEntry, index int64, data []byte) error {
+	c.mu.Lock()
+	current := c.entries[e.meta.Key] == e
+	_, cached := e.blocks[index]
+	writeMeta := !e.stored
+	maxSize := c.maxSize
+	c.mu.Unlock()
+	if !current || cached || int64(len(data)) > maxSize {
+		return nil
+	}
+
+	if writeMeta {
+		if err := os.MkdirAll(e.dir, 0755); err != nil {
+			return err
+		}
+		meta, _ := json.Marshal(&e.meta)
+		if err := writeFileAtomic(filepath.Join(e.dir, "meta.json"), meta); err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		e.stored = true
+		c.mu.Unlock()
+	}
+
+	b := &diskCacheBlock{entry: e, index: index, size: int64(len(data)), used: time.Now().UnixNano(), hits: 1}
+	if err := writeFileAtomic(b.path(), data); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries[e.meta.Key] != e {
+		// Replaced while writing; its directory is gone or going
+		os.Remove(b.path())
+		return nil
+	}
+	if _, ok := e.blocks[index]; !ok {
+		e.blocks[index] = b
+		c.size += b.size
+		c.evictLocked()
+	}
+	return nil
+}
+
+// writeFileAtomic writes through a temporary file, so a crash never
+// leaves a partial block under its final name
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// DiskCacheProxy serves reads through a disk cache, filling it with the
+// blocks its reads fetch from the backend. Everything else goes to the
+// backend, and writes invalidate the key's cached blocks.
+type DiskCacheProxy struct {
+	S3Proxy
+	cache           *diskCache
+	revalidateAfter time.Duration
+	now             func() time.Time
+}
+
+func NewDiskCacheProxy(backend S3Proxy, cache *diskCache, revalidateAfter time.Duration) *DiskCacheProxy {
+	return &DiskCacheProxy{S3Proxy: backend, cache: cache, revalidateAfter: revalidateAfter, now: time.Now}
+}
+
+// entry returns the cache entry of key's current version, checking the
+// backend's ETag unless it was checked within revalidateAfter
+func (p *DiskCacheProxy) entry(key string) (*diskCacheEntry, error) {
+	c := p.cache
+	now := p.now()
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	fresh := ok && p.revalidateAfter > 0 && now.Sub(e.checked) < p.revalidateAfter
+	c.mu.Unlock()
+	if fresh {
+		return e, nil
+	}
+
+	head, err := p.S3Proxy.Head(key)
+	if err != nil {
+		if isNotFound(err) {
+			c.invalidate(key)
+		}
+		return nil, err
+	}
+
+	meta := diskCacheMeta{
+		Key:          key,
+		ETag:         aws.StringValue(head.ETag),
+		Size:         aws.Int64Value(head.ContentLength),
+		LastModified: aws.TimeValue(head.LastModified),
+		Head:         head,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		if e.meta.ETag == meta.ETag && e.meta.Size == meta.Size {
+			e.checked = now
+			return e, nil
+		}
+		c.dropLocked(e)
+	}
+
+	meta.BlockSize = c.blockSize
+	e = &diskCacheEntry{
+		dir:     c.entryDir(key, meta.ETag),
+		meta:    meta,
+		checked: now,
+		blocks:  make(map[int64]*diskCacheBlock),
+	}
+	c.entries[key] = e
+	return e, nil
+}
+
+// Get serves a read from the cached blocks and the backend. The first block
+// is read before returning, so backend errors such as a key deleted since
+// the HEAD or an archived object are reported instead of a truncated body.
+func (p *DiskCacheProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	e, err := p.entry(key)
+	if err != nil {
+		return nil, err
+	}
+
+	size := e.meta.Size
+	out := getOutputFromHead(e.meta.Head)
+	out.AcceptRanges = aws.String("bytes")
+	out.ContentLength = aws.Int64(size)
+
+	start, end := int64(0), size-1
+	if rangeHeader != "" {
+		if start, end, err = parseByteRange(rangeHeader, size); err != nil {
+			return nil, err
+		}
+		out.ContentLength = aws.Int64(end - start + 1)
+		out.ContentRange = aws.String(contentRange(start, end, size))
+	}
+
+	r := &diskCacheReader{p: p, e: e, pos: start, end: end}
+	if start <= end {
+		if err := r.fill(); err != nil {
+			return nil, err
+		}
+	}
+
+	out.Body = r
+	return out, nil
+}
+
+// getOutputFromHead returns the headers of a HEAD as those of a GET of the
+// whole object
+func getOutputFromHead(h *s3.HeadObjectOutput) *s3.GetObjectOutput {
+	return &s3.GetObjectOutput{
+		AcceptRanges:              h.AcceptRanges,
+		BucketKeyEnabled:          h.BucketKeyEnabled,
+		CacheControl:              h.CacheControl,
+		ChecksumCRC32:             h.ChecksumCRC32,
+		ChecksumCRC32C:            h.ChecksumCRC32C,
+		ChecksumSHA1:              h.ChecksumSHA1,
+		ChecksumSHA256:            h.ChecksumSHA256,
+		ContentDisposition:        h.ContentDisposition,
+		ContentEncoding:           h.ContentEncoding,
+		ContentLanguage:           h.ContentLanguage,
+		ContentLength:             h.ContentLength,
+		ContentType:               h.ContentType,
+		DeleteMarker:              h.DeleteMarker,
+		ETag:                      h.ETag,
+		Expiration:                h.Expiration,
+		Expires:                   h.Expires,
+		LastModified:              h.LastModified,
+		Metadata:                  h.Metadata,
+		MissingMeta:               h.MissingMeta,
+		ObjectLockLegalHoldStatus: h.ObjectLockLegalHoldStatus,
+		ObjectLockMode:            h.ObjectLockMode,
+		ObjectLockRetainUntilDate: h.ObjectLockRetainUntilDate,
+		PartsCount:                h.PartsCount,
+		ReplicationStatus:         h.ReplicationStatus,
+		RequestCharged:            h.RequestCharged,
+		Restore:                   h.Restore,
+		SSECustomerAlgorithm:      h.SSECustomerAlgorithm,
+		SSECustomerKeyMD5:         h.SSECustomerKeyMD5,
+		SSEKMSKeyId:               h.SSEKMSKeyId,
+		ServerSideEncryption:      h.ServerSideEncryption,
+		StorageClass:              h.StorageClass,
+		VersionId:                 h.VersionId,
+		WebsiteRedirectLocation:   h.WebsiteRedirectLocation,
+	}
+}
+
+// diskCacheReader serves a byte range block by block, reading cached
+// blocks from disk and fetching runs of missing blocks from the backend
+type diskCacheReader struct {
+	p        *DiskCacheProxy
+	e        *diskCacheEntry
+	pos, end int64 // next offset to return and the inclusive last one
+	buf      []byte
+	err      error
+}
+
+func (r *diskCacheReader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.pos > r.end {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *diskCacheReader) Close() error {
+	return nil
+}
+
+func (r *diskCacheReader) fill() error {
+	c := r.p.cache
+	blockSize := r.e.meta.BlockSize
+	first := r.pos / blockSize
+	last := r.end / blockSize
+
+	data := c.read(r.e, first)
+	if data == nil {
+		// Fetch the run of missing blocks starting here
+		run := first
+		for run < last && run-first+1 < diskCacheFetchBlocks && !c.has(r.e, run+1) {
+			run++
+		}
+
+		var err error
+		if data, err = r.fetch(first, run); err != nil {
+			return err
+		}
+	}
+
+	base := first * blockSize
+	end := base + int64(len(data)) - 1
+	if end > r.end {
+		end = r.end
+	}
+	r.buf = data[r.pos-base : end-base+1]
+	r.pos = end + 1
+	return nil
+}
+
+// fetch reads blocks first to last from the backend and caches them
+func (r *diskCacheReader) fetch(first, last int64) ([]byte, error) {
+	meta := r.e.meta
+	start := first * meta.BlockSize
+	end := (last+1)*meta.BlockSize - 1
+	if end >= meta.Size {
+		end = meta.Size - 1
+	}
+
+	obj, err := r.p.S3Proxy.Get(meta.Key, fmt.Sprintf("bytes=%d-%d", start, end))
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	if etag := aws.StringValue(obj.ETag); etag != "" && etag != meta.ETag {
+		// Changed behind the proxy's back since the HEAD
+		r.p.cache.invalidate(meta.Key)
+		return nil, fmt.Errorf("%s changed while being read", meta.Key)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(obj.Body, end-start+2))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != end-start+1 {
+		return nil, fmt.Errorf("%s: read %d bytes of range %d-%d", meta.Key, len(data), start, end)
+	}
+
+	for index := first; index <= last; index++ {
+		from := (index - first) * meta.BlockSize
+		to := from + meta.BlockSize
+		if to > int64(len(data)) {
+			to = int64(len(data))
+		}
+		if err := r.p.cache.store(r.e, index, data[from:to]); err != nil {
+			log.Printf("disk cache: storing %s block %d: %v", meta.Key, index, err)
+		}
+	}
+
+	return data, nil
+}
+
+// PurgeCache drops the cached blocks of the keys
+func (p *DiskCacheProxy) PurgeCache(key string, prefix bool) int {
+	return p.cache.purge(key, prefix) + purgeCache(p.S3Proxy, key, prefix)
+}
+
+// HasCache is true, as the proxy is a cache
+func (p *DiskCacheProxy) HasCache() bool {
+	return true
+}
+
+// MigrationStatus reports the migration of the backend behind the proxy
+func (p *DiskCacheProxy) MigrationStatus() (MigrationStatus, bool) {
+	return migrationStatus(p.S3Proxy)
+}
+
+func (p *DiskCacheProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	defer p.cache.invalidate(key)
+	return p.S3Proxy.Put(key, body, contentType)
+}
+
+// PutIfAbsent uses the backend's atomic create, and is not implemented over
+// backends without one
+func (p *DiskCacheProxy) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	cp, ok := p.S3Proxy.(ConditionalPutter)
+	if !ok {
+		return nil, errNotImplemented("Atomic create")
+	}
+
+	defer p.cache.invalidate(key)
+	return cp.PutIfAbsent(key, body, contentType)
+}
+
+func (p *DiskCacheProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	defer p.cache.invalidate(key)
+	return p.S3Proxy.Delete(key)
+}
+
+func (p *DiskCacheProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	defer p.cache.invalidate(key)
+	return p.S3Proxy.CompleteMultipartUpload(key, uploadId, parts)
+}
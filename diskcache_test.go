@@ -0,0 +1,228 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func newTestDiskCacheProxy(t *testing.T, dir string, maxSize int64, eviction string, revalidateAfter time.Duration) (*DiskCacheProxy, *fakeProxy) {
+	t.Helper()
+
+	cache, err := openDiskCache(dir, maxSize, 16, eviction)
+	if err != nil {
+		t.Fatalf("openDiskCache() error = %v", err)
+	}
+	t.Cleanup(func() {
+		openDiskCaches.Lock()
+		delete(openDiskCaches.m, cache.dir)
+		openDiskCaches.Unlock()
+	})
+
+	backend := newFakeProxy()
+	return NewDiskCacheProxy(backend, cache, revalidateAfter), backend
+}
+
+func TestDiskCacheProxy_Blocks(t *testing.T) {
+	p, backend := newTestDiskCacheProxy(t, t.TempDir(), 1<<20, "", 0)
+	content := testContent(100)
+	putString(t, backend, "key", content)
+
+	tests := []struct {
+		name        string
+		rangeHeader string
+		want        string
+		wantReads   []string
+	}{
+		{name: "first read", rangeHeader: "bytes=20-40", want: content[20:41], wantReads: []string{"bytes=16-47"}},
+		{name: "cached", rangeHeader: "bytes=17-46", want: content[17:47]},
+		{name: "missing blocks around cached ones", rangeHeader: "bytes=0-63", want: content[:64], wantReads: []string{"bytes=0-15", "bytes=48-63"}},
+		{name: "short last block", want: content, wantReads: []string{"bytes=64-99"}},
+		{name: "all cached", rangeHeader: "bytes=-10", want: content[90:]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getString(t, p, "key", tt.rangeHeader); got != tt.want {
+				t.Errorf("Get() = %q, want %q", got, tt.want)
+			}
+			if got := backend.reads(); !reflect.DeepEqual(got, tt.wantReads) {
+				t.Errorf("backend reads = %v, want %v", got, tt.wantReads)
+			}
+		})
+	}
+}
+
+func TestDiskCacheProxy_Invalidation(t *testing.T) {
+	p, backend := newTestDiskCacheProxy(t, t.TempDir(), 1<<20, "", 0)
+	putString(t, p, "key", "first")
+	getString(t, p, "key", "")
+
+	putString(t, p, "key", "second")
+	if got := getString(t, p, "key", ""); got != "second" {
+		t.Errorf("Get() after Put() = %q", got)
+	}
+
+	// Writes made behind the proxy's back show up as a new ETag
+	putString(t, backend, "key", "third")
+	if got := getString(t, p, "key", ""); got != "third" {
+		t.Errorf("Get() after a direct write = %q", got)
+	}
+
+	if _, err := p.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get("key", ""); !isNotFound(err) {
+		t.Errorf("Get() after Delete() error = %v, want not found", err)
+	}
+}
+
+func TestDiskCacheProxy_BackendErrors(t *testing.T) {
+	p, backend := newTestDiskCacheProxy(t, t.TempDir(), 1<<20, "", time.Hour)
+	putString(t, backend, "key", testContent(64))
+	getString(t, p, "key", "bytes=0-15")
+
+	// Deleted behind the proxy's back after the HEAD was cached
+	if _, err := backend.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get("key", "bytes=32-47"); !isNotFound(err) {
+		t.Errorf("Get() of a deleted key error = %v, want not found", err)
+	}
+}
+
+func TestDiskCacheProxy_Headers(t *testing.T) {
+	p, backend := newTestDiskCacheProxy(t, t.TempDir(), 1<<20, "", time.Hour)
+	backend.archived = true
+	putString(t, backend, "key", "content")
+
+	for _, rangeHeader := range []string{"", "bytes=2-3"} {
+		out, err := p.Get("key", rangeHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Body.Close()
+
+		if aws.StringValue(out.CacheControl) != "max-age=60" || aws.StringValue(out.ContentEncoding) != "gzip" ||
+			aws.StringValue(out.Metadata["Owner"]) != "alice" || aws.StringValue(out.Restore) != `ongoing-request="false"` ||
+			aws.StringValue(out.StorageClass) != s3.StorageClassGlacier || aws.StringValue(out.VersionId) != "v1" {
+			t.Errorf("Get(%q) lost the HEAD's headers: %+v", rangeHeader, out)
+		}
+	}
+}
+
+func TestDiskCacheProxy_RevalidateAfter(t *testing.T) {
+	p, backend := newTestDiskCacheProxy(t, t.TempDir(), 1<<20, "", time.Minute)
+	putString(t, backend, "key", "cached")
+	getString(t, p, "key", "")
+	backend.heads = 0
+
+	putString(t, backend, "key", "behind")
+	if got := getString(t, p, "key", ""); got != "cached" || backend.heads != 0 {
+		t.Errorf("Get() within revalidateAfter = %q after %d HEADs", got, backend.heads)
+	}
+
+	p.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if got := getString(t, p, "key", ""); got != "behind" {
+		t.Errorf("Get() after revalidateAfter = %q", got)
+	}
+}
+
+func TestDiskCacheProxy_Eviction(t *testing.T) {
+	tests := []struct {
+		name     string
+		eviction string
+		wantGone string
+	}{
+		{name: "lru", eviction: "lru", wantGone: "b"},
+		{name: "lfu", eviction: "lfu", wantGone: "c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Room for three of the four one-block objects
+			p, backend := newTestDiskCacheProxy(t, t.TempDir(), 60, tt.eviction, 0)
+			for _, key := range []string{"a", "b", "c", "d"} {
+				putString(t, backend, key, strings.Repeat(key, 16))
+			}
+
+			for _, key := range []string{"a", "b", "a", "b", "c", "a"} {
+				getString(t, p, key, "")
+			}
+			getString(t, p, "d", "")
+			backend.reads()
+
+			for _, key := range []string{"a", "b", "c", "d"} {
+				getString(t, p, key, "")
+				if reads := backend.reads(); (len(reads) > 0) != (key == tt.wantGone) {
+					t.Errorf("%s read from the backend %v, want only %s evicted", key, reads, tt.wantGone)
+				}
+				if key == tt.wantGone {
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestDiskCacheProxy_Persists(t *testing.T) {
+	dir := t.TempDir()
+	p, backend := newTestDiskCacheProxy(t, dir, 1<<20, "", 0)
+	content := testContent(40)
+	putString(t, backend, "key", content)
+	getString(t, p, "key", "")
+	backend.reads()
+
+	// A fresh index is rebuilt from the directory
+	openDiskCaches.Lock()
+	delete(openDiskCaches.m, p.cache.dir)
+	openDiskCaches.Unlock()
+
+	cache, err := openDiskCache(dir, 1<<20, 16, "")
+	if err != nil {
+		t.Fatalf("openDiskCache() error = %v", err)
+	}
+	if cache.size != 40 {
+		t.Errorf("reloaded cache holds %d bytes, want 40", cache.size)
+	}
+
+	reloaded := NewDiskCacheProxy(backend, cache, 0)
+	if got := getString(t, reloaded, "key", ""); got != content {
+		t.Errorf("Get() = %q", got)
+	}
+	if reads := backend.reads(); len(reads) != 0 {
+		t.Errorf("backend reads after reload = %v, want none", reads)
+	}
+}
+
+func TestDiskCacheProxy_PutIfAbsent(t *testing.T) {
+	p, backend := newTestDiskCacheProxy(t, t.TempDir(), 1<<20, "", 0)
+
+	checkNoAtomicCreate(t, p, backend)
+}
+
+func TestDiskCacheConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  DiskCacheConfig
+		wantErr bool
+	}{
+		{name: "valid", config: DiskCacheConfig{Dir: "/var/cache", MaxSize: 1 << 30, Eviction: "LFU", RevalidateAfter: "30s"}},
+		{name: "no dir", config: DiskCacheConfig{MaxSize: 1}, wantErr: true},
+		{name: "no size", config: DiskCacheConfig{Dir: "/var/cache"}, wantErr: true},
+		{name: "bad eviction", config: DiskCacheConfig{Dir: "/var/cache", MaxSize: 1, Eviction: "fifo"}, wantErr: true},
+		{name: "bad revalidateAfter", config: DiskCacheConfig{Dir: "/var/cache", MaxSize: 1, RevalidateAfter: "soon"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,1057 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// erasurePrefix holds the erasure backend's shard data and multipart
+// uploads on every backend. Manifests are stored under the object's own key
+// so that backend listings find them.
+const erasurePrefix = ".s3proxy-erasure/"
+
+const (
+	erasureShardPrefix  = erasurePrefix + "shards/"
+	erasureUploadPrefix = erasurePrefix + "uploads/"
+	erasurePartPrefix   = erasurePrefix + "parts/"
+
+	erasureFormat = "s3proxy-erasure/1"
+
+	// defaultErasureBlockSize is the bytes of an object each data shard
+	// holds per stripe
+	defaultErasureBlockSize = 1 << 20
+
+	// erasureReadBatch is roughly how much object data a read fetches from
+	// the shards at a time
+	erasureReadBatch = 8 << 20
+
+	// erasureManifestLimit bounds manifest reads, in case a key holds
+	// something else
+	erasureManifestLimit = 64 << 10
+
+	// erasureListConcurrency is how many manifests a listing reads at once
+	erasureListConcurrency = 16
+)
+
+func init() {
+	RegisterBackend("erasure", validateErasureSite, func(s Site) (S3Proxy, error) {
+		cfg := s.Erasure
+		backends := make([]S3Proxy, 0, len(cfg.Backends))
+		for i, site := range cfg.Backends {
+			proxy, err := NewBackend(site)
+			if err != nil {
+				return nil, fmt.Errorf("erasure backend %d: %v", i, err)
+			}
+			backends = append(backends, proxy)
+		}
+
+		return NewErasureProxy(backends, cfg.DataShards, cfg.BlockSize, cfg.WriteQuorum)
+	})
+}
+
+// ErasureConfig configures the erasure backend. Backends are full site
+// backend configurations (without host, users or options), one per shard:
+// the first DataShards hold the object data and the rest hold parity, so
+// objects survive the loss of up to len(Backends)-DataShards of them.
+//
+// BlockSize is the bytes of an object each data shard holds per stripe
+// (default 1 MiB). WriteQuorum is how many backends a write must reach to
+// succeed, from DataShards up to every backend (the default).
+type ErasureConfig struct {
+	Backends    []Site `json:"backends" yaml:"backends"`
+	DataShards  int    `json:"dataShards" yaml:"dataShards"`
+	BlockSize   int64  `json:"blockSize,omitempty" yaml:"blockSize,omitempty"`
+	WriteQuorum int    `json:"writeQuorum,omitempty" yaml:"writeQuorum,omitempty"`
+}
+
+func validateErasureSite(s Site) error {
+	cfg := s.Erasure
+	if cfg == nil || len(cfg.Backends) == 0 {
+		return errors.New("Erasure backends not specified")
+	}
+
+	for i, backend := range cfg.Backends {
+		if err := backend.validate(); err != nil {
+			return fmt.Errorf("%v in erasure backend %d", err, i)
+		}
+	}
+
+	if cfg.DataShards < 1 || cfg.DataShards > len(cfg.Backends) {
+		return fmt.Errorf("Erasure dataShards must be between 1 and the number of backends (%d)", len(cfg.Backends))
+	}
+	if len(cfg.Backends) > 256 {
+		return errors.New("Erasure supports at most 256 backends")
+	}
+
+	if cfg.BlockSize < 0 {
+		return errors.New("Erasure blockSize must not be negative")
+	}
+
+	if cfg.WriteQuorum != 0 && (cfg.WriteQuorum < cfg.DataShards || cfg.WriteQuorum > len(cfg.Backends)) {
+		return fmt.Errorf("Erasure writeQuorum must be between dataShards and the number of backends (%d)", len(cfg.Backends))
+	}
+
+	return nil
+}
+
+// erasureManifest describes one version of an object. Every backend holds
+// a copy under the object's key, and the most recently written copy wins,
+// so backends that missed a write or a delete are outvoted. Deletes leave
+// a tombstone manifest until every backend has seen them.
+type erasureManifest struct {
+	Format      string `json:"format"`
+	Written     int64  `json:"written"` // Unix nanoseconds
+	Deleted     bool   `json:"deleted,omitempty"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+	ETag        string `json:"etag,omitempty"`
+	MD5         string `json:"md5,omitempty"`
+
+	DataShards int    `json:"dataShards,omitempty"`
+	Shards     int    `json:"shards,omitempty"`
+	BlockSize  int64  `json:"blockSize,omitempty"`
+	WriteID    string `json:"writeId,omitempty"` // names this version's shards
+
+	// UploadKey marks the manifest of a multipart upload in progress
+	UploadKey string `json:"uploadKey,omitempty"`
+}
+
+func (m *erasureManifest) lastModified() time.Time {
+	return time.Unix(0, m.Written).UTC()
+}
+
+// ErasureProxy splits objects into data and parity shards stored on
+// separate backends. Each stripe of an object is cut into one block per
+// data shard, and Reed-Solomon parity blocks are computed from them, so any
+// DataShards of the backends can rebuild the object.
+type ErasureProxy struct {
+	backends    []S3Proxy
+	rs          *reedSolomon
+	blockSize   int64
+	writeQuorum int
+	locks       keyLocks
+}
+
+func NewErasureProxy(backends []S3Proxy, dataShards int, blockSize int64, writeQuorum int) (*ErasureProxy, error) {
+	rs, err := newReedSolomon(dataShards, len(backends)-dataShards)
+	if err != nil {
+		return nil, err
+	}
+
+	if blockSize <= 0 {
+		blockSize = defaultErasureBlockSize
+	}
+	if writeQuorum <= 0 {
+		writeQuorum = len(backends)
+	}
+
+	return &ErasureProxy{backends: backends, rs: rs, blockSize: blockSize, writeQuorum: writeQuorum}, nil
+}
+
+func checkErasureKey(key string) error {
+	if strings.HasPrefix(key, erasurePrefix) {
+		return errInvalidArgument("Keys under " + erasurePrefix + " are reserved")
+	}
+	return nil
+}
+
+func erasureShardKey(key string, writeID string) string {
+	return erasureShardPrefix + key + "/" + writeID
+}
+
+func erasureUploadKey(uploadId string) string {
+	return erasureUploadPrefix + uploadId
+}
+
+func erasurePartKey(uploadId string, partNumber int64) string {
+	return fmt.Sprintf("%s%s/%05d", erasurePartPrefix, uploadId, partNumber)
+}
+
+// errErasureUnavailable is returned when too few backends answer to read or
+// write an object
+func errErasureUnavailable(available, required int, cause error) error {
+	return awserr.NewRequestFailure(
+		awserr.New("ServiceUnavailable", fmt.Sprintf("%d of the %d backends required are available: %v", available, required, cause), nil),
+		http.StatusServiceUnavailable, "")
+}
+
+// each runs fn against every backend concurrently and returns their errors
+func (p *ErasureProxy) each(fn func(i int, backend S3Proxy) error) []error {
+	errs := make([]error, len(p.backends))
+
+	var wg sync.WaitGroup
+	for i, backend := range p.backends {
+		wg.Add(1)
+		go func(i int, backend S3Proxy) {
+			defer wg.Done()
+			errs[i] = fn(i, backend)
+		}(i, backend)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// readManifest returns the newest manifest of key across the backends. A
+// missing key, or one whose newest manifest is a tombstone, is not found.
+func (p *ErasureProxy) readManifest(key string) (*erasureManifest, error) {
+	manifests := make([]*erasureManifest, len(p.backends))
+	errs := p.each(func(i int, backend S3Proxy) error {
+		out, err := backend.Get(key, "")
+		if err != nil {
+			return err
+		}
+		defer out.Body.Close()
+
+		data, err := io.ReadAll(io.LimitReader(out.Body, erasureManifestLimit))
+		if err != nil {
+			return err
+		}
+
+		var m erasureManifest
+		if json.Unmarshal(data, &m) != nil || m.Format != erasureFormat {
+			return errNoSuchKey(key)
+		}
+		manifests[i] = &m
+		return nil
+	})
+
+	var newest *erasureManifest
+	var lastErr error
+	failures := 0
+	for i, err := range errs {
+		if err != nil {
+			if !isNotFound(err) {
+				failures++
+				lastErr = err
+			}
+			continue
+		}
+		if newest == nil || manifests[i].Written > newest.Written {
+			newest = manifests[i]
+		}
+	}
+
+	// Once as many backends as a write needs have failed, the ones left may
+	// all have missed the newest write. Fewer than DataShards backends could
+	// not serve the data anyway.
+	required := len(p.backends) - p.writeQuorum + 1
+	if required < p.rs.k {
+		required = p.rs.k
+	}
+	if available := len(p.backends) - failures; available < required {
+		return nil, errErasureUnavailable(available, required, lastErr)
+	}
+
+	if newest == nil || newest.Deleted {
+		return nil, errNoSuchKey(key)
+	}
+	return newest, nil
+}
+
+// writeManifest stores m under key on every backend. It fails unless the
+// write quorum was reached, and returns whether every backend was written.
+func (p *ErasureProxy) writeManifest(key string, m *erasureManifest) (bool, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return false, err
+	}
+
+	errs := p.each(func(i int, backend S3Proxy) error {
+		_, err := backend.Put(key, bytes.NewReader(data), "application/json")
+		return err
+	})
+
+	return p.checkQuorum(errs)
+}
+
+// checkQuorum counts the backends a write reached
+func (p *ErasureProxy) checkQuorum(errs []error) (bool, error) {
+	var lastErr error
+	written := 0
+	for _, err := range errs {
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		written++
+	}
+
+	if written < p.writeQuorum {
+		return false, errErasureUnavailable(written, p.writeQuorum, lastErr)
+	}
+	return written == len(p.backends), nil
+}
+
+// blockSizeFor shrinks the block size for small objects, so they are not
+// padded to a whole stripe
+func (p *ErasureProxy) blockSizeFor(size int64) int64 {
+	k := int64(p.rs.k)
+	if block := (size + k - 1) / k; block < p.blockSize {
+		if block == 0 {
+			return 1
+		}
+		return block
+	}
+	return p.blockSize
+}
+
+// write encodes size bytes of body into shards, stores them and commits m
+// as the key's manifest, then removes the shards of the version it
+// replaced. m is completed with the object's layout and checksums. The
+// caller holds the key's lock.
+func (p *ErasureProxy) write(key string, body io.Reader, size int64, m *erasureManifest) error {
+	previous, err := p.readManifest(key)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	n := len(p.backends)
+	m.Format = erasureFormat
+	m.Size = size
+	m.DataShards = p.rs.k
+	m.Shards = n
+	m.BlockSize = p.blockSizeFor(size)
+	m.WriteID = newUploadID()
+
+	spools := make([]*os.File, n)
+	defer func() {
+		for _, spool := range spools {
+			if spool != nil {
+				removeSpool(spool)
+			}
+		}
+	}()
+	for i := range spools {
+		if spools[i], err = os.CreateTemp("", "s3proxy-spool-*"); err != nil {
+			return err
+		}
+	}
+
+	sum := md5.New()
+	if err := p.encode(io.TeeReader(body, sum), size, m.BlockSize, spools); err != nil {
+		return err
+	}
+	m.MD5 = hex.EncodeToString(sum.Sum(nil))
+	if m.ETag == "" {
+		m.ETag = quoteETag(sum.Sum(nil))
+	}
+
+	shardKey := erasureShardKey(key, m.WriteID)
+	errs := p.each(func(i int, backend S3Proxy) error {
+		if _, err := spools[i].Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := backend.Put(shardKey, spools[i], "application/octet-stream")
+		return err
+	})
+	if _, err := p.checkQuorum(errs); err != nil {
+		p.deleteShards(key, m.WriteID)
+		return err
+	}
+
+	m.Written = time.Now().UnixNano()
+	if _, err := p.writeManifest(key, m); err != nil {
+		// Backends holding the new manifest still need its shards
+		return err
+	}
+
+	if previous != nil && previous.WriteID != "" {
+		p.deleteShards(key, previous.WriteID)
+	}
+	return nil
+}
+
+// encode cuts body into stripes and appends each shard's blocks to its
+// spool file. The last stripe is padded with zeros.
+func (p *ErasureProxy) encode(body io.Reader, size int64, blockSize int64, spools []*os.File) error {
+	k := p.rs.k
+	stripe := make([]byte, int64(k)*blockSize)
+	shards := make([][]byte, len(spools))
+	for i := range shards {
+		if i < k {
+			shards[i] = stripe[int64(i)*blockSize : int64(i+1)*blockSize]
+		} else {
+			shards[i] = make([]byte, blockSize)
+		}
+	}
+
+	for remaining := size; remaining > 0; {
+		n := int64(len(stripe))
+		if remaining < n {
+			n = remaining
+		}
+
+		if _, err := io.ReadFull(body, stripe[:n]); err != nil {
+			return err
+		}
+		for i := n; i < int64(len(stripe)); i++ {
+			stripe[i] = 0
+		}
+
+		p.rs.encode(shards)
+		for i, shard := range shards {
+			if _, err := spools[i].Write(shard); err != nil {
+				return err
+			}
+		}
+		remaining -= n
+	}
+
+	return nil
+}
+
+// deleteShards removes one version's shards, logging backends that fail
+func (p *ErasureProxy) deleteShards(key string, writeID string) {
+	shardKey := erasureShardKey(key, writeID)
+	for i, err := range p.each(func(i int, backend S3Proxy) error {
+		_, err := backend.Delete(shardKey)
+		return err
+	}) {
+		if err != nil && !isNotFound(err) {
+			log.Printf("erasure: removing %s from backend %d: %v", shardKey, i, err)
+		}
+	}
+}
+
+// remove deletes key by writing a tombstone manifest, which is itself
+// removed once every backend has it. The caller holds the key's lock.
+func (p *ErasureProxy) remove(key string) error {
+	previous, err := p.readManifest(key)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	all, err := p.writeManifest(key, &erasureManifest{Format: erasureFormat, Written: time.Now().UnixNano(), Deleted: true})
+	if err != nil {
+		return err
+	}
+
+	if all {
+		p.each(func(i int, backend S3Proxy) error {
+			_, err := backend.Delete(key)
+			return err
+		})
+	}
+	if previous.WriteID != "" {
+		p.deleteShards(key, previous.WriteID)
+	}
+	return nil
+}
+
+// erasureReader reads a byte range of an object, fetching the shards a few
+// stripes at a time. Shards that fail are skipped for the rest of the read
+// and rebuilt from parity.
+type erasureReader struct {
+	p        *ErasureProxy
+	shardKey string
+	m        *erasureManifest
+	pos, end int64 // next offset to return and the inclusive last one
+	buf      []byte
+	failed   []bool
+	err      error
+}
+
+func (p *ErasureProxy) newReader(key string, m *erasureManifest, start, end int64) *erasureReader {
+	return &erasureReader{
+		p:        p,
+		shardKey: erasureShardKey(key, m.WriteID),
+		m:        m,
+		pos:      start,
+		end:      end,
+		failed:   make([]bool, m.Shards),
+	}
+}
+
+func (r *erasureReader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.pos > r.end {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *erasureReader) Close() error {
+	return nil
+}
+
+// fill decodes the next batch of stripes into buf
+func (r *erasureReader) fill() error {
+	k := r.m.DataShards
+	block := r.m.BlockSize
+	stripeSize := int64(k) * block
+
+	first := r.pos / stripeSize
+	last := r.end / stripeSize
+	if batch := erasureReadBatch / stripeSize; batch > 0 && last-first+1 > batch {
+		last = first + batch - 1
+	}
+	stripes := last - first + 1
+
+	shards, err := r.fetch(first*block, (last+1)*block-1)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, 0, stripes*stripeSize)
+	stripe := make([][]byte, len(shards))
+	for s := int64(0); s < stripes; s++ {
+		for i, shard := range shards {
+			stripe[i] = nil
+			if shard != nil {
+				stripe[i] = shard[s*block : (s+1)*block]
+			}
+		}
+		if err := r.p.rs.reconstructData(stripe); err != nil {
+			return err
+		}
+		for i := 0; i < k; i++ {
+			data = append(data, stripe[i]...)
+		}
+	}
+
+	base := first * stripeSize
+	end := (last+1)*stripeSize - 1
+	if end > r.end {
+		end = r.end
+	}
+	r.buf = data[r.pos-base : end-base+1]
+	r.pos = end + 1
+	return nil
+}
+
+// fetch reads the same byte range of k shards, preferring the data shards
+// so that nothing needs decoding. Missing shards are nil.
+func (r *erasureReader) fetch(start, end int64) ([][]byte, error) {
+	k := r.m.DataShards
+	shards := make([][]byte, r.m.Shards)
+	tried := make([]bool, r.m.Shards)
+	rangeHeader := fmt.Sprintf("bytes=%d-%d", start, end)
+
+	var lastErr error
+	have := 0
+	for have < k {
+		var pick []int
+		for i := range shards {
+			if len(pick) == k-have {
+				break
+			}
+			if !tried[i] && !r.failed[i] {
+				pick = append(pick, i)
+			}
+		}
+		if len(pick) < k-have {
+			return nil, errErasureUnavailable(have+len(pick), k, lastErr)
+		}
+
+		errs := make([]error, len(pick))
+		var wg sync.WaitGroup
+		for j, i := range pick {
+			tried[i] = true
+			wg.Add(1)
+			go func(j, i int) {
+				defer wg.Done()
+				shards[i], errs[j] = r.fetchShard(i, rangeHeader, end-start+1)
+			}(j, i)
+		}
+		wg.Wait()
+
+		for j, i := range pick {
+			if errs[j] != nil {
+				log.Printf("erasure: reading %s from backend %d: %v", r.shardKey, i, errs[j])
+				r.failed[i] = true
+				shards[i] = nil
+				lastErr = errs[j]
+				continue
+			}
+			have++
+		}
+	}
+
+	return shards, nil
+}
+
+func (r *erasureReader) fetchShard(i int, rangeHeader string, length int64) ([]byte, error) {
+	out, err := r.p.backends[i].Get(r.shardKey, rangeHeader)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(out.Body, length+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("shard returned %d bytes, want %d", len(data), length)
+	}
+	return data, nil
+}
+
+func (p *ErasureProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	m, err := p.readManifest(key)
+	if err != nil {
+		return nil, err
+	}
+	if m.UploadKey != "" {
+		return nil, errNoSuchKey(key)
+	}
+
+	out := &s3.GetObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: aws.Int64(m.Size),
+		ContentType:   aws.String(m.ContentType),
+		ETag:          aws.String(m.ETag),
+		LastModified:  aws.Time(m.lastModified()),
+		Body:          io.NopCloser(bytes.NewReader(nil)),
+	}
+
+	start, end := int64(0), m.Size-1
+	if rangeHeader != "" {
+		if start, end, err = parseByteRange(rangeHeader, m.Size); err != nil {
+			return nil, err
+		}
+		out.ContentLength = aws.Int64(end - start + 1)
+		out.ContentRange = aws.String(contentRange(start, end, m.Size))
+	}
+
+	if m.Size > 0 {
+		out.Body = p.newReader(key, m, start, end)
+	}
+	return out, nil
+}
+
+func (p *ErasureProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	if err := checkErasureKey(key); err != nil {
+		return nil, err
+	}
+
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	m := &erasureManifest{ContentType: contentType}
+	if err := p.write(key, body, size, m); err != nil {
+		return nil, err
+	}
+
+	return &s3.PutObjectOutput{ETag: aws.String(m.ETag)}, nil
+}
+
+func (p *ErasureProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	m, err := p.readManifest(key)
+	if err != nil {
+		return nil, err
+	}
+	if m.UploadKey != "" {
+		return nil, errNoSuchKey(key)
+	}
+
+	return &s3.HeadObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: aws.Int64(m.Size),
+		ContentType:   aws.String(m.ContentType),
+		ETag:          aws.String(m.ETag),
+		LastModified:  aws.Time(m.lastModified()),
+	}, nil
+}
+
+func (p *ErasureProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	if err := checkErasureKey(key); err != nil {
+		return nil, err
+	}
+
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	if err := p.remove(key); err != nil {
+		return nil, err
+	}
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// erasureLister lists one backend for a merged listing. A backend that
+// fails lists as empty, so listings survive unavailable backends.
+type erasureLister struct {
+	S3Proxy
+	failures *int32
+}
+
+func (l erasureLister) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	out, err := l.S3Proxy.ListObjects(prefix, delimiter, maxKeys, continuationToken)
+	if err != nil {
+		log.Printf("erasure: listing %q: %v", prefix, err)
+		atomic.AddInt32(l.failures, 1)
+		return &s3.ListObjectsV2Output{}, nil
+	}
+	return out, nil
+}
+
+// mergeManifests returns a merged listing of the manifests on every
+// backend under prefix, with strip removed from their keys
+func (p *ErasureProxy) mergeManifests(prefix, delimiter, strip string, pageSize int64, continuationToken string) (*mergeLister, *int32, error) {
+	failures := new(int32)
+	iters := make([]*listIterator, 0, len(p.backends))
+	for _, backend := range p.backends {
+		iters = append(iters, &listIterator{
+			proxy:     erasureLister{S3Proxy: backend, failures: failures},
+			prefix:    prefix,
+			delimiter: delimiter,
+			strip:     strip,
+			pageSize:  pageSize,
+		})
+	}
+
+	m, err := newMergeLister(iters, continuationToken)
+	return m, failures, err
+}
+
+// resolve reads the manifests of listed keys concurrently. Keys that turn
+// out to be deleted get a nil manifest.
+func (p *ErasureProxy) resolve(keys []string) ([]*erasureManifest, error) {
+	manifests := make([]*erasureManifest, len(keys))
+	errs := make([]error, len(keys))
+
+	sem := make(chan struct{}, erasureListConcurrency)
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, key string) {
+			defer func() { <-sem; wg.Done() }()
+			manifests[i], errs[i] = p.readManifest(key)
+		}(i, key)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+	}
+	return manifests, nil
+}
+
+// ListObjects merges the manifests listed by every backend. Each listed
+// key's manifest is read to skip deleted keys and report the object's size.
+func (p *ErasureProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	if maxKeys <= 0 || maxKeys > defaultMaxKeys {
+		maxKeys = defaultMaxKeys
+	}
+
+	m, failures, err := p.mergeManifests(prefix, delimiter, "", maxKeys, continuationToken)
+	if err != nil {
+		return nil, err
+	}
+
+	page := newMergedPage(prefix, maxKeys)
+	for done := false; !done && page.count() < maxKeys; {
+		// Collect a batch of entries, then read their manifests together
+		var entries []*listEntry
+		var keys []string
+		for int64(len(entries)) < maxKeys-page.count() {
+			e, _, err := m.next()
+			if err != nil {
+				return nil, err
+			}
+			if e == nil {
+				done = true
+				break
+			}
+			if strings.HasPrefix(e.key, erasurePrefix) {
+				continue
+			}
+
+			entries = append(entries, e)
+			if !e.isPrefix {
+				keys = append(keys, e.key)
+			}
+		}
+
+		manifests, err := p.resolve(keys)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if !e.isPrefix {
+				manifest := manifests[0]
+				manifests = manifests[1:]
+				if manifest == nil || manifest.UploadKey != "" {
+					continue
+				}
+				e.obj = &s3.Object{
+					Key:          aws.String(e.key),
+					Size:         aws.Int64(manifest.Size),
+					ETag:         aws.String(manifest.ETag),
+					LastModified: aws.Time(manifest.lastModified()),
+					StorageClass: aws.String(s3.StorageClassStandard),
+				}
+			}
+			page.add(e)
+		}
+	}
+
+	if failed := int(atomic.LoadInt32(failures)); failed >= p.writeQuorum {
+		return nil, errErasureUnavailable(len(p.backends)-failed, len(p.backends)-p.writeQuorum+1, errors.New("listing failed"))
+	}
+
+	return page.result(m)
+}
+
+func (p *ErasureProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	if err := checkErasureKey(key); err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, errInvalidArgument("Object key must not be empty")
+	}
+
+	uploadId := newUploadID()
+	m := &erasureManifest{
+		Format:      erasureFormat,
+		Written:     time.Now().UnixNano(),
+		ContentType: contentType,
+		UploadKey:   key,
+	}
+	if _, err := p.writeManifest(erasureUploadKey(uploadId), m); err != nil {
+		return nil, err
+	}
+
+	return &s3.CreateMultipartUploadOutput{
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}, nil
+}
+
+func (p *ErasureProxy) upload(key string, uploadId string) (*erasureManifest, error) {
+	m, err := p.readManifest(erasureUploadKey(uploadId))
+	if isNotFound(err) || (err == nil && m.UploadKey != key) {
+		return nil, errNoSuchUpload(uploadId)
+	}
+	return m, err
+}
+
+// UploadPart stores each part as an erasure coded object of its own
+func (p *ErasureProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	if partNumber < 1 || partNumber > 10000 {
+		return nil, errInvalidArgument("Part number must be an integer between 1 and 10000, inclusive")
+	}
+	if _, err := p.upload(key, uploadId); err != nil {
+		return nil, err
+	}
+
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	partKey := erasurePartKey(uploadId, partNumber)
+	unlock := p.locks.lock(partKey)
+	defer unlock()
+
+	m := &erasureManifest{}
+	if err := p.write(partKey, body, size, m); err != nil {
+		return nil, err
+	}
+
+	return &s3.UploadPartOutput{ETag: aws.String(m.ETag)}, nil
+}
+
+// CompleteMultipartUpload re-encodes the parts, read back in order, as the
+// final object
+func (p *ErasureProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	upload, err := p.upload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	uploaded := make(map[int64]string)
+	manifests := make(map[int64]*erasureManifest)
+	for _, part := range parts {
+		n := aws.Int64Value(part.PartNumber)
+		m, err := p.readManifest(erasurePartKey(uploadId, n))
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		uploaded[n] = m.ETag
+		manifests[n] = m
+	}
+	if err := checkCompletedParts(parts, uploaded); err != nil {
+		return nil, err
+	}
+
+	var readers []io.Reader
+	var sums [][]byte
+	var size int64
+	for _, part := range parts {
+		n := aws.Int64Value(part.PartNumber)
+		m := manifests[n]
+		sum, _ := hex.DecodeString(m.MD5)
+		sums = append(sums, sum)
+		size += m.Size
+		if m.Size > 0 {
+			readers = append(readers, p.newReader(erasurePartKey(uploadId, n), m, 0, m.Size-1))
+		}
+	}
+
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	m := &erasureManifest{ContentType: upload.ContentType, ETag: multipartETag(sums)}
+	if err := p.write(key, io.MultiReader(readers...), size, m); err != nil {
+		return nil, err
+	}
+
+	if err := p.removeUpload(uploadId); err != nil {
+		log.Printf("erasure: cleaning up upload %s: %v", uploadId, err)
+	}
+
+	return &s3.CompleteMultipartUploadOutput{
+		Key:  aws.String(key),
+		ETag: aws.String(m.ETag),
+	}, nil
+}
+
+// removeUpload deletes an upload's parts, then the upload itself
+func (p *ErasureProxy) removeUpload(uploadId string) error {
+	prefix := erasurePartPrefix + uploadId + "/"
+	m, _, err := p.mergeManifests(prefix, "", "", defaultMaxKeys, "")
+	if err != nil {
+		return err
+	}
+
+	for {
+		e, _, err := m.next()
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			break
+		}
+		if err := p.remove(e.key); err != nil {
+			return err
+		}
+	}
+
+	return p.remove(erasureUploadKey(uploadId))
+}
+
+func (p *ErasureProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	if _, err := p.upload(key, uploadId); err != nil {
+		return nil, err
+	}
+
+	if err := p.removeUpload(uploadId); err != nil {
+		return nil, err
+	}
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (p *ErasureProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	m, _, err := p.mergeManifests(erasureUploadPrefix, "", erasureUploadPrefix, defaultMaxKeys, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for {
+		e, _, err := m.next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		ids = append(ids, e.key)
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = erasureUploadKey(id)
+	}
+	manifests, err := p.resolve(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var uploads []*s3.MultipartUpload
+	for i, manifest := range manifests {
+		if manifest == nil || manifest.UploadKey == "" {
+			continue
+		}
+		uploads = append(uploads, &s3.MultipartUpload{
+			Key:          aws.String(manifest.UploadKey),
+			UploadId:     aws.String(ids[i]),
+			Initiated:    aws.Time(manifest.lastModified()),
+			StorageClass: aws.String(s3.StorageClassStandard),
+		})
+	}
+
+	out := listUploads(uploads, prefix, delimiter, maxUploads)
+	out.Prefix = aws.String(prefix)
+	return out, nil
+}
+
+// GetWebsiteConfig returns the website configuration of the first backend
+// that answers
+func (p *ErasureProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	var err error
+	for _, backend := range p.backends {
+		var out *s3.GetBucketWebsiteOutput
+		if out, err = backend.GetWebsiteConfig(); err == nil || !isBackendFailure(err) {
+			return out, err
+		}
+	}
+	return nil, err
+}
+
+func (p *ErasureProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	if _, err := p.Head(key); err != nil {
+		return nil, err
+	}
+	return nil, errObjectAlreadyInActiveTier()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func newTestErasureProxy(t *testing.T, k, n int, writeQuorum int) (*ErasureProxy, []*fakeProxy) {
+	t.Helper()
+
+	var backends []S3Proxy
+	var fakes []*fakeProxy
+	for i := 0; i < n; i++ {
+		f := newFakeProxy()
+		backends = append(backends, f)
+		fakes = append(fakes, f)
+	}
+
+	p, err := NewErasureProxy(backends, k, 16, writeQuorum)
+	if err != nil {
+		t.Fatalf("NewErasureProxy() error = %v", err)
+	}
+	return p, fakes
+}
+
+func testContent(n int) string {
+	var b strings.Builder
+	for i := 0; b.Len() < n; i++ {
+		fmt.Fprintf(&b, "%d,", i)
+	}
+	return b.String()[:n]
+}
+
+func TestErasureProxy_RoundTrip(t *testing.T) {
+	p, backends := newTestErasureProxy(t, 3, 5, 0)
+
+	for _, size := range []int{0, 1, 47, 48, 49, 500} {
+		key := fmt.Sprintf("size-%d", size)
+		content := testContent(size)
+		putString(t, p, key, content)
+
+		if got := getString(t, p, key, ""); got != content {
+			t.Errorf("Get(%s) = %q, want %q", key, got, content)
+		}
+
+		head, err := p.Head(key)
+		if err != nil || aws.Int64Value(head.ContentLength) != int64(size) {
+			t.Errorf("Head(%s) = %v, %v", key, head, err)
+		}
+
+		if size > 1 {
+			rangeHeader := fmt.Sprintf("bytes=1-%d", size-2)
+			if got := getString(t, p, key, rangeHeader); got != content[1:size-1] {
+				t.Errorf("Get(%s, %s) = %q", key, rangeHeader, got)
+			}
+		}
+	}
+
+	// No backend holds the object in the clear
+	out, _ := backends[0].MemoryProxy.Get("size-500", "")
+	if out != nil && aws.Int64Value(out.ContentLength) == 500 {
+		t.Error("backend holds the whole object under its key")
+	}
+
+	if _, err := p.Put(erasurePrefix+"x", strings.NewReader("x"), ""); err == nil {
+		t.Error("Put() under the reserved prefix should fail")
+	}
+}
+
+func TestErasureProxy_Reconstruct(t *testing.T) {
+	p, backends := newTestErasureProxy(t, 3, 5, 0)
+	content := testContent(1000)
+	putString(t, p, "key", content)
+
+	// Any two backends may be lost, data shards included
+	backends[0].setDown(true)
+	backends[2].setDown(true)
+	if got := getString(t, p, "key", ""); got != content {
+		t.Errorf("Get() with two backends down = %q", got)
+	}
+	if got := getString(t, p, "key", "bytes=500-519"); got != content[500:520] {
+		t.Errorf("ranged Get() with two backends down = %q", got)
+	}
+
+	backends[4].setDown(true)
+	if _, err := p.Head("key"); !isBackendFailure(err) {
+		t.Errorf("Head() with three backends down error = %v, want unavailable", err)
+	}
+
+	// Every backend must take a write by default
+	backends[4].setDown(false)
+	if _, err := p.Put("other", strings.NewReader("x"), ""); !isBackendFailure(err) {
+		t.Errorf("Put() with a backend down error = %v, want unavailable", err)
+	}
+}
+
+func TestErasureProxy_RangeFetchesNeededStripes(t *testing.T) {
+	p, backends := newTestErasureProxy(t, 2, 3, 0)
+
+	// Stripes of 32 bytes, so bytes 100-110 are in the fourth
+	content := testContent(320)
+	putString(t, p, "key", content)
+	if got := getString(t, p, "key", "bytes=100-110"); got != content[100:111] {
+		t.Fatalf("Get() = %q", got)
+	}
+
+	for i, b := range backends[:2] {
+		if reads, want := b.readsUnder(erasureShardPrefix), []string{"bytes=48-63"}; !reflect.DeepEqual(reads, want) {
+			t.Errorf("data shard %d read %v, want %v", i, reads, want)
+		}
+	}
+	if reads := backends[2].readsUnder(erasureShardPrefix); len(reads) != 0 {
+		t.Errorf("parity shard read %v with every data shard available", reads)
+	}
+
+	// A lost data shard is replaced by parity for the same stripe
+	backends[0].setDown(true)
+	if got := getString(t, p, "key", "bytes=100-110"); got != content[100:111] {
+		t.Fatalf("Get() with a data shard down = %q", got)
+	}
+	if reads, want := backends[2].readsUnder(erasureShardPrefix), []string{"bytes=48-63"}; !reflect.DeepEqual(reads, want) {
+		t.Errorf("parity shard read %v, want %v", reads, want)
+	}
+}
+
+func TestErasureProxy_StaleBackends(t *testing.T) {
+	p, backends := newTestErasureProxy(t, 2, 4, 3)
+	putString(t, p, "key", "old")
+	putString(t, p, "gone", "gone")
+
+	// A backend missing an overwrite and a delete is outvoted by the others
+	backends[1].setDown(true)
+	putString(t, p, "key", "new")
+	if _, err := p.Delete("gone"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	backends[1].setDown(false)
+
+	if got := getString(t, p, "key", ""); got != "new" {
+		t.Errorf("Get() = %q, want the newest write", got)
+	}
+	if _, err := p.Get("gone", ""); !isNotFound(err) {
+		t.Errorf("Get() of a deleted key error = %v, want not found", err)
+	}
+
+	keys, _ := listAll(t, p, "", "", 0)
+	if want := []string{"key"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+}
+
+func TestErasureProxy_ListObjects(t *testing.T) {
+	p, backends := newTestErasureProxy(t, 2, 3, 0)
+	for _, key := range []string{"a", "dir/b", "dir/c", "e"} {
+		putString(t, p, key, key+key)
+	}
+	if _, err := p.Delete("e"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, prefixes := listAll(t, p, "", "/", 1)
+	if !reflect.DeepEqual(keys, []string{"a"}) || !reflect.DeepEqual(prefixes, []string{"dir/"}) {
+		t.Errorf("listing = %v %v, want [a] [dir/]", keys, prefixes)
+	}
+
+	out, err := p.ListObjects("dir/", "", 0, "")
+	if err != nil || len(out.Contents) != 2 || aws.Int64Value(out.Contents[0].Size) != 10 {
+		t.Errorf("ListObjects() = %v, %v", out, err)
+	}
+
+	// Listings survive a lost backend
+	backends[0].setDown(true)
+	keys, _ = listAll(t, p, "", "", 0)
+	if want := []string{"a", "dir/b", "dir/c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys with a backend down = %v, want %v", keys, want)
+	}
+}
+
+func TestErasureProxy_Multipart(t *testing.T) {
+	p, _ := newTestErasureProxy(t, 2, 3, 0)
+
+	created, err := p.CreateMultipartUpload("key", "text/plain")
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload() error = %v", err)
+	}
+	uploadId := aws.StringValue(created.UploadId)
+
+	uploads, err := p.ListMultipartUploads("", "", 0)
+	if err != nil || len(uploads.Uploads) != 1 || aws.StringValue(uploads.Uploads[0].Key) != "key" {
+		t.Fatalf("ListMultipartUploads() = %v, %v", uploads, err)
+	}
+
+	var parts []*s3.CompletedPart
+	for i, body := range []string{testContent(100), "tail"} {
+		part, err := p.UploadPart("key", uploadId, int64(i+1), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("UploadPart() error = %v", err)
+		}
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(int64(i + 1)), ETag: part.ETag})
+	}
+
+	out, err := p.CompleteMultipartUpload("key", uploadId, parts)
+	if err != nil {
+		t.Fatalf("CompleteMultipartUpload() error = %v", err)
+	}
+	if !strings.HasSuffix(aws.StringValue(out.ETag), `-2"`) {
+		t.Errorf("ETag = %s, want a multipart ETag", aws.StringValue(out.ETag))
+	}
+
+	if got := getString(t, p, "key", ""); got != testContent(100)+"tail" {
+		t.Errorf("Get() = %q", got)
+	}
+
+	uploads, _ = p.ListMultipartUploads("", "", 0)
+	if len(uploads.Uploads) != 0 {
+		t.Errorf("upload still listed after completing: %v", uploads.Uploads)
+	}
+	if _, err := p.UploadPart("key", uploadId, 3, strings.NewReader("x")); !isNotFound(err) {
+		t.Errorf("UploadPart() after completing error = %v, want NoSuchUpload", err)
+	}
+}
+
+func TestValidateErasureSite(t *testing.T) {
+	memory := []Site{{Type: "memory"}, {Type: "memory"}, {Type: "memory"}}
+
+	tests := []struct {
+		name    string
+		erasure *ErasureConfig
+		wantErr bool
+	}{
+		{name: "valid", erasure: &ErasureConfig{Backends: memory, DataShards: 2, BlockSize: 4096, WriteQuorum: 2}},
+		{name: "missing", wantErr: true},
+		{name: "no data shards", erasure: &ErasureConfig{Backends: memory}, wantErr: true},
+		{name: "too many data shards", erasure: &ErasureConfig{Backends: memory, DataShards: 4}, wantErr: true},
+		{name: "quorum below data shards", erasure: &ErasureConfig{Backends: memory, DataShards: 2, WriteQuorum: 1}, wantErr: true},
+		{name: "invalid backend", erasure: &ErasureConfig{Backends: []Site{{Type: "nope"}}, DataShards: 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site := Site{Type: "erasure", Erasure: tt.erasure}
+			if err := site.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
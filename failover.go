@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckKey      = "s3proxy-health-check"
+	defaultFailureThreshold    = 3
+	// failoverRecoveryThreshold is how many probes in a row an unhealthy
+	// member must pass before it serves reads again
+	failoverRecoveryThreshold = 2
+	// failoverLatencyWeight is the weight of the newest sample in the
+	// latency moving average
+	failoverLatencyWeight = 0.3
+)
+
+// FailoverConfig adds members that serve reads when the site's backend
+// fails. Endpoints are further endpoints of the same S3 bucket, Replicas
+// are full site backend configurations (without host, users or options),
+// for example buckets kept in sync with replication.
+type FailoverConfig struct {
+	Endpoints           []string `json:"endpoints,omitempty" yaml:"endpoints,omitempty"`
+	Replicas            []Site   `json:"replicas,omitempty" yaml:"replicas,omitempty"`
+	HealthCheckKey      string   `json:"healthCheckKey,omitempty" yaml:"healthCheckKey,omitempty"`
+	HealthCheckInterval string   `json:"healthCheckInterval,omitempty" yaml:"healthCheckInterval,omitempty"`
+	FailureThreshold    int      `json:"failureThreshold,omitempty" yaml:"failureThreshold,omitempty"`
+}
+
+func validateFailover(s Site) error {
+	c := s.Failover
+	if len(c.Endpoints) == 0 && len(c.Replicas) == 0 {
+		return errors.New("Failover endpoints or replicas not specified")
+	}
+
+	if len(c.Endpoints) > 0 && s.backendType() != defaultBackendType {
+		return errors.New("Failover endpoints require an s3 site")
+	}
+
+	for i, replica := range c.Replicas {
+		if err := replica.validate(); err != nil {
+			return fmt.Errorf("%v in failover replica %d", err, i)
+		}
+	}
+
+	if c.HealthCheckInterval != "" {
+		if d, err := time.ParseDuration(c.HealthCheckInterval); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid failover healthCheckInterval %q", c.HealthCheckInterval)
+		}
+	}
+
+	if c.FailureThreshold < 0 {
+		return errors.New("Failover failureThreshold must not be negative")
+	}
+
+	return nil
+}
+
+// newFailoverBackend wraps a site's backend with its failover members
+func newFailoverBackend(primary S3Proxy, s Site) (S3Proxy, error) {
+	cfg := s.Failover
+	members := []*failoverMember{{name: "primary", proxy: primary}}
+
+	for _, endpoint := range cfg.Endpoints {
+		site := s
+		site.AWSEndpoint = endpoint
+		site.Failover = nil
+		site.Replication = nil
+		site.WriteBack = nil
+		// Reads through the endpoint already pass the site's caches
+		site.DiskCache = nil
+		site.MemoryCache = nil
+		site.Coalesce = nil
+		site.ReadAhead = nil
+
+		proxy, err := NewBackend(site)
+		if err != nil {
+			return nil, fmt.Errorf("failover endpoint %s: %v", endpoint, err)
+		}
+		members = append(members, &failoverMember{name: "endpoint " + endpoint, proxy: proxy})
+	}
+
+	for i, site := range cfg.Replicas {
+		proxy, err := NewBackend(site)
+		if err != nil {
+			return nil, fmt.Errorf("failover replica %d: %v", i, err)
+		}
+		members = append(members, &failoverMember{name: fmt.Sprintf("replica %d", i), proxy: proxy})
+	}
+
+	interval := defaultHealthCheckInterval
+	if cfg.HealthCheckInterval != "" {
+		interval, _ = time.ParseDuration(cfg.HealthCheckInterval)
+	}
+
+	return newFailoverProxy(members, cfg.HealthCheckKey, interval, cfg.FailureThreshold), nil
+}
+
+// failoverMember tracks the health of one backend serving reads
+type failoverMember struct {
+	index int
+	name  string
+	proxy S3Proxy
+
+	// The fields below are guarded by the proxy's mutex
+	unhealthy bool
+	failures  int // consecutive failed requests or probes
+	successes int // consecutive passed probes while unhealthy
+	latency   float64
+	measured  bool
+}
+
+// FailoverProxy serves reads from the fastest healthy member, retrying on
+// the next member when one fails before returning a response. Writes and
+// multipart uploads always go to the primary.
+//
+// Members are marked unhealthy after failureThreshold consecutive failures,
+// seen either by requests or by health probes, and serve reads again after
+// passing probes. Probes run in the background at most once per interval
+// while the site serves requests.
+type FailoverProxy struct {
+	members          []*failoverMember
+	healthCheckKey   string
+	interval         time.Duration
+	failureThreshold int
+
+	mu        sync.Mutex
+	lastProbe time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+func newFailoverProxy(members []*failoverMember, healthCheckKey string, interval time.Duration, failureThreshold int) *FailoverProxy {
+	if healthCheckKey == "" {
+		healthCheckKey = defaultHealthCheckKey
+	}
+	if failureThreshold <= 0 {
+		failureThreshold = defaultFailureThreshold
+	}
+	for i, m := range members {
+		m.index = i
+	}
+
+	return &FailoverProxy{
+		members:          members,
+		healthCheckKey:   healthCheckKey,
+		interval:         interval,
+		failureThreshold: failureThreshold,
+		now:              time.Now,
+	}
+}
+
+func (p *FailoverProxy) primary() S3Proxy {
+	return p.members[0].proxy
+}
+
+// isBackendFailure reports whether err means the backend failed, rather
+// than answering the request with an error of its own such as NoSuchKey
+func isBackendFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		status := reqErr.StatusCode()
+		return status >= 500 && status != http.StatusNotImplemented
+	}
+
+	return true
+}
+
+// candidates orders the members to try for a read: healthy members by
+// latency, members without samples in configuration order after them, and
+// unhealthy members last in case every member is failing
+func (p *FailoverProxy) candidates() []*failoverMember {
+	p.maybeProbe()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ordered := append([]*failoverMember(nil), p.members...)
+	rank := func(m *failoverMember) (bool, float64) {
+		if !m.measured {
+			return m.unhealthy, math.Inf(1)
+		}
+		return m.unhealthy, m.latency
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ui, li := rank(ordered[i])
+		uj, lj := rank(ordered[j])
+		if ui != uj {
+			return !ui
+		}
+		return li < lj
+	})
+
+	return ordered
+}
+
+// record updates a member's health from the outcome of a request
+func (p *FailoverProxy) record(m *failoverMember, elapsed time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if isBackendFailure(err) {
+		m.failures++
+		m.successes = 0
+		if !m.unhealthy && m.failures >= p.failureThreshold {
+			m.unhealthy = true
+			log.Printf("failover: %s is unhealthy: %v", m.name, err)
+		}
+		return
+	}
+
+	m.failures = 0
+	sample := float64(elapsed)
+	if m.measured {
+		m.latency = failoverLatencyWeight*sample + (1-failoverLatencyWeight)*m.latency
+	} else {
+		m.latency, m.measured = sample, true
+	}
+}
+
+// recordProbe updates a member's health from a probe, which is what brings
+// unhealthy members back
+func (p *FailoverProxy) recordProbe(m *failoverMember, elapsed time.Duration, err error) {
+	p.record(m, elapsed, err)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !m.unhealthy || isBackendFailure(err) {
+		return
+	}
+
+	m.successes++
+	if m.successes >= failoverRecoveryThreshold {
+		m.unhealthy = false
+		m.successes = 0
+		log.Printf("failover: %s is healthy again", m.name)
+	}
+}
+
+// maybeProbe starts a round of health probes if the last one is older than
+// the interval
+func (p *FailoverProxy) maybeProbe() {
+	p.mu.Lock()
+	if p.probing || p.now().Sub(p.lastProbe) < p.interval {
+		p.mu.Unlock()
+		return
+	}
+	p.probing = true
+	p.lastProbe = p.now()
+	p.mu.Unlock()
+
+	go func() {
+		p.probe()
+
+		p.mu.Lock()
+		p.probing = false
+		p.mu.Unlock()
+	}()
+}
+
+// probe checks every member in parallel. Any answer, including NoSuchKey
+// for the health check key, shows the member is up.
+func (p *FailoverProxy) probe() {
+	var wg sync.WaitGroup
+	for _, m := range p.members {
+		wg.Add(1)
+		go func(m *failoverMember) {
+			defer wg.Done()
+
+			start := time.Now()
+			_, err := m.proxy.Head(p.healthCheckKey)
+			p.recordProbe(m, time.Since(start), err)
+		}(m)
+	}
+	wg.Wait()
+}
+
+// read runs fn against each candidate in turn until one does not fail
+func (p *FailoverProxy) read(fn func(m *failoverMember) error) error {
+	var err error
+	for _, m := range p.candidates() {
+		start := time.Now()
+		err = fn(m)
+		p.record(m, time.Since(start), err)
+
+		if !isBackendFailure(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (p *FailoverProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	var out *s3.GetObjectOutput
+	err := p.read(func(m *failoverMember) (err error) {
+		out, err = m.proxy.Get(key, rangeHeader)
+		return err
+	})
+	return out, err
+}
+
+func (p *FailoverProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	var out *s3.HeadObjectOutput
+	err := p.read(func(m *failoverMember) (err error) {
+		out, err = m.proxy.Head(key)
+		return err
+	})
+	return out, err
+}
+
+// ListObjects tags continuation tokens with the member that issued them,
+// since tokens are only meaningful to the backend they came from. Later
+// pages are read from that member without failing over.
+func (p *FailoverProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	if continuationToken != "" {
+		i, token, ok := p.parseToken(continuationToken)
+		if !ok {
+			return nil, errInvalidArgument("The continuation token provided is incorrect")
+		}
+
+		m := p.members[i]
+		start := time.Now()
+		out, err := m.proxy.ListObjects(prefix, delimiter, maxKeys, token)
+		p.record(m, time.Since(start), err)
+		if err != nil {
+			return nil, err
+		}
+		return p.tagToken(out, i), nil
+	}
+
+	var out *s3.ListObjectsV2Output
+	var from int
+	err := p.read(func(m *failoverMember) (err error) {
+		out, err = m.proxy.ListObjects(prefix, delimiter, maxKeys, "")
+		from = m.index
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p.tagToken(out, from), nil
+}
+
+func (p *FailoverProxy) tagToken(out *s3.ListObjectsV2Output, member int) *s3.ListObjectsV2Output {
+	if out.NextContinuationToken != nil {
+		tagged := strconv.Itoa(member) + "." + *out.NextContinuationToken
+		out.NextContinuationToken = &tagged
+	}
+	return out
+}
+
+func (p *FailoverProxy) parseToken(token string) (int, string, bool) {
+	index, rest, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, "", false
+	}
+
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 || i >= len(p.members) {
+		return 0, "", false
+	}
+	return i, rest, true
+}
+
+func (p *FailoverProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	return p.primary().Put(key, body, contentType)
+}
+
+// PutIfAbsent uses the primary's atomic create. Without one it is not
+// implemented, and handlePut's existence check is all there is.
+func (p *FailoverProxy) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	if cp, ok := p.primary().(ConditionalPutter); ok {
+		return cp.PutIfAbsent(key, body, contentType)
+	}
+	return nil, errNotImplemented("Atomic create")
+}
+
+func (p *FailoverProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	return p.primary().Delete(key)
+}
+
+func (p *FailoverProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	return p.primary().CreateMultipartUpload(key, contentType)
+}
+
+func (p *FailoverProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	return p.primary().UploadPart(key, uploadId, partNumber, body)
+}
+
+func (p *FailoverProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	return p.primary().CompleteMultipartUpload(key, uploadId, parts)
+}
+
+func (p *FailoverProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	return p.primary().AbortMultipartUpload(key, uploadId)
+}
+
+func (p *FailoverProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	return p.primary().ListMultipartUploads(prefix, delimiter, maxUploads)
+}
+
+func (p *FailoverProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	var out *s3.GetBucketWebsiteOutput
+	err := p.read(func(m *failoverMember) (err error) {
+		out, err = m.proxy.GetWebsiteConfig()
+		return err
+	})
+	return out, err
+}
+
+func (p *FailoverProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	return p.primary().RestoreObject(key, days, tier)
+}
+
+// MigrationStatus reports the migration of the primary
+func (p *FailoverProxy) MigrationStatus() (MigrationStatus, bool) {
+	return migrationStatus(p.primary())
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestFailoverProxy(members ...S3Proxy) *FailoverProxy {
+	var ms []*failoverMember
+	for _, m := range members {
+		ms = append(ms, &failoverMember{name: "member", proxy: m})
+	}
+
+	p := newFailoverProxy(ms, "", time.Hour, 2)
+	// Probes are run explicitly by the tests
+	p.lastProbe = time.Now()
+	return p
+}
+
+func TestFailoverProxy_Failover(t *testing.T) {
+	primary, replica := newFakeProxy(), newFakeProxy()
+	putString(t, primary, "key", "primary")
+	putString(t, replica, "key", "replica")
+	putString(t, replica, "replica-only", "replica")
+	p := newTestFailoverProxy(primary, replica)
+
+	if got := getString(t, p, "key", ""); got != "primary" {
+		t.Errorf("Get() = %q, want the primary's copy", got)
+	}
+
+	// A missing key is an answer, not a failure
+	if _, err := p.Get("replica-only", ""); !isNotFound(err) {
+		t.Errorf("Get() of a key missing on the primary error = %v, want not found", err)
+	}
+
+	primary.setDown(true)
+	if got := getString(t, p, "key", ""); got != "replica" {
+		t.Errorf("Get() with the primary down = %q, want the replica's copy", got)
+	}
+
+	// The failed read and a failed probe reach the threshold
+	p.probe()
+	if first := p.candidates()[0]; first.proxy != replica || !p.members[0].unhealthy {
+		t.Errorf("primary not marked unhealthy after repeated failures")
+	}
+
+	// Failback needs consecutive passing probes
+	primary.setDown(false)
+	p.probe()
+	if !p.members[0].unhealthy {
+		t.Error("primary recovered after a single probe")
+	}
+	p.probe()
+	if p.members[0].unhealthy {
+		t.Error("primary still unhealthy after passing probes")
+	}
+
+	// Every member failing returns the last error
+	primary.setDown(true)
+	replica.setDown(true)
+	if _, err := p.Head("key"); !isBackendFailure(err) {
+		t.Errorf("Head() with every member down error = %v", err)
+	}
+}
+
+func TestFailoverProxy_PrefersLowLatency(t *testing.T) {
+	slow := newFakeProxy()
+	slow.headDelay = 30 * time.Millisecond
+	fast := newFakeProxy()
+	p := newTestFailoverProxy(slow, fast)
+
+	p.probe()
+	if first := p.candidates()[0]; first.proxy != fast {
+		t.Errorf("candidates() starts with %v, want the faster member", first.name)
+	}
+
+	// Writes stay on the primary regardless
+	putString(t, p, "key", "value")
+	if _, err := slow.MemoryProxy.Head("key"); err != nil {
+		t.Errorf("write did not go to the primary: %v", err)
+	}
+	if _, err := fast.Head("key"); !isNotFound(err) {
+		t.Errorf("write reached a read replica: %v", err)
+	}
+}
+
+func TestFailoverProxy_ListObjects(t *testing.T) {
+	primary, replica := newFakeProxy(), newFakeProxy()
+	for _, key := range []string{"a", "b", "c"} {
+		putString(t, primary, key, key)
+		putString(t, replica, key, key)
+	}
+	p := newTestFailoverProxy(primary, replica)
+
+	primary.setDown(true)
+	keys, _ := listAll(t, p, "", "", 1)
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+
+	if _, err := p.ListObjects("", "", 1, "not-a-token"); err == nil {
+		t.Error("ListObjects() with an invalid token should fail")
+	}
+}
+
+func TestFailoverProxy_PutIfAbsent(t *testing.T) {
+	primary, replica := newFakeProxy(), newFakeProxy()
+	p := newTestFailoverProxy(primary, replica)
+
+	checkNoAtomicCreate(t, p, primary, replica)
+}
+
+func TestValidateFailover(t *testing.T) {
+	s3Site := Site{AWSKey: "key", AWSSecret: "secret", AWSRegion: "us-east-1", AWSBucket: "bucket"}
+
+	tests := []struct {
+		name     string
+		site     Site
+		failover FailoverConfig
+		wantErr  bool
+	}{
+		{name: "endpoints", site: s3Site, failover: FailoverConfig{Endpoints: []string{"https://s3.eu-central-1.wasabisys.com"}}},
+		{name: "replicas", site: Site{Type: "memory"}, failover: FailoverConfig{Replicas: []Site{{Type: "memory"}}, HealthCheckInterval: "5s"}},
+		{name: "no members", site: s3Site, wantErr: true},
+		{name: "endpoints on another backend", site: Site{Type: "memory"}, failover: FailoverConfig{Endpoints: []string{"https://example.com"}}, wantErr: true},
+		{name: "invalid replica", site: s3Site, failover: FailoverConfig{Replicas: []Site{{Type: "nope"}}}, wantErr: true},
+		{name: "bad interval", site: s3Site, failover: FailoverConfig{Endpoints: []string{"https://example.com"}, HealthCheckInterval: "often"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.site.Failover = &tt.failover
+			if err := tt.site.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Objects are stored under the root directory with one directory level per
+// "/" separated key component. Names are prefixed so that a key can be both
+// an object and a "directory" of other keys ("a" and "a/b"):
+//
+//	d.<component>  directory holding keys below <component>/
+//	o.<component>  object data
+//	m.<component>  JSON metadata sidecar for the object
+//
+// Components are percent-encoded, so names never contain path separators
+// and never start with ".", which leaves .s3proxy free for temporary files
+// and staged multipart uploads.
+const (
+	fsInternalDir  = ".s3proxy"
+	fsDirPrefix    = "d."
+	fsObjectPrefix = "o."
+	fsMetaPrefix   = "m."
+)
+
+func init() {
+	RegisterBackend("filesystem", validateFilesystemSite, func(s Site) (S3Proxy, error) {
+		return NewFilesystemProxy(s.Filesystem.Root, s.Filesystem.Website)
+	})
+}
+
+// FilesystemConfig configures the local filesystem backend
+type FilesystemConfig struct {
+	Root    string         `json:"root" yaml:"root"`
+	Website *WebsiteConfig `json:"website,omitempty" yaml:"website,omitempty"`
+}
+
+func validateFilesystemSite(s Site) error {
+	if s.Filesystem == nil || s.Filesystem.Root == "" {
+		return errors.New("Filesystem root not specified")
+	}
+
+	return nil
+}
+
+// FilesystemProxy is an S3Proxy storing objects in a local directory
+type FilesystemProxy struct {
+	root    string
+	website *WebsiteConfig
+
+	// mu serializes the renames that publish or remove an object and its
+	// metadata, so readers always see a matching pair
+	mu sync.RWMutex
+}
+
+type fsMeta struct {
+	ETag        string `json:"etag"`
+	ContentType string `json:"contentType"`
+}
+
+type fsUpload struct {
+	Key         string    `json:"key"`
+	ContentType string    `json:"contentType"`
+	Initiated   time.Time `json:"initiated"`
+}
+
+func NewFilesystemProxy(root string, website *WebsiteConfig) (*FilesystemProxy, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range []string{"tmp", "uploads"} {
+		if err := os.MkdirAll(filepath.Join(root, fsInternalDir, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &FilesystemProxy{
+		root:    root,
+		website: website,
+	}, nil
+}
+
+// paths returns the directory, data file and metadata file for a key
+func (p *FilesystemProxy) paths(key string) (string, string, string, error) {
+	if key == "" {
+		return "", "", "", errInvalidArgument("Object key must not be empty")
+	}
+
+	parts := strings.Split(key, "/")
+	dir := p.root
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, fsDirPrefix+url.PathEscape(part))
+	}
+
+	name := url.PathEscape(parts[len(parts)-1])
+	if len(name)+len(fsObjectPrefix) > 255 {
+		return "", "", "", errInvalidArgument("Object key component is too long for the filesystem backend")
+	}
+
+	return dir, filepath.Join(dir, fsObjectPrefix+name), filepath.Join(dir, fsMetaPrefix+name), nil
+}
+
+func (p *FilesystemProxy) tempFile() (*os.File, error) {
+	return os.CreateTemp(filepath.Join(p.root, fsInternalDir, "tmp"), "obj-*")
+}
+
+// writeTemp copies r into a synced temporary file, returning it with the MD5 of the data
+func (p *FilesystemProxy) writeTemp(r io.Reader) (string, []byte, error) {
+	f, err := p.tempFile()
+	if err != nil {
+		return "", nil, err
+	}
+
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+
+	return f.Name(), h.Sum(nil), nil
+}
+
+// publish atomically moves a staged data file and its metadata into place
+func (p *FilesystemProxy) publish(key string, dataTmp string, meta fsMeta) error {
+	dir, dataPath, metaPath, err := p.paths(key)
+	if err != nil {
+		os.Remove(dataTmp)
+		return err
+	}
+
+	metaData, _ := json.Marshal(meta)
+	metaTmp, _, err := p.writeTemp(strings.NewReader(string(metaData)))
+	if err != nil {
+		os.Remove(dataTmp)
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		os.Remove(dataTmp)
+		os.Remove(metaTmp)
+		return err
+	}
+
+	if err := os.Rename(metaTmp, metaPath); err != nil {
+		os.Remove(dataTmp)
+		os.Remove(metaTmp)
+		return err
+	}
+
+	if err := os.Rename(dataTmp, dataPath); err != nil {
+		os.Remove(dataTmp)
+		return err
+	}
+
+	return nil
+}
+
+// open returns the data file, its size and metadata for a key
+func (p *FilesystemProxy) open(key string) (*os.File, os.FileInfo, fsMeta, error) {
+	var meta fsMeta
+
+	_, dataPath, metaPath, err := p.paths(key)
+	if err != nil {
+		return nil, nil, meta, err
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	f, err := os.Open(dataPath)
+	if os.IsNotExist(err) {
+		return nil, nil, meta, errNoSuchKey(key)
+	}
+	if err != nil {
+		return nil, nil, meta, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, meta, err
+	}
+
+	if data, err := os.ReadFile(metaPath); err == nil {
+		json.Unmarshal(data, &meta)
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = "application/octet-stream"
+	}
+
+	return f, info, meta, nil
+}
+
+func (p *FilesystemProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	f, info, meta, err := p.open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	size := info.Size()
+	out := &s3.GetObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(meta.ContentType),
+		ETag:          aws.String(meta.ETag),
+		LastModified:  aws.Time(info.ModTime()),
+		Body:          f,
+	}
+
+	if rangeHeader != "" {
+		start, end, err := parseByteRange(rangeHeader, size)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		out.ContentLength = aws.Int64(end - start + 1)
+		out.ContentRange = aws.String(contentRange(start, end, size))
+		out.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(f, start, end-start+1), f}
+	}
+
+	return out, nil
+}
+
+func (p *FilesystemProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	f, info, meta, err := p.open(key)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	return &s3.HeadObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: aws.Int64(info.Size()),
+		ContentType:   aws.String(meta.ContentType),
+		ETag:          aws.String(meta.ETag),
+		LastModified:  aws.Time(info.ModTime()),
+	}, nil
+}
+
+func (p *FilesystemProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	if _, _, _, err := p.paths(key); err != nil {
+		return nil, err
+	}
+
+	tmp, sum, err := p.writeTemp(body)
+	if err != nil {
+		return nil, err
+	}
+
+	etag := quoteETag(sum)
+	if err := p.publish(key, tmp, fsMeta{ETag: etag, ContentType: contentType}); err != nil {
+		return nil, err
+	}
+
+	return &s3.PutObjectOutput{ETag: aws.String(etag)}, nil
+}
+
+func (p *FilesystemProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	dir, dataPath, metaPath, err := p.paths(key)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Deleting a missing key succeeds, as it does on S3
+	if err := os.Remove(dataPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	os.Remove(metaPath)
+
+	// Prune directories left empty so listings do not report them
+	for dir != p.root {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (p *FilesystemProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	lister, err := newKeyLister(prefix, delimiter, maxKeys, continuationToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.walk(p.root, "", lister); err != nil {
+		return nil, err
+	}
+
+	out := lister.result()
+	out.Prefix = aws.String(prefix)
+	return out, nil
+}
+
+type fsEntry struct {
+	name    string
+	file    string
+	isDir   bool
+	sortKey string
+}
+
+// readDir returns the objects and directories of dir in key order. A
+// directory "a" sorts as "a/" so that the walk visits keys lexicographically.
+func readDir(dir string) ([]fsEntry, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []fsEntry
+	for _, e := range dirEntries {
+		name := e.Name()
+		isDir := strings.HasPrefix(name, fsDirPrefix) && e.IsDir()
+		if !isDir && !(strings.HasPrefix(name, fsObjectPrefix) && !e.IsDir()) {
+			continue
+		}
+
+		component, err := url.PathUnescape(name[2:])
+		if err != nil {
+			continue
+		}
+
+		entry := fsEntry{name: component, file: filepath.Join(dir, name), isDir: isDir, sortKey: component}
+		if isDir {
+			entry.sortKey += "/"
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].sortKey < entries[j].sortKey
+	})
+
+	return entries, nil
+}
+
+func (p *FilesystemProxy) walk(dir string, keyPrefix string, lister *keyLister) error {
+	entries, err := readDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if lister.full() {
+			return nil
+		}
+
+		key := keyPrefix + e.sortKey
+		if e.isDir {
+			skip, commonPrefix := lister.pruneDir(key)
+			if commonPrefix != "" {
+				if hasObjects(e.file) && !lister.addCommonPrefix(commonPrefix) {
+					return nil
+				}
+				continue
+			}
+			if skip {
+				continue
+			}
+			if err := p.walk(e.file, key, lister); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(key, lister.prefix) || lister.skip(key) {
+			continue
+		}
+
+		info, err := os.Stat(e.file)
+		if err != nil {
+			// Deleted while listing
+			continue
+		}
+
+		var meta fsMeta
+		if data, err := os.ReadFile(filepath.Join(dir, fsMetaPrefix+strings.TrimPrefix(filepath.Base(e.file), fsObjectPrefix))); err == nil {
+			json.Unmarshal(data, &meta)
+		}
+
+		if !lister.add(&s3.Object{
+			Key:          aws.String(key),
+			ETag:         aws.String(meta.ETag),
+			Size:         aws.Int64(info.Size()),
+			LastModified: aws.Time(info.ModTime()),
+			StorageClass: aws.String(s3.StorageClassStandard),
+		}) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// hasObjects reports whether any object is stored below dir
+func hasObjects(dir string) bool {
+	entries, err := readDir(dir)
+	if err != nil {
+		return false
+	}
+
+	for _, e := range entries {
+		if !e.isDir || hasObjects(e.file) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *FilesystemProxy) uploadDir(uploadId string) (string, error) {
+	// Upload IDs are hex, anything else could escape the uploads directory
+	if _, err := hex.DecodeString(uploadId); err != nil || uploadId == "" {
+		return "", errNoSuchUpload(uploadId)
+	}
+
+	return filepath.Join(p.root, fsInternalDir, "uploads", uploadId), nil
+}
+
+func (p *FilesystemProxy) readUpload(key string, uploadId string) (string, fsUpload, error) {
+	var upload fsUpload
+
+	dir, err := p.uploadDir(uploadId)
+	if err != nil {
+		return "", upload, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "upload.json"))
+	if err != nil {
+		return "", upload, errNoSuchUpload(uploadId)
+	}
+
+	if err := json.Unmarshal(data, &upload); err != nil || upload.Key != key {
+		return "", upload, errNoSuchUpload(uploadId)
+	}
+
+	return dir, upload, nil
+}
+
+func (p *FilesystemProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	if _, _, _, err := p.paths(key); err != nil {
+		return nil, err
+	}
+
+	uploadId := newUploadID()
+	dir, _ := p.uploadDir(uploadId)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	data, _ := json.Marshal(fsUpload{Key: key, ContentType: contentType, Initiated: time.Now().UTC()})
+	if err := os.WriteFile(filepath.Join(dir, "upload.json"), data, 0644); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &s3.CreateMultipartUploadOutput{
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}, nil
+}
+
+func (p *FilesystemProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	if partNumber < 1 || partNumber > 10000 {
+		return nil, errInvalidArgument("Part number must be an integer between 1 and 10000, inclusive")
+	}
+
+	dir, _, err := p.readUpload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, sum, err := p.writeTemp(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// The part's MD5 is kept next to it for the final multipart ETag
+	name := filepath.Join(dir, fmt.Sprintf("part.%05d", partNumber))
+	if err := os.WriteFile(name+".md5", []byte(hex.EncodeToString(sum)), 0644); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	return &s3.UploadPartOutput{ETag: aws.String(quoteETag(sum))}, nil
+}
+
+func (p *FilesystemProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	dir, upload, err := p.readUpload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make(map[int64][]byte)
+	uploaded := make(map[int64]string)
+	for _, part := range parts {
+		n := aws.Int64Value(part.PartNumber)
+		data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("part.%05d.md5", n)))
+		if err != nil {
+			continue
+		}
+		sum, err := hex.DecodeString(string(data))
+		if err != nil {
+			continue
+		}
+		sums[n] = sum
+		uploaded[n] = quoteETag(sum)
+	}
+
+	if err := checkCompletedParts(parts, uploaded); err != nil {
+		return nil, err
+	}
+
+	f, err := p.tempFile()
+	if err != nil {
+		return nil, err
+	}
+
+	ordered := make([][]byte, 0, len(parts))
+	for _, part := range parts {
+		n := aws.Int64Value(part.PartNumber)
+		src, err := os.Open(filepath.Join(dir, fmt.Sprintf("part.%05d", n)))
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, errInvalidPart(fmt.Sprintf("Part %d could not be found", n))
+		}
+		_, err = io.Copy(f, src)
+		src.Close()
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, err
+		}
+		ordered = append(ordered, sums[n])
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	f.Close()
+
+	etag := multipartETag(ordered)
+	if err := p.publish(key, f.Name(), fsMeta{ETag: etag, ContentType: upload.ContentType}); err != nil {
+		return nil, err
+	}
+
+	os.RemoveAll(dir)
+
+	return &s3.CompleteMultipartUploadOutput{
+		Key:  aws.String(key),
+		ETag: aws.String(etag),
+	}, nil
+}
+
+func (p *FilesystemProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	dir, _, err := p.readUpload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (p *FilesystemProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	uploadsDir := filepath.Join(p.root, fsInternalDir, "uploads")
+	entries, err := os.ReadDir(uploadsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var uploads []*s3.MultipartUpload
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(uploadsDir, e.Name(), "upload.json"))
+		if err != nil {
+			continue
+		}
+
+		var upload fsUpload
+		if err := json.Unmarshal(data, &upload); err != nil {
+			continue
+		}
+
+		uploads = append(uploads, &s3.MultipartUpload{
+			Key:          aws.String(upload.Key),
+			UploadId:     aws.String(e.Name()),
+			Initiated:    aws.Time(upload.Initiated),
+			StorageClass: aws.String(s3.StorageClassStandard),
+		})
+	}
+
+	out := listUploads(uploads, prefix, delimiter, maxUploads)
+	out.Prefix = aws.String(prefix)
+	return out, nil
+}
+
+func (p *FilesystemProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	return p.website.output()
+}
+
+func (p *FilesystemProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	if _, err := p.Head(key); err != nil {
+		return nil, err
+	}
+
+	return nil, errObjectAlreadyInActiveTier()
+}
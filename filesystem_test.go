@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func newTestFilesystemProxy(t *testing.T) *FilesystemProxy {
+	t.Helper()
+
+	p, err := NewFilesystemProxy(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("NewFilesystemProxy() error = %v", err)
+	}
+	return p
+}
+
+func putString(t *testing.T, p S3Proxy, key string, body string) {
+	t.Helper()
+
+	if _, err := p.Put(key, strings.NewReader(body), "text/plain"); err != nil {
+		t.Fatalf("Put(%q) error = %v", key, err)
+	}
+}
+
+func getString(t *testing.T, p S3Proxy, key string, rangeHeader string) string {
+	t.Helper()
+
+	obj, err := p.Get(key, rangeHeader)
+	if err != nil {
+		t.Fatalf("Get(%q) error = %v", key, err)
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return string(data)
+}
+
+// listAll pages through a listing and returns the keys and common prefixes
+func listAll(t *testing.T, p S3Proxy, prefix string, delimiter string, maxKeys int64) ([]string, []string) {
+	t.Helper()
+
+	var keys, prefixes []string
+	token := ""
+	for {
+		out, err := p.ListObjects(prefix, delimiter, maxKeys, token)
+		if err != nil {
+			t.Fatalf("ListObjects() error = %v", err)
+		}
+		for _, obj := range out.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		for _, cp := range out.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(cp.Prefix))
+		}
+		if !aws.BoolValue(out.IsTruncated) {
+			return keys, prefixes
+		}
+		token = aws.StringValue(out.NextContinuationToken)
+	}
+}
+
+func TestFilesystemProxy_PutGetDelete(t *testing.T) {
+	p := newTestFilesystemProxy(t)
+
+	putString(t, p, "dir/file.txt", "hello world")
+	putString(t, p, "dir", "both an object and a prefix")
+
+	if got := getString(t, p, "dir/file.txt", ""); got != "hello world" {
+		t.Errorf("Get() = %q, want %q", got, "hello world")
+	}
+	if got := getString(t, p, "dir/file.txt", "bytes=6-"); got != "world" {
+		t.Errorf("Get() with range = %q, want %q", got, "world")
+	}
+	if got := getString(t, p, "dir", ""); got != "both an object and a prefix" {
+		t.Errorf("Get() = %q", got)
+	}
+
+	head, err := p.Head("dir/file.txt")
+	if err != nil {
+		t.Fatalf("Head() error = %v", err)
+	}
+	if aws.Int64Value(head.ContentLength) != 11 || aws.StringValue(head.ContentType) != "text/plain" {
+		t.Errorf("Head() = %v", head)
+	}
+	if aws.StringValue(head.ETag) != `"5eb63bbbe01eeed093cb22bb8f5acdc3"` {
+		t.Errorf("Head() ETag = %s, want MD5 of body", aws.StringValue(head.ETag))
+	}
+
+	if _, err := p.Get("dir/file.txt", "bytes=50-"); err == nil {
+		t.Error("Get() with unsatisfiable range should fail")
+	}
+
+	if _, err := p.Delete("dir/file.txt"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := p.Head("dir/file.txt"); !isNotFound(err) {
+		t.Errorf("Head() after delete error = %v, want not found", err)
+	}
+	if _, err := p.Delete("dir/file.txt"); err != nil {
+		t.Errorf("Delete() of missing key error = %v, want nil", err)
+	}
+}
+
+func TestFilesystemProxy_ListObjects(t *testing.T) {
+	p := newTestFilesystemProxy(t)
+
+	for _, key := range []string{"a/b", "a-c", "a/d/e", "b", "a", "c/x y", "c/%2F"} {
+		putString(t, p, key, key)
+	}
+
+	tests := []struct {
+		name         string
+		prefix       string
+		delimiter    string
+		maxKeys      int64
+		wantKeys     []string
+		wantPrefixes []string
+	}{
+		{
+			name:     "all keys in lexicographic order",
+			wantKeys: []string{"a", "a-c", "a/b", "a/d/e", "b", "c/%2F", "c/x y"},
+		},
+		{
+			name:     "paged",
+			maxKeys:  2,
+			wantKeys: []string{"a", "a-c", "a/b", "a/d/e", "b", "c/%2F", "c/x y"},
+		},
+		{
+			name:         "delimiter",
+			delimiter:    "/",
+			wantKeys:     []string{"a", "a-c", "b"},
+			wantPrefixes: []string{"a/", "c/"},
+		},
+		{
+			name:         "delimiter paged",
+			delimiter:    "/",
+			maxKeys:      1,
+			wantKeys:     []string{"a", "a-c", "b"},
+			wantPrefixes: []string{"a/", "c/"},
+		},
+		{
+			name:         "prefix and delimiter",
+			prefix:       "a/",
+			delimiter:    "/",
+			wantKeys:     []string{"a/b"},
+			wantPrefixes: []string{"a/d/"},
+		},
+		{
+			name:     "partial component prefix",
+			prefix:   "a-",
+			wantKeys: []string{"a-c"},
+		},
+		{
+			name:         "non-slash delimiter",
+			delimiter:    "-",
+			wantKeys:     []string{"a", "a/b", "a/d/e", "b", "c/%2F", "c/x y"},
+			wantPrefixes: []string{"a-"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, prefixes := listAll(t, p, tt.prefix, tt.delimiter, tt.maxKeys)
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("keys = %v, want %v", keys, tt.wantKeys)
+			}
+			if !reflect.DeepEqual(prefixes, tt.wantPrefixes) {
+				t.Errorf("prefixes = %v, want %v", prefixes, tt.wantPrefixes)
+			}
+		})
+	}
+}
+
+func TestFilesystemProxy_Multipart(t *testing.T) {
+	p := newTestFilesystemProxy(t)
+
+	created, err := p.CreateMultipartUpload("big/object", "application/zip")
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload() error = %v", err)
+	}
+	uploadId := aws.StringValue(created.UploadId)
+
+	var parts []*s3.CompletedPart
+	for i, body := range []string{"part one ", "part two"} {
+		out, err := p.UploadPart("big/object", uploadId, int64(i+1), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("UploadPart() error = %v", err)
+		}
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(int64(i + 1)), ETag: out.ETag})
+	}
+
+	uploads, err := p.ListMultipartUploads("big/", "", 0)
+	if err != nil || len(uploads.Uploads) != 1 {
+		t.Fatalf("ListMultipartUploads() = %v, %v, want one upload", uploads, err)
+	}
+
+	bad := []*s3.CompletedPart{{PartNumber: aws.Int64(1), ETag: aws.String(`"nope"`)}}
+	if _, err := p.CompleteMultipartUpload("big/object", uploadId, bad); err == nil {
+		t.Error("CompleteMultipartUpload() with wrong ETag should fail")
+	}
+
+	done, err := p.CompleteMultipartUpload("big/object", uploadId, parts)
+	if err != nil {
+		t.Fatalf("CompleteMultipartUpload() error = %v", err)
+	}
+	if !strings.HasSuffix(aws.StringValue(done.ETag), `-2"`) {
+		t.Errorf("CompleteMultipartUpload() ETag = %s, want multipart ETag", aws.StringValue(done.ETag))
+	}
+
+	if got := getString(t, p, "big/object", ""); got != "part one part two" {
+		t.Errorf("Get() = %q", got)
+	}
+
+	if _, err := p.UploadPart("big/object", uploadId, 3, strings.NewReader("x")); !isNotFound(err) {
+		t.Errorf("UploadPart() after completion error = %v, want NoSuchUpload", err)
+	}
+	if _, err := p.AbortMultipartUpload("big/object", "../../etc"); err == nil {
+		t.Error("AbortMultipartUpload() with invalid upload ID should fail")
+	}
+}
@@ -0,0 +1,970 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	gcsDefaultEndpoint = "https://storage.googleapis.com"
+	gcsScope           = "https://www.googleapis.com/auth/devstorage.read_write"
+
+	// gcsChunkSize is the resumable upload chunk size, which GCS requires
+	// to be a multiple of 256 KiB. Larger bodies use resumable uploads.
+	gcsChunkSize = 8 << 20
+
+	// gcsMaxComposeSources is the most objects one compose request accepts
+	gcsMaxComposeSources = 32
+
+	// gcsETagKey is the custom metadata key holding the S3 ETag of objects
+	// composed from multipart uploads, which have no MD5 in GCS
+	gcsETagKey = "s3proxy-etag"
+)
+
+// Multipart uploads are staged in the bucket under gcsUploadsPrefix: an
+// upload marker object <id> whose metadata holds the target key and content
+// type, and one temporary object <id>/part.NNNNN per part. Completion
+// composes the parts into the target, in rounds of at most 32 sources.
+const gcsUploadsPrefix = ".s3proxy/uploads/"
+
+func init() {
+	RegisterBackend("gcs", validateGCSSite, func(s Site) (S3Proxy, error) {
+		return NewGCSProxy(*s.GCS, s.AWSBucket)
+	})
+}
+
+// GCSConfig configures the Google Cloud Storage backend. CredentialsFile is
+// a service account key file; it may be omitted together with a custom
+// Endpoint for emulators that do not check authentication.
+type GCSConfig struct {
+	CredentialsFile string         `json:"credentialsFile,omitempty" yaml:"credentialsFile,omitempty"`
+	Bucket          string         `json:"bucket,omitempty" yaml:"bucket,omitempty"`
+	Endpoint        string         `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	Website         *WebsiteConfig `json:"website,omitempty" yaml:"website,omitempty"`
+}
+
+func validateGCSSite(s Site) error {
+	if s.GCS == nil {
+		return errors.New("GCS settings not specified")
+	}
+
+	if s.GCS.CredentialsFile == "" && s.GCS.Endpoint == "" {
+		return errors.New("GCS credentialsFile not specified")
+	}
+
+	if s.GCS.Bucket == "" && s.AWSBucket == "" {
+		return errors.New("GCS bucket not specified")
+	}
+
+	return nil
+}
+
+// GCSProxy is an S3Proxy backed by a Google Cloud Storage bucket
+type GCSProxy struct {
+	client    *http.Client
+	endpoint  string
+	bucket    string
+	website   *WebsiteConfig
+	tokens    *gcsTokenSource
+	chunkSize int64
+}
+
+// NewGCSProxy creates a backend for the configured bucket, falling back to
+// bucketName when no bucket is set
+func NewGCSProxy(cfg GCSConfig, bucketName string) (*GCSProxy, error) {
+	p := &GCSProxy{
+		client:    http.DefaultClient,
+		endpoint:  strings.TrimSuffix(cfg.Endpoint, "/"),
+		bucket:    cfg.Bucket,
+		website:   cfg.Website,
+		chunkSize: gcsChunkSize,
+	}
+
+	if p.endpoint == "" {
+		p.endpoint = gcsDefaultEndpoint
+	}
+	if p.bucket == "" {
+		p.bucket = bucketName
+	}
+
+	if cfg.CredentialsFile != "" {
+		var err error
+		if p.tokens, err = loadGCSCredentials(cfg.CredentialsFile, p.client); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// gcsTokenSource exchanges self-signed service account JWTs for OAuth2
+// access tokens and caches them until shortly before they expire
+type gcsTokenSource struct {
+	client   *http.Client
+	email    string
+	keyID    string
+	key      *rsa.PrivateKey
+	tokenURI string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func loadGCSCredentials(path string, client *http.Client) (*gcsTokenSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKeyID string `json:"private_key_id"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("Invalid GCS credentials file: %v", err)
+	}
+
+	if creds.Type != "service_account" {
+		return nil, fmt.Errorf("GCS credentials file must be a service account key, got type %q", creds.Type)
+	}
+
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, errors.New("GCS credentials file has no PEM private key")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("Invalid GCS private key: %v", err)
+		}
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("GCS private key is not an RSA key")
+	}
+
+	if creds.TokenURI == "" {
+		creds.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	return &gcsTokenSource{
+		client:   client,
+		email:    creds.ClientEmail,
+		keyID:    creds.PrivateKeyID,
+		key:      key,
+		tokenURI: creds.TokenURI,
+	}, nil
+}
+
+// assertion builds the signed JWT presented to the token endpoint
+func (ts *gcsTokenSource) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": ts.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   ts.email,
+		"scope": gcsScope,
+		"aud":   ts.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+func (ts *gcsTokenSource) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	now := time.Now()
+	if ts.token != "" && now.Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	assertion, err := ts.assertion(now)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+
+	resp, err := ts.client.PostForm(ts.tokenURI, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", awserr.NewRequestFailure(
+			awserr.New("AccessDenied", "GCS token exchange failed: "+string(body), nil),
+			http.StatusForbidden, "")
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("decoding GCS token response: %v", err)
+	}
+
+	// Refresh a minute early so requests never carry an expired token
+	ts.token = token.AccessToken
+	ts.expiry = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+
+	return ts.token, nil
+}
+
+// gcsObject is the JSON API object resource
+type gcsObject struct {
+	Name               string            `json:"name"`
+	Size               string            `json:"size"`
+	ContentType        string            `json:"contentType"`
+	ContentEncoding    string            `json:"contentEncoding"`
+	ContentDisposition string            `json:"contentDisposition"`
+	ContentLanguage    string            `json:"contentLanguage"`
+	CacheControl       string            `json:"cacheControl"`
+	MD5Hash            string            `json:"md5Hash"`
+	Generation         string            `json:"generation"`
+	Updated            time.Time         `json:"updated"`
+	StorageClass       string            `json:"storageClass"`
+	Metadata           map[string]string `json:"metadata"`
+}
+
+func (o *gcsObject) size() int64 {
+	n, _ := strconv.ParseInt(o.Size, 10, 64)
+	return n
+}
+
+// etag returns the S3 ETag of an object: the stored multipart ETag for
+// composed objects, otherwise the hex MD5, falling back to the generation
+func (o *gcsObject) etag() string {
+	if etag := o.Metadata[gcsETagKey]; etag != "" {
+		return etag
+	}
+
+	if sum, err := base64.StdEncoding.DecodeString(o.MD5Hash); err == nil && len(sum) == md5.Size {
+		return quoteETag(sum)
+	}
+
+	return `"` + o.Generation + `"`
+}
+
+// userMetadata returns the custom metadata without the keys used internally
+func (o *gcsObject) userMetadata() map[string]*string {
+	var meta map[string]*string
+	for k, v := range o.Metadata {
+		if k == gcsETagKey {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]*string)
+		}
+		meta[k] = aws.String(v)
+	}
+	return meta
+}
+
+// gcsStorageClass maps a GCS storage class to the closest S3 storage class.
+// Every GCS class is readable without a restore.
+func gcsStorageClass(class string) string {
+	switch class {
+	case "NEARLINE", "COLDLINE":
+		return s3.StorageClassStandardIa
+	case "ARCHIVE":
+		return s3.StorageClassGlacierIr
+	}
+	return s3.StorageClassStandard
+}
+
+func (p *GCSProxy) objectURL(name string, query url.Values) string {
+	u := p.endpoint + "/storage/v1/b/" + url.PathEscape(p.bucket) + "/o"
+	if name != "" {
+		u += "/" + url.PathEscape(name)
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+func (p *GCSProxy) uploadURL(query url.Values) string {
+	return p.endpoint + "/upload/storage/v1/b/" + url.PathEscape(p.bucket) + "/o?" + query.Encode()
+}
+
+// do sends an authenticated request and converts GCS error responses into
+// S3 errors. key names the object for not found errors.
+func (p *GCSProxy) do(method string, rawURL string, header http.Header, body io.Reader, length int64, key string) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.ContentLength = length
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if p.tokens != nil {
+		token, err := p.tokens.Token()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// 308 is how resumable uploads acknowledge an intermediate chunk
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusPermanentRedirect {
+		defer resp.Body.Close()
+		return nil, gcsError(resp, key)
+	}
+
+	return resp, nil
+}
+
+// gcsError maps a JSON API error response to the error S3 would return
+func gcsError(resp *http.Response, key string) error {
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	message := body.Error.Message
+
+	requestId := resp.Header.Get("X-GUploader-UploadID")
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		if strings.Contains(message, "bucket") {
+			return awserr.NewRequestFailure(
+				awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil),
+				http.StatusNotFound, requestId)
+		}
+		return errNoSuchKey(key)
+	case http.StatusPreconditionFailed:
+		return awserr.NewRequestFailure(
+			awserr.New("PreconditionFailed", "At least one of the preconditions you specified did not hold", nil),
+			http.StatusPreconditionFailed, requestId)
+	case http.StatusRequestedRangeNotSatisfiable:
+		return awserr.NewRequestFailure(
+			awserr.New("InvalidRange", "The requested range is not satisfiable", nil),
+			http.StatusRequestedRangeNotSatisfiable, requestId)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return awserr.NewRequestFailure(
+			awserr.New("AccessDenied", message, nil),
+			http.StatusForbidden, requestId)
+	}
+
+	return awserr.NewRequestFailure(
+		awserr.New(strings.ReplaceAll(http.StatusText(resp.StatusCode), " ", ""), message, nil),
+		resp.StatusCode, requestId)
+}
+
+func decodeGCSObject(resp *http.Response) (*gcsObject, error) {
+	defer resp.Body.Close()
+
+	var obj gcsObject
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("decoding GCS object: %v", err)
+	}
+	return &obj, nil
+}
+
+func (p *GCSProxy) stat(key string) (*gcsObject, error) {
+	resp, err := p.do(http.MethodGet, p.objectURL(key, nil), nil, nil, 0, key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeGCSObject(resp)
+}
+
+func (p *GCSProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	obj, err := p.stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pin the read to the generation just stat'ed so the body always
+	// matches the metadata returned alongside it
+	query := url.Values{}
+	query.Set("alt", "media")
+	query.Set("generation", obj.Generation)
+
+	header := http.Header{}
+	if rangeHeader != "" {
+		header.Set("Range", rangeHeader)
+	}
+
+	resp, err := p.do(http.MethodGet, p.objectURL(key, query), header, nil, 0, key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &s3.GetObjectOutput{
+		AcceptRanges:       aws.String("bytes"),
+		Body:               resp.Body,
+		CacheControl:       aws.String(obj.CacheControl),
+		ContentDisposition: aws.String(obj.ContentDisposition),
+		ContentEncoding:    aws.String(obj.ContentEncoding),
+		ContentLanguage:    aws.String(obj.ContentLanguage),
+		ContentLength:      aws.Int64(obj.size()),
+		ContentType:        aws.String(obj.ContentType),
+		ETag:               aws.String(obj.etag()),
+		LastModified:       aws.Time(obj.Updated),
+		Metadata:           obj.userMetadata(),
+		StorageClass:       aws.String(gcsStorageClass(obj.StorageClass)),
+		VersionId:          aws.String(obj.Generation),
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		out.ContentLength = aws.Int64(resp.ContentLength)
+		out.ContentRange = aws.String(resp.Header.Get("Content-Range"))
+	}
+
+	return out, nil
+}
+
+func (p *GCSProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	obj, err := p.stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.HeadObjectOutput{
+		AcceptRanges:       aws.String("bytes"),
+		CacheControl:       aws.String(obj.CacheControl),
+		ContentDisposition: aws.String(obj.ContentDisposition),
+		ContentEncoding:    aws.String(obj.ContentEncoding),
+		ContentLanguage:    aws.String(obj.ContentLanguage),
+		ContentLength:      aws.Int64(obj.size()),
+		ContentType:        aws.String(obj.ContentType),
+		ETag:               aws.String(obj.etag()),
+		LastModified:       aws.Time(obj.Updated),
+		Metadata:           obj.userMetadata(),
+		StorageClass:       aws.String(gcsStorageClass(obj.StorageClass)),
+		VersionId:          aws.String(obj.Generation),
+	}, nil
+}
+
+func (p *GCSProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	return p.put(key, body, contentType, false)
+}
+
+// PutIfAbsent creates the object only if the key does not exist yet, using
+// ifGenerationMatch=0 so the check and the write are a single atomic request
+func (p *GCSProxy) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	return p.put(key, body, contentType, true)
+}
+
+func (p *GCSProxy) put(key string, body io.ReadSeeker, contentType string, ifAbsent bool) (*s3.PutObjectOutput, error) {
+	if strings.HasPrefix(key, gcsUploadsPrefix) {
+		return nil, errInvalidArgument("Keys under " + gcsUploadsPrefix + " are reserved")
+	}
+
+	query := url.Values{}
+	if ifAbsent {
+		query.Set("ifGenerationMatch", "0")
+	}
+
+	obj, err := p.upload(key, body, contentType, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.PutObjectOutput{
+		ETag:      aws.String(obj.etag()),
+		VersionId: aws.String(obj.Generation),
+	}, nil
+}
+
+// upload writes an object, with a single request for small bodies and a
+// chunked resumable upload for bodies larger than one chunk
+func (p *GCSProxy) upload(key string, body io.ReadSeeker, contentType string, query url.Values) (*gcsObject, error) {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	query.Set("name", key)
+
+	if size <= p.chunkSize {
+		query.Set("uploadType", "media")
+
+		header := http.Header{}
+		header.Set("Content-Type", contentType)
+
+		resp, err := p.do(http.MethodPost, p.uploadURL(query), header, body, size, key)
+		if err != nil {
+			return nil, err
+		}
+		return decodeGCSObject(resp)
+	}
+
+	query.Set("uploadType", "resumable")
+
+	meta, _ := json.Marshal(map[string]string{"contentType": contentType})
+	header := http.Header{}
+	header.Set("Content-Type", "application/json; charset=UTF-8")
+	header.Set("X-Upload-Content-Type", contentType)
+	header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	resp, err := p.do(http.MethodPost, p.uploadURL(query), header, bytes.NewReader(meta), int64(len(meta)), key)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return nil, errors.New("GCS resumable upload returned no session URI")
+	}
+
+	for offset := int64(0); ; {
+		n := p.chunkSize
+		if offset+n > size {
+			n = size - offset
+		}
+
+		header := http.Header{}
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size))
+
+		resp, err := p.do(http.MethodPut, session, header, io.LimitReader(body, n), n, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusPermanentRedirect {
+			return decodeGCSObject(resp)
+		}
+		resp.Body.Close()
+
+		offset += n
+		if offset >= size {
+			return nil, errors.New("GCS resumable upload did not finalize")
+		}
+	}
+}
+
+func (p *GCSProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	resp, err := p.do(http.MethodDelete, p.objectURL(key, nil), nil, nil, 0, key)
+	if err != nil {
+		// S3 deletes are idempotent
+		if isNotFound(err) {
+			return &s3.DeleteObjectOutput{}, nil
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+type gcsListResult struct {
+	Items         []*gcsObject `json:"items"`
+	Prefixes      []string     `json:"prefixes"`
+	NextPageToken string       `json:"nextPageToken"`
+}
+
+func (p *GCSProxy) list(query url.Values) (*gcsListResult, error) {
+	resp, err := p.do(http.MethodGet, p.objectURL("", query), nil, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result gcsListResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding GCS object list: %v", err)
+	}
+	return &result, nil
+}
+
+func (p *GCSProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	if maxKeys <= 0 || maxKeys > defaultMaxKeys {
+		maxKeys = defaultMaxKeys
+	}
+
+	query := url.Values{}
+	query.Set("maxResults", strconv.FormatInt(maxKeys, 10))
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	// GCS page tokens are opaque, so they are passed through as tokens
+	if continuationToken != "" {
+		query.Set("pageToken", continuationToken)
+	}
+
+	result, err := p.list(query)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &s3.ListObjectsV2Output{
+		Prefix:      aws.String(prefix),
+		MaxKeys:     aws.Int64(maxKeys),
+		IsTruncated: aws.Bool(result.NextPageToken != ""),
+	}
+	if result.NextPageToken != "" {
+		out.NextContinuationToken = aws.String(result.NextPageToken)
+	}
+
+	// Staged multipart uploads are an implementation detail and never listed
+	for _, obj := range result.Items {
+		if strings.HasPrefix(obj.Name, gcsUploadsPrefix) {
+			continue
+		}
+
+		out.Contents = append(out.Contents, &s3.Object{
+			Key:          aws.String(obj.Name),
+			ETag:         aws.String(obj.etag()),
+			Size:         aws.Int64(obj.size()),
+			LastModified: aws.Time(obj.Updated),
+			StorageClass: aws.String(gcsStorageClass(obj.StorageClass)),
+		})
+	}
+	for _, cp := range result.Prefixes {
+		if strings.HasPrefix(gcsUploadsPrefix, cp) {
+			continue
+		}
+		out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(cp)})
+	}
+	out.KeyCount = aws.Int64(int64(len(out.Contents) + len(out.CommonPrefixes)))
+
+	return out, nil
+}
+
+func (p *GCSProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	uploadId := newUploadID()
+
+	marker, _ := json.Marshal(map[string]interface{}{
+		"name": gcsUploadsPrefix + uploadId,
+		"metadata": map[string]string{
+			"key":         key,
+			"contentType": contentType,
+		},
+	})
+
+	query := url.Values{}
+	query.Set("uploadType", "multipart")
+
+	// A multipart/related upload carries the marker's metadata and its
+	// (empty) content in one request
+	var buf bytes.Buffer
+	boundary := "s3proxy" + uploadId
+	fmt.Fprintf(&buf, "--%s\r\nContent-Type: application/json; charset=UTF-8\r\n\r\n%s\r\n", boundary, marker)
+	fmt.Fprintf(&buf, "--%s\r\nContent-Type: application/octet-stream\r\n\r\n\r\n--%s--", boundary, boundary)
+
+	header := http.Header{}
+	header.Set("Content-Type", "multipart/related; boundary="+boundary)
+
+	resp, err := p.do(http.MethodPost, p.uploadURL(query), header, &buf, int64(buf.Len()), key)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &s3.CreateMultipartUploadOutput{
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}, nil
+}
+
+// uploadMarker returns the marker object of an in-progress upload
+func (p *GCSProxy) uploadMarker(key string, uploadId string) (*gcsObject, error) {
+	if _, err := hex.DecodeString(uploadId); err != nil || uploadId == "" {
+		return nil, errNoSuchUpload(uploadId)
+	}
+
+	marker, err := p.stat(gcsUploadsPrefix + uploadId)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, errNoSuchUpload(uploadId)
+		}
+		return nil, err
+	}
+
+	if marker.Metadata["key"] != key {
+		return nil, errNoSuchUpload(uploadId)
+	}
+
+	return marker, nil
+}
+
+func gcsPartName(uploadId string, partNumber int64) string {
+	return fmt.Sprintf("%s%s/part.%05d", gcsUploadsPrefix, uploadId, partNumber)
+}
+
+func (p *GCSProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	if partNumber < 1 || partNumber > 10000 {
+		return nil, errInvalidArgument("Part number must be an integer between 1 and 10000, inclusive")
+	}
+
+	if _, err := p.uploadMarker(key, uploadId); err != nil {
+		return nil, err
+	}
+
+	obj, err := p.upload(gcsPartName(uploadId, partNumber), body, "application/octet-stream", url.Values{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.UploadPartOutput{ETag: aws.String(obj.etag())}, nil
+}
+
+// stagedObjects lists every object staged for an upload
+func (p *GCSProxy) stagedObjects(uploadId string) ([]*gcsObject, error) {
+	var objects []*gcsObject
+
+	query := url.Values{}
+	query.Set("prefix", gcsUploadsPrefix+uploadId+"/")
+	for {
+		result, err := p.list(query)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, result.Items...)
+
+		if result.NextPageToken == "" {
+			return objects, nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+// compose concatenates sources into the destination object
+func (p *GCSProxy) compose(dest string, sources []string, contentType string, metadata map[string]string) (*gcsObject, error) {
+	type source struct {
+		Name string `json:"name"`
+	}
+
+	req := struct {
+		SourceObjects []source `json:"sourceObjects"`
+		Destination   struct {
+			ContentType string            `json:"contentType"`
+			Metadata    map[string]string `json:"metadata,omitempty"`
+		} `json:"destination"`
+	}{}
+	for _, name := range sources {
+		req.SourceObjects = append(req.SourceObjects, source{Name: name})
+	}
+	req.Destination.ContentType = contentType
+	req.Destination.Metadata = metadata
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+
+	resp, err := p.do(http.MethodPost, p.objectURL(dest, nil)+"/compose", header, bytes.NewReader(body), int64(len(body)), dest)
+	if err != nil {
+		return nil, err
+	}
+	return decodeGCSObject(resp)
+}
+
+func (p *GCSProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	marker, err := p.uploadMarker(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	staged, err := p.stagedObjects(uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	uploaded := make(map[int64]string)
+	partPrefix := gcsUploadsPrefix + uploadId + "/part."
+	for _, obj := range staged {
+		if n, err := strconv.ParseInt(strings.TrimPrefix(obj.Name, partPrefix), 10, 64); err == nil {
+			uploaded[n] = obj.etag()
+		}
+	}
+
+	if err := checkCompletedParts(parts, uploaded); err != nil {
+		return nil, err
+	}
+
+	sources := make([]string, 0, len(parts))
+	sums := make([][]byte, 0, len(parts))
+	for _, part := range parts {
+		n := aws.Int64Value(part.PartNumber)
+		sources = append(sources, gcsPartName(uploadId, n))
+		sum, _ := hex.DecodeString(strings.Trim(uploaded[n], `"`))
+		sums = append(sums, sum)
+	}
+
+	// Compose accepts at most 32 sources, so larger uploads are reduced in
+	// rounds through intermediate objects staged next to the parts
+	for round := 0; len(sources) > gcsMaxComposeSources; round++ {
+		var next []string
+		for i := 0; i < len(sources); i += gcsMaxComposeSources {
+			end := i + gcsMaxComposeSources
+			if end > len(sources) {
+				end = len(sources)
+			}
+
+			name := fmt.Sprintf("%s%s/compose.%d.%05d", gcsUploadsPrefix, uploadId, round, len(next))
+			if _, err := p.compose(name, sources[i:end], "application/octet-stream", nil); err != nil {
+				return nil, err
+			}
+			next = append(next, name)
+		}
+		sources = next
+	}
+
+	etag := multipartETag(sums)
+	obj, err := p.compose(key, sources, marker.Metadata["contentType"], map[string]string{gcsETagKey: etag})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.removeUpload(uploadId); err != nil {
+		return nil, err
+	}
+
+	return &s3.CompleteMultipartUploadOutput{
+		Key:       aws.String(key),
+		ETag:      aws.String(etag),
+		VersionId: aws.String(obj.Generation),
+	}, nil
+}
+
+// removeUpload deletes the staged objects and marker of an upload
+func (p *GCSProxy) removeUpload(uploadId string) error {
+	staged, err := p.stagedObjects(uploadId)
+	if err != nil {
+		return err
+	}
+
+	names := []string{gcsUploadsPrefix + uploadId}
+	for _, obj := range staged {
+		names = append(names, obj.Name)
+	}
+
+	for _, name := range names {
+		resp, err := p.do(http.MethodDelete, p.objectURL(name, nil), nil, nil, 0, name)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	return nil
+}
+
+func (p *GCSProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	if _, err := p.uploadMarker(key, uploadId); err != nil {
+		return nil, err
+	}
+
+	if err := p.removeUpload(uploadId); err != nil {
+		return nil, err
+	}
+
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (p *GCSProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	var uploads []*s3.MultipartUpload
+
+	// The delimiter rolls each upload's staged parts into a prefix, leaving
+	// only the markers as items
+	query := url.Values{}
+	query.Set("prefix", gcsUploadsPrefix)
+	query.Set("delimiter", "/")
+	for {
+		result, err := p.list(query)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, marker := range result.Items {
+			uploads = append(uploads, &s3.MultipartUpload{
+				Key:          aws.String(marker.Metadata["key"]),
+				UploadId:     aws.String(strings.TrimPrefix(marker.Name, gcsUploadsPrefix)),
+				Initiated:    aws.Time(marker.Updated),
+				StorageClass: aws.String(s3.StorageClassStandard),
+			})
+		}
+
+		if result.NextPageToken == "" {
+			break
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+
+	out := listUploads(uploads, prefix, delimiter, maxUploads)
+	out.Prefix = aws.String(prefix)
+	return out, nil
+}
+
+func (p *GCSProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	return p.website.output()
+}
+
+func (p *GCSProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	if _, err := p.stat(key); err != nil {
+		return nil, err
+	}
+
+	return nil, errObjectAlreadyInActiveTier()
+}
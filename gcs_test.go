@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type fakeGCSObject struct {
+	data        []byte
+	contentType string
+	generation  int64
+	metadata    map[string]string
+}
+
+// fakeGCS is a minimal stand-in for the GCS JSON API and OAuth2 token
+// endpoint. It verifies the service account JWT and bearer tokens.
+type fakeGCS struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu         sync.Mutex
+	objects    map[string]*fakeGCSObject
+	sessions   map[string]*bytes.Buffer
+	generation int64
+	composes   int
+}
+
+func newFakeGCS(t *testing.T) *fakeGCS {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeGCS{
+		key:      key,
+		objects:  make(map[string]*fakeGCSObject),
+		sessions: make(map[string]*bytes.Buffer),
+	}
+	f.server = httptest.NewServer(f)
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+// credentialsFile writes a service account key file for the fake
+func (f *fakeGCS) credentialsFile(t *testing.T) string {
+	t.Helper()
+
+	der, _ := x509.MarshalPKCS8PrivateKey(f.key)
+	creds, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "proxy@project.iam.gserviceaccount.com",
+		"private_key_id": "key1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      f.server.URL + "/token",
+	})
+
+	path := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(path, creds, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func (f *fakeGCS) fail(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, status, message)
+}
+
+func (f *fakeGCS) resource(name string, obj *fakeGCSObject) map[string]interface{} {
+	sum := md5.Sum(obj.data)
+	return map[string]interface{}{
+		"name":        name,
+		"size":        strconv.Itoa(len(obj.data)),
+		"contentType": obj.contentType,
+		"md5Hash":     base64.StdEncoding.EncodeToString(sum[:]),
+		"generation":  strconv.FormatInt(obj.generation, 10),
+		"updated":     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339),
+		"metadata":    obj.metadata,
+	}
+}
+
+func (f *fakeGCS) store(w http.ResponseWriter, query url.Values, name string, obj *fakeGCSObject) {
+	if query.Get("ifGenerationMatch") == "0" && f.objects[name] != nil {
+		f.fail(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return
+	}
+
+	f.generation++
+	obj.generation = f.generation
+	f.objects[name] = obj
+	json.NewEncoder(w).Encode(f.resource(name, obj))
+}
+
+func (f *fakeGCS) checkJWT(assertion string) bool {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(&f.key.PublicKey, crypto.SHA256, sum[:], sig) != nil {
+		return false
+	}
+
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var c struct {
+		Iss   string `json:"iss"`
+		Scope string `json:"scope"`
+		Aud   string `json:"aud"`
+	}
+	json.Unmarshal(claims, &c)
+	return c.Iss == "proxy@project.iam.gserviceaccount.com" && c.Scope == gcsScope && c.Aud == f.server.URL+"/token"
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		r.ParseForm()
+		if !f.checkJWT(r.PostForm.Get("assertion")) {
+			f.fail(w, http.StatusUnauthorized, "invalid_grant")
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"token","expires_in":3600,"token_type":"Bearer"}`)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		f.fail(w, http.StatusUnauthorized, "Invalid Credentials")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	path := r.URL.EscapedPath()
+
+	switch {
+	case strings.HasPrefix(path, "/upload/resumable/"):
+		f.resumable(w, r, strings.TrimPrefix(path, "/upload/resumable/"))
+
+	case path == "/upload/storage/v1/b/bucket/o":
+		f.upload(w, r, query)
+
+	case path == "/storage/v1/b/bucket/o":
+		f.list(w, query)
+
+	case strings.HasPrefix(path, "/storage/v1/b/bucket/o/"):
+		rest := strings.TrimPrefix(path, "/storage/v1/b/bucket/o/")
+		compose := strings.HasSuffix(rest, "/compose")
+		name, _ := url.PathUnescape(strings.TrimSuffix(rest, "/compose"))
+
+		if compose {
+			f.compose(w, r, query, name)
+			return
+		}
+
+		obj, ok := f.objects[name]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "No such object: bucket/"+name)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodDelete:
+			delete(f.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		case query.Get("alt") == "media":
+			if g := query.Get("generation"); g != "" && g != strconv.FormatInt(obj.generation, 10) {
+				f.fail(w, http.StatusNotFound, "No such object: bucket/"+name)
+				return
+			}
+			data := obj.data
+			if rng := r.Header.Get("Range"); rng != "" {
+				start, end, err := parseByteRange(rng, int64(len(data)))
+				if err != nil {
+					f.fail(w, http.StatusRequestedRangeNotSatisfiable, "Requested range not satisfiable")
+					return
+				}
+				w.Header().Set("Content-Range", contentRange(start, end, int64(len(data))))
+				w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+				w.WriteHeader(http.StatusPartialContent)
+				data = data[start : end+1]
+			}
+			w.Write(data)
+		default:
+			json.NewEncoder(w).Encode(f.resource(name, obj))
+		}
+
+	default:
+		f.fail(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (f *fakeGCS) upload(w http.ResponseWriter, r *http.Request, query url.Values) {
+	switch query.Get("uploadType") {
+	case "media":
+		data, _ := io.ReadAll(r.Body)
+		f.store(w, query, query.Get("name"), &fakeGCSObject{data: data, contentType: r.Header.Get("Content-Type")})
+
+	case "multipart":
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		mr := multipart.NewReader(r.Body, params["boundary"])
+
+		var meta struct {
+			Name     string            `json:"name"`
+			Metadata map[string]string `json:"metadata"`
+		}
+		part, _ := mr.NextPart()
+		json.NewDecoder(part).Decode(&meta)
+		part, _ = mr.NextPart()
+		data, _ := io.ReadAll(part)
+
+		f.store(w, query, meta.Name, &fakeGCSObject{data: data, metadata: meta.Metadata})
+
+	case "resumable":
+		id := strconv.Itoa(len(f.sessions))
+		f.sessions[id] = &bytes.Buffer{}
+		q := url.Values{}
+		q.Set("name", query.Get("name"))
+		q.Set("contentType", r.Header.Get("X-Upload-Content-Type"))
+		q.Set("ifGenerationMatch", query.Get("ifGenerationMatch"))
+		w.Header().Set("Location", f.server.URL+"/upload/resumable/"+id+"?"+q.Encode())
+
+	default:
+		f.fail(w, http.StatusBadRequest, "bad uploadType")
+	}
+}
+
+func (f *fakeGCS) resumable(w http.ResponseWriter, r *http.Request, id string) {
+	buf, ok := f.sessions[id]
+	if !ok {
+		f.fail(w, http.StatusNotFound, "No such upload")
+		return
+	}
+
+	var start, end, total int
+	fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+	if start != buf.Len() {
+		f.fail(w, http.StatusBadRequest, "Invalid Content-Range")
+		return
+	}
+	io.Copy(buf, r.Body)
+
+	if buf.Len() < total {
+		if buf.Len()%(256<<10) != 0 {
+			f.fail(w, http.StatusBadRequest, "Chunk size must be a multiple of 256 KiB")
+			return
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+
+	query := r.URL.Query()
+	delete(f.sessions, id)
+	f.store(w, query, query.Get("name"), &fakeGCSObject{data: buf.Bytes(), contentType: query.Get("contentType")})
+}
+
+func (f *fakeGCS) compose(w http.ResponseWriter, r *http.Request, query url.Values, name string) {
+	var req struct {
+		SourceObjects []struct {
+			Name string `json:"name"`
+		} `json:"sourceObjects"`
+		Destination struct {
+			ContentType string            `json:"contentType"`
+			Metadata    map[string]string `json:"metadata"`
+		} `json:"destination"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	if len(req.SourceObjects) > gcsMaxComposeSources {
+		f.fail(w, http.StatusBadRequest, "The number of source components provided exceeds the maximum")
+		return
+	}
+
+	var data []byte
+	for _, src := range req.SourceObjects {
+		obj, ok := f.objects[src.Name]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "No such object: bucket/"+src.Name)
+			return
+		}
+		data = append(data, obj.data...)
+	}
+
+	f.composes++
+	f.store(w, query, name, &fakeGCSObject{data: data, contentType: req.Destination.ContentType, metadata: req.Destination.Metadata})
+}
+
+func (f *fakeGCS) list(w http.ResponseWriter, query url.Values) {
+	prefix, delimiter, token := query.Get("prefix"), query.Get("delimiter"), query.Get("pageToken")
+	max, _ := strconv.Atoi(query.Get("maxResults"))
+	if max <= 0 {
+		max = 1000
+	}
+
+	names := make([]string, 0, len(f.objects))
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) && name > token {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := struct {
+		Items         []map[string]interface{} `json:"items,omitempty"`
+		Prefixes      []string                 `json:"prefixes,omitempty"`
+		NextPageToken string                   `json:"nextPageToken,omitempty"`
+	}{}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if len(result.Items)+len(result.Prefixes) == max {
+			break
+		}
+		// Page tokens are the last name returned, so a prefix is only
+		// returned once even when its keys span pages
+		result.NextPageToken = name
+
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				cp := name[:len(prefix)+i+len(delimiter)]
+				if !seen[cp] && !strings.HasPrefix(token, cp) {
+					seen[cp] = true
+					result.Prefixes = append(result.Prefixes, cp)
+				}
+				continue
+			}
+		}
+		result.Items = append(result.Items, f.resource(name, f.objects[name]))
+	}
+
+	if result.NextPageToken == "" || result.NextPageToken == names[len(names)-1] {
+		result.NextPageToken = ""
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+func newTestGCSProxy(t *testing.T, f *fakeGCS) *GCSProxy {
+	t.Helper()
+
+	p, err := NewGCSProxy(GCSConfig{
+		CredentialsFile: f.credentialsFile(t),
+		Endpoint:        f.server.URL,
+	}, "bucket")
+	if err != nil {
+		t.Fatalf("NewGCSProxy() error = %v", err)
+	}
+	return p
+}
+
+func TestGCSProxy_PutGetDelete(t *testing.T) {
+	p := newTestGCSProxy(t, newFakeGCS(t))
+
+	putString(t, p, "dir/hello world.txt", "hello world")
+
+	if got := getString(t, p, "dir/hello world.txt", ""); got != "hello world" {
+		t.Errorf("Get() = %q, want %q", got, "hello world")
+	}
+	if got := getString(t, p, "dir/hello world.txt", "bytes=6-"); got != "world" {
+		t.Errorf("Get() with range = %q, want %q", got, "world")
+	}
+
+	head, err := p.Head("dir/hello world.txt")
+	if err != nil {
+		t.Fatalf("Head() error = %v", err)
+	}
+	if aws.StringValue(head.ETag) != `"5eb63bbbe01eeed093cb22bb8f5acdc3"` {
+		t.Errorf("Head() ETag = %s, want MD5 of body", aws.StringValue(head.ETag))
+	}
+	if aws.StringValue(head.VersionId) != "1" {
+		t.Errorf("Head() VersionId = %s, want generation 1", aws.StringValue(head.VersionId))
+	}
+
+	if _, err := p.Delete("dir/hello world.txt"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := p.Get("dir/hello world.txt", ""); !isNotFound(err) {
+		t.Errorf("Get() after delete error = %v, want not found", err)
+	}
+	if _, err := p.Delete("dir/hello world.txt"); err != nil {
+		t.Errorf("Delete() of missing key error = %v, want nil", err)
+	}
+}
+
+func TestGCSProxy_PutIfAbsent(t *testing.T) {
+	p := newTestGCSProxy(t, newFakeGCS(t))
+
+	if _, err := p.PutIfAbsent("once", strings.NewReader("first"), "text/plain"); err != nil {
+		t.Fatalf("PutIfAbsent() error = %v", err)
+	}
+
+	_, err := p.PutIfAbsent("once", strings.NewReader("second"), "text/plain")
+	if reqErr, ok := err.(interface{ StatusCode() int }); !ok || reqErr.StatusCode() != http.StatusPreconditionFailed {
+		t.Errorf("PutIfAbsent() on existing key error = %v, want 412", err)
+	}
+	if got := getString(t, p, "once", ""); got != "first" {
+		t.Errorf("Get() = %q, want %q", got, "first")
+	}
+}
+
+func TestGCSProxy_ResumableUpload(t *testing.T) {
+	p := newTestGCSProxy(t, newFakeGCS(t))
+	p.chunkSize = 256 << 10
+
+	body := strings.Repeat("0123456789abcdef", 40<<10)
+	putString(t, p, "large", body)
+
+	if got := getString(t, p, "large", ""); got != body {
+		t.Errorf("Get() returned %d bytes, want %d", len(got), len(body))
+	}
+}
+
+func TestGCSProxy_ListObjects(t *testing.T) {
+	p := newTestGCSProxy(t, newFakeGCS(t))
+
+	for _, key := range []string{"a/b", "a-c", "a/d/e", "b", "a"} {
+		putString(t, p, key, key)
+	}
+	if _, err := p.CreateMultipartUpload("pending", "text/plain"); err != nil {
+		t.Fatalf("CreateMultipartUpload() error = %v", err)
+	}
+
+	keys, prefixes := listAll(t, p, "", "/", 2)
+	if want := []string{"a", "a-c", "b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+	if want := []string{"a/"}; !reflect.DeepEqual(prefixes, want) {
+		t.Errorf("prefixes = %v, want %v", prefixes, want)
+	}
+
+	keys, _ = listAll(t, p, "a/", "", 1)
+	if want := []string{"a/b", "a/d/e"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+}
+
+func TestGCSProxy_Multipart(t *testing.T) {
+	f := newFakeGCS(t)
+	p := newTestGCSProxy(t, f)
+
+	created, err := p.CreateMultipartUpload("big/object", "application/zip")
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload() error = %v", err)
+	}
+	uploadId := aws.StringValue(created.UploadId)
+
+	// More parts than one compose request accepts
+	var parts []*s3.CompletedPart
+	var want strings.Builder
+	for i := 1; i <= 40; i++ {
+		body := fmt.Sprintf("part %02d;", i)
+		want.WriteString(body)
+
+		out, err := p.UploadPart("big/object", uploadId, int64(i), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("UploadPart() error = %v", err)
+		}
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(int64(i)), ETag: out.ETag})
+	}
+
+	uploads, err := p.ListMultipartUploads("big/", "", 0)
+	if err != nil || len(uploads.Uploads) != 1 || aws.StringValue(uploads.Uploads[0].Key) != "big/object" {
+		t.Fatalf("ListMultipartUploads() = %v, %v, want one upload", uploads, err)
+	}
+
+	done, err := p.CompleteMultipartUpload("big/object", uploadId, parts)
+	if err != nil {
+		t.Fatalf("CompleteMultipartUpload() error = %v", err)
+	}
+	if f.composes != 3 {
+		t.Errorf("compose requests = %d, want 3", f.composes)
+	}
+
+	if got := getString(t, p, "big/object", ""); got != want.String() {
+		t.Errorf("Get() = %q", got)
+	}
+
+	head, _ := p.Head("big/object")
+	if aws.StringValue(head.ETag) != aws.StringValue(done.ETag) || !strings.HasSuffix(aws.StringValue(done.ETag), `-40"`) {
+		t.Errorf("Head() ETag = %s, completion ETag = %s, want matching multipart ETags",
+			aws.StringValue(head.ETag), aws.StringValue(done.ETag))
+	}
+	if aws.StringValue(head.ContentType) != "application/zip" {
+		t.Errorf("Head() ContentType = %q, want application/zip", aws.StringValue(head.ContentType))
+	}
+
+	// Only the assembled object remains
+	if len(f.objects) != 1 {
+		t.Errorf("bucket holds %d objects after completion, want 1", len(f.objects))
+	}
+}
+
+func TestValidateSite_GCS(t *testing.T) {
+	tests := []struct {
+		name    string
+		site    Site
+		wantErr bool
+	}{
+		{name: "credentials", site: Site{GCS: &GCSConfig{CredentialsFile: "/etc/key.json"}, AWSBucket: "b"}},
+		{name: "emulator", site: Site{GCS: &GCSConfig{Endpoint: "http://localhost:4443", Bucket: "b"}}},
+		{name: "no settings", site: Site{AWSBucket: "b"}, wantErr: true},
+		{name: "no credentials", site: Site{GCS: &GCSConfig{}, AWSBucket: "b"}, wantErr: true},
+		{name: "no bucket", site: Site{GCS: &GCSConfig{CredentialsFile: "/etc/key.json"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.site.Type = "gcs"
+			if err := tt.site.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -6,11 +6,14 @@ require (
 	github.com/aws/aws-sdk-go v1.55.8
 	github.com/fsnotify/fsnotify v1.9.0
 	github.com/gorilla/handlers v1.5.2
+	github.com/pkg/sftp v1.13.6
+	golang.org/x/crypto v0.14.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/felixge/httpsnoop v1.0.3 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 )
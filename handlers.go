@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"encoding/xml"
 	"io"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -143,6 +145,12 @@ func NewProxyHandler(proxy S3Proxy, prefix string, bucketName string) http.Handl
 		// Extract key from path for regular operations
 		key := extractKeyFromPath(r.URL.Path, bucketName)
 
+		// Migration progress: GET on the bucket with ?migration
+		if _, hasMigration := query["migration"]; hasMigration && key == "" && r.Method == http.MethodGet {
+			handleMigrationStatus(proxy, w)
+			return
+		}
+
 		// Apply prefix if configured
 		if prefix != "" {
 			if key != "" {
@@ -159,6 +167,18 @@ func NewProxyHandler(proxy S3Proxy, prefix string, bucketName string) http.Handl
 		case http.MethodPut:
 			handlePut(proxy, key, w, r)
 		case http.MethodPost:
+			// RestoreObject: POST with ?restore
+			if _, hasRestore := query["restore"]; hasRestore {
+				handleRestore(proxy, key, w, r)
+				return
+			}
+
+			// SelectObjectContent: POST with ?select&select-type=2
+			if _, hasSelect := query["select"]; hasSelect && query.Get("select-type") == "2" {
+				handleSelect(proxy, key, w, r)
+				return
+			}
+
 			// POST without multipart params - treat as regular PUT
 			handlePut(proxy, key, w, r)
 		case http.MethodDelete:
@@ -174,11 +194,18 @@ func handleGet(proxy S3Proxy, key string, w http.ResponseWriter, r *http.Request
 	// Get Range header for partial content requests
 	rangeHeader := r.Header.Get("Range")
 
-	obj, err := proxy.Get(key, rangeHeader)
+	var obj *s3.GetObjectOutput
+	var err error
+	if cg, ok := proxy.(ClientGetter); ok {
+		obj, err = cg.GetForClient(clientAddress(r), key, rangeHeader)
+	} else {
+		obj, err = proxy.Get(key, rangeHeader)
+	}
 	if err != nil {
 		handleS3Error(w, err)
 		return
 	}
+	defer obj.Body.Close()
 
 	// Set headers BEFORE WriteHeader
 	setHeader(w, "Cache-Control", s2s(obj.CacheControl))
@@ -191,6 +218,9 @@ func handleGet(proxy S3Proxy, key string, w http.ResponseWriter, r *http.Request
 	setHeader(w, "ETag", s2s(obj.ETag))
 	setHeader(w, "Expires", s2s(obj.Expires))
 	setHeader(w, "Last-Modified", t2s(obj.LastModified))
+	setHeader(w, "x-amz-restore", s2s(obj.Restore))
+	setHeader(w, "x-amz-storage-class", s2s(obj.StorageClass))
+	setHeader(w, "x-amz-version-id", s2s(obj.VersionId))
 
 	// If Range was requested and we got partial content, return 206
 	if rangeHeader != "" && obj.ContentRange != nil {
@@ -212,20 +242,36 @@ func handlePut(proxy S3Proxy, key string, w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Read request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
-	}
-
 	contentType := r.Header.Get("Content-Type")
 	if contentType == "" {
 		contentType = "application/octet-stream"
 	}
 
-	// Put object to S3
-	result, err := proxy.Put(key, bytes.NewReader(body), contentType)
+	// Put object to S3, atomically for create-only writes when the backend
+	// supports it rather than relying on the HEAD check above alone. Other
+	// writes are streamed to backends that take the body as it arrives.
+	var result *s3.PutObjectOutput
+	var err error
+	cp, conditional := proxy.(ConditionalPutter)
+	conditional = conditional && r.Header.Get("If-None-Match") == "*"
+	if sp, ok := proxy.(StreamPutter); ok && !conditional {
+		result, err = sp.PutStream(key, r.Body, r.ContentLength, contentType)
+	} else {
+		// Read request body
+		body, readErr := io.ReadAll(r.Body)
+		if readErr != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		if conditional {
+			result, err = cp.PutIfAbsent(key, bytes.NewReader(body), contentType)
+		}
+		if !conditional || isNotImplemented(err) {
+			// Without an atomic create, the HEAD check above is all there is
+			result, err = proxy.Put(key, bytes.NewReader(body), contentType)
+		}
+	}
 	if err != nil {
 		handleS3Error(w, err)
 		return
@@ -235,6 +281,7 @@ func handlePut(proxy S3Proxy, key string, w http.ResponseWriter, r *http.Request
 	if result.ETag != nil {
 		w.Header().Set("ETag", *result.ETag)
 	}
+	setHeader(w, "x-amz-version-id", s2s(result.VersionId))
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -256,6 +303,69 @@ func handleDelete(proxy S3Proxy, key string, w http.ResponseWriter, r *http.Requ
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func handleRestore(proxy S3Proxy, key string, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	type RestoreRequest struct {
+		XMLName              xml.Name `xml:"RestoreRequest"`
+		Days                 int64    `xml:"Days"`
+		GlacierJobParameters struct {
+			Tier string `xml:"Tier"`
+		} `xml:"GlacierJobParameters"`
+	}
+
+	var restore RestoreRequest
+	if len(body) > 0 {
+		if err := xml.Unmarshal(body, &restore); err != nil {
+			writeS3Error(w, "MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// S3 requires Days for restores of archived objects
+	if restore.Days <= 0 {
+		writeS3Error(w, "InvalidArgument", "Days must be a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	// 202 Accepted signals that the restore has been initiated, and 200 OK
+	// that a restored copy is already available, which the restore only
+	// keeps for longer
+	status := http.StatusAccepted
+	if head, err := proxy.Head(key); err == nil && isRestored(head.Restore) {
+		status = http.StatusOK
+	}
+
+	_, err = proxy.RestoreObject(key, restore.Days, restore.GlacierJobParameters.Tier)
+	if err != nil {
+		handleS3Error(w, err)
+		return
+	}
+
+	w.WriteHeader(status)
+}
+
+// isRestored reports whether an x-amz-restore header value describes a
+// finished restore
+func isRestored(restore *string) bool {
+	return strings.Contains(aws.StringValue(restore), `ongoing-request="false"`)
+}
+
+func handleMigrationStatus(proxy S3Proxy, w http.ResponseWriter) {
+	status, ok := migrationStatus(proxy)
+	if !ok {
+		handleS3Error(w, errNotImplemented("Migration status"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
 func handleCreateMultipartUpload(proxy S3Proxy, r *http.Request, w http.ResponseWriter, bucketName string) {
 	key := extractKeyFromPath(r.URL.Path, bucketName)
 	contentType := r.Header.Get("Content-Type")
@@ -681,6 +791,15 @@ func challenge(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "", http.StatusUnauthorized)
 }
 
+// clientAddress returns the IP address of the client making r
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func getHost(r *http.Request) string {
 	host := r.Header.Get("Host")
 	if host == "" {
@@ -723,6 +842,20 @@ func setHeader(w http.ResponseWriter, key, value string) {
 // handleS3Error properly maps AWS S3 errors to HTTP status codes
 // and passes through the original S3 error status codes (like 403 for SignatureDoesNotMatch)
 func handleS3Error(w http.ResponseWriter, err error) {
+	// Archived objects must be restored before they can be read; S3 reports
+	// this as a 403 with an XML body that clients such as the AWS CLI parse
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeInvalidObjectState {
+		writeS3Error(w, awsErr.Code(), awsErr.Message(), http.StatusForbidden)
+		return
+	}
+
+	// Writes against read-only backends get the same XML error S3 returns
+	// for unsupported methods, so SDKs surface the code instead of a parse error
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "MethodNotAllowed" {
+		writeS3Error(w, awsErr.Code(), awsErr.Message(), http.StatusMethodNotAllowed)
+		return
+	}
+
 	// Check if it's an AWS RequestFailure (has HTTP status code)
 	if reqErr, ok := err.(awserr.RequestFailure); ok {
 		statusCode := reqErr.StatusCode()
@@ -750,3 +883,20 @@ func handleS3Error(w http.ResponseWriter, err error) {
 	// Non-AWS error
 	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
+
+// writeS3Error writes an S3-style XML error document with the given status
+func writeS3Error(w http.ResponseWriter, code string, message string, statusCode int) {
+	type Error struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	w.Write([]byte(xml.Header))
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	encoder.Encode(Error{Code: code, Message: message})
+}
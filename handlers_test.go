@@ -1,9 +1,17 @@
 package main
 
 import (
+	"encoding/xml"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 func TestGetHost(t *testing.T) {
@@ -84,3 +92,322 @@ func TestHostDispatchingHandler(t *testing.T) {
 	}
 }
 
+// stubProxy embeds S3Proxy so tests only need to implement the methods they exercise
+type stubProxy struct {
+	S3Proxy
+	restoreKey  string
+	restoreDays int64
+	restoreTier string
+	restoreErr  error
+	restored    bool
+	object      *s3.GetObjectOutput
+	getErr      error
+}
+
+func (p *stubProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	if p.getErr != nil {
+		return nil, p.getErr
+	}
+	out := *p.object
+	out.Body = io.NopCloser(strings.NewReader("content"))
+	return &out, nil
+}
+
+func (p *stubProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	out := &s3.HeadObjectOutput{StorageClass: aws.String(s3.StorageClassGlacier)}
+	if p.restored {
+		out.Restore = aws.String(`ongoing-request="false", expiry-date="Fri, 23 Dec 2012 00:00:00 GMT"`)
+	}
+	return out, nil
+}
+
+func (p *stubProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	p.restoreKey, p.restoreDays, p.restoreTier = key, days, tier
+	if p.restoreErr != nil {
+		return nil, p.restoreErr
+	}
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func TestHandleRestore(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		restoreErr error
+		restored   bool
+		wantStatus int
+		wantDays   int64
+		wantTier   string
+	}{
+		{
+			name:       "days and tier",
+			body:       `<RestoreRequest><Days>3</Days><GlacierJobParameters><Tier>Bulk</Tier></GlacierJobParameters></RestoreRequest>`,
+			wantStatus: http.StatusAccepted,
+			wantDays:   3,
+			wantTier:   "Bulk",
+		},
+		{
+			name:       "already restored",
+			body:       `<RestoreRequest><Days>2</Days></RestoreRequest>`,
+			restored:   true,
+			wantStatus: http.StatusOK,
+			wantDays:   2,
+		},
+		{
+			name:       "missing days",
+			body:       `<RestoreRequest></RestoreRequest>`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "malformed xml",
+			body:       `<RestoreRequest>`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "already in progress",
+			body:       `<RestoreRequest><Days>1</Days></RestoreRequest>`,
+			restoreErr: awserr.NewRequestFailure(awserr.New("RestoreAlreadyInProgress", "in progress", nil), http.StatusConflict, ""),
+			wantStatus: http.StatusConflict,
+			wantDays:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := &stubProxy{restoreErr: tt.restoreErr, restored: tt.restored}
+			handler := NewProxyHandler(proxy, "snapshots", "bucket")
+
+			req := httptest.NewRequest("POST", "/bucket/cold/object?restore", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("handler returned status %v, want %v", rr.Code, tt.wantStatus)
+			}
+			if proxy.restoreDays != tt.wantDays || proxy.restoreTier != tt.wantTier {
+				t.Errorf("RestoreObject() got days=%d tier=%q, want days=%d tier=%q",
+					proxy.restoreDays, proxy.restoreTier, tt.wantDays, tt.wantTier)
+			}
+			if tt.wantDays > 0 && proxy.restoreKey != "snapshots/cold/object" {
+				t.Errorf("RestoreObject() key = %q, want %q", proxy.restoreKey, "snapshots/cold/object")
+			}
+		})
+	}
+}
+
+func TestHandleS3Error_InvalidObjectState(t *testing.T) {
+	err := awserr.New(s3.ErrCodeInvalidObjectState, "The operation is not valid for the object's storage class", nil)
+	rr := httptest.NewRecorder()
+
+	handleS3Error(rr, err)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("handleS3Error() status = %v, want %v", rr.Code, http.StatusForbidden)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/xml" {
+		t.Errorf("handleS3Error() Content-Type = %q, want application/xml", ct)
+	}
+	if !strings.Contains(rr.Body.String(), "<Code>InvalidObjectState</Code>") {
+		t.Errorf("handleS3Error() body = %q, want InvalidObjectState code", rr.Body.String())
+	}
+}
+
+func TestHandleGet_ArchiveHeaders(t *testing.T) {
+	tests := []struct {
+		name             string
+		object           *s3.GetObjectOutput
+		getErr           error
+		wantStatus       int
+		wantRestore      string
+		wantStorageClass string
+		wantVersionID    string
+	}{
+		{
+			name:       "archived",
+			getErr:     awserr.New(s3.ErrCodeInvalidObjectState, "The operation is not valid for the object's storage class", nil),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "restoring",
+			object: &s3.GetObjectOutput{
+				Restore:      aws.String(`ongoing-request="true"`),
+				StorageClass: aws.String(s3.StorageClassGlacier),
+				VersionId:    aws.String("v1"),
+			},
+			wantStatus:       http.StatusOK,
+			wantRestore:      `ongoing-request="true"`,
+			wantStorageClass: s3.StorageClassGlacier,
+			wantVersionID:    "v1",
+		},
+		{
+			name: "restored",
+			object: &s3.GetObjectOutput{
+				Restore:      aws.String(`ongoing-request="false", expiry-date="Fri, 23 Dec 2026 00:00:00 GMT"`),
+				StorageClass: aws.String(s3.StorageClassDeepArchive),
+				VersionId:    aws.String("v2"),
+			},
+			wantStatus:       http.StatusOK,
+			wantRestore:      `ongoing-request="false", expiry-date="Fri, 23 Dec 2026 00:00:00 GMT"`,
+			wantStorageClass: s3.StorageClassDeepArchive,
+			wantVersionID:    "v2",
+		},
+		{
+			name:       "standard",
+			object:     &s3.GetObjectOutput{},
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			t.Run(tt.name+"/"+method, func(t *testing.T) {
+				handler := NewProxyHandler(&stubProxy{object: tt.object, getErr: tt.getErr}, "", "bucket")
+
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest(method, "/bucket/cold/object", nil))
+
+				if rr.Code != tt.wantStatus {
+					t.Errorf("handler returned status %v, want %v", rr.Code, tt.wantStatus)
+				}
+				headers := map[string]string{
+					"x-amz-restore":       tt.wantRestore,
+					"x-amz-storage-class": tt.wantStorageClass,
+					"x-amz-version-id":    tt.wantVersionID,
+				}
+				for name, want := range headers {
+					if got := rr.Header().Get(name); got != want {
+						t.Errorf("%s = %q, want %q", name, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestProxyHandler_MemoryBackend drives the full handler stack against the
+// in-memory backend, so the S3 API surface is covered without live storage
+func TestProxyHandler_MemoryBackend(t *testing.T) {
+	handler, err := createSiteHandler(Site{Type: "memory", AWSBucket: "bucket"})
+	if err != nil {
+		t.Fatalf("createSiteHandler() error = %v", err)
+	}
+
+	do := func(method, target, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	steps := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		header     http.Header
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "put", method: "PUT", target: "/bucket/docs/a.txt", body: "alpha", wantStatus: http.StatusOK},
+		{name: "put nested", method: "PUT", target: "/bucket/docs/sub/b.txt", body: "beta", wantStatus: http.StatusOK},
+		{name: "get", method: "GET", target: "/bucket/docs/a.txt", wantStatus: http.StatusOK, wantBody: "alpha"},
+		{name: "range", method: "GET", target: "/bucket/docs/a.txt", header: http.Header{"Range": {"bytes=1-2"}}, wantStatus: http.StatusPartialContent, wantBody: "lp"},
+		{name: "head", method: "HEAD", target: "/bucket/docs/a.txt", wantStatus: http.StatusOK},
+		{name: "missing", method: "GET", target: "/bucket/nope", wantStatus: http.StatusNotFound},
+		{name: "create only", method: "PUT", target: "/bucket/docs/a.txt", header: http.Header{"If-None-Match": {"*"}}, wantStatus: http.StatusPreconditionFailed},
+		{name: "list", method: "GET", target: "/bucket?list-type=2&prefix=docs/&delimiter=/", wantStatus: http.StatusOK, wantBody: "<Prefix>docs/sub/</Prefix>"},
+		{name: "restore", method: "POST", target: "/bucket/docs/a.txt?restore", body: "<RestoreRequest><Days>1</Days></RestoreRequest>", wantStatus: http.StatusForbidden},
+		{name: "delete", method: "DELETE", target: "/bucket/docs/a.txt", wantStatus: http.StatusNoContent},
+		{name: "deleted", method: "GET", target: "/bucket/docs/a.txt", wantStatus: http.StatusNotFound},
+	}
+
+	for _, step := range steps {
+		rr := do(step.method, step.target, step.body, step.header)
+		if rr.Code != step.wantStatus {
+			t.Fatalf("%s: status = %v, want %v (body %q)", step.name, rr.Code, step.wantStatus, rr.Body.String())
+		}
+		if step.wantBody != "" && !strings.Contains(rr.Body.String(), step.wantBody) {
+			t.Errorf("%s: body = %q, want %q", step.name, rr.Body.String(), step.wantBody)
+		}
+	}
+
+	// Multipart upload round trip
+	rr := do("POST", "/bucket/big.bin?uploads", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("CreateMultipartUpload status = %v", rr.Code)
+	}
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(rr.Body.Bytes(), &initiated); err != nil || initiated.UploadId == "" {
+		t.Fatalf("CreateMultipartUpload body = %q, err = %v", rr.Body.String(), err)
+	}
+
+	complete := "<CompleteMultipartUpload>"
+	for i, part := range []string{"first ", "second"} {
+		target := fmt.Sprintf("/bucket/big.bin?uploadId=%s&partNumber=%d", initiated.UploadId, i+1)
+		rr := do("PUT", target, part, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("UploadPart status = %v, body %q", rr.Code, rr.Body.String())
+		}
+		complete += fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, rr.Header().Get("ETag"))
+	}
+	complete += "</CompleteMultipartUpload>"
+
+	rr = do("POST", "/bucket/big.bin?uploadId="+initiated.UploadId, complete, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("CompleteMultipartUpload status = %v, body %q", rr.Code, rr.Body.String())
+	}
+
+	rr = do("GET", "/bucket/big.bin", "", nil)
+	if rr.Body.String() != "first second" {
+		t.Errorf("GET after multipart = %q, want %q", rr.Body.String(), "first second")
+	}
+}
+
+// conditionalStub is a backend whose only create-only check is PutIfAbsent,
+// as if a concurrent writer created the key after the HEAD check
+type conditionalStub struct {
+	S3Proxy
+	puts, conditionalPuts int
+}
+
+func (p *conditionalStub) Head(key string) (*s3.HeadObjectOutput, error) {
+	return nil, errNoSuchKey(key)
+}
+
+func (p *conditionalStub) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	p.puts++
+	return &s3.PutObjectOutput{ETag: aws.String(`"etag"`)}, nil
+}
+
+func (p *conditionalStub) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	p.conditionalPuts++
+	return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "exists", nil), http.StatusPreconditionFailed, "")
+}
+
+func TestHandlePut_ConditionalPutter(t *testing.T) {
+	proxy := &conditionalStub{}
+	handler := NewProxyHandler(proxy, "", "bucket")
+
+	req := httptest.NewRequest("PUT", "/bucket/key", strings.NewReader("body"))
+	req.Header.Set("If-None-Match", "*")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusPreconditionFailed || proxy.conditionalPuts != 1 || proxy.puts != 0 {
+		t.Errorf("create-only PUT returned %v with %d conditional and %d plain puts, want 412 via PutIfAbsent",
+			rr.Code, proxy.conditionalPuts, proxy.puts)
+	}
+
+	req = httptest.NewRequest("PUT", "/bucket/key", strings.NewReader("body"))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || proxy.puts != 1 {
+		t.Errorf("unconditional PUT returned %v with %d plain puts, want 200 via Put", rr.Code, proxy.puts)
+	}
+}
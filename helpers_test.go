@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeProxy is the memory backend behind the tests of proxies wrapping a
+// backend. It records the requests reaching it, and can be made to fail,
+// hold or slow down requests, and to return more headers.
+type fakeProxy struct {
+	*MemoryProxy
+
+	// Set before the proxy is used
+	failPart  int64         // UploadPart of this part number fails
+	partSize  int64         // reported by PartSize, unknown if 0
+	headDelay time.Duration // added to every HEAD
+	archived  bool          // GETs and HEADs have an archived, versioned object's headers
+	open      chan struct{} // if set, GETs and HEADs wait until it is closed
+
+	mu    sync.Mutex
+	down  bool
+	gets  []fakeGet
+	heads int
+	puts  int
+	parts int
+}
+
+type fakeGet struct {
+	key         string
+	rangeHeader string // "" for whole objects
+}
+
+func newFakeProxy() *fakeProxy {
+	return &fakeProxy{MemoryProxy: NewMemoryProxy(0, 0, nil)}
+}
+
+// holdReads makes GETs and HEADs wait until releaseReads is called
+func (p *fakeProxy) holdReads() {
+	p.open = make(chan struct{})
+}
+
+func (p *fakeProxy) releaseReads() {
+	close(p.open)
+}
+
+// setDown makes every request fail while down is set
+func (p *fakeProxy) setDown(down bool) {
+	p.mu.Lock()
+	p.down = down
+	p.mu.Unlock()
+}
+
+func (p *fakeProxy) check() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.down {
+		return awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "down", nil), http.StatusServiceUnavailable, "")
+	}
+	return nil
+}
+
+func (p *fakeProxy) wait() {
+	if p.open != nil {
+		<-p.open
+	}
+}
+
+// started returns the number of GETs that reached the backend
+func (p *fakeProxy) started() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.gets)
+}
+
+// reads returns and resets the range headers of the recorded GETs
+func (p *fakeProxy) reads() []string {
+	return p.readsUnder("")
+}
+
+// readsUnder returns the range headers of the recorded GETs of keys
+// starting with prefix, and resets the recorded GETs
+func (p *fakeProxy) readsUnder(prefix string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var ranges []string
+	for _, g := range p.gets {
+		if strings.HasPrefix(g.key, prefix) {
+			ranges = append(ranges, g.rangeHeader)
+		}
+	}
+	p.gets = nil
+	return ranges
+}
+
+// calls returns and resets the numbers of GETs and HEADs
+func (p *fakeProxy) calls() (int, int) {
+	gets := len(p.reads())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	heads := p.heads
+	p.heads = 0
+	return gets, heads
+}
+
+func (p *fakeProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.gets = append(p.gets, fakeGet{key: key, rangeHeader: rangeHeader})
+	p.mu.Unlock()
+
+	out, err := p.MemoryProxy.Get(key, rangeHeader)
+	p.wait()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.archived {
+		out.CacheControl = aws.String("max-age=60")
+		out.ContentEncoding = aws.String("gzip")
+		out.Metadata = map[string]*string{"Owner": aws.String("alice")}
+		out.Restore = aws.String(`ongoing-request="false"`)
+		out.StorageClass = aws.String(s3.StorageClassGlacier)
+		out.VersionId = aws.String("v1")
+	}
+	return out, nil
+}
+
+func (p *fakeProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.heads++
+	p.mu.Unlock()
+
+	time.Sleep(p.headDelay)
+	out, err := p.MemoryProxy.Head(key)
+	p.wait()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.archived {
+		out.CacheControl = aws.String("max-age=60")
+		out.ContentEncoding = aws.String("gzip")
+		out.Metadata = map[string]*string{"Owner": aws.String("alice")}
+		out.Restore = aws.String(`ongoing-request="false"`)
+		out.StorageClass = aws.String(s3.StorageClassGlacier)
+		out.VersionId = aws.String("v1")
+	}
+	return out, nil
+}
+
+func (p *fakeProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p.MemoryProxy.ListObjects(prefix, delimiter, maxKeys, continuationToken)
+}
+
+func (p *fakeProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.puts++
+	p.mu.Unlock()
+	return p.MemoryProxy.Put(key, body, contentType)
+}
+
+func (p *fakeProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p.MemoryProxy.Delete(key)
+}
+
+func (p *fakeProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	if partNumber == p.failPart {
+		return nil, errors.New("part upload failed")
+	}
+
+	p.mu.Lock()
+	p.parts++
+	p.mu.Unlock()
+	return p.MemoryProxy.UploadPart(key, uploadId, partNumber, body)
+}
+
+// PartSize reports the part size set on the proxy
+func (p *fakeProxy) PartSize(key string) (int64, error) {
+	if p.partSize == 0 {
+		return 0, errNotImplemented("Part sizes")
+	}
+	return p.partSize, nil
+}
+
+// conditionalProxy adds an atomic create to a fake backend
+type conditionalProxy struct {
+	*fakeProxy
+	createMu sync.Mutex
+}
+
+func (p *conditionalProxy) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	p.createMu.Lock()
+	defer p.createMu.Unlock()
+
+	if _, err := p.MemoryProxy.Head(key); !isNotFound(err) {
+		if err == nil {
+			err = errPreconditionFailed()
+		}
+		return nil, err
+	}
+	return p.Put(key, body, contentType)
+}
+
+// checkNoAtomicCreate checks that p leaves create-only writes to handlePut
+// when there is no atomic create behind it, without writing to backends
+func checkNoAtomicCreate(t *testing.T, p ConditionalPutter, backends ...S3Proxy) {
+	t.Helper()
+
+	if _, err := p.PutIfAbsent("created", strings.NewReader("body"), "text/plain"); !isNotImplemented(err) {
+		t.Errorf("PutIfAbsent() without an atomic create error = %v, want NotImplemented", err)
+	}
+	for i, b := range backends {
+		if _, err := b.Head("created"); !isNotFound(err) {
+			t.Errorf("PutIfAbsent() without an atomic create wrote to backend %d", i)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// httpOriginKeyPlaceholder is replaced by the escaped object key in URL templates
+const httpOriginKeyPlaceholder = "{key}"
+
+func init() {
+	RegisterBackend("http", validateHTTPOriginSite, func(s Site) (S3Proxy, error) {
+		return NewHTTPOriginProxy(*s.HTTP), nil
+	})
+}
+
+// HTTPOriginConfig configures the read-only HTTP origin backend. URLTemplate
+// maps a key to the URL it is fetched from, e.g.
+// "https://mirror.example.com/pub/{key}". Headers are added to every origin
+// request, for example to authenticate against the origin.
+type HTTPOriginConfig struct {
+	URLTemplate string            `json:"urlTemplate" yaml:"urlTemplate"`
+	Headers     map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Website     *WebsiteConfig    `json:"website,omitempty" yaml:"website,omitempty"`
+}
+
+func validateHTTPOriginSite(s Site) error {
+	if s.HTTP == nil || s.HTTP.URLTemplate == "" {
+		return errors.New("HTTP urlTemplate not specified")
+	}
+
+	if !strings.Contains(s.HTTP.URLTemplate, httpOriginKeyPlaceholder) {
+		return errors.New("HTTP urlTemplate must contain " + httpOriginKeyPlaceholder)
+	}
+
+	u, err := url.Parse(strings.ReplaceAll(s.HTTP.URLTemplate, httpOriginKeyPlaceholder, "key"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid HTTP urlTemplate %q", s.HTTP.URLTemplate)
+	}
+
+	return nil
+}
+
+// HTTPOriginProxy is a read-only S3Proxy serving objects from a plain HTTP
+// origin. Writes fail with MethodNotAllowed and listing is not supported,
+// since origins have no portable way to enumerate their files.
+type HTTPOriginProxy struct {
+	client   *http.Client
+	template string
+	headers  map[string]string
+	website  *WebsiteConfig
+}
+
+func NewHTTPOriginProxy(cfg HTTPOriginConfig) *HTTPOriginProxy {
+	return &HTTPOriginProxy{
+		client:   http.DefaultClient,
+		template: cfg.URLTemplate,
+		headers:  cfg.Headers,
+		website:  cfg.Website,
+	}
+}
+
+func (p *HTTPOriginProxy) request(method string, key string, rangeHeader string) (*http.Response, error) {
+	if key == "" {
+		return nil, errNoSuchKey(key)
+	}
+
+	req, err := http.NewRequest(method, strings.ReplaceAll(p.template, httpOriginKeyPlaceholder, escapeKey(key)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+
+	// Transparent decompression would change lengths and break ranges
+	req.Header.Set("Accept-Encoding", "identity")
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, httpOriginError(resp.StatusCode, key)
+	}
+
+	return resp, nil
+}
+
+// httpOriginError maps an origin status code to the error S3 would return
+func httpOriginError(status int, key string) error {
+	switch status {
+	case http.StatusNotFound, http.StatusGone:
+		return errNoSuchKey(key)
+	case http.StatusRequestedRangeNotSatisfiable:
+		return awserr.NewRequestFailure(
+			awserr.New("InvalidRange", "The requested range is not satisfiable", nil),
+			http.StatusRequestedRangeNotSatisfiable, "")
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return awserr.NewRequestFailure(
+			awserr.New("AccessDenied", "Access Denied", nil),
+			http.StatusForbidden, "")
+	}
+
+	// Anything else is the origin failing rather than the request
+	return awserr.NewRequestFailure(
+		awserr.New("BadGateway", fmt.Sprintf("The origin returned status %d", status), nil),
+		http.StatusBadGateway, "")
+}
+
+// httpOriginETag converts an origin ETag to the strong, quoted form S3 uses
+func httpOriginETag(etag string) *string {
+	etag = strings.TrimPrefix(etag, "W/")
+	if etag == "" {
+		return nil
+	}
+	return aws.String(`"` + strings.Trim(etag, `"`) + `"`)
+}
+
+func optionalHeader(h http.Header, name string) *string {
+	if v := h.Get(name); v != "" {
+		return aws.String(v)
+	}
+	return nil
+}
+
+func (p *HTTPOriginProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	resp, err := p.request(http.MethodGet, key, rangeHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &s3.GetObjectOutput{
+		AcceptRanges:       aws.String("bytes"),
+		Body:               resp.Body,
+		CacheControl:       optionalHeader(resp.Header, "Cache-Control"),
+		ContentDisposition: optionalHeader(resp.Header, "Content-Disposition"),
+		ContentEncoding:    optionalHeader(resp.Header, "Content-Encoding"),
+		ContentLanguage:    optionalHeader(resp.Header, "Content-Language"),
+		ContentType:        optionalHeader(resp.Header, "Content-Type"),
+		ETag:               httpOriginETag(resp.Header.Get("ETag")),
+		Expires:            optionalHeader(resp.Header, "Expires"),
+		LastModified:       parseHTTPTime(resp.Header.Get("Last-Modified")),
+	}
+	if resp.ContentLength >= 0 {
+		out.ContentLength = aws.Int64(resp.ContentLength)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		out.ContentRange = optionalHeader(resp.Header, "Content-Range")
+
+	case rangeHeader != "" && resp.ContentLength >= 0:
+		// The origin ignored the range, so skip to it in the full body
+		start, end, err := parseByteRange(rangeHeader, resp.ContentLength)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+
+		if _, err := io.CopyN(io.Discard, resp.Body, start); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+
+		out.ContentLength = aws.Int64(end - start + 1)
+		out.ContentRange = aws.String(contentRange(start, end, resp.ContentLength))
+		out.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(resp.Body, end-start+1), resp.Body}
+	}
+
+	return out, nil
+}
+
+func (p *HTTPOriginProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	resp, err := p.request(http.MethodHead, key, "")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	out := &s3.HeadObjectOutput{
+		AcceptRanges:       aws.String("bytes"),
+		CacheControl:       optionalHeader(resp.Header, "Cache-Control"),
+		ContentDisposition: optionalHeader(resp.Header, "Content-Disposition"),
+		ContentEncoding:    optionalHeader(resp.Header, "Content-Encoding"),
+		ContentLanguage:    optionalHeader(resp.Header, "Content-Language"),
+		ContentType:        optionalHeader(resp.Header, "Content-Type"),
+		ETag:               httpOriginETag(resp.Header.Get("ETag")),
+		Expires:            optionalHeader(resp.Header, "Expires"),
+		LastModified:       parseHTTPTime(resp.Header.Get("Last-Modified")),
+	}
+
+	// HEAD responses have no body, so the length comes from the header
+	if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		out.ContentLength = aws.Int64(n)
+	}
+
+	return out, nil
+}
+
+func (p *HTTPOriginProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	return nil, errMethodNotAllowed()
+}
+
+func (p *HTTPOriginProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	return nil, errMethodNotAllowed()
+}
+
+func (p *HTTPOriginProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	return nil, errNotImplemented("ListObjects")
+}
+
+func (p *HTTPOriginProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	return nil, errMethodNotAllowed()
+}
+
+func (p *HTTPOriginProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	return nil, errMethodNotAllowed()
+}
+
+func (p *HTTPOriginProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	return nil, errMethodNotAllowed()
+}
+
+func (p *HTTPOriginProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	return nil, errMethodNotAllowed()
+}
+
+// ListMultipartUploads reports no uploads, as none can ever be in progress
+func (p *HTTPOriginProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	out := listUploads(nil, prefix, delimiter, maxUploads)
+	out.Prefix = aws.String(prefix)
+	return out, nil
+}
+
+func (p *HTTPOriginProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	return p.website.output()
+}
+
+func (p *HTTPOriginProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	if _, err := p.Head(key); err != nil {
+		return nil, err
+	}
+
+	return nil, errObjectAlreadyInActiveTier()
+}
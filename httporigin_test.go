@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// newTestOrigin serves files like a static file server. Paths under
+// /norange/ ignore Range headers, as some legacy servers do.
+func newTestOrigin(t *testing.T, files map[string]string) *httptest.Server {
+	t.Helper()
+
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer origin-token" {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/pub/")
+		body, ok := files[strings.TrimPrefix(name, "norange/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if strings.HasPrefix(name, "norange/") {
+			r.Header.Del("Range")
+		}
+
+		w.Header().Set("ETag", `W/"v1"`)
+		http.ServeContent(w, r, name, modified, strings.NewReader(body))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func newTestHTTPOriginProxy(t *testing.T, files map[string]string) *HTTPOriginProxy {
+	t.Helper()
+
+	origin := newTestOrigin(t, files)
+	return NewHTTPOriginProxy(HTTPOriginConfig{
+		URLTemplate: origin.URL + "/pub/{key}",
+		Headers:     map[string]string{"Authorization": "Bearer origin-token"},
+	})
+}
+
+func TestHTTPOriginProxy_Get(t *testing.T) {
+	p := newTestHTTPOriginProxy(t, map[string]string{
+		"releases/app v1.txt": "0123456789",
+	})
+
+	tests := []struct {
+		name      string
+		key       string
+		rng       string
+		want      string
+		wantRange string
+	}{
+		{name: "full", key: "releases/app v1.txt", want: "0123456789"},
+		{name: "range", key: "releases/app v1.txt", rng: "bytes=2-4", want: "234", wantRange: "bytes 2-4/10"},
+		{name: "range ignored by origin", key: "norange/releases/app v1.txt", rng: "bytes=-3", want: "789", wantRange: "bytes 7-9/10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj, err := p.Get(tt.key, tt.rng)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			obj.Body.Close()
+
+			if got := getString(t, p, tt.key, tt.rng); got != tt.want {
+				t.Errorf("Get() = %q, want %q", got, tt.want)
+			}
+			if got := aws.StringValue(obj.ContentRange); got != tt.wantRange {
+				t.Errorf("ContentRange = %q, want %q", got, tt.wantRange)
+			}
+			if aws.Int64Value(obj.ContentLength) != int64(len(tt.want)) {
+				t.Errorf("ContentLength = %d, want %d", aws.Int64Value(obj.ContentLength), len(tt.want))
+			}
+			if aws.StringValue(obj.ETag) != `"v1"` {
+				t.Errorf("ETag = %s, want strong quoted ETag", aws.StringValue(obj.ETag))
+			}
+		})
+	}
+
+	head, err := p.Head("releases/app v1.txt")
+	if err != nil {
+		t.Fatalf("Head() error = %v", err)
+	}
+	if aws.Int64Value(head.ContentLength) != 10 || head.LastModified == nil || head.LastModified.Year() != 2024 {
+		t.Errorf("Head() = %v", head)
+	}
+
+	if _, err := p.Get("missing", ""); !isNotFound(err) {
+		t.Errorf("Get() of missing key error = %v, want not found", err)
+	}
+	if _, err := p.Get("releases/app v1.txt", "bytes=20-"); err == nil {
+		t.Error("Get() with unsatisfiable range should fail")
+	}
+}
+
+func TestHTTPOriginProxy_ReadOnly(t *testing.T) {
+	origin := newTestOrigin(t, map[string]string{"file": "data"})
+	handler, err := createSiteHandler(Site{
+		Type:      "http",
+		AWSBucket: "bucket",
+		HTTP: &HTTPOriginConfig{
+			URLTemplate: origin.URL + "/pub/{key}",
+			Headers:     map[string]string{"Authorization": "Bearer origin-token"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("createSiteHandler() error = %v", err)
+	}
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		req := httptest.NewRequest(method, "/bucket/file", strings.NewReader("new"))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusMethodNotAllowed || !strings.Contains(rr.Body.String(), "<Code>MethodNotAllowed</Code>") {
+			t.Errorf("%s returned %v %q, want 405 MethodNotAllowed XML", method, rr.Code, rr.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/bucket/file", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "data" {
+		t.Errorf("GET returned %v %q, want 200 %q", rr.Code, rr.Body.String(), "data")
+	}
+}
+
+func TestValidateSite_HTTPOrigin(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  bool
+	}{
+		{name: "valid", template: "https://mirror.example.com/pub/{key}"},
+		{name: "empty", wantErr: true},
+		{name: "no placeholder", template: "https://mirror.example.com/pub/", wantErr: true},
+		{name: "not http", template: "ftp://mirror.example.com/{key}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Site{Type: "http", HTTP: &HTTPOriginConfig{URLTemplate: tt.template}}.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
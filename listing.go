@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// This file holds helpers shared by backends that implement S3 semantics
+// themselves rather than delegating to an S3-compatible service.
+
+const defaultMaxKeys = 1000
+
+// keyLister builds a ListObjectsV2 page from keys visited in lexicographic
+// order, applying the prefix, delimiter, max-keys and continuation token.
+type keyLister struct {
+	prefix     string
+	delimiter  string
+	maxKeys    int64
+	after      string
+	afterIsDir bool
+
+	out        *s3.ListObjectsV2Output
+	count      int64
+	lastPrefix string
+	lastToken  string
+	done       bool
+}
+
+func newKeyLister(prefix string, delimiter string, maxKeys int64, continuationToken string) (*keyLister, error) {
+	if maxKeys <= 0 {
+		maxKeys = defaultMaxKeys
+	}
+
+	l := &keyLister{
+		prefix:    prefix,
+		delimiter: delimiter,
+		maxKeys:   maxKeys,
+		out: &s3.ListObjectsV2Output{
+			IsTruncated: aws.Bool(false),
+			MaxKeys:     aws.Int64(maxKeys),
+		},
+	}
+
+	if continuationToken != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(continuationToken)
+		if err != nil || len(raw) == 0 || (raw[0] != 'k' && raw[0] != 'p') {
+			return nil, awserr.NewRequestFailure(
+				awserr.New("InvalidArgument", "The continuation token provided is incorrect", nil),
+				http.StatusBadRequest, "")
+		}
+		l.after = string(raw[1:])
+		l.afterIsDir = raw[0] == 'p'
+	}
+
+	return l, nil
+}
+
+// full reports whether the page is full and the walk can stop
+func (l *keyLister) full() bool {
+	return l.done
+}
+
+// skip reports whether a key was already returned on an earlier page
+func (l *keyLister) skip(key string) bool {
+	if l.after == "" {
+		return false
+	}
+	return key <= l.after || (l.afterIsDir && strings.HasPrefix(key, l.after))
+}
+
+// add offers an object to the page. It returns false once the page is full.
+func (l *keyLister) add(obj *s3.Object) bool {
+	if l.done {
+		return false
+	}
+
+	key := aws.StringValue(obj.Key)
+	if !strings.HasPrefix(key, l.prefix) || l.skip(key) {
+		return true
+	}
+
+	if l.delimiter != "" {
+		rest := key[len(l.prefix):]
+		if idx := strings.Index(rest, l.delimiter); idx >= 0 {
+			return l.addCommonPrefix(l.prefix + rest[:idx+len(l.delimiter)])
+		}
+	}
+
+	if !l.reserve() {
+		return false
+	}
+
+	l.out.Contents = append(l.out.Contents, obj)
+	l.lastToken = "k" + key
+	return true
+}
+
+func (l *keyLister) addCommonPrefix(cp string) bool {
+	if cp == l.lastPrefix || (l.afterIsDir && cp == l.after) {
+		return true
+	}
+
+	if !l.reserve() {
+		return false
+	}
+
+	l.out.CommonPrefixes = append(l.out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(cp)})
+	l.lastPrefix = cp
+	l.lastToken = "p" + cp
+	return true
+}
+
+// reserve claims a slot on the page, marking it truncated when none is left
+func (l *keyLister) reserve() bool {
+	if l.count >= l.maxKeys {
+		l.out.IsTruncated = aws.Bool(true)
+		l.out.NextContinuationToken = aws.String(base64.RawURLEncoding.EncodeToString([]byte(l.lastToken)))
+		l.done = true
+		return false
+	}
+
+	l.count++
+	return true
+}
+
+// pruneDir decides whether a subtree whose keys all start with dirKey can be
+// skipped. If every key below it rolls up into one common prefix, that prefix
+// is returned and the caller should add it (when the subtree is non-empty)
+// instead of descending.
+func (l *keyLister) pruneDir(dirKey string) (skip bool, commonPrefix string) {
+	if !strings.HasPrefix(dirKey, l.prefix) && !strings.HasPrefix(l.prefix, dirKey) {
+		return true, ""
+	}
+
+	// Every key below dirKey sorts before the continuation point
+	if l.after != "" && l.after > dirKey && !strings.HasPrefix(l.after, dirKey) {
+		return true, ""
+	}
+	if l.afterIsDir && strings.HasPrefix(dirKey, l.after) {
+		return true, ""
+	}
+
+	if l.delimiter != "" && strings.HasPrefix(dirKey, l.prefix) {
+		rest := dirKey[len(l.prefix):]
+		if idx := strings.Index(rest, l.delimiter); idx >= 0 {
+			return true, l.prefix + rest[:idx+len(l.delimiter)]
+		}
+	}
+
+	return false, ""
+}
+
+func (l *keyLister) result() *s3.ListObjectsV2Output {
+	l.out.KeyCount = aws.Int64(l.count)
+	return l.out
+}
+
+var byteRangePattern = regexp.MustCompile(`^bytes=(\d*)-(\d*)$`)
+
+// parseByteRange resolves a single HTTP Range header against an object size,
+// returning the inclusive start and end offsets
+func parseByteRange(header string, size int64) (int64, int64, error) {
+	m := byteRangePattern.FindStringSubmatch(strings.TrimSpace(header))
+	if m == nil || (m[1] == "" && m[2] == "") {
+		return 0, 0, errInvalidRange(size)
+	}
+
+	var start, end int64
+	if m[1] == "" {
+		// Suffix range: the last n bytes
+		n, _ := strconv.ParseInt(m[2], 10, 64)
+		if n == 0 {
+			return 0, 0, errInvalidRange(size)
+		}
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size-1
+	} else {
+		start, _ = strconv.ParseInt(m[1], 10, 64)
+		end = size - 1
+		if m[2] != "" {
+			end, _ = strconv.ParseInt(m[2], 10, 64)
+			if end >= size {
+				end = size - 1
+			}
+		}
+	}
+
+	if start >= size || start > end {
+		return 0, 0, errInvalidRange(size)
+	}
+
+	return start, end, nil
+}
+
+func errInvalidRange(size int64) error {
+	return awserr.NewRequestFailure(
+		awserr.New("InvalidRange", fmt.Sprintf("The requested range is not satisfiable (object size %d)", size), nil),
+		http.StatusRequestedRangeNotSatisfiable, "")
+}
+
+func contentRange(start, end, size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", start, end, size)
+}
+
+// parseContentRange reads a Content-Range header built by contentRange.
+// It fails for an unknown object size ("*").
+func parseContentRange(header string) (int64, int64, int64, bool) {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return 0, 0, 0, false
+	}
+	return start, end, size, start <= end && end < size
+}
+
+// newUploadID returns a random identifier for a multipart upload
+func newUploadID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// quoteETag formats a digest the way S3 returns ETags
+func quoteETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// multipartETag computes the S3 ETag of an object assembled from parts whose
+// MD5 digests are given in order
+func multipartETag(partSums [][]byte) string {
+	h := md5.New()
+	for _, sum := range partSums {
+		h.Write(sum)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(len(partSums)) + `"`
+}
+
+// checkCompletedParts validates the part list of a CompleteMultipartUpload
+// request against the ETags of the uploaded parts
+func checkCompletedParts(parts []*s3.CompletedPart, uploaded map[int64]string) error {
+	if len(parts) == 0 {
+		return awserr.NewRequestFailure(
+			awserr.New("MalformedXML", "You must specify at least one part", nil),
+			http.StatusBadRequest, "")
+	}
+
+	var last int64
+	for _, p := range parts {
+		n := aws.Int64Value(p.PartNumber)
+		if n <= last {
+			return awserr.NewRequestFailure(
+				awserr.New("InvalidPartOrder", "The list of parts was not in ascending order", nil),
+				http.StatusBadRequest, "")
+		}
+		last = n
+
+		etag, ok := uploaded[n]
+		if !ok || strings.Trim(etag, `"`) != strings.Trim(aws.StringValue(p.ETag), `"`) {
+			return errInvalidPart(fmt.Sprintf("Part %d could not be found or its ETag did not match", n))
+		}
+	}
+
+	return nil
+}
+
+// listUploads builds a ListMultipartUploads result from in-progress uploads
+func listUploads(uploads []*s3.MultipartUpload, prefix string, delimiter string, maxUploads int64) *s3.ListMultipartUploadsOutput {
+	if maxUploads <= 0 {
+		maxUploads = defaultMaxKeys
+	}
+
+	sort.Slice(uploads, func(i, j int) bool {
+		ki, kj := aws.StringValue(uploads[i].Key), aws.StringValue(uploads[j].Key)
+		if ki != kj {
+			return ki < kj
+		}
+		return aws.TimeValue(uploads[i].Initiated).Before(aws.TimeValue(uploads[j].Initiated))
+	})
+
+	out := &s3.ListMultipartUploadsOutput{
+		IsTruncated: aws.Bool(false),
+		MaxUploads:  aws.Int64(maxUploads),
+	}
+
+	var count int64
+	seen := make(map[string]bool)
+	for _, u := range uploads {
+		key := aws.StringValue(u.Key)
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if count >= maxUploads {
+			out.IsTruncated = aws.Bool(true)
+			break
+		}
+
+		if delimiter != "" {
+			rest := key[len(prefix):]
+			if idx := strings.Index(rest, delimiter); idx >= 0 {
+				cp := prefix + rest[:idx+len(delimiter)]
+				if !seen[cp] {
+					seen[cp] = true
+					out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(cp)})
+					count++
+				}
+				continue
+			}
+		}
+
+		out.Uploads = append(out.Uploads, u)
+		out.NextKeyMarker = u.Key
+		out.NextUploadIdMarker = u.UploadId
+		count++
+	}
+
+	return out
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header    string
+		size      int64
+		wantStart int64
+		wantEnd   int64
+		wantErr   bool
+	}{
+		{header: "bytes=0-9", size: 100, wantStart: 0, wantEnd: 9},
+		{header: "bytes=90-", size: 100, wantStart: 90, wantEnd: 99},
+		{header: "bytes=-10", size: 100, wantStart: 90, wantEnd: 99},
+		{header: "bytes=-500", size: 100, wantStart: 0, wantEnd: 99},
+		{header: "bytes=50-500", size: 100, wantStart: 50, wantEnd: 99},
+		{header: "bytes=100-", size: 100, wantErr: true},
+		{header: "bytes=9-0", size: 100, wantErr: true},
+		{header: "bytes=-", size: 100, wantErr: true},
+		{header: "bytes=0-1,5-6", size: 100, wantErr: true},
+		{header: "items=0-1", size: 100, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			start, end, err := parseByteRange(tt.header, tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseByteRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (start != tt.wantStart || end != tt.wantEnd) {
+				t.Errorf("parseByteRange() = %d-%d, want %d-%d", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
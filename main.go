@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 )
 
+// shutdownTimeout is how long requests in progress get to finish once the
+// proxy is asked to stop
+const shutdownTimeout = 30 * time.Second
+
 type Site struct {
 	Host        string  `json:"host" yaml:"host"`
+	Type        string  `json:"type,omitempty" yaml:"type,omitempty"`
 	AWSKey      string  `json:"awsKey" yaml:"awsKey"`
 	AWSSecret   string  `json:"awsSecret" yaml:"awsSecret"`
 	AWSRegion   string  `json:"awsRegion" yaml:"awsRegion"`
@@ -17,6 +27,43 @@ type Site struct {
 	AWSEndpoint string  `json:"awsEndpoint,omitempty" yaml:"awsEndpoint,omitempty"`
 	Users       []User  `json:"users" yaml:"users"`
 	Options     Options `json:"options" yaml:"options"`
+
+	// Users allowed the cache administration requests, which the site's
+	// users are not
+	Admins []User `json:"admins,omitempty" yaml:"admins,omitempty"`
+
+	// Backend specific settings, used when Type selects the backend
+	Filesystem *FilesystemConfig `json:"filesystem,omitempty" yaml:"filesystem,omitempty"`
+	Memory     *MemoryConfig     `json:"memory,omitempty" yaml:"memory,omitempty"`
+	Azure      *AzureConfig      `json:"azure,omitempty" yaml:"azure,omitempty"`
+	GCS        *GCSConfig        `json:"gcs,omitempty" yaml:"gcs,omitempty"`
+	SFTP       *SFTPConfig       `json:"sftp,omitempty" yaml:"sftp,omitempty"`
+	HTTP       *HTTPOriginConfig `json:"http,omitempty" yaml:"http,omitempty"`
+	Union      *UnionConfig      `json:"union,omitempty" yaml:"union,omitempty"`
+	Migrate    *MigrateConfig    `json:"migrate,omitempty" yaml:"migrate,omitempty"`
+	Shard      *ShardConfig      `json:"shard,omitempty" yaml:"shard,omitempty"`
+	Erasure    *ErasureConfig    `json:"erasure,omitempty" yaml:"erasure,omitempty"`
+	Tier       *TierConfig       `json:"tier,omitempty" yaml:"tier,omitempty"`
+
+	// Replicas receiving every write made to the backend, and members
+	// serving reads when it fails
+	Replication *ReplicationConfig `json:"replication,omitempty" yaml:"replication,omitempty"`
+	Failover    *FailoverConfig    `json:"failover,omitempty" yaml:"failover,omitempty"`
+
+	// Splitting of large backend reads and writes into concurrent range
+	// requests and multipart uploads
+	ParallelGet  *ParallelGetConfig  `json:"parallelGet,omitempty" yaml:"parallelGet,omitempty"`
+	MultipartPut *MultipartPutConfig `json:"multipartPut,omitempty" yaml:"multipartPut,omitempty"`
+
+	// Caches serving reads in front of the backend, sharing of concurrent
+	// reads of the same key, and prefetching for sequential readers
+	DiskCache   *DiskCacheConfig   `json:"diskCache,omitempty" yaml:"diskCache,omitempty"`
+	MemoryCache *MemoryCacheConfig `json:"memoryCache,omitempty" yaml:"memoryCache,omitempty"`
+	Coalesce    *CoalesceConfig    `json:"coalesce,omitempty" yaml:"coalesce,omitempty"`
+	ReadAhead   *ReadAheadConfig   `json:"readAhead,omitempty" yaml:"readAhead,omitempty"`
+
+	// Local staging of writes, uploaded to the backend in the background
+	WriteBack *WriteBackConfig `json:"writeBack,omitempty" yaml:"writeBack,omitempty"`
 }
 
 type User struct {
@@ -46,6 +93,31 @@ func main() {
 
 	portStr := strconv.FormatInt(int64(*port), 10)
 
+	server := &http.Server{Addr: ":" + portStr, Handler: handler}
+
+	// On SIGINT or SIGTERM, stop accepting requests, let the ones in
+	// progress finish, then stop the background workers, uploading the
+	// writes staged for write-back
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("s3-proxy received %v, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+		close(stopped)
+	}()
+
 	log.Println("s3-proxy is listening on port " + portStr)
-	log.Fatal(http.ListenAndServe(":"+portStr, handler))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-stopped
+	stopWorkers()
 }
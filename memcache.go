@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultMemoryCacheMaxObjectSize = 64 << 10
+	defaultMemoryCacheTTL           = time.Minute
+	defaultMemoryCacheNegativeTTL   = 5 * time.Second
+	// memoryCacheEntryOverhead approximates the memory an entry takes
+	// besides its key and body
+	memoryCacheEntryOverhead = 256
+)
+
+// MemoryCacheConfig keeps HEAD metadata and the bodies of objects up to
+// MaxObjectSize bytes (default 64 KiB) in memory, up to MaxSize bytes in
+// all. Entries expire after TTL (default "1m"), and keys found missing are
+// remembered for NegativeTTL (default "5s", "0s" to disable). Writes
+// through the proxy invalidate the key at once.
+type MemoryCacheConfig struct {
+	MaxSize       int64  `json:"maxSize" yaml:"maxSize"`
+	MaxObjectSize int64  `json:"maxObjectSize,omitempty" yaml:"maxObjectSize,omitempty"`
+	TTL           string `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	NegativeTTL   string `json:"negativeTTL,omitempty" yaml:"negativeTTL,omitempty"`
+}
+
+func (c *MemoryCacheConfig) validate() error {
+	if c.MaxSize <= 0 {
+		return errors.New("Memory cache maxSize must be positive")
+	}
+	if c.MaxObjectSize < 0 {
+		return errors.New("Memory cache maxObjectSize must not be negative")
+	}
+
+	if c.TTL != "" {
+		if d, err := time.ParseDuration(c.TTL); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid memory cache ttl %q", c.TTL)
+		}
+	}
+	if c.NegativeTTL != "" {
+		if d, err := time.ParseDuration(c.NegativeTTL); err != nil || d < 0 {
+			return fmt.Errorf("Invalid memory cache negativeTTL %q", c.NegativeTTL)
+		}
+	}
+
+	return nil
+}
+
+// newMemoryCacheBackend puts a site's backend behind its memory cache
+func newMemoryCacheBackend(backend S3Proxy, cfg MemoryCacheConfig) S3Proxy {
+	ttl := defaultMemoryCacheTTL
+	if cfg.TTL != "" {
+		ttl, _ = time.ParseDuration(cfg.TTL)
+	}
+	negativeTTL := defaultMemoryCacheNegativeTTL
+	if cfg.NegativeTTL != "" {
+		negativeTTL, _ = time.ParseDuration(cfg.NegativeTTL)
+	}
+
+	return NewMemoryCacheProxy(backend, cfg.MaxSize, cfg.MaxObjectSize, ttl, negativeTTL)
+}
+
+// memoryCacheEntry caches what is known about a key: that it is missing
+// (head is nil), its metadata, or its metadata and body
+type memoryCacheEntry struct {
+	key     string
+	head    *s3.HeadObjectOutput
+	body    []byte
+	hasBody bool
+	expires time.Time
+	size    int64
+	elem    *list.Element
+}
+
+// MemoryCacheProxy serves HEADs and small GETs from memory, evicting the
+// least recently used entries once maxSize is reached. Everything else
+// goes to the backend.
+type MemoryCacheProxy struct {
+	S3Proxy
+	maxSize       int64
+	maxObjectSize int64
+	ttl           time.Duration
+	negativeTTL   time.Duration
+	now           func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*memoryCacheEntry
+	lru     *list.List // front is most recently used
+	size    int64
+	// writes counts invalidations, so a response fetched across a write
+	// is not cached
+	writes uint64
+}
+
+func NewMemoryCacheProxy(backend S3Proxy, maxSize, maxObjectSize int64, ttl, negativeTTL time.Duration) *MemoryCacheProxy {
+	if maxObjectSize <= 0 {
+		maxObjectSize = defaultMemoryCacheMaxObjectSize
+	}
+
+	return &MemoryCacheProxy{
+		S3Proxy:       backend,
+		maxSize:       maxSize,
+		maxObjectSize: maxObjectSize,
+		ttl:           ttl,
+		negativeTTL:   negativeTTL,
+		now:           time.Now,
+		entries:       make(map[string]*memoryCacheEntry),
+		lru:           list.New(),
+	}
+}
+
+// lookup returns the live entry for key and the write count to pass to
+// store if it has to be fetched
+func (p *MemoryCacheProxy) lookup(key string) (*memoryCacheEntry, uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.entries[key]
+	if !ok {
+		return nil, p.writes
+	}
+	if !p.now().Before(e.expires) {
+		p.removeLocked(e)
+		return nil, p.writes
+	}
+
+	p.lru.MoveToFront(e.elem)
+	return e, p.writes
+}
+
+func (p *MemoryCacheProxy) removeLocked(e *memoryCacheEntry) {
+	p.lru.Remove(e.elem)
+	delete(p.entries, e.key)
+	p.size -= e.size
+}
+
+// store caches an entry fetched after lookup returned writes, unless a
+// write has happened since
+func (p *MemoryCacheProxy) store(e *memoryCacheEntry, writes uint64) {
+	ttl := p.ttl
+	if e.head == nil {
+		ttl = p.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	e.size = int64(len(e.key)+len(e.body)) + memoryCacheEntryOverhead
+	if e.size > p.maxSize {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.writes != writes {
+		return
+	}
+
+	if prev, ok := p.entries[e.key]; ok {
+		p.removeLocked(prev)
+	}
+
+	e.expires = p.now().Add(ttl)
+	e.elem = p.lru.PushFront(e)
+	p.entries[e.key] = e
+	p.size += e.size
+
+	for p.size > p.maxSize {
+		p.removeLocked(p.lru.Back().Value.(*memoryCacheEntry))
+	}
+}
+
+func (p *MemoryCacheProxy) invalidate(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.writes++
+	if e, ok := p.entries[key]; ok {
+		p.removeLocked(e)
+	}
+}
+
+// PurgeCache drops the cached entries of the keys, and of the caches behind
+// this one
+func (p *MemoryCacheProxy) PurgeCache(key string, prefix bool) int {
+	p.mu.Lock()
+	// Responses fetched before the purge are not cached either
+	p.writes++
+	n := 0
+	for cached, e := range p.entries {
+		if purgeMatches(cached, key, prefix) {
+			p.removeLocked(e)
+			n++
+		}
+	}
+	p.mu.Unlock()
+
+	return n + purgeCache(p.S3Proxy, key, prefix)
+}
+
+// HasCache is true, as the proxy is a cache
+func (p *MemoryCacheProxy) HasCache() bool {
+	return true
+}
+
+// MigrationStatus reports the migration of the backend behind the proxy
+func (p *MemoryCacheProxy) MigrationStatus() (MigrationStatus, bool) {
+	return migrationStatus(p.S3Proxy)
+}
+
+// headFromGet returns the headers of a GET of a whole object as those of a
+// HEAD, the inverse of getOutputFromHead
+func headFromGet(out *s3.GetObjectOutput) *s3.HeadObjectOutput {
+	return &s3.HeadObjectOutput{
+		AcceptRanges:              aws.String("bytes"),
+		BucketKeyEnabled:          out.BucketKeyEnabled,
+		CacheControl:              out.CacheControl,
+		ChecksumCRC32:             out.ChecksumCRC32,
+		ChecksumCRC32C:            out.ChecksumCRC32C,
+		ChecksumSHA1:              out.ChecksumSHA1,
+		ChecksumSHA256:            out.ChecksumSHA256,
+		ContentDisposition:        out.ContentDisposition,
+		ContentEncoding:           out.ContentEncoding,
+		ContentLanguage:           out.ContentLanguage,
+		ContentLength:             out.ContentLength,
+		ContentType:               out.ContentType,
+		DeleteMarker:              out.DeleteMarker,
+		ETag:                      out.ETag,
+		Expiration:                out.Expiration,
+		Expires:                   out.Expires,
+		LastModified:              out.LastModified,
+		Metadata:                  out.Metadata,
+		MissingMeta:               out.MissingMeta,
+		ObjectLockLegalHoldStatus: out.ObjectLockLegalHoldStatus,
+		ObjectLockMode:            out.ObjectLockMode,
+		ObjectLockRetainUntilDate: out.ObjectLockRetainUntilDate,
+		PartsCount:                out.PartsCount,
+		ReplicationStatus:         out.ReplicationStatus,
+		RequestCharged:            out.RequestCharged,
+		Restore:                   out.Restore,
+		SSECustomerAlgorithm:      out.SSECustomerAlgorithm,
+		SSECustomerKeyMD5:         out.SSECustomerKeyMD5,
+		SSEKMSKeyId:               out.SSEKMSKeyId,
+		ServerSideEncryption:      out.ServerSideEncryption,
+		StorageClass:              out.StorageClass,
+		VersionId:                 out.VersionId,
+		WebsiteRedirectLocation:   out.WebsiteRedirectLocation,
+	}
+}
+
+// serve answers a GET from a cached body, with the headers the backend
+// returned for it
+func (p *MemoryCacheProxy) serve(e *memoryCacheEntry, rangeHeader string) (*s3.GetObjectOutput, error) {
+	size := int64(len(e.body))
+	out := getOutputFromHead(e.head)
+	out.AcceptRanges = aws.String("bytes")
+	out.ContentLength = aws.Int64(size)
+	out.Body = io.NopCloser(bytes.NewReader(e.body))
+
+	if rangeHeader != "" {
+		start, end, err := parseByteRange(rangeHeader, size)
+		if err != nil {
+			return nil, err
+		}
+
+		out.ContentLength = aws.Int64(end - start + 1)
+		out.ContentRange = aws.String(contentRange(start, end, size))
+		out.Body = io.NopCloser(bytes.NewReader(e.body[start : end+1]))
+	}
+
+	return out, nil
+}
+
+func (p *MemoryCacheProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	e, writes := p.lookup(key)
+	if e != nil {
+		if e.head == nil {
+			return nil, errNoSuchKey(key)
+		}
+		if e.hasBody {
+			return p.serve(e, rangeHeader)
+		}
+	}
+
+	out, err := p.S3Proxy.Get(key, rangeHeader)
+	if err != nil {
+		if isNotFound(err) {
+			p.store(&memoryCacheEntry{key: key}, writes)
+		}
+		return nil, err
+	}
+
+	if rangeHeader != "" || out.ContentLength == nil || aws.Int64Value(out.ContentLength) > p.maxObjectSize {
+		return out, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(out.Body, p.maxObjectSize+1))
+	out.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) == aws.Int64Value(out.ContentLength) {
+		p.store(&memoryCacheEntry{key: key, head: headFromGet(out), body: data, hasBody: true}, writes)
+	}
+	out.Body = io.NopCloser(bytes.NewReader(data))
+	return out, nil
+}
+
+func (p *MemoryCacheProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	e, writes := p.lookup(key)
+	if e != nil {
+		if e.head == nil {
+			return nil, errNoSuchKey(key)
+		}
+		head := *e.head
+		return &head, nil
+	}
+
+	out, err := p.S3Proxy.Head(key)
+	if err != nil {
+		if isNotFound(err) {
+			p.store(&memoryCacheEntry{key: key}, writes)
+		}
+		return nil, err
+	}
+
+	head := *out
+	p.store(&memoryCacheEntry{key: key, head: &head}, writes)
+	return out, nil
+}
+
+func (p *MemoryCacheProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	defer p.invalidate(key)
+	return p.S3Proxy.Put(key, body, contentType)
+}
+
+// PutIfAbsent uses the backend's atomic create. Over backends without one
+// it is not implemented, so create-only writes fall back on handlePut.
+func (p *MemoryCacheProxy) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	cp, ok := p.S3Proxy.(ConditionalPutter)
+	if !ok {
+		return nil, errNotImplemented("Atomic create")
+	}
+
+	defer p.invalidate(key)
+	return cp.PutIfAbsent(key, body, contentType)
+}
+
+func (p *MemoryCacheProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	defer p.invalidate(key)
+	return p.S3Proxy.Delete(key)
+}
+
+func (p *MemoryCacheProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	defer p.invalidate(key)
+	return p.S3Proxy.CompleteMultipartUpload(key, uploadId, parts)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func newTestMemoryCacheProxy(maxSize int64) (*MemoryCacheProxy, *fakeProxy) {
+	backend := newFakeProxy()
+	return NewMemoryCacheProxy(backend, maxSize, 32, time.Minute, 5*time.Second), backend
+}
+
+func TestMemoryCacheProxy_SmallObjects(t *testing.T) {
+	p, backend := newTestMemoryCacheProxy(1 << 20)
+	putString(t, backend, "small", "tiny")
+	putString(t, backend, "large", strings.Repeat("x", 100))
+
+	tests := []struct {
+		name        string
+		key         string
+		rangeHeader string
+		head        bool
+		want        string
+		wantGets    int
+		wantHeads   int
+	}{
+		{name: "first read", key: "small", want: "tiny", wantGets: 1},
+		{name: "cached", key: "small", want: "tiny"},
+		{name: "cached range", key: "small", rangeHeader: "bytes=1-2", want: "in"},
+		{name: "head from cached body", key: "small", head: true},
+		{name: "large object", key: "large", rangeHeader: "bytes=0-1", want: "xx", wantGets: 1},
+		{name: "large object again", key: "large", want: strings.Repeat("x", 100), wantGets: 1},
+		{name: "large object head", key: "large", head: true, wantHeads: 1},
+		{name: "large object head cached", key: "large", head: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.head {
+				if _, err := p.Head(tt.key); err != nil {
+					t.Fatalf("Head() error = %v", err)
+				}
+			} else if got := getString(t, p, tt.key, tt.rangeHeader); got != tt.want {
+				t.Errorf("Get() = %q, want %q", got, tt.want)
+			}
+
+			if gets, heads := backend.calls(); gets != tt.wantGets || heads != tt.wantHeads {
+				t.Errorf("backend saw %d GETs and %d HEADs, want %d and %d", gets, heads, tt.wantGets, tt.wantHeads)
+			}
+		})
+	}
+}
+
+func TestMemoryCacheProxy_NegativeCache(t *testing.T) {
+	p, backend := newTestMemoryCacheProxy(1 << 20)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Head("missing"); !isNotFound(err) {
+			t.Fatalf("Head() error = %v, want not found", err)
+		}
+		if _, err := p.Get("missing", ""); !isNotFound(err) {
+			t.Fatalf("Get() error = %v, want not found", err)
+		}
+	}
+	if gets, heads := backend.calls(); gets+heads != 1 {
+		t.Errorf("backend saw %d GETs and %d HEADs of a missing key, want one request", gets, heads)
+	}
+
+	now = now.Add(6 * time.Second)
+	p.Head("missing")
+	if _, heads := backend.calls(); heads != 1 {
+		t.Errorf("negative entry not expired after negativeTTL")
+	}
+
+	// Writes through the proxy replace the negative entry at once
+	putString(t, p, "missing", "found")
+	if got := getString(t, p, "missing", ""); got != "found" {
+		t.Errorf("Get() after Put() = %q", got)
+	}
+}
+
+func TestMemoryCacheProxy_Invalidation(t *testing.T) {
+	p, _ := newTestMemoryCacheProxy(1 << 20)
+	putString(t, p, "key", "first")
+	getString(t, p, "key", "")
+
+	putString(t, p, "key", "second")
+	if got := getString(t, p, "key", ""); got != "second" {
+		t.Errorf("Get() after Put() = %q", got)
+	}
+
+	if _, err := p.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Head("key"); !isNotFound(err) {
+		t.Errorf("Head() after Delete() error = %v, want not found", err)
+	}
+}
+
+func TestMemoryCacheProxy_Headers(t *testing.T) {
+	backend := newFakeProxy()
+	backend.archived = true
+	putString(t, backend, "key", "content")
+	p := NewMemoryCacheProxy(backend, 1<<20, 0, time.Minute, 0)
+	getString(t, p, "key", "")
+
+	for _, rangeHeader := range []string{"", "bytes=2-3"} {
+		out, err := p.Get("key", rangeHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Body.Close()
+
+		if aws.StringValue(out.CacheControl) != "max-age=60" || aws.StringValue(out.ContentEncoding) != "gzip" ||
+			aws.StringValue(out.Metadata["Owner"]) != "alice" || aws.StringValue(out.Restore) != `ongoing-request="false"` ||
+			aws.StringValue(out.StorageClass) != s3.StorageClassGlacier || aws.StringValue(out.VersionId) != "v1" {
+			t.Errorf("cached Get(%q) lost the object's headers: %+v", rangeHeader, out)
+		}
+	}
+
+	head, err := p.Head("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(head.ContentEncoding) != "gzip" || aws.StringValue(head.StorageClass) != s3.StorageClassGlacier {
+		t.Errorf("cached Head() lost the object's headers: %+v", head)
+	}
+	if gets, heads := backend.calls(); gets != 1 || heads != 0 {
+		t.Errorf("backend saw %d GETs and %d HEADs, want the first GET only", gets, heads)
+	}
+}
+
+func TestMemoryCacheProxy_Eviction(t *testing.T) {
+	// Room for two entries with their overhead
+	p, backend := newTestMemoryCacheProxy(2*memoryCacheEntryOverhead + 20)
+	for _, key := range []string{"a", "b", "c"} {
+		putString(t, backend, key, key)
+	}
+
+	getString(t, p, "a", "")
+	getString(t, p, "b", "")
+	getString(t, p, "a", "")
+	getString(t, p, "c", "")
+	backend.calls()
+
+	getString(t, p, "a", "")
+	if gets, _ := backend.calls(); gets != 0 {
+		t.Error("recently used entry evicted")
+	}
+	getString(t, p, "b", "")
+	if gets, _ := backend.calls(); gets != 1 {
+		t.Error("least recently used entry kept")
+	}
+	if p.size > p.maxSize {
+		t.Errorf("cache holds %d bytes, over its %d byte budget", p.size, p.maxSize)
+	}
+}
+
+func TestMemoryCacheProxy_PutIfAbsent(t *testing.T) {
+	p, backend := newTestMemoryCacheProxy(1 << 20)
+
+	checkNoAtomicCreate(t, p, backend)
+}
+
+func TestMemoryCacheConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  MemoryCacheConfig
+		wantErr bool
+	}{
+		{name: "valid", config: MemoryCacheConfig{MaxSize: 64 << 20, MaxObjectSize: 4096, TTL: "30s", NegativeTTL: "0s"}},
+		{name: "no size", config: MemoryCacheConfig{}, wantErr: true},
+		{name: "negative object size", config: MemoryCacheConfig{MaxSize: 1, MaxObjectSize: -1}, wantErr: true},
+		{name: "zero ttl", config: MemoryCacheConfig{MaxSize: 1, TTL: "0s"}, wantErr: true},
+		{name: "bad negativeTTL", config: MemoryCacheConfig{MaxSize: 1, NegativeTTL: "brief"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
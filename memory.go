@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func init() {
+	RegisterBackend("memory", validateMemorySite, func(s Site) (S3Proxy, error) {
+		cfg := s.Memory
+		if cfg == nil {
+			cfg = &MemoryConfig{}
+		}
+
+		var ttl time.Duration
+		if cfg.TTL != "" {
+			ttl, _ = time.ParseDuration(cfg.TTL)
+		}
+
+		return NewMemoryProxy(cfg.MaxSize, ttl, cfg.Website), nil
+	})
+}
+
+// MemoryConfig configures the in-memory backend. MaxSize caps the bytes held
+// by objects and in-progress uploads (0 for no limit); TTL is a duration such
+// as "24h" after which objects expire (empty for no expiry).
+type MemoryConfig struct {
+	MaxSize int64          `json:"maxSize,omitempty" yaml:"maxSize,omitempty"`
+	TTL     string         `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	Website *WebsiteConfig `json:"website,omitempty" yaml:"website,omitempty"`
+}
+
+func validateMemorySite(s Site) error {
+	if s.Memory == nil {
+		return nil
+	}
+
+	if s.Memory.MaxSize < 0 {
+		return errors.New("Memory maxSize must not be negative")
+	}
+
+	if s.Memory.TTL != "" {
+		ttl, err := time.ParseDuration(s.Memory.TTL)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("Invalid memory ttl %q", s.Memory.TTL)
+		}
+	}
+
+	return nil
+}
+
+// MemoryProxy is an S3Proxy keeping all objects in memory. It is safe for
+// concurrent use.
+type MemoryProxy struct {
+	maxSize int64
+	ttl     time.Duration
+	website *WebsiteConfig
+	now     func() time.Time
+
+	mu        sync.RWMutex
+	objects   map[string]*memObject
+	uploads   map[string]*memUpload
+	size      int64
+	lastSweep time.Time
+}
+
+type memObject struct {
+	data         []byte
+	etag         string
+	contentType  string
+	lastModified time.Time
+}
+
+type memUpload struct {
+	key         string
+	contentType string
+	initiated   time.Time
+	parts       map[int64][]byte
+}
+
+func NewMemoryProxy(maxSize int64, ttl time.Duration, website *WebsiteConfig) *MemoryProxy {
+	return &MemoryProxy{
+		maxSize: maxSize,
+		ttl:     ttl,
+		website: website,
+		now:     time.Now,
+		objects: make(map[string]*memObject),
+		uploads: make(map[string]*memUpload),
+	}
+}
+
+func errQuotaExceeded() error {
+	return awserr.NewRequestFailure(
+		awserr.New("QuotaExceeded", "The in-memory bucket has reached its configured maxSize", nil),
+		http.StatusInsufficientStorage, "")
+}
+
+func (p *MemoryProxy) expired(obj *memObject, now time.Time) bool {
+	return p.ttl > 0 && now.Sub(obj.lastModified) >= p.ttl
+}
+
+// sweep drops expired objects. Callers must hold the write lock.
+func (p *MemoryProxy) sweep(now time.Time) {
+	if p.ttl <= 0 || now.Sub(p.lastSweep) < time.Second {
+		return
+	}
+	p.lastSweep = now
+
+	for key, obj := range p.objects {
+		if p.expired(obj, now) {
+			p.size -= int64(len(obj.data))
+			delete(p.objects, key)
+		}
+	}
+}
+
+// lookup returns a live object. Callers must hold the lock.
+func (p *MemoryProxy) lookup(key string) (*memObject, error) {
+	obj, ok := p.objects[key]
+	if !ok || p.expired(obj, p.now()) {
+		return nil, errNoSuchKey(key)
+	}
+	return obj, nil
+}
+
+// reserve accounts for delta additional bytes, failing if over the cap.
+// Callers must hold the write lock.
+func (p *MemoryProxy) reserve(delta int64) error {
+	if p.maxSize > 0 && p.size+delta > p.maxSize {
+		return errQuotaExceeded()
+	}
+	p.size += delta
+	return nil
+}
+
+// store replaces the object at key. Callers must hold the write lock.
+func (p *MemoryProxy) store(key string, obj *memObject) error {
+	var old int64
+	if existing, ok := p.objects[key]; ok {
+		old = int64(len(existing.data))
+	}
+
+	if err := p.reserve(int64(len(obj.data)) - old); err != nil {
+		return err
+	}
+
+	p.objects[key] = obj
+	return nil
+}
+
+func (p *MemoryProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	p.mu.RLock()
+	obj, err := p.lookup(key)
+	p.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Stored slices are never modified, so they can be read without the lock
+	size := int64(len(obj.data))
+	out := &s3.GetObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(obj.contentType),
+		ETag:          aws.String(obj.etag),
+		LastModified:  aws.Time(obj.lastModified),
+		Body:          io.NopCloser(bytes.NewReader(obj.data)),
+	}
+
+	if rangeHeader != "" {
+		start, end, err := parseByteRange(rangeHeader, size)
+		if err != nil {
+			return nil, err
+		}
+
+		out.ContentLength = aws.Int64(end - start + 1)
+		out.ContentRange = aws.String(contentRange(start, end, size))
+		out.Body = io.NopCloser(bytes.NewReader(obj.data[start : end+1]))
+	}
+
+	return out, nil
+}
+
+func (p *MemoryProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	obj, err := p.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.HeadObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: aws.Int64(int64(len(obj.data))),
+		ContentType:   aws.String(obj.contentType),
+		ETag:          aws.String(obj.etag),
+		LastModified:  aws.Time(obj.lastModified),
+	}, nil
+}
+
+func (p *MemoryProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	if key == "" {
+		return nil, errInvalidArgument("Object key must not be empty")
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := md5.Sum(data)
+	obj := &memObject{
+		data:        data,
+		etag:        quoteETag(sum[:]),
+		contentType: contentType,
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.sweep(now)
+	obj.lastModified = now
+
+	if err := p.store(key, obj); err != nil {
+		return nil, err
+	}
+
+	return &s3.PutObjectOutput{ETag: aws.String(obj.etag)}, nil
+}
+
+func (p *MemoryProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if obj, ok := p.objects[key]; ok {
+		p.size -= int64(len(obj.data))
+		delete(p.objects, key)
+	}
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (p *MemoryProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	lister, err := newKeyLister(prefix, delimiter, maxKeys, continuationToken)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.sweep(now)
+
+	keys := make([]string, 0, len(p.objects))
+	for key := range p.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		obj := p.objects[key]
+		if p.expired(obj, now) {
+			continue
+		}
+
+		if !lister.add(&s3.Object{
+			Key:          aws.String(key),
+			ETag:         aws.String(obj.etag),
+			Size:         aws.Int64(int64(len(obj.data))),
+			LastModified: aws.Time(obj.lastModified),
+			StorageClass: aws.String(s3.StorageClassStandard),
+		}) {
+			break
+		}
+	}
+
+	out := lister.result()
+	out.Prefix = aws.String(prefix)
+	return out, nil
+}
+
+func (p *MemoryProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	if key == "" {
+		return nil, errInvalidArgument("Object key must not be empty")
+	}
+
+	uploadId := newUploadID()
+
+	p.mu.Lock()
+	p.uploads[uploadId] = &memUpload{
+		key:         key,
+		contentType: contentType,
+		initiated:   p.now(),
+		parts:       make(map[int64][]byte),
+	}
+	p.mu.Unlock()
+
+	return &s3.CreateMultipartUploadOutput{
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}, nil
+}
+
+// upload returns an in-progress upload. Callers must hold the lock.
+func (p *MemoryProxy) upload(key string, uploadId string) (*memUpload, error) {
+	upload, ok := p.uploads[uploadId]
+	if !ok || upload.key != key {
+		return nil, errNoSuchUpload(uploadId)
+	}
+	return upload, nil
+}
+
+func (p *MemoryProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	if partNumber < 1 || partNumber > 10000 {
+		return nil, errInvalidArgument("Part number must be an integer between 1 and 10000, inclusive")
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	upload, err := p.upload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.reserve(int64(len(data)) - int64(len(upload.parts[partNumber]))); err != nil {
+		return nil, err
+	}
+	upload.parts[partNumber] = data
+
+	sum := md5.Sum(data)
+	return &s3.UploadPartOutput{ETag: aws.String(quoteETag(sum[:]))}, nil
+}
+
+func (p *MemoryProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	upload, err := p.upload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	uploaded := make(map[int64]string, len(upload.parts))
+	sums := make(map[int64][]byte, len(upload.parts))
+	for n, data := range upload.parts {
+		sum := md5.Sum(data)
+		sums[n] = sum[:]
+		uploaded[n] = quoteETag(sum[:])
+	}
+
+	if err := checkCompletedParts(parts, uploaded); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	ordered := make([][]byte, 0, len(parts))
+	for _, part := range parts {
+		n := aws.Int64Value(part.PartNumber)
+		buf.Write(upload.parts[n])
+		ordered = append(ordered, sums[n])
+	}
+
+	// The parts' bytes move to the object, so release them before storing
+	for _, data := range upload.parts {
+		p.size -= int64(len(data))
+	}
+	delete(p.uploads, uploadId)
+
+	obj := &memObject{
+		data:         buf.Bytes(),
+		etag:         multipartETag(ordered),
+		contentType:  upload.contentType,
+		lastModified: p.now(),
+	}
+	if err := p.store(key, obj); err != nil {
+		return nil, err
+	}
+
+	return &s3.CompleteMultipartUploadOutput{
+		Key:  aws.String(key),
+		ETag: aws.String(obj.etag),
+	}, nil
+}
+
+func (p *MemoryProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	upload, err := p.upload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, data := range upload.parts {
+		p.size -= int64(len(data))
+	}
+	delete(p.uploads, uploadId)
+
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (p *MemoryProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	p.mu.RLock()
+	uploads := make([]*s3.MultipartUpload, 0, len(p.uploads))
+	for id, upload := range p.uploads {
+		uploads = append(uploads, &s3.MultipartUpload{
+			Key:          aws.String(upload.key),
+			UploadId:     aws.String(id),
+			Initiated:    aws.Time(upload.initiated),
+			StorageClass: aws.String(s3.StorageClassStandard),
+		})
+	}
+	p.mu.RUnlock()
+
+	out := listUploads(uploads, prefix, delimiter, maxUploads)
+	out.Prefix = aws.String(prefix)
+	return out, nil
+}
+
+func (p *MemoryProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	return p.website.output()
+}
+
+func (p *MemoryProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	if _, err := p.Head(key); err != nil {
+		return nil, err
+	}
+
+	return nil, errObjectAlreadyInActiveTier()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestMemoryProxy_PutGetDelete(t *testing.T) {
+	p := NewMemoryProxy(0, 0, nil)
+
+	putString(t, p, "dir/file.txt", "hello world")
+
+	if got := getString(t, p, "dir/file.txt", ""); got != "hello world" {
+		t.Errorf("Get() = %q, want %q", got, "hello world")
+	}
+	if got := getString(t, p, "dir/file.txt", "bytes=-5"); got != "world" {
+		t.Errorf("Get() with range = %q, want %q", got, "world")
+	}
+
+	head, err := p.Head("dir/file.txt")
+	if err != nil {
+		t.Fatalf("Head() error = %v", err)
+	}
+	if aws.StringValue(head.ETag) != `"5eb63bbbe01eeed093cb22bb8f5acdc3"` {
+		t.Errorf("Head() ETag = %s, want MD5 of body", aws.StringValue(head.ETag))
+	}
+
+	if _, err := p.Delete("dir/file.txt"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := p.Get("dir/file.txt", ""); !isNotFound(err) {
+		t.Errorf("Get() after delete error = %v, want not found", err)
+	}
+}
+
+func TestMemoryProxy_ListObjects(t *testing.T) {
+	p := NewMemoryProxy(0, 0, nil)
+
+	for _, key := range []string{"a/b", "a-c", "a/d/e", "b", "a"} {
+		putString(t, p, key, key)
+	}
+
+	keys, prefixes := listAll(t, p, "", "/", 1)
+	if want := []string{"a", "a-c", "b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+	if want := []string{"a/"}; !reflect.DeepEqual(prefixes, want) {
+		t.Errorf("prefixes = %v, want %v", prefixes, want)
+	}
+
+	keys, _ = listAll(t, p, "a/", "", 0)
+	if want := []string{"a/b", "a/d/e"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+}
+
+func TestMemoryProxy_Multipart(t *testing.T) {
+	p := NewMemoryProxy(20, 0, nil)
+
+	created, err := p.CreateMultipartUpload("big", "application/zip")
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload() error = %v", err)
+	}
+	uploadId := aws.StringValue(created.UploadId)
+
+	var parts []*s3.CompletedPart
+	for i, body := range []string{"part one ", "part two"} {
+		out, err := p.UploadPart("big", uploadId, int64(i+1), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("UploadPart() error = %v", err)
+		}
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(int64(i + 1)), ETag: out.ETag})
+	}
+
+	if _, err := p.CompleteMultipartUpload("big", uploadId, parts); err != nil {
+		t.Fatalf("CompleteMultipartUpload() error = %v", err)
+	}
+	if got := getString(t, p, "big", ""); got != "part one part two" {
+		t.Errorf("Get() = %q", got)
+	}
+	if p.size != 17 {
+		t.Errorf("size after completion = %d, want 17", p.size)
+	}
+
+	uploads, err := p.ListMultipartUploads("", "", 0)
+	if err != nil || len(uploads.Uploads) != 0 {
+		t.Errorf("ListMultipartUploads() = %v, %v, want none", uploads, err)
+	}
+}
+
+func TestMemoryProxy_MaxSize(t *testing.T) {
+	p := NewMemoryProxy(10, 0, nil)
+
+	putString(t, p, "a", "12345")
+	putString(t, p, "a", "1234567890")
+
+	_, err := p.Put("b", strings.NewReader("x"), "text/plain")
+	if reqErr, ok := err.(awserr.RequestFailure); !ok || reqErr.Code() != "QuotaExceeded" {
+		t.Fatalf("Put() over maxSize error = %v, want QuotaExceeded", err)
+	}
+
+	// Deleting frees the space again
+	p.Delete("a")
+	putString(t, p, "b", "x")
+}
+
+func TestMemoryProxy_TTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := NewMemoryProxy(0, time.Hour, nil)
+	p.now = func() time.Time { return now }
+
+	putString(t, p, "old", "old")
+	now = now.Add(30 * time.Minute)
+	putString(t, p, "new", "new")
+	now = now.Add(45 * time.Minute)
+
+	if _, err := p.Head("old"); !isNotFound(err) {
+		t.Errorf("Head() of expired object error = %v, want not found", err)
+	}
+	if got := getString(t, p, "new", ""); got != "new" {
+		t.Errorf("Get() = %q, want %q", got, "new")
+	}
+
+	keys, _ := listAll(t, p, "", "", 0)
+	if want := []string{"new"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+	if p.size != 3 {
+		t.Errorf("size after sweep = %d, want 3", p.size)
+	}
+}
+
+func TestMemoryProxy_Concurrent(t *testing.T) {
+	p := NewMemoryProxy(0, 0, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprintf("k%d/%d", i, j)
+				p.Put(key, strings.NewReader(key), "text/plain")
+				p.Get(key, "")
+				p.ListObjects("", "/", 10, "")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	keys, _ := listAll(t, p, "", "", 0)
+	if len(keys) != 400 {
+		t.Errorf("got %d keys, want 400", len(keys))
+	}
+}
+
+func TestValidateSite_Memory(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *MemoryConfig
+		wantErr bool
+	}{
+		{name: "no settings"},
+		{name: "valid", config: &MemoryConfig{MaxSize: 1 << 20, TTL: "24h"}},
+		{name: "negative size", config: &MemoryConfig{MaxSize: -1}, wantErr: true},
+		{name: "bad ttl", config: &MemoryConfig{TTL: "tomorrow"}, wantErr: true},
+		{name: "zero ttl", config: &MemoryConfig{TTL: "0s"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Site{Type: "memory", Memory: tt.config}.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// This file holds helpers shared by backends composed of other backends.
+// Merged listings page through each backend with its own continuation
+// tokens and merge the pages in key order.
+
+// listEntry is an object or a common prefix from a listing
+type listEntry struct {
+	key      string
+	obj      *s3.Object
+	isPrefix bool
+}
+
+// listIterator walks one backend's listing in key order, fetching pages as
+// needed. Keys starting with strip have it removed, so listings of a
+// reserved prefix can be merged with ordinary keys.
+type listIterator struct {
+	proxy     S3Proxy
+	prefix    string
+	delimiter string
+	strip     string
+	pageSize  int64
+
+	pageToken string // token that fetched the current page
+	nextToken string
+	entries   []listEntry
+	pos       int
+	fetched   bool
+	done      bool
+}
+
+func (it *listIterator) fetch() error {
+	out, err := it.proxy.ListObjects(it.prefix, it.delimiter, it.pageSize, it.pageToken)
+	if err != nil {
+		return err
+	}
+
+	it.entries = it.entries[:0]
+	for _, obj := range out.Contents {
+		it.entries = append(it.entries, listEntry{key: strings.TrimPrefix(aws.StringValue(obj.Key), it.strip), obj: obj})
+	}
+	for _, cp := range out.CommonPrefixes {
+		it.entries = append(it.entries, listEntry{key: strings.TrimPrefix(aws.StringValue(cp.Prefix), it.strip), isPrefix: true})
+	}
+
+	// Contents and common prefixes are each sorted, but not together
+	sort.SliceStable(it.entries, func(i, j int) bool {
+		return it.entries[i].key < it.entries[j].key
+	})
+
+	it.pos = 0
+	it.fetched = true
+	it.nextToken = ""
+	if aws.BoolValue(out.IsTruncated) {
+		it.nextToken = aws.StringValue(out.NextContinuationToken)
+	}
+
+	return nil
+}
+
+// peek returns the next entry without consuming it, or nil at the end
+func (it *listIterator) peek() (*listEntry, error) {
+	for !it.done {
+		if !it.fetched {
+			if err := it.fetch(); err != nil {
+				return nil, err
+			}
+		}
+
+		if it.pos < len(it.entries) {
+			return &it.entries[it.pos], nil
+		}
+
+		if it.nextToken == "" {
+			it.done = true
+			break
+		}
+
+		it.pageToken = it.nextToken
+		it.fetched = false
+	}
+
+	return nil, nil
+}
+
+func (it *listIterator) advance() {
+	it.pos++
+}
+
+// mergeState is the decoded form of a merged continuation token
+type mergeState struct {
+	Last   string             `json:"l"`
+	Cursor []mergeCursorState `json:"c"`
+}
+
+type mergeCursorState struct {
+	Token string `json:"t,omitempty"`
+	Done  bool   `json:"d,omitempty"`
+}
+
+// mergeLister merges the listings of several iterators. Entries present in
+// more than one iterator are returned once, together with the indexes of
+// every iterator that had them.
+type mergeLister struct {
+	iters []*listIterator
+	last  string
+}
+
+// newMergeLister resumes the iterators from a continuation token previously
+// returned by token. Iterators are restarted on the page they were on, and
+// entries up to the last one returned are skipped.
+func newMergeLister(iters []*listIterator, continuationToken string) (*mergeLister, error) {
+	m := &mergeLister{iters: iters}
+	if continuationToken == "" {
+		return m, nil
+	}
+
+	invalid := awserr.NewRequestFailure(
+		awserr.New("InvalidArgument", "The continuation token provided is incorrect", nil),
+		http.StatusBadRequest, "")
+
+	raw, err := base64.RawURLEncoding.DecodeString(continuationToken)
+	if err != nil {
+		return nil, invalid
+	}
+
+	var state mergeState
+	if err := json.Unmarshal(raw, &state); err != nil || len(state.Cursor) != len(iters) {
+		return nil, invalid
+	}
+
+	m.last = state.Last
+	for i, it := range iters {
+		it.pageToken = state.Cursor[i].Token
+		it.done = state.Cursor[i].Done
+	}
+
+	return m, nil
+}
+
+// next returns the smallest remaining entry and the iterators it came from,
+// or nil when every iterator is exhausted
+func (m *mergeLister) next() (*listEntry, []int, error) {
+	for {
+		var min *listEntry
+		var sources []int
+
+		for i, it := range m.iters {
+			e, err := it.peek()
+			if err != nil {
+				return nil, nil, err
+			}
+			if e == nil {
+				continue
+			}
+
+			switch {
+			case min == nil || e.key < min.key:
+				min, sources = e, []int{i}
+			case e.key == min.key:
+				sources = append(sources, i)
+			}
+		}
+
+		if min == nil {
+			return nil, nil, nil
+		}
+
+		entry := *min
+		for _, i := range sources {
+			m.iters[i].advance()
+		}
+
+		// Skip what earlier pages already returned
+		if m.last != "" && entry.key <= m.last {
+			continue
+		}
+
+		m.last = entry.key
+		return &entry, sources, nil
+	}
+}
+
+// more reports whether any iterator has entries left
+func (m *mergeLister) more() (bool, error) {
+	for _, it := range m.iters {
+		e, err := it.peek()
+		if err != nil {
+			return false, err
+		}
+		if e != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// token encodes the position after the last entry returned by next
+func (m *mergeLister) token() string {
+	state := mergeState{Last: m.last}
+	for _, it := range m.iters {
+		state.Cursor = append(state.Cursor, mergeCursorState{Token: it.pageToken, Done: it.done})
+	}
+
+	data, _ := json.Marshal(state)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// mergedPage collects the entries of one merged ListObjectsV2 page
+type mergedPage struct {
+	out *s3.ListObjectsV2Output
+}
+
+func newMergedPage(prefix string, maxKeys int64) *mergedPage {
+	return &mergedPage{out: &s3.ListObjectsV2Output{
+		Prefix:      aws.String(prefix),
+		MaxKeys:     aws.Int64(maxKeys),
+		IsTruncated: aws.Bool(false),
+	}}
+}
+
+func (pg *mergedPage) add(e *listEntry) {
+	if e.isPrefix {
+		pg.out.CommonPrefixes = append(pg.out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(e.key)})
+	} else {
+		pg.out.Contents = append(pg.out.Contents, e.obj)
+	}
+}
+
+func (pg *mergedPage) count() int64 {
+	return int64(len(pg.out.Contents) + len(pg.out.CommonPrefixes))
+}
+
+// result finishes the page, marking it truncated if the merge has more
+func (pg *mergedPage) result(m *mergeLister) (*s3.ListObjectsV2Output, error) {
+	more, err := m.more()
+	if err != nil {
+		return nil, err
+	}
+
+	if more {
+		pg.out.IsTruncated = aws.Bool(true)
+		pg.out.NextContinuationToken = aws.String(m.token())
+	}
+	pg.out.KeyCount = aws.Int64(pg.count())
+
+	return pg.out, nil
+}
+
+// keyLocks serializes writes to the same key across the backends of a
+// composite, so copying a key between them never overwrites a newer write
+type keyLocks struct {
+	mu sync.Mutex
+	m  map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks key and returns the function unlocking it
+func (l *keyLocks) lock(key string) func() {
+	l.mu.Lock()
+	if l.m == nil {
+		l.m = make(map[string]*keyLock)
+	}
+	kl, ok := l.m[key]
+	if !ok {
+		kl = &keyLock{}
+		l.m[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+
+		l.mu.Lock()
+		kl.refs--
+		if kl.refs == 0 {
+			delete(l.m, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// spoolBody copies an object body to a temporary file, so it can be written
+// to another backend, which needs a seekable body. The file is positioned
+// at its start and must be released with removeSpool.
+func spoolBody(body io.Reader) (*os.File, error) {
+	spool, err := os.CreateTemp("", "s3proxy-spool-*")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(spool, body); err != nil {
+		removeSpool(spool)
+		return nil, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		removeSpool(spool)
+		return nil, err
+	}
+
+	return spool, nil
+}
+
+func removeSpool(spool *os.File) {
+	spool.Close()
+	os.Remove(spool.Name())
+}
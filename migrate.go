@@ -0,0 +1,743 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	migratePageSize      = 1000
+	migrateDefaultWorker = 4
+	// migrateRetryInterval is how long the worker waits after a failed
+	// listing, or between passes over keys that failed to copy
+	migrateRetryInterval = 30 * time.Second
+)
+
+func init() {
+	RegisterBackend("migrate", validateMigrateSite, func(s Site) (S3Proxy, error) {
+		source, err := NewBackend(s.Migrate.Source)
+		if err != nil {
+			return nil, fmt.Errorf("migration source: %v", err)
+		}
+		destination, err := NewBackend(s.Migrate.Destination)
+		if err != nil {
+			return nil, fmt.Errorf("migration destination: %v", err)
+		}
+
+		p, err := NewMigrateProxy(source, destination, s.Migrate.StateFile, s.Migrate.Workers)
+		if err != nil {
+			return nil, err
+		}
+
+		startWorker(p)
+		return p, nil
+	})
+}
+
+// MigrateConfig configures the migration backend. Source and Destination
+// are full site backend configurations (without host, users or options).
+// StateFile records the background copy's progress so it resumes after a
+// restart.
+type MigrateConfig struct {
+	Source      Site   `json:"source" yaml:"source"`
+	Destination Site   `json:"destination" yaml:"destination"`
+	StateFile   string `json:"stateFile" yaml:"stateFile"`
+	Workers     int    `json:"workers,omitempty" yaml:"workers,omitempty"`
+}
+
+func validateMigrateSite(s Site) error {
+	if s.Migrate == nil {
+		return errors.New("Migrate settings not specified")
+	}
+
+	if err := s.Migrate.Source.validate(); err != nil {
+		return fmt.Errorf("%v in migration source", err)
+	}
+	if err := s.Migrate.Destination.validate(); err != nil {
+		return fmt.Errorf("%v in migration destination", err)
+	}
+
+	if s.Migrate.StateFile == "" {
+		return errors.New("Migrate stateFile not specified")
+	}
+	if s.Migrate.Workers < 0 {
+		return errors.New("Migrate workers must not be negative")
+	}
+
+	return nil
+}
+
+// MigrationStatus reports the progress of a background migration
+type MigrationStatus struct {
+	Running   bool      `json:"running"`
+	Done      bool      `json:"done"`
+	Copied    int64     `json:"copied"`
+	Skipped   int64     `json:"skipped"`
+	Failed    int64     `json:"failed"`
+	Bytes     int64     `json:"bytes"`
+	Pending   int       `json:"pending"`
+	Started   time.Time `json:"started"`
+	Updated   time.Time `json:"updated"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// migrationState is persisted to the state file after every listing page
+// and every change to the deleted keys
+type migrationState struct {
+	MigrationStatus
+
+	// Token continues the source listing where the worker stopped
+	Token string `json:"token,omitempty"`
+	// Listed is set once the whole source listing has been walked
+	Listed bool `json:"listed,omitempty"`
+	// Retry holds keys whose copy failed, retried after the listing
+	Retry map[string]bool `json:"retry,omitempty"`
+	// Deleted holds keys deleted through the proxy that the source still
+	// has, so they are neither read from nor copied from the source
+	Deleted map[string]bool `json:"deleted,omitempty"`
+}
+
+// MigrateProxy moves a bucket from one backend to another while serving it.
+// Reads are served from the destination, falling back to the source and
+// copying what they read into the destination. Writes only go to the
+// destination. A background worker walks the source listing to copy
+// everything that is not read in the meantime.
+type MigrateProxy struct {
+	source      S3Proxy
+	destination S3Proxy
+	stateFile   string
+	workers     int
+
+	mu    sync.Mutex
+	state migrationState
+	locks keyLocks
+	// copying holds keys being copied outside the worker, so concurrent
+	// ranged reads of a missing key start one copy
+	copying map[string]bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewMigrateProxy creates a migration from source to destination, resuming
+// from stateFile if it exists. The background copy starts with Start.
+func NewMigrateProxy(source, destination S3Proxy, stateFile string, workers int) (*MigrateProxy, error) {
+	if workers <= 0 {
+		workers = migrateDefaultWorker
+	}
+
+	p := &MigrateProxy{
+		source:      source,
+		destination: destination,
+		stateFile:   stateFile,
+		workers:     workers,
+		copying:     make(map[string]bool),
+	}
+
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// load reads the state file, starting afresh if there is none
+func (p *MigrateProxy) load() error {
+	var state migrationState
+
+	data, err := os.ReadFile(p.stateFile)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("Invalid migration state file %s: %v", p.stateFile, err)
+		}
+	case os.IsNotExist(err):
+		state.Started = time.Now().UTC()
+	default:
+		return err
+	}
+
+	if state.Retry == nil {
+		state.Retry = make(map[string]bool)
+	}
+	if state.Deleted == nil {
+		state.Deleted = make(map[string]bool)
+	}
+	state.Running = false
+
+	p.mu.Lock()
+	p.state = state
+	p.mu.Unlock()
+
+	return nil
+}
+
+func (p *MigrateProxy) statePath() string {
+	return p.stateFile
+}
+
+// Start runs the background copy until it completes or Close is called
+func (p *MigrateProxy) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stop != nil || p.state.Done {
+		return
+	}
+
+	p.stop = make(chan struct{})
+	p.state.Running = true
+	p.wg.Add(1)
+	go p.run(p.stop)
+}
+
+// Close stops the background copy and waits for it to save its progress
+func (p *MigrateProxy) Close() error {
+	p.mu.Lock()
+	stop := p.stop
+	p.stop = nil
+	p.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		p.wg.Wait()
+	}
+	return nil
+}
+
+// MigrationStatus returns the progress of the background copy
+func (p *MigrateProxy) MigrationStatus() (MigrationStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := p.state.MigrationStatus
+	status.Pending = len(p.state.Retry)
+	return status, true
+}
+
+// saveLocked writes the state file atomically. p.mu must be held.
+func (p *MigrateProxy) saveLocked() error {
+	p.state.Updated = time.Now().UTC()
+
+	data, err := json.Marshal(&p.state)
+	if err != nil {
+		return err
+	}
+
+	tmp := p.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.stateFile)
+}
+
+func (p *MigrateProxy) run(stop chan struct{}) {
+	defer p.wg.Done()
+
+	wait := func() bool {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(migrateRetryInterval):
+			return true
+		}
+	}
+
+	for {
+		select {
+		case <-stop:
+			p.finish(false)
+			return
+		default:
+		}
+
+		p.mu.Lock()
+		listed, token := p.state.Listed, p.state.Token
+		retry := make([]string, 0, len(p.state.Retry))
+		for key := range p.state.Retry {
+			retry = append(retry, key)
+		}
+		p.mu.Unlock()
+
+		if listed {
+			if len(retry) == 0 {
+				p.finish(true)
+				return
+			}
+
+			if !p.copyAll(retry, stop) {
+				p.finish(false)
+				return
+			}
+
+			p.mu.Lock()
+			failed := len(p.state.Retry) > 0
+			p.mu.Unlock()
+			if failed && !wait() {
+				p.finish(false)
+				return
+			}
+			continue
+		}
+
+		out, err := p.source.ListObjects("", "", migratePageSize, token)
+		if err != nil {
+			p.recordError(err)
+			if !wait() {
+				p.finish(false)
+				return
+			}
+			continue
+		}
+
+		keys := make([]string, 0, len(out.Contents))
+		for _, obj := range out.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		if !p.copyAll(keys, stop) {
+			// Interrupted part way, so redo this page on the next start
+			p.finish(false)
+			return
+		}
+
+		p.mu.Lock()
+		if aws.BoolValue(out.IsTruncated) {
+			p.state.Token = aws.StringValue(out.NextContinuationToken)
+		} else {
+			p.state.Token = ""
+			p.state.Listed = true
+		}
+		if err := p.saveLocked(); err != nil {
+			log.Printf("migration: saving state: %v", err)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// finish records the worker stopping and saves the state
+func (p *MigrateProxy) finish(done bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.state.Running = false
+	p.state.Done = done
+	if err := p.saveLocked(); err != nil {
+		log.Printf("migration: saving state: %v", err)
+	}
+}
+
+func (p *MigrateProxy) recordError(err error) {
+	log.Printf("migration: %v", err)
+
+	p.mu.Lock()
+	p.state.LastError = err.Error()
+	p.mu.Unlock()
+}
+
+// copyAll copies keys with the configured number of workers. It returns
+// false if stop was closed before every key was attempted.
+func (p *MigrateProxy) copyAll(keys []string, stop chan struct{}) bool {
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				p.copyKey(key)
+			}
+		}()
+	}
+
+	completed := true
+send:
+	for _, key := range keys {
+		select {
+		case work <- key:
+		case <-stop:
+			completed = false
+			break send
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	return completed
+}
+
+// copyKey copies one key from the source unless the destination already
+// has it, recording the outcome
+func (p *MigrateProxy) copyKey(key string) {
+	copied, n, err := p.copyFromSource(key)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case err != nil:
+		p.state.Failed++
+		p.state.LastError = err.Error()
+		p.state.Retry[key] = true
+	case copied:
+		p.state.Copied++
+		p.state.Bytes += n
+		delete(p.state.Retry, key)
+	default:
+		p.state.Skipped++
+		delete(p.state.Retry, key)
+	}
+
+	if err != nil {
+		log.Printf("migration: copying %s: %v", key, err)
+	}
+}
+
+func (p *MigrateProxy) isDeleted(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.state.Deleted[key]
+}
+
+// inDestination reports whether the destination has key
+func (p *MigrateProxy) inDestination(key string) (bool, error) {
+	_, err := p.destination.Head(key)
+	if err == nil {
+		return true, nil
+	}
+	if isNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (p *MigrateProxy) copyFromSource(key string) (bool, int64, error) {
+	if p.isDeleted(key) {
+		return false, 0, nil
+	}
+	if ok, err := p.inDestination(key); ok || err != nil {
+		return false, 0, err
+	}
+
+	obj, err := p.source.Get(key, "")
+	if isNotFound(err) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	defer obj.Body.Close()
+
+	spool, err := spoolBody(obj.Body)
+	if err != nil {
+		return false, 0, err
+	}
+	defer removeSpool(spool)
+
+	return p.fill(key, spool, aws.StringValue(obj.ContentType))
+}
+
+// fill writes a copy of a source object to the destination, unless the key
+// was written or deleted through the proxy while it was being read
+func (p *MigrateProxy) fill(key string, spool *os.File, contentType string) (bool, int64, error) {
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	if p.isDeleted(key) {
+		return false, 0, nil
+	}
+	if ok, err := p.inDestination(key); ok || err != nil {
+		return false, 0, err
+	}
+
+	n, err := spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, 0, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return false, 0, err
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	if _, err := p.destination.Put(key, spool, contentType); err != nil {
+		return false, 0, err
+	}
+	return true, n, nil
+}
+
+// copyInBackground copies a key read from the source with a range, which
+// cannot be copied from the response itself
+func (p *MigrateProxy) copyInBackground(key string) {
+	p.mu.Lock()
+	if p.copying[key] {
+		p.mu.Unlock()
+		return
+	}
+	p.copying[key] = true
+	p.mu.Unlock()
+
+	go func() {
+		p.copyKey(key)
+
+		p.mu.Lock()
+		delete(p.copying, key)
+		p.mu.Unlock()
+	}()
+}
+
+// migrateTee spools a source object to a temporary file as the client reads
+// it, and copies it to the destination once it has been read in full
+type migrateTee struct {
+	io.ReadCloser
+	p           *MigrateProxy
+	key         string
+	contentType string
+	size        int64
+	spool       *os.File
+	n           int64
+	failed      bool
+	handedOff   bool
+}
+
+func (t *migrateTee) Read(b []byte) (int, error) {
+	n, err := t.ReadCloser.Read(b)
+	if n > 0 && !t.failed {
+		if _, werr := t.spool.Write(b[:n]); werr != nil {
+			t.failed = true
+		}
+	}
+	t.n += int64(n)
+
+	if err == io.EOF && !t.failed && !t.handedOff && t.n == t.size {
+		t.handedOff = true
+		go func() {
+			defer removeSpool(t.spool)
+
+			copied, n, err := t.p.fill(t.key, t.spool, t.contentType)
+			t.p.recordFill(t.key, copied, n, err)
+		}()
+	}
+
+	return n, err
+}
+
+func (t *migrateTee) Close() error {
+	err := t.ReadCloser.Close()
+	if !t.handedOff {
+		t.handedOff = true
+		removeSpool(t.spool)
+	}
+	return err
+}
+
+// recordFill counts a copy made by a read, which the worker then skips
+func (p *MigrateProxy) recordFill(key string, copied bool, n int64, err error) {
+	if err != nil {
+		log.Printf("migration: copying %s on read: %v", key, err)
+		return
+	}
+
+	if copied {
+		p.mu.Lock()
+		p.state.Copied++
+		p.state.Bytes += n
+		p.mu.Unlock()
+	}
+}
+
+func (p *MigrateProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	out, err := p.destination.Get(key, rangeHeader)
+	if err == nil || !isNotFound(err) || p.isDeleted(key) {
+		return out, err
+	}
+
+	out, err = p.source.Get(key, rangeHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	if out.ContentRange != nil || out.ContentLength == nil {
+		p.copyInBackground(key)
+		return out, nil
+	}
+
+	spool, err := os.CreateTemp("", "s3proxy-spool-*")
+	if err != nil {
+		// Serve the read anyway and leave the copy to the worker
+		log.Printf("migration: %v", err)
+		return out, nil
+	}
+
+	out.Body = &migrateTee{
+		ReadCloser:  out.Body,
+		p:           p,
+		key:         key,
+		contentType: aws.StringValue(out.ContentType),
+		size:        aws.Int64Value(out.ContentLength),
+		spool:       spool,
+	}
+	return out, nil
+}
+
+func (p *MigrateProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	out, err := p.destination.Head(key)
+	if err == nil || !isNotFound(err) || p.isDeleted(key) {
+		return out, err
+	}
+
+	return p.source.Head(key)
+}
+
+// setDeleted records or clears a delete of a key the source still has
+func (p *MigrateProxy) setDeleted(key string, deleted bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state.Deleted[key] == deleted {
+		return nil
+	}
+
+	if deleted {
+		p.state.Deleted[key] = true
+	} else {
+		delete(p.state.Deleted, key)
+	}
+	return p.saveLocked()
+}
+
+func (p *MigrateProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	out, err := p.destination.Put(key, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.setDeleted(key, false); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (p *MigrateProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	out, err := p.destination.Delete(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The source is never written to, so remember the delete instead
+	_, err = p.source.Head(key)
+	if isNotFound(err) {
+		return out, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.setDeleted(key, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListObjects merges the destination and source listings. Common prefixes
+// of the source are listed even if every key below them was deleted.
+func (p *MigrateProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	if maxKeys <= 0 || maxKeys > defaultMaxKeys {
+		maxKeys = defaultMaxKeys
+	}
+
+	m, err := newMergeLister([]*listIterator{
+		{proxy: p.destination, prefix: prefix, delimiter: delimiter, pageSize: maxKeys},
+		{proxy: p.source, prefix: prefix, delimiter: delimiter, pageSize: maxKeys},
+	}, continuationToken)
+	if err != nil {
+		return nil, err
+	}
+
+	page := newMergedPage(prefix, maxKeys)
+	for page.count() < maxKeys {
+		e, sources, err := m.next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+
+		if sources[0] == 1 && !e.isPrefix && p.isDeleted(e.key) {
+			continue
+		}
+		page.add(e)
+	}
+
+	return page.result(m)
+}
+
+func (p *MigrateProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	return p.destination.CreateMultipartUpload(key, contentType)
+}
+
+func (p *MigrateProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	return p.destination.UploadPart(key, uploadId, partNumber, body)
+}
+
+func (p *MigrateProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	out, err := p.destination.CompleteMultipartUpload(key, uploadId, parts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.setDeleted(key, false); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (p *MigrateProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	return p.destination.AbortMultipartUpload(key, uploadId)
+}
+
+func (p *MigrateProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	return p.destination.ListMultipartUploads(prefix, delimiter, maxUploads)
+}
+
+func (p *MigrateProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	out, err := p.destination.GetWebsiteConfig()
+	if err == nil {
+		return out, nil
+	}
+	return p.source.GetWebsiteConfig()
+}
+
+func (p *MigrateProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	ok, err := p.inDestination(key)
+	switch {
+	case err != nil:
+		return nil, err
+	case ok:
+		return p.destination.RestoreObject(key, days, tier)
+	case p.isDeleted(key):
+		return nil, errNoSuchKey(key)
+	}
+
+	return p.source.RestoreObject(key, days, tier)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMigrateProxy(t *testing.T) (*MigrateProxy, *MemoryProxy, *MemoryProxy) {
+	t.Helper()
+
+	source := NewMemoryProxy(0, 0, nil)
+	destination := NewMemoryProxy(0, 0, nil)
+	p, err := NewMigrateProxy(source, destination, filepath.Join(t.TempDir(), "state.json"), 2)
+	if err != nil {
+		t.Fatalf("NewMigrateProxy() error = %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return p, source, destination
+}
+
+// waitFor polls until cond holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func inProxy(p S3Proxy, key string) func() bool {
+	return func() bool {
+		_, err := p.Head(key)
+		return err == nil
+	}
+}
+
+func TestMigrateProxy_ReadThrough(t *testing.T) {
+	p, source, destination := newTestMigrateProxy(t)
+
+	putString(t, source, "full", "copied while read")
+	putString(t, source, "ranged", "copied in the background")
+	putString(t, source, "abandoned", "never read to the end")
+
+	if got := getString(t, p, "full", ""); got != "copied while read" {
+		t.Errorf("Get() = %q", got)
+	}
+	waitFor(t, "read-through copy", inProxy(destination, "full"))
+	if got := getString(t, destination, "full", ""); got != "copied while read" {
+		t.Errorf("destination has %q", got)
+	}
+
+	if got := getString(t, p, "ranged", "bytes=0-5"); got != "copied" {
+		t.Errorf("Get() with range = %q", got)
+	}
+	waitFor(t, "background copy", inProxy(destination, "ranged"))
+
+	obj, err := p.Get("abandoned", "")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	io.CopyN(io.Discard, obj.Body, 3)
+	obj.Body.Close()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := destination.Head("abandoned"); !isNotFound(err) {
+		t.Errorf("partially read object was copied: %v", err)
+	}
+
+	if status, _ := p.MigrationStatus(); status.Copied != 2 || status.Bytes != int64(len("copied while read")+len("copied in the background")) {
+		t.Errorf("MigrationStatus() = %+v", status)
+	}
+}
+
+func TestMigrateProxy_Writes(t *testing.T) {
+	p, source, destination := newTestMigrateProxy(t)
+
+	putString(t, source, "old", "source")
+	putString(t, source, "kept", "source")
+	putString(t, p, "new", "destination")
+
+	if _, err := source.Head("new"); !isNotFound(err) {
+		t.Errorf("write reached the source: %v", err)
+	}
+	if got := getString(t, destination, "new", ""); got != "destination" {
+		t.Errorf("destination has %q", got)
+	}
+
+	if _, err := p.Delete("old"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := p.Get("old", ""); !isNotFound(err) {
+		t.Errorf("Get() after delete error = %v, want not found", err)
+	}
+	if _, err := source.Head("old"); err != nil {
+		t.Errorf("delete reached the source: %v", err)
+	}
+
+	keys, _ := listAll(t, p, "", "", 1)
+	if want := []string{"kept", "new"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+
+	// Deletes survive a restart and are undone by writing the key again
+	restarted, err := NewMigrateProxy(source, destination, p.stateFile, 1)
+	if err != nil {
+		t.Fatalf("NewMigrateProxy() error = %v", err)
+	}
+	if _, err := restarted.Head("old"); !isNotFound(err) {
+		t.Errorf("Head() after restart error = %v, want not found", err)
+	}
+	putString(t, restarted, "old", "rewritten")
+	if got := getString(t, restarted, "old", ""); got != "rewritten" {
+		t.Errorf("Get() after rewrite = %q", got)
+	}
+}
+
+func TestMigrateProxy_Background(t *testing.T) {
+	p, source, destination := newTestMigrateProxy(t)
+
+	var want []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("obj/%02d", i)
+		putString(t, source, key, key)
+		want = append(want, key)
+	}
+
+	// Newer writes and deletes through the proxy are not overwritten
+	putString(t, p, "obj/00", "newer")
+	p.Delete("obj/01")
+	want = want[1:]
+
+	p.Start()
+	waitFor(t, "migration to finish", func() bool { status, _ := p.MigrationStatus(); return status.Done })
+
+	keys, _ := listAll(t, destination, "", "", 0)
+	if !reflect.DeepEqual(keys, append([]string{"obj/00"}, want[1:]...)) {
+		t.Errorf("destination keys = %v", keys)
+	}
+	if got := getString(t, destination, "obj/00", ""); got != "newer" {
+		t.Errorf("copy overwrote a newer write: %q", got)
+	}
+
+	status, _ := p.MigrationStatus()
+	if status.Running || status.Copied != 23 || status.Skipped != 2 || status.Failed != 0 {
+		t.Errorf("MigrationStatus() = %+v", status)
+	}
+
+	data, err := os.ReadFile(p.stateFile)
+	if err != nil {
+		t.Fatalf("reading state file: %v", err)
+	}
+	var saved migrationState
+	if err := json.Unmarshal(data, &saved); err != nil || !saved.Done || !saved.Listed {
+		t.Errorf("state file = %s, %v", data, err)
+	}
+}
+
+func TestMigrateProxy_Resume(t *testing.T) {
+	source := NewMemoryProxy(0, 0, nil)
+	destination := NewMemoryProxy(0, 0, nil)
+	for _, key := range []string{"a", "b", "c"} {
+		putString(t, source, key, key)
+	}
+
+	// A previous run walked the whole listing but failed to copy b
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(stateFile, []byte(`{"copied":2,"listed":true,"retry":{"b":true}}`), 0644)
+
+	p, err := NewMigrateProxy(source, destination, stateFile, 1)
+	if err != nil {
+		t.Fatalf("NewMigrateProxy() error = %v", err)
+	}
+	defer p.Close()
+
+	p.Start()
+	waitFor(t, "migration to finish", func() bool { status, _ := p.MigrationStatus(); return status.Done })
+
+	keys, _ := listAll(t, destination, "", "", 0)
+	if want := []string{"b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("destination keys = %v, want %v", keys, want)
+	}
+	if status, _ := p.MigrationStatus(); status.Copied != 3 || status.Pending != 0 {
+		t.Errorf("MigrationStatus() = %+v", status)
+	}
+
+	if _, err := NewMigrateProxy(source, destination, filepath.Join(t.TempDir(), "missing", "state.json"), 1); err != nil {
+		t.Errorf("NewMigrateProxy() without a state file error = %v", err)
+	}
+	os.WriteFile(stateFile, []byte("{"), 0644)
+	if _, err := NewMigrateProxy(source, destination, stateFile, 1); err == nil {
+		t.Error("NewMigrateProxy() with a corrupt state file should fail")
+	}
+}
+
+func TestHandleMigrationStatus(t *testing.T) {
+	p, _, _ := newTestMigrateProxy(t)
+
+	tests := []struct {
+		name       string
+		proxy      S3Proxy
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "migrating", proxy: p, wantStatus: http.StatusOK, wantBody: `"copied":0`},
+		{name: "not migrating", proxy: NewMemoryProxy(0, 0, nil), wantStatus: http.StatusNotImplemented},
+		{
+			name:       "migrating behind caches",
+			proxy:      NewCoalescingProxy(NewMemoryCacheProxy(p, 1<<20, 0, time.Minute, 0), 0),
+			wantStatus: http.StatusOK,
+			wantBody:   `"copied":0`,
+		},
+		{
+			name:       "not migrating behind caches",
+			proxy:      NewCoalescingProxy(NewMemoryCacheProxy(NewMemoryProxy(0, 0, nil), 1<<20, 0, time.Minute, 0), 0),
+			wantStatus: http.StatusNotImplemented,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			NewProxyHandler(tt.proxy, "", "bucket").ServeHTTP(rr, httptest.NewRequest("GET", "/bucket?migration", nil))
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", rr.Code, tt.wantStatus)
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultMultipartPutThreshold   = 64 << 20
+	defaultMultipartPutPartSize    = 16 << 20
+	defaultMultipartPutParallelism = 4
+	// minMultipartPartSize is the smallest part S3 accepts but for the last
+	minMultipartPartSize = 5 << 20
+	// maxMultipartParts is the most parts S3 accepts in an upload
+	maxMultipartParts = 10000
+)
+
+// MultipartPutConfig turns PUTs of more than Threshold bytes (default
+// 64 MiB) into multipart uploads to the backend, in parts of PartSize bytes
+// (default 16 MiB) with Parallelism of them (default 4) uploading at once.
+type MultipartPutConfig struct {
+	Threshold   int64 `json:"threshold,omitempty" yaml:"threshold,omitempty"`
+	PartSize    int64 `json:"partSize,omitempty" yaml:"partSize,omitempty"`
+	Parallelism int   `json:"parallelism,omitempty" yaml:"parallelism,omitempty"`
+}
+
+func (c *MultipartPutConfig) validate() error {
+	if c.Threshold < 0 || c.Parallelism < 0 {
+		return errors.New("Multipart PUT threshold and parallelism must not be negative")
+	}
+	if c.PartSize != 0 && c.PartSize < minMultipartPartSize {
+		return fmt.Errorf("Multipart PUT partSize must be at least %d bytes", minMultipartPartSize)
+	}
+	return nil
+}
+
+// MultipartPutProxy stores large PUTs as multipart uploads, reading the
+// body one part at a time so at most parallelism+1 parts are held in
+// memory. Bodies up to the threshold, and bodies of unknown size until they
+// pass it, are read whole first, so a PUT may also hold up to threshold
+// bytes. Failed uploads are aborted.
+type MultipartPutProxy struct {
+	S3Proxy
+	threshold   int64
+	partSize    int64
+	parallelism int
+}
+
+func NewMultipartPutProxy(backend S3Proxy, threshold, partSize int64, parallelism int) *MultipartPutProxy {
+	if threshold <= 0 {
+		threshold = defaultMultipartPutThreshold
+	}
+	if partSize <= 0 {
+		partSize = defaultMultipartPutPartSize
+	}
+	if parallelism <= 0 {
+		parallelism = defaultMultipartPutParallelism
+	}
+
+	return &MultipartPutProxy{S3Proxy: backend, threshold: threshold, partSize: partSize, parallelism: parallelism}
+}
+
+// PutStream stores a body of size bytes, or of unknown size if it is -1.
+// Bodies up to the threshold are read into memory and stored with Put, and
+// bodies known to be larger go straight into parts.
+func (p *MultipartPutProxy) PutStream(key string, body io.Reader, size int64, contentType string) (*s3.PutObjectOutput, error) {
+	if size > p.threshold {
+		return p.putMultipart(key, body, size, contentType)
+	}
+
+	head, err := io.ReadAll(io.LimitReader(body, p.threshold+1))
+	if err != nil {
+		return nil, errIncompleteBody()
+	}
+
+	if int64(len(head)) <= p.threshold {
+		// That was the whole body
+		if size >= 0 && int64(len(head)) != size {
+			return nil, errIncompleteBody()
+		}
+		return p.S3Proxy.Put(key, bytes.NewReader(head), contentType)
+	}
+
+	return p.putMultipart(key, io.MultiReader(bytes.NewReader(head), body), size, contentType)
+}
+
+// Put uploads bodies over the threshold in parts
+func (p *MultipartPutProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if size <= p.threshold {
+		return p.S3Proxy.Put(key, body, contentType)
+	}
+	return p.putMultipart(key, body, size, contentType)
+}
+
+func (p *MultipartPutProxy) putMultipart(key string, body io.Reader, size int64, contentType string) (*s3.PutObjectOutput, error) {
+	partSize := p.partSize
+	if size > 0 && (size+partSize-1)/partSize > maxMultipartParts {
+		partSize = (size + maxMultipartParts - 1) / maxMultipartParts
+	}
+
+	created, err := p.S3Proxy.CreateMultipartUpload(key, contentType)
+	if err != nil {
+		return nil, err
+	}
+	uploadId := aws.StringValue(created.UploadId)
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		parts []*s3.CompletedPart
+		total int64
+		sem   = make(chan struct{}, p.parallelism)
+	)
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return err
+	}
+	fail := func(e error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			err = e
+		}
+	}
+
+	for n := int64(1); failed() == nil; n++ {
+		data := make([]byte, partSize)
+		read, readErr := io.ReadFull(body, data)
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil && readErr != io.ErrUnexpectedEOF {
+			fail(errIncompleteBody())
+			break
+		}
+		if n > maxMultipartParts {
+			fail(errInvalidArgument(fmt.Sprintf("Objects of unknown size are limited to %d parts", maxMultipartParts)))
+			break
+		}
+		total += int64(read)
+
+		mu.Lock()
+		parts = append(parts, nil)
+		mu.Unlock()
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(n int64, data []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			out, err := p.S3Proxy.UploadPart(key, uploadId, n, bytes.NewReader(data))
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			mu.Lock()
+			parts[n-1] = &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(n)}
+			mu.Unlock()
+		}(n, data[:read])
+
+		if readErr == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	wg.Wait()
+
+	if err == nil && size >= 0 && total != size {
+		err = errIncompleteBody()
+	}
+
+	var completed *s3.CompleteMultipartUploadOutput
+	if err == nil {
+		completed, err = p.S3Proxy.CompleteMultipartUpload(key, uploadId, parts)
+	}
+	if err != nil {
+		if _, abortErr := p.S3Proxy.AbortMultipartUpload(key, uploadId); abortErr != nil {
+			log.Printf("multipart put: aborting upload %s of %s: %v", uploadId, key, abortErr)
+		}
+		return nil, err
+	}
+
+	return &s3.PutObjectOutput{ETag: completed.ETag, VersionId: completed.VersionId}, nil
+}
+
+// GetForClient keeps the backend's per-client reads, such as read-ahead
+func (p *MultipartPutProxy) GetForClient(client string, key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	if cg, ok := p.S3Proxy.(ClientGetter); ok {
+		return cg.GetForClient(client, key, rangeHeader)
+	}
+	return p.S3Proxy.Get(key, rangeHeader)
+}
+
+// PutIfAbsent uses the backend's atomic create. Backends without one leave
+// create-only writes to handlePut's existence check.
+func (p *MultipartPutProxy) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	if cp, ok := p.S3Proxy.(ConditionalPutter); ok {
+		return cp.PutIfAbsent(key, body, contentType)
+	}
+	return nil, errNotImplemented("Atomic create")
+}
+
+// PurgeCache purges the caches behind the proxy
+func (p *MultipartPutProxy) PurgeCache(key string, prefix bool) int {
+	return purgeCache(p.S3Proxy, key, prefix)
+}
+
+// HasCache reports whether there is a cache behind the proxy
+func (p *MultipartPutProxy) HasCache() bool {
+	return hasCache(p.S3Proxy)
+}
+
+// MigrationStatus reports the migration of the backend behind the proxy
+func (p *MultipartPutProxy) MigrationStatus() (MigrationStatus, bool) {
+	return migrationStatus(p.S3Proxy)
+}
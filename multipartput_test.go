@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// brokenReader returns its content, then fails as a dropped connection
+// would
+type brokenReader struct {
+	io.Reader
+}
+
+func (r brokenReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err == io.EOF {
+		err = errors.New("connection reset by peer")
+	}
+	return n, err
+}
+
+func TestMultipartPutProxy_PutStream(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		size      int64 // -1 for the content's length unknown
+		wantPuts  int
+		wantParts int
+	}{
+		{name: "small", content: testContent(80), size: 80, wantPuts: 1},
+		{name: "at the threshold", content: testContent(100), size: 100, wantPuts: 1},
+		{name: "large", content: testContent(250), size: 250, wantParts: 8},
+		{name: "small of unknown size", content: testContent(80), size: -1, wantPuts: 1},
+		{name: "large of unknown size", content: testContent(250), size: -1, wantParts: 8},
+		{name: "just over the threshold", content: testContent(101), size: 101, wantParts: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newFakeProxy()
+			p := NewMultipartPutProxy(backend, 100, 32, 3)
+
+			if _, err := p.PutStream("key", strings.NewReader(tt.content), tt.size, "text/plain"); err != nil {
+				t.Fatalf("PutStream() error = %v", err)
+			}
+			if got := getString(t, backend, "key", ""); got != tt.content {
+				t.Errorf("stored %q, want %q", got, tt.content)
+			}
+			if backend.puts != tt.wantPuts || backend.parts != tt.wantParts {
+				t.Errorf("backend saw %d PUTs and %d parts, want %d and %d", backend.puts, backend.parts, tt.wantPuts, tt.wantParts)
+			}
+
+			head, err := backend.Head("key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := aws.StringValue(head.ContentType); got != "text/plain" {
+				t.Errorf("ContentType = %q", got)
+			}
+		})
+	}
+}
+
+func TestMultipartPutProxy_Failures(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     io.Reader
+		size     int64
+		failPart int64
+	}{
+		{name: "part upload fails", body: strings.NewReader(testContent(250)), size: 250, failPart: 3},
+		{name: "body shorter than its size", body: strings.NewReader(testContent(250)), size: 300},
+		{name: "body longer than its size", body: strings.NewReader(testContent(250)), size: 200},
+		{name: "small body shorter than its size", body: strings.NewReader(testContent(50)), size: 60},
+		{name: "client goes away", body: brokenReader{strings.NewReader(testContent(250))}, size: 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newFakeProxy()
+			backend.failPart = tt.failPart
+			p := NewMultipartPutProxy(backend, 100, 32, 3)
+
+			if _, err := p.PutStream("key", tt.body, tt.size, "text/plain"); err == nil {
+				t.Fatal("PutStream() succeeded")
+			}
+			if _, err := backend.Head("key"); !isNotFound(err) {
+				t.Errorf("Head() error = %v, want not found", err)
+			}
+
+			uploads, err := backend.ListMultipartUploads("", "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(uploads.Uploads) != 0 {
+				t.Errorf("%d uploads left behind, want them aborted", len(uploads.Uploads))
+			}
+		})
+	}
+}
+
+func TestMultipartPutProxy_StreamsLargeBodies(t *testing.T) {
+	backend := newFakeProxy()
+	p := NewMultipartPutProxy(backend, 100, 32, 3)
+
+	// A body known to be over the threshold is not read up to it first, so
+	// the parts before a dropped connection are already uploading
+	body := brokenReader{strings.NewReader(testContent(80))}
+	if _, err := p.PutStream("key", body, 400, "text/plain"); err == nil {
+		t.Fatal("PutStream() succeeded")
+	}
+	if backend.parts != 2 {
+		t.Errorf("backend saw %d parts before the body broke, want 2", backend.parts)
+	}
+}
+
+func TestMultipartPutProxy_Put(t *testing.T) {
+	backend := newFakeProxy()
+	p := NewMultipartPutProxy(backend, 100, 32, 3)
+
+	content := testContent(200)
+	putString(t, p, "key", content)
+	if got := getString(t, backend, "key", ""); got != content || backend.parts != 7 {
+		t.Errorf("stored %q in %d parts", got, backend.parts)
+	}
+}
+
+func TestHandlePut_Streams(t *testing.T) {
+	backend := newFakeProxy()
+	p := NewMultipartPutProxy(backend, 100, 32, 3)
+
+	content := testContent(250)
+	r := httptest.NewRequest(http.MethodPut, "/key", strings.NewReader(content))
+	w := httptest.NewRecorder()
+	handlePut(p, "key", w, r)
+
+	if w.Code != http.StatusOK || !strings.HasSuffix(w.Header().Get("ETag"), `-8"`) {
+		t.Errorf("PUT returned %d with ETag %s", w.Code, w.Header().Get("ETag"))
+	}
+	if got := getString(t, backend, "key", ""); got != content {
+		t.Errorf("stored %q", got)
+	}
+}
+
+func TestHandlePut_CreateOnlyWithoutAtomicCreate(t *testing.T) {
+	backend := newFakeProxy()
+	p := NewMultipartPutProxy(backend, 100, 32, 3)
+
+	if _, err := p.PutIfAbsent("key", strings.NewReader("body"), "text/plain"); !isNotImplemented(err) || backend.puts != 0 {
+		t.Fatalf("PutIfAbsent() error = %v after %d puts, want NotImplemented", err, backend.puts)
+	}
+
+	// handlePut falls back on its existence check
+	for _, want := range []int{http.StatusOK, http.StatusPreconditionFailed} {
+		r := httptest.NewRequest(http.MethodPut, "/key", strings.NewReader("body"))
+		r.Header.Set("If-None-Match", "*")
+		w := httptest.NewRecorder()
+		handlePut(p, "key", w, r)
+
+		if w.Code != want {
+			t.Errorf("create-only PUT returned %d, want %d", w.Code, want)
+		}
+	}
+	if backend.puts != 1 {
+		t.Errorf("backend saw %d puts, want one", backend.puts)
+	}
+}
+
+func TestMultipartPutConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  MultipartPutConfig
+		wantErr bool
+	}{
+		{name: "default", config: MultipartPutConfig{}},
+		{name: "sizes", config: MultipartPutConfig{Threshold: 1 << 30, PartSize: 64 << 20, Parallelism: 8}},
+		{name: "part too small", config: MultipartPutConfig{PartSize: 1 << 20}, wantErr: true},
+		{name: "negative threshold", config: MultipartPutConfig{Threshold: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultParallelGetPartSize    = 8 << 20
+	defaultParallelGetParallelism = 4
+	defaultParallelGetMaxMemory   = 128 << 20
+)
+
+// ParallelGetConfig splits GETs of more than PartSize bytes (default
+// 8 MiB) into range requests of about that size, Parallelism of them
+// (default 4) in flight at once. Objects uploaded in parts are split on
+// their part boundaries when the backend can tell them. The ranges held in
+// memory by all of the site's downloads total at most MaxMemory bytes
+// (default 128 MiB); downloads over the budget fetch fewer ranges ahead.
+type ParallelGetConfig struct {
+	PartSize    int64 `json:"partSize,omitempty" yaml:"partSize,omitempty"`
+	Parallelism int   `json:"parallelism,omitempty" yaml:"parallelism,omitempty"`
+	MaxMemory   int64 `json:"maxMemory,omitempty" yaml:"maxMemory,omitempty"`
+}
+
+func (c *ParallelGetConfig) validate() error {
+	if c.PartSize < 0 {
+		return errors.New("Parallel GET partSize must not be negative")
+	}
+	if c.Parallelism < 0 {
+		return errors.New("Parallel GET parallelism must not be negative")
+	}
+	if c.MaxMemory < 0 {
+		return errors.New("Parallel GET maxMemory must not be negative")
+	}
+	return nil
+}
+
+// memoryBudget limits the bytes held by concurrent users
+type memoryBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	max  int64
+	used int64
+}
+
+func newMemoryBudget(max int64) *memoryBudget {
+	b := &memoryBudget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// reserve takes n bytes of the budget, or the whole budget if n is larger,
+// and returns the amount taken. It waits for them to be free if wait is
+// set, and otherwise returns 0 when they are not.
+func (b *memoryBudget) reserve(n int64, wait bool) int64 {
+	if n > b.max {
+		n = b.max
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.used+n > b.max {
+		if !wait {
+			return 0
+		}
+		b.cond.Wait()
+	}
+	b.used += n
+	return n
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+	b.cond.Broadcast()
+}
+
+// ParallelGetProxy downloads large objects from the backend in concurrent
+// range requests, and streams the ranges to the client in order. The first
+// range is streamed as it arrives while the following ones are fetched
+// into memory once the client starts reading, so a read holds at most
+// parallelism ranges, and all reads together at most maxMemory bytes.
+type ParallelGetProxy struct {
+	S3Proxy
+	partSize    int64
+	parallelism int
+	budget      *memoryBudget
+}
+
+func NewParallelGetProxy(backend S3Proxy, partSize int64, parallelism int, maxMemory int64) *ParallelGetProxy {
+	if partSize <= 0 {
+		partSize = defaultParallelGetPartSize
+	}
+	if parallelism <= 0 {
+		parallelism = defaultParallelGetParallelism
+	}
+	if maxMemory <= 0 {
+		maxMemory = defaultParallelGetMaxMemory
+	}
+
+	return &ParallelGetProxy{
+		S3Proxy:     backend,
+		partSize:    partSize,
+		parallelism: parallelism,
+		budget:      newMemoryBudget(maxMemory),
+	}
+}
+
+func isInvalidRange(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() == http.StatusRequestedRangeNotSatisfiable
+}
+
+func (p *ParallelGetProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	// Suffix ranges need the object's size to be split, so they go to the
+	// backend as they are
+	var start, end int64 = 0, -1
+	if rangeHeader != "" {
+		m := byteRangePattern.FindStringSubmatch(strings.TrimSpace(rangeHeader))
+		if m == nil || m[1] == "" {
+			return p.S3Proxy.Get(key, rangeHeader)
+		}
+		start, _ = strconv.ParseInt(m[1], 10, 64)
+		if m[2] != "" {
+			end, _ = strconv.ParseInt(m[2], 10, 64)
+			if end < start {
+				return p.S3Proxy.Get(key, rangeHeader)
+			}
+		}
+	}
+
+	// The first request ends on a part boundary and tells the object's
+	// size and ETag
+	firstEnd := (start/p.partSize+1)*p.partSize - 1
+	if end >= 0 && end < firstEnd {
+		firstEnd = end
+	}
+	out, err := p.S3Proxy.Get(key, fmt.Sprintf("bytes=%d-%d", start, firstEnd))
+	if err != nil {
+		if rangeHeader == "" && isInvalidRange(err) {
+			// Empty objects have no first byte to ask for
+			return p.S3Proxy.Get(key, "")
+		}
+		return nil, err
+	}
+	if out.ContentRange == nil {
+		// The backend ignored the range and sent the whole object
+		return out, nil
+	}
+
+	_, gotEnd, size, ok := parseContentRange(aws.StringValue(out.ContentRange))
+	if !ok {
+		return out, nil
+	}
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+
+	if gotEnd < end {
+		chunks := p.split(key, aws.StringValue(out.ETag), gotEnd+1, end)
+		out.Body = newParallelReader(p, key, aws.StringValue(out.ETag), out.Body, chunks)
+		out.ContentLength = aws.Int64(end - start + 1)
+	}
+
+	out.ContentRange = aws.String(contentRange(start, end, size))
+	if rangeHeader == "" {
+		out.ContentRange = nil
+	}
+	return out, nil
+}
+
+// split divides bytes start to end into the ranges to fetch. For objects
+// uploaded in parts the ranges are a whole number of parts.
+func (p *ParallelGetProxy) split(key, etag string, start, end int64) []*parallelChunk {
+	chunkSize := p.partSize
+	if ps, ok := p.S3Proxy.(PartSizer); ok && strings.Contains(etag, "-") {
+		if partSize, err := ps.PartSize(key); err == nil && partSize > 0 {
+			n := (p.partSize + partSize/2) / partSize
+			if n < 1 {
+				n = 1
+			}
+			chunkSize = n * partSize
+		}
+	}
+
+	var chunks []*parallelChunk
+	for pos := start; pos <= end; {
+		chunkEnd := (pos/chunkSize+1)*chunkSize - 1
+		if chunkEnd > end {
+			chunkEnd = end
+		}
+		chunks = append(chunks, &parallelChunk{start: pos, end: chunkEnd, done: make(chan struct{})})
+		pos = chunkEnd + 1
+	}
+	return chunks
+}
+
+// parallelChunk is a range of an object fetched into memory
+type parallelChunk struct {
+	start, end int64
+	reserved   int64         // bytes of the proxy's budget held for the chunk
+	done       chan struct{} // closed once data and err are set
+	data       []byte
+	err        error
+}
+
+// parallelReader streams the first response's body, then the chunks in
+// order, keeping up to parallelism chunks in flight. Nothing is fetched
+// before the first Read, so responses whose body is not read, such as
+// those of HEAD requests, cost only the first request.
+type parallelReader struct {
+	p        *ParallelGetProxy
+	key      string
+	etag     string
+	current  io.ReadCloser
+	reserved int64 // budget held for the chunk in current
+	chunks   []*parallelChunk
+	next     int // chunk read after current
+	started  int
+	reading  bool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newParallelReader(p *ParallelGetProxy, key, etag string, first io.ReadCloser, chunks []*parallelChunk) *parallelReader {
+	return &parallelReader{p: p, key: key, etag: etag, current: first, chunks: chunks}
+}
+
+// startFetches keeps up to parallelism chunks ahead of the one being read,
+// as far as the proxy's budget allows. The chunk read next is fetched even
+// when that means waiting for the budget; the reader then holds none.
+func (r *parallelReader) startFetches() {
+	for r.started < len(r.chunks) && r.started < r.next+r.p.parallelism {
+		c := r.chunks[r.started]
+		wait := r.started == r.next && r.current == nil
+		if c.reserved = r.p.budget.reserve(c.end-c.start+1, wait); c.reserved == 0 {
+			return
+		}
+		go r.fetch(c)
+		r.started++
+	}
+}
+
+func (r *parallelReader) fetch(c *parallelChunk) {
+	defer close(c.done)
+
+	out, err := r.p.S3Proxy.Get(r.key, fmt.Sprintf("bytes=%d-%d", c.start, c.end))
+	if err != nil {
+		c.err = err
+		return
+	}
+	defer out.Body.Close()
+
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		c.err = io.ErrClosedPipe
+		return
+	}
+
+	if aws.StringValue(out.ETag) != r.etag {
+		c.err = fmt.Errorf("object %s changed during a parallel download", r.key)
+		return
+	}
+
+	size := c.end - c.start + 1
+	c.data, c.err = io.ReadAll(io.LimitReader(out.Body, size+1))
+	if c.err == nil && int64(len(c.data)) != size {
+		c.err = io.ErrUnexpectedEOF
+	}
+}
+
+func (r *parallelReader) Read(b []byte) (int, error) {
+	if !r.reading {
+		r.reading = true
+		r.startFetches()
+	}
+
+	for {
+		if r.current != nil {
+			n, err := r.current.Read(b)
+			if err == io.EOF {
+				r.current.Close()
+				r.current = nil
+				r.p.budget.release(r.reserved)
+				r.reserved = 0
+				err = nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		if r.next == len(r.chunks) {
+			return 0, io.EOF
+		}
+
+		if r.started == r.next {
+			r.startFetches()
+		}
+		c := r.chunks[r.next]
+		<-c.done
+		if c.err != nil {
+			return 0, c.err
+		}
+		r.current = io.NopCloser(bytes.NewReader(c.data))
+		r.reserved = c.reserved
+		r.chunks[r.next] = nil
+		r.next++
+		r.startFetches()
+	}
+}
+
+func (r *parallelReader) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.mu.Unlock()
+
+	// Chunks still being fetched give their budget back once they end
+	pending := r.chunks[r.next:r.started]
+	r.p.budget.release(r.reserved)
+	r.reserved = 0
+	go func() {
+		for _, c := range pending {
+			<-c.done
+			r.p.budget.release(c.reserved)
+		}
+	}()
+
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// PutIfAbsent forwards to the backend's atomic create. Backends without one
+// leave create-only writes to handlePut's existence check.
+func (p *ParallelGetProxy) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	if cp, ok := p.S3Proxy.(ConditionalPutter); ok {
+		return cp.PutIfAbsent(key, body, contentType)
+	}
+	return nil, errNotImplemented("Atomic create")
+}
+
+// MigrationStatus reports the migration of the backend behind the proxy
+func (p *ParallelGetProxy) MigrationStatus() (MigrationStatus, bool) {
+	return migrationStatus(p.S3Proxy)
+}
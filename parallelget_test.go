@@ -0,0 +1,254 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestParallelGetProxy_Get(t *testing.T) {
+	content := testContent(100)
+
+	tests := []struct {
+		name        string
+		rangeHeader string
+		want        string
+		wantRange   string
+		wantReads   []string
+	}{
+		{
+			name:      "whole object",
+			want:      content,
+			wantReads: []string{"bytes=0-15", "bytes=16-31", "bytes=32-47", "bytes=48-63", "bytes=64-79", "bytes=80-95", "bytes=96-99"},
+		},
+		{
+			name:        "range",
+			rangeHeader: "bytes=10-40",
+			want:        content[10:41],
+			wantRange:   "bytes 10-40/100",
+			wantReads:   []string{"bytes=10-15", "bytes=16-31", "bytes=32-40"},
+		},
+		{
+			name:        "range within a part",
+			rangeHeader: "bytes=20-30",
+			want:        content[20:31],
+			wantRange:   "bytes 20-30/100",
+			wantReads:   []string{"bytes=20-30"},
+		},
+		{
+			name:        "open range",
+			rangeHeader: "bytes=70-",
+			want:        content[70:],
+			wantRange:   "bytes 70-99/100",
+			wantReads:   []string{"bytes=70-79", "bytes=80-95", "bytes=96-99"},
+		},
+		{
+			name:        "range past the end",
+			rangeHeader: "bytes=90-200",
+			want:        content[90:],
+			wantRange:   "bytes 90-99/100",
+			wantReads:   []string{"bytes=90-95", "bytes=96-99"},
+		},
+		{
+			name:        "suffix range",
+			rangeHeader: "bytes=-30",
+			want:        content[70:],
+			wantRange:   "bytes 70-99/100",
+			wantReads:   []string{"bytes=-30"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newFakeProxy()
+			putString(t, backend, "key", content)
+			p := NewParallelGetProxy(backend, 16, 2, 0)
+
+			out, err := p.Get("key", tt.rangeHeader)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			data, err := io.ReadAll(out.Body)
+			out.Body.Close()
+			if err != nil || string(data) != tt.want {
+				t.Errorf("Get() = %q, %v, want %q", data, err, tt.want)
+			}
+
+			if got := aws.Int64Value(out.ContentLength); got != int64(len(tt.want)) {
+				t.Errorf("ContentLength = %d, want %d", got, len(tt.want))
+			}
+			if got := aws.StringValue(out.ContentRange); got != tt.wantRange {
+				t.Errorf("ContentRange = %q, want %q", got, tt.wantRange)
+			}
+
+			// Chunks are fetched concurrently, in no particular order
+			reads := backend.reads()
+			want := append([]string(nil), tt.wantReads...)
+			sort.Strings(reads)
+			sort.Strings(want)
+			if !reflect.DeepEqual(reads, want) {
+				t.Errorf("backend reads = %v, want %v", reads, want)
+			}
+		})
+	}
+}
+
+func TestParallelGetProxy_PartBoundaries(t *testing.T) {
+	backend := newFakeProxy()
+	backend.partSize = 20
+	p := NewParallelGetProxy(backend, 16, 4, 0)
+
+	// Three parts of 20, 20 and 10 bytes
+	content := testContent(50)
+	upload, err := backend.CreateMultipartUpload("key", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []*s3.CompletedPart
+	for i, part := range []string{content[:20], content[20:40], content[40:]} {
+		out, err := backend.UploadPart("key", aws.StringValue(upload.UploadId), int64(i+1), strings.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(int64(i + 1))})
+	}
+	if _, err := backend.CompleteMultipartUpload("key", aws.StringValue(upload.UploadId), parts); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := getString(t, p, "key", ""); got != content {
+		t.Errorf("Get() = %q", got)
+	}
+
+	reads := backend.reads()
+	sort.Strings(reads)
+	if want := []string{"bytes=0-15", "bytes=16-19", "bytes=20-39", "bytes=40-49"}; !reflect.DeepEqual(reads, want) {
+		t.Errorf("backend reads = %v, want %v", reads, want)
+	}
+}
+
+func TestParallelGetProxy_EmptyObject(t *testing.T) {
+	backend := newFakeProxy()
+	putString(t, backend, "empty", "")
+	p := NewParallelGetProxy(backend, 16, 2, 0)
+
+	if got := getString(t, p, "empty", ""); got != "" {
+		t.Errorf("Get() = %q", got)
+	}
+	if _, err := p.Get("missing", ""); !isNotFound(err) {
+		t.Errorf("Get() error = %v, want not found", err)
+	}
+}
+
+func TestParallelGetProxy_ObjectChanged(t *testing.T) {
+	backend := newFakeProxy()
+	putString(t, backend, "key", testContent(100))
+	p := NewParallelGetProxy(backend, 16, 1, 0)
+
+	out, err := p.Get("key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Body.Close()
+
+	// Chunks fetched after the write see a different ETag
+	putString(t, backend, "key", testContent(200))
+	if _, err := io.ReadAll(out.Body); err == nil {
+		t.Error("reading an object rewritten mid-download succeeded")
+	}
+}
+
+func TestParallelGetProxy_Head(t *testing.T) {
+	backend := newFakeProxy()
+	putString(t, backend, "key", testContent(100))
+	handler := NewProxyHandler(NewParallelGetProxy(backend, 16, 2, 0), "", "bucket")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodHead, "/bucket/key", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Length") != "100" {
+		t.Fatalf("HEAD returned %d with Content-Length %q", rr.Code, rr.Header().Get("Content-Length"))
+	}
+
+	// Only the first range is requested when the body is not read
+	if reads := backend.reads(); len(reads) != 1 {
+		t.Errorf("backend reads = %v, want the first range only", reads)
+	}
+}
+
+func TestParallelGetProxy_MaxMemory(t *testing.T) {
+	backend := newFakeProxy()
+	content := testContent(100)
+	putString(t, backend, "key", content)
+	// Room for two of the 16 byte chunks
+	p := NewParallelGetProxy(backend, 16, 4, 32)
+
+	first, err := p.Get("key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.Get("key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first reader takes the whole budget, so the second fetches no
+	// chunk ahead until it needs one
+	buf := make([]byte, 1)
+	for _, out := range []*s3.GetObjectOutput{first, second} {
+		if _, err := out.Body.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if used := p.budget.used; used != 32 {
+		t.Errorf("readers hold %d bytes, want the 32 byte budget", used)
+	}
+
+	for _, out := range []*s3.GetObjectOutput{first, second} {
+		data, err := io.ReadAll(out.Body)
+		out.Body.Close()
+		if err != nil || string(data) != content[1:] {
+			t.Errorf("Get() = %q, %v", data, err)
+		}
+	}
+	waitFor(t, "the budget to be released", func() bool {
+		p.budget.mu.Lock()
+		defer p.budget.mu.Unlock()
+		return p.budget.used == 0
+	})
+}
+
+func TestParallelGetProxy_PutIfAbsent(t *testing.T) {
+	backend := newFakeProxy()
+	p := NewParallelGetProxy(backend, 16, 2, 0)
+
+	checkNoAtomicCreate(t, p, backend)
+}
+
+func TestParallelGetConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ParallelGetConfig
+		wantErr bool
+	}{
+		{name: "default", config: ParallelGetConfig{}},
+		{name: "sizes", config: ParallelGetConfig{PartSize: 16 << 20, Parallelism: 8}},
+		{name: "negative part size", config: ParallelGetConfig{PartSize: -1}, wantErr: true},
+		{name: "negative parallelism", config: ParallelGetConfig{Parallelism: -1}, wantErr: true},
+		{name: "negative max memory", config: ParallelGetConfig{MaxMemory: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
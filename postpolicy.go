@@ -0,0 +1,488 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const postPolicyAlgorithm = "AWS4-HMAC-SHA256"
+
+// postPolicy is the decoded JSON policy document of a browser form upload
+type postPolicy struct {
+	Expiration string            `json:"expiration"`
+	Conditions []json.RawMessage `json:"conditions"`
+}
+
+// postPolicyCondition is a single normalized policy condition. Field names are
+// lowercased without the leading "$"; content-length-range uses min and max.
+type postPolicyCondition struct {
+	op    string
+	field string
+	value string
+	min   int64
+	max   int64
+}
+
+// postPolicyError carries the S3 error code returned to the browser
+type postPolicyError struct {
+	code    string
+	message string
+	status  int
+}
+
+func (e *postPolicyError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func policyDenied(format string, args ...interface{}) error {
+	return &postPolicyError{
+		code:    "AccessDenied",
+		message: "Invalid according to Policy: " + fmt.Sprintf(format, args...),
+		status:  http.StatusForbidden,
+	}
+}
+
+// NewPostPolicyHandler serves S3 POST Object uploads from HTML forms. Requests
+// are authenticated by the signed policy document rather than basic auth, so
+// this handler must wrap the basic auth handler. The access key in
+// x-amz-credential is a configured user name and the signing secret is that
+// user's password. All other requests are passed to next.
+func NewPostPolicyHandler(proxy S3Proxy, users []User, prefix string, bucketName string, next http.Handler) http.HandlerFunc {
+	secrets := make(map[string]string)
+	for _, u := range users {
+		secrets[u.Name] = u.Password
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isPostPolicyRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		handlePostPolicy(proxy, secrets, prefix, bucketName, w, r)
+	}
+}
+
+func isPostPolicyRequest(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+
+	// Multipart upload and restore requests use query parameters instead
+	query := r.URL.Query()
+	if _, ok := query["uploads"]; ok {
+		return false
+	}
+	if query.Get("uploadId") != "" {
+		return false
+	}
+	if _, ok := query["restore"]; ok {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+func handlePostPolicy(proxy S3Proxy, secrets map[string]string, prefix string, bucketName string, w http.ResponseWriter, r *http.Request) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeS3Error(w, "MalformedPOSTRequest", "The body of your POST request is not well-formed multipart/form-data", http.StatusBadRequest)
+		return
+	}
+
+	// Collect form fields until the file part. S3 ignores any fields
+	// that follow the file, so the upload can be streamed from there.
+	fields := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			writeS3Error(w, "InvalidArgument", "POST requires exactly one file upload per request", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeS3Error(w, "MalformedPOSTRequest", "The body of your POST request is not well-formed multipart/form-data", http.StatusBadRequest)
+			return
+		}
+
+		name := strings.ToLower(part.FormName())
+		if name != "file" {
+			value, err := io.ReadAll(io.LimitReader(part, 1<<20))
+			if err != nil {
+				writeS3Error(w, "MalformedPOSTRequest", "The body of your POST request is not well-formed multipart/form-data", http.StatusBadRequest)
+				return
+			}
+			fields[name] = string(value)
+			continue
+		}
+
+		if key, ok := fields["key"]; ok {
+			fields["key"] = strings.ReplaceAll(key, "${filename}", part.FileName())
+		}
+
+		conditions, err := verifyPostPolicy(fields, secrets, bucketName, time.Now())
+		if err != nil {
+			writePostPolicyError(w, err)
+			return
+		}
+
+		storePostPolicyUpload(proxy, fields, conditions, part, prefix, bucketName, w, r)
+		return
+	}
+}
+
+// verifyPostPolicy checks the policy signature, expiration and conditions
+// against the submitted form fields, returning the parsed conditions
+func verifyPostPolicy(fields map[string]string, secrets map[string]string, bucketName string, now time.Time) ([]postPolicyCondition, error) {
+	for _, required := range []string{"key", "policy", "x-amz-algorithm", "x-amz-credential", "x-amz-date", "x-amz-signature"} {
+		if fields[required] == "" {
+			return nil, &postPolicyError{
+				code:    "InvalidArgument",
+				message: "Bucket POST must contain a field named '" + required + "'",
+				status:  http.StatusBadRequest,
+			}
+		}
+	}
+
+	if fields["x-amz-algorithm"] != postPolicyAlgorithm {
+		return nil, &postPolicyError{
+			code:    "InvalidArgument",
+			message: "Unsupported x-amz-algorithm " + fields["x-amz-algorithm"],
+			status:  http.StatusBadRequest,
+		}
+	}
+
+	// Credential scope: <access key>/<yyyymmdd>/<region>/s3/aws4_request
+	scope := strings.Split(fields["x-amz-credential"], "/")
+	if len(scope) != 5 || scope[3] != "s3" || scope[4] != "aws4_request" {
+		return nil, &postPolicyError{
+			code:    "InvalidArgument",
+			message: "Malformed x-amz-credential " + fields["x-amz-credential"],
+			status:  http.StatusBadRequest,
+		}
+	}
+
+	secret, ok := secrets[scope[0]]
+	if !ok {
+		return nil, &postPolicyError{
+			code:    "InvalidAccessKeyId",
+			message: "The access key ID you provided does not exist in our records",
+			status:  http.StatusForbidden,
+		}
+	}
+
+	signature := postPolicySignature(secret, scope[1], scope[2], fields["policy"])
+	if !hmac.Equal([]byte(signature), []byte(strings.ToLower(fields["x-amz-signature"]))) {
+		return nil, &postPolicyError{
+			code:    "SignatureDoesNotMatch",
+			message: "The request signature we calculated does not match the signature you provided",
+			status:  http.StatusForbidden,
+		}
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(fields["policy"])
+	if err != nil {
+		return nil, &postPolicyError{code: "InvalidPolicyDocument", message: "Invalid Policy: Invalid Base64 encoding", status: http.StatusBadRequest}
+	}
+
+	var policy postPolicy
+	if err := json.Unmarshal(decoded, &policy); err != nil {
+		return nil, &postPolicyError{code: "InvalidPolicyDocument", message: "Invalid Policy: Invalid JSON", status: http.StatusBadRequest}
+	}
+
+	expiration, err := time.Parse(time.RFC3339, policy.Expiration)
+	if err != nil {
+		return nil, &postPolicyError{code: "InvalidPolicyDocument", message: "Invalid Policy: Invalid 'expiration' value", status: http.StatusBadRequest}
+	}
+	if !now.Before(expiration) {
+		return nil, policyDenied("Policy expired.")
+	}
+
+	conditions, err := parsePostPolicyConditions(policy.Conditions)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bucket is not a form field but may still appear in conditions
+	values := make(map[string]string, len(fields)+1)
+	for k, v := range fields {
+		values[k] = v
+	}
+	values["bucket"] = bucketName
+
+	covered := make(map[string]bool)
+	for _, c := range conditions {
+		covered[c.field] = true
+
+		switch c.op {
+		case "eq":
+			if values[c.field] != c.value {
+				return nil, policyDenied("Policy Condition failed: [\"eq\", \"$%s\", \"%s\"]", c.field, c.value)
+			}
+		case "starts-with":
+			if !strings.HasPrefix(values[c.field], c.value) {
+				return nil, policyDenied("Policy Condition failed: [\"starts-with\", \"$%s\", \"%s\"]", c.field, c.value)
+			}
+		}
+	}
+
+	// Every submitted field must be matched by a condition
+	for name := range fields {
+		switch {
+		case name == "policy", name == "x-amz-signature", strings.HasPrefix(name, "x-ignore-"):
+			continue
+		case !covered[name]:
+			return nil, policyDenied("Extra input fields: %s", name)
+		}
+	}
+
+	return conditions, nil
+}
+
+func parsePostPolicyConditions(raw []json.RawMessage) ([]postPolicyCondition, error) {
+	invalid := &postPolicyError{code: "InvalidPolicyDocument", message: "Invalid Policy: Invalid conditions", status: http.StatusBadRequest}
+	conditions := make([]postPolicyCondition, 0, len(raw))
+
+	for _, item := range raw {
+		// {"field": "value"} is shorthand for an exact match
+		var exact map[string]string
+		if err := json.Unmarshal(item, &exact); err == nil {
+			for field, value := range exact {
+				conditions = append(conditions, postPolicyCondition{op: "eq", field: strings.ToLower(field), value: value})
+			}
+			continue
+		}
+
+		var list []interface{}
+		if err := json.Unmarshal(item, &list); err != nil || len(list) != 3 {
+			return nil, invalid
+		}
+
+		op, _ := list[0].(string)
+		op = strings.ToLower(op)
+
+		switch op {
+		case "eq", "starts-with":
+			field, ok1 := list[1].(string)
+			value, ok2 := list[2].(string)
+			if !ok1 || !ok2 || !strings.HasPrefix(field, "$") {
+				return nil, invalid
+			}
+			conditions = append(conditions, postPolicyCondition{
+				op:    op,
+				field: strings.ToLower(strings.TrimPrefix(field, "$")),
+				value: value,
+			})
+		case "content-length-range":
+			min, ok1 := list[1].(float64)
+			max, ok2 := list[2].(float64)
+			if !ok1 || !ok2 || min < 0 || max < min {
+				return nil, invalid
+			}
+			conditions = append(conditions, postPolicyCondition{op: op, min: int64(min), max: int64(max)})
+		default:
+			return nil, invalid
+		}
+	}
+
+	return conditions, nil
+}
+
+// postPolicySignature derives the SigV4 signing key for the credential scope
+// and signs the base64 encoded policy document with it
+func postPolicySignature(secret string, date string, region string, policy string) string {
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+
+	key := mac([]byte("AWS4"+secret), date)
+	key = mac(key, region)
+	key = mac(key, "s3")
+	key = mac(key, "aws4_request")
+
+	return hex.EncodeToString(mac(key, policy))
+}
+
+func storePostPolicyUpload(proxy S3Proxy, fields map[string]string, conditions []postPolicyCondition, file io.Reader, prefix string, bucketName string, w http.ResponseWriter, r *http.Request) {
+	// Backends store no user metadata, so refuse uploads that set any
+	// rather than dropping it
+	for name := range fields {
+		if strings.HasPrefix(name, "x-amz-meta-") {
+			writeS3Error(w, "NotImplemented", "User metadata is not supported for form uploads", http.StatusNotImplemented)
+			return
+		}
+	}
+
+	body := &postPolicyBody{r: file, max: -1}
+	for _, c := range conditions {
+		if c.op == "content-length-range" {
+			body.min, body.max = c.min, c.max
+		}
+	}
+
+	key := fields["key"]
+	if prefix != "" {
+		key = prefix + "/" + key
+	}
+
+	contentType := fields["content-type"]
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	var result *s3.PutObjectOutput
+	var err error
+	if sp, ok := proxy.(StreamPutter); ok {
+		result, err = sp.PutStream(key, body, -1, contentType)
+	} else {
+		result, err = spoolPostPolicyUpload(proxy, key, body, contentType)
+	}
+	if body.err != nil {
+		writePostPolicyError(w, body.err)
+		return
+	}
+	if err != nil {
+		handleS3Error(w, err)
+		return
+	}
+
+	etag := aws.StringValue(result.ETag)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	// Responses report the key as the client submitted it, without the site prefix
+	if redirect := fields["success_action_redirect"]; redirect != "" {
+		if dest, err := url.Parse(redirect); err == nil {
+			q := dest.Query()
+			q.Set("bucket", bucketName)
+			q.Set("key", fields["key"])
+			q.Set("etag", etag)
+			dest.RawQuery = q.Encode()
+
+			http.Redirect(w, r, dest.String(), http.StatusSeeOther)
+			return
+		}
+	}
+
+	status, _ := strconv.Atoi(fields["success_action_status"])
+	switch status {
+	case http.StatusOK:
+		w.WriteHeader(http.StatusOK)
+	case http.StatusCreated:
+		type PostResponse struct {
+			XMLName  xml.Name `xml:"PostResponse"`
+			Location string   `xml:"Location"`
+			Bucket   string   `xml:"Bucket"`
+			Key      string   `xml:"Key"`
+			ETag     string   `xml:"ETag"`
+		}
+
+		location := "/" + fields["key"]
+		if bucketName != "" {
+			location = "/" + bucketName + location
+		}
+
+		w.Header().Set("Location", location)
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(xml.Header))
+
+		encoder := xml.NewEncoder(w)
+		encoder.Indent("", "  ")
+		encoder.Encode(PostResponse{
+			Location: location,
+			Bucket:   bucketName,
+			Key:      fields["key"],
+			ETag:     etag,
+		})
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// spoolPostPolicyUpload stores a form upload with Put, spooling it to disk
+// so it can be handed to the backend as a ReadSeeker without holding the
+// whole upload in memory
+func spoolPostPolicyUpload(proxy S3Proxy, key string, body io.Reader, contentType string) (*s3.PutObjectOutput, error) {
+	tmp, err := os.CreateTemp("", "s3-proxy-post-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		return nil, errIncompleteBody()
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return proxy.Put(key, tmp, contentType)
+}
+
+// postPolicyBody enforces the policy's content-length-range on an upload as
+// it is read, failing the read that crosses either bound so the backend
+// does not store the object
+type postPolicyBody struct {
+	r        io.Reader
+	min, max int64
+	n        int64
+	err      error
+}
+
+func (b *postPolicyBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	switch {
+	case b.max >= 0 && b.n > b.max:
+		b.err = &postPolicyError{
+			code:    "EntityTooLarge",
+			message: "Your proposed upload exceeds the maximum allowed size",
+			status:  http.StatusBadRequest,
+		}
+	case err == io.EOF && b.n < b.min:
+		b.err = &postPolicyError{
+			code:    "EntityTooSmall",
+			message: "Your proposed upload is smaller than the minimum allowed size",
+			status:  http.StatusBadRequest,
+		}
+	default:
+		return n, err
+	}
+	return n, b.err
+}
+
+func writePostPolicyError(w http.ResponseWriter, err error) {
+	var perr *postPolicyError
+	if errors.As(err, &perr) {
+		writeS3Error(w, perr.code, perr.message, perr.status)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
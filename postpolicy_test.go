@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type putRecorder struct {
+	S3Proxy
+	key         string
+	body        string
+	contentType string
+}
+
+func (p *putRecorder) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	p.key, p.body, p.contentType = key, string(data), contentType
+	return &s3.PutObjectOutput{ETag: aws.String(`"abc123"`)}, nil
+}
+
+// streamPutRecorder records uploads handed to the backend as a stream
+type streamPutRecorder struct {
+	*putRecorder
+}
+
+func (p streamPutRecorder) PutStream(key string, body io.Reader, size int64, contentType string) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return p.Put(key, bytes.NewReader(data), contentType)
+}
+
+func newPostPolicyRequest(t *testing.T, policy string, secret string, fields map[string]string, file string) *http.Request {
+	t.Helper()
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(policy))
+	date := time.Now().UTC().Format("20060102")
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("policy", encoded)
+	mw.WriteField("x-amz-algorithm", postPolicyAlgorithm)
+	mw.WriteField("x-amz-credential", "uploader/"+date+"/us-east-1/s3/aws4_request")
+	mw.WriteField("x-amz-date", date+"T000000Z")
+	mw.WriteField("x-amz-signature", postPolicySignature(secret, date, "us-east-1", encoded))
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+
+	fw, err := mw.CreateFormFile("file", "photo.jpg")
+	if err != nil {
+		t.Fatalf("CreateFormFile() error = %v", err)
+	}
+	fw.Write([]byte(file))
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestPostPolicyHandler(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	expired := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	basePolicy := func(expiration string, extra string) string {
+		return fmt.Sprintf(`{"expiration": %q, "conditions": [
+			{"bucket": "uploads"},
+			["starts-with", "$key", "user/"],
+			{"x-amz-algorithm": "AWS4-HMAC-SHA256"},
+			["starts-with", "$x-amz-credential", "uploader/"],
+			["starts-with", "$x-amz-date", ""],
+			["starts-with", "$Content-Type", "image/"]%s
+		]}`, expiration, extra)
+	}
+
+	tests := []struct {
+		name       string
+		policy     string
+		secret     string
+		fields     map[string]string
+		file       string
+		wantStatus int
+		wantKey    string
+	}{
+		{
+			name:       "valid upload",
+			policy:     basePolicy(expires, `, ["content-length-range", 1, 100]`),
+			secret:     "s3cret",
+			fields:     map[string]string{"key": "user/${filename}", "Content-Type": "image/jpeg"},
+			file:       "jpeg bytes",
+			wantStatus: http.StatusNoContent,
+			wantKey:    "site/user/photo.jpg",
+		},
+		{
+			name:       "status 201",
+			policy:     basePolicy(expires, `, {"success_action_status": "201"}`),
+			secret:     "s3cret",
+			fields:     map[string]string{"key": "user/a.jpg", "Content-Type": "image/jpeg", "success_action_status": "201"},
+			file:       "jpeg bytes",
+			wantStatus: http.StatusCreated,
+			wantKey:    "site/user/a.jpg",
+		},
+		{
+			name:       "redirect",
+			policy:     basePolicy(expires, `, ["starts-with", "$success_action_redirect", "https://app/"]`),
+			secret:     "s3cret",
+			fields:     map[string]string{"key": "user/a.jpg", "Content-Type": "image/jpeg", "success_action_redirect": "https://app/done"},
+			file:       "jpeg bytes",
+			wantStatus: http.StatusSeeOther,
+			wantKey:    "site/user/a.jpg",
+		},
+		{
+			name:       "bad signature",
+			policy:     basePolicy(expires, ""),
+			secret:     "wrong",
+			fields:     map[string]string{"key": "user/a.jpg", "Content-Type": "image/jpeg"},
+			file:       "jpeg bytes",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "expired policy",
+			policy:     basePolicy(expired, ""),
+			secret:     "s3cret",
+			fields:     map[string]string{"key": "user/a.jpg", "Content-Type": "image/jpeg"},
+			file:       "jpeg bytes",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "key outside policy prefix",
+			policy:     basePolicy(expires, ""),
+			secret:     "s3cret",
+			fields:     map[string]string{"key": "admin/a.jpg", "Content-Type": "image/jpeg"},
+			file:       "jpeg bytes",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "field not covered by policy",
+			policy:     basePolicy(expires, ""),
+			secret:     "s3cret",
+			fields:     map[string]string{"key": "user/a.jpg", "Content-Type": "image/jpeg", "acl": "public-read"},
+			file:       "jpeg bytes",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "file too large",
+			policy:     basePolicy(expires, `, ["content-length-range", 1, 4]`),
+			secret:     "s3cret",
+			fields:     map[string]string{"key": "user/a.jpg", "Content-Type": "image/jpeg"},
+			file:       "jpeg bytes",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "file too small",
+			policy:     basePolicy(expires, `, ["content-length-range", 100, 200]`),
+			secret:     "s3cret",
+			fields:     map[string]string{"key": "user/a.jpg", "Content-Type": "image/jpeg"},
+			file:       "jpeg bytes",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "user metadata",
+			policy:     basePolicy(expires, `, ["starts-with", "$x-amz-meta-owner", ""]`),
+			secret:     "s3cret",
+			fields:     map[string]string{"key": "user/a.jpg", "Content-Type": "image/jpeg", "x-amz-meta-owner": "alice"},
+			file:       "jpeg bytes",
+			wantStatus: http.StatusNotImplemented,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, stream := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/stream=%v", tt.name, stream), func(t *testing.T) {
+				recorder := &putRecorder{}
+				var proxy S3Proxy = recorder
+				if stream {
+					proxy = streamPutRecorder{recorder}
+				}
+				next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					t.Error("form upload should not reach the next handler")
+				})
+				handler := NewPostPolicyHandler(proxy, []User{{Name: "uploader", Password: "s3cret"}}, "site", "uploads", next)
+
+				req := newPostPolicyRequest(t, tt.policy, tt.secret, tt.fields, tt.file)
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+
+				if rr.Code != tt.wantStatus {
+					t.Errorf("handler returned status %v, want %v: %s", rr.Code, tt.wantStatus, rr.Body.String())
+				}
+				if recorder.key != tt.wantKey {
+					t.Errorf("Put() key = %q, want %q", recorder.key, tt.wantKey)
+				}
+				if tt.wantKey != "" && recorder.body != tt.file {
+					t.Errorf("Put() body = %q, want %q", recorder.body, tt.file)
+				}
+				if tt.wantStatus == http.StatusSeeOther && !strings.Contains(rr.Header().Get("Location"), "key=user%2Fa.jpg") {
+					t.Errorf("redirect Location = %q, want key parameter", rr.Header().Get("Location"))
+				}
+			})
+		}
+	}
+}
+
+func TestPostPolicyHandler_PassesThroughOtherRequests(t *testing.T) {
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	handler := NewPostPolicyHandler(&putRecorder{}, nil, "", "uploads", next)
+
+	req := httptest.NewRequest("POST", "/key?uploads", strings.NewReader(""))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !called {
+		t.Error("multipart upload initiation should be passed to the next handler")
+	}
+}
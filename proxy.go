@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -23,6 +24,13 @@ type S3Proxy interface {
 	AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error)
 	ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error)
 	GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error)
+	RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error)
+}
+
+func init() {
+	RegisterBackend("s3", validateS3Site, func(s Site) (S3Proxy, error) {
+		return NewS3Proxy(s.AWSKey, s.AWSSecret, s.AWSRegion, s.AWSBucket, s.AWSEndpoint), nil
+	})
 }
 
 type RealS3Proxy struct {
@@ -84,6 +92,26 @@ func normalizeWasabiEndpoint(endpoint, region string) string {
 	return endpoint
 }
 
+func validateS3Site(s Site) error {
+	if s.AWSKey == "" {
+		return errors.New("AWS Key not specified")
+	}
+
+	if s.AWSSecret == "" {
+		return errors.New("AWS Secret not specified")
+	}
+
+	if s.AWSRegion == "" {
+		return errors.New("AWS Region not specified")
+	}
+
+	if s.AWSBucket == "" {
+		return errors.New("AWS Bucket not specified")
+	}
+
+	return nil
+}
+
 func (p *RealS3Proxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
 	req := &s3.GetObjectInput{
 		Bucket: aws.String(p.bucket),
@@ -107,6 +135,24 @@ func (p *RealS3Proxy) Head(key string) (*s3.HeadObjectOutput, error) {
 	return p.s3.HeadObject(req)
 }
 
+// PartSize asks for the first part of the object, which has the size all
+// parts but the last share
+func (p *RealS3Proxy) PartSize(key string) (int64, error) {
+	out, err := p.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket:     aws.String(p.bucket),
+		Key:        aws.String(key),
+		PartNumber: aws.Int64(1),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if aws.Int64Value(out.PartsCount) <= 1 {
+		return 0, nil
+	}
+	return aws.Int64Value(out.ContentLength), nil
+}
+
 func (p *RealS3Proxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
 	req := &s3.DeleteObjectInput{
 		Bucket: aws.String(p.bucket),
@@ -222,3 +268,24 @@ func (p *RealS3Proxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
 
 	return p.s3.GetBucketWebsite(req)
 }
+
+func (p *RealS3Proxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	restore := &s3.RestoreRequest{
+		Days: aws.Int64(days),
+	}
+
+	// Tier is optional; the backend defaults to Standard when omitted
+	if tier != "" {
+		restore.GlacierJobParameters = &s3.GlacierJobParameters{
+			Tier: aws.String(tier),
+		}
+	}
+
+	req := &s3.RestoreObjectInput{
+		Bucket:         aws.String(p.bucket),
+		Key:            aws.String(key),
+		RestoreRequest: restore,
+	}
+
+	return p.s3.RestoreObject(req)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultReadAheadMinWindow = 1 << 20
+	defaultReadAheadMaxWindow = 16 << 20
+	defaultReadAheadMaxSize   = 256 << 20
+	// readAheadDepth is the number of windows fetched ahead of a client
+	readAheadDepth = 2
+	// readAheadWindowTime is how long the backend should take to deliver
+	// a window at the observed throughput
+	readAheadWindowTime = time.Second
+	// readAheadIdle is how long a stream is kept without reads
+	readAheadIdle = 30 * time.Second
+)
+
+var errReadAheadCancelled = errors.New("read-ahead cancelled")
+
+// ReadAheadConfig prefetches the next windows of an object for clients
+// reading it sequentially in ranges, holding up to MaxSize bytes (default
+// 256 MiB) in memory for all clients. Windows start at MinWindow bytes
+// (default 1 MiB) and grow up to MaxWindow (default 16 MiB) as the backend
+// proves faster.
+type ReadAheadConfig struct {
+	MinWindow int64 `json:"minWindow,omitempty" yaml:"minWindow,omitempty"`
+	MaxWindow int64 `json:"maxWindow,omitempty" yaml:"maxWindow,omitempty"`
+	MaxSize   int64 `json:"maxSize,omitempty" yaml:"maxSize,omitempty"`
+}
+
+func (c *ReadAheadConfig) validate() error {
+	if c.MinWindow < 0 || c.MaxWindow < 0 || c.MaxSize < 0 {
+		return errors.New("Read-ahead sizes must not be negative")
+	}
+	if c.MinWindow > 0 && c.MaxWindow > 0 && c.MinWindow > c.MaxWindow {
+		return errors.New("Read-ahead minWindow must not exceed maxWindow")
+	}
+	return nil
+}
+
+// prefetch is a window of an object being read ahead of a client
+type prefetch struct {
+	start, end int64
+	etag       string
+	done       chan struct{} // closed once data and err are set
+
+	data []byte
+	err  error
+
+	// Guarded by ReadAheadProxy.mu
+	body      io.Closer
+	cancelled bool
+}
+
+func (f *prefetch) size() int64 {
+	return f.end - f.start + 1
+}
+
+// readAheadStream follows one client reading one key. Its prefetches are
+// contiguous and start at or before next.
+type readAheadStream struct {
+	key  string
+	next int64 // offset the client is expected to read next
+	run  int   // sequential reads so far
+	used time.Time
+
+	// Object the stream reads, from the first response
+	etag string
+	size int64
+	head *s3.HeadObjectOutput
+
+	window     int64
+	rate       float64 // bytes per second, 0 until measured
+	prefetches []*prefetch
+}
+
+// ReadAheadProxy detects clients reading an object in consecutive
+// "bytes=a-b" ranges, and fetches the next windows in the background so
+// their following reads are served from memory.
+type ReadAheadProxy struct {
+	S3Proxy
+	minWindow int64
+	maxWindow int64
+	maxSize   int64
+	now       func() time.Time
+
+	mu        sync.Mutex
+	streams   map[string]*readAheadStream
+	buffered  int64 // bytes held or reserved by prefetches
+	lastSweep time.Time
+}
+
+func NewReadAheadProxy(backend S3Proxy, minWindow, maxWindow, maxSize int64) *ReadAheadProxy {
+	if minWindow <= 0 {
+		minWindow = defaultReadAheadMinWindow
+	}
+	if maxWindow <= 0 {
+		maxWindow = defaultReadAheadMaxWindow
+	}
+	if maxWindow < minWindow {
+		maxWindow = minWindow
+	}
+	if maxSize <= 0 {
+		maxSize = defaultReadAheadMaxSize
+	}
+
+	return &ReadAheadProxy{
+		S3Proxy:   backend,
+		minWindow: minWindow,
+		maxWindow: maxWindow,
+		maxSize:   maxSize,
+		now:       time.Now,
+		streams:   make(map[string]*readAheadStream),
+	}
+}
+
+// readAheadWindow sizes windows so the backend delivers one in
+// readAheadWindowTime at rate bytes per second
+func readAheadWindow(rate float64, minWindow, maxWindow int64) int64 {
+	window := rate * readAheadWindowTime.Seconds()
+	if window < float64(minWindow) {
+		return minWindow
+	}
+	if window > float64(maxWindow) {
+		return maxWindow
+	}
+	return int64(window)
+}
+
+func (p *ReadAheadProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	return p.GetForClient("", key, rangeHeader)
+}
+
+func (p *ReadAheadProxy) GetForClient(client string, key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	start, end, ok := parseSimpleRange(rangeHeader)
+	if !ok {
+		return p.S3Proxy.Get(key, rangeHeader)
+	}
+
+	id := client + "\x00" + key
+	p.mu.Lock()
+	p.sweepLocked()
+	s := p.streams[id]
+	if s == nil || start != s.next {
+		// A new stream, or the pattern broke
+		if s != nil {
+			p.dropLocked(id, s)
+		}
+		s = &readAheadStream{key: key, window: p.minWindow}
+		p.streams[id] = s
+	} else {
+		s.run++
+	}
+	s.next = end + 1
+	s.used = p.now()
+
+	if s.run > 0 {
+		p.prefetchLocked(s, start)
+	}
+	chunks := s.coveringLocked(start, end)
+	p.mu.Unlock()
+
+	if out := p.serve(s, chunks, start, end); out != nil {
+		return out, nil
+	}
+
+	out, err := p.S3Proxy.Get(key, rangeHeader)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.streams[id] != s {
+		// Another read of the client broke the pattern meanwhile
+		return out, err
+	}
+	if err != nil {
+		p.dropLocked(id, s)
+		return nil, err
+	}
+	p.observeLocked(s, out)
+	if s.run > 0 {
+		p.prefetchLocked(s, start)
+	}
+	return out, nil
+}
+
+// observeLocked records the object a stream reads from a backend response.
+// A different ETag means the object changed and its prefetches are stale.
+func (p *ReadAheadProxy) observeLocked(s *readAheadStream, out *s3.GetObjectOutput) {
+	_, _, size, ok := parseContentRange(aws.StringValue(out.ContentRange))
+	etag := aws.StringValue(out.ETag)
+	if !ok || etag == "" {
+		return
+	}
+
+	if s.etag != etag {
+		p.cancelLocked(s)
+		s.etag, s.size = etag, size
+		s.head = headFromGet(out)
+	}
+}
+
+// coveringLocked returns the prefetches holding bytes start to end, or nil
+// if they are not all being read ahead
+func (s *readAheadStream) coveringLocked(start, end int64) []*prefetch {
+	if s.etag == "" || start >= s.size {
+		return nil
+	}
+	if end >= s.size {
+		end = s.size - 1
+	}
+
+	var chunks []*prefetch
+	pos := start
+	for _, f := range s.prefetches {
+		if f.end < pos {
+			continue
+		}
+		if f.start > pos {
+			break
+		}
+		chunks = append(chunks, f)
+		pos = f.end + 1
+		if pos > end {
+			return chunks
+		}
+	}
+	return nil
+}
+
+// serve answers a read from prefetched windows, or returns nil if any of
+// them failed
+func (p *ReadAheadProxy) serve(s *readAheadStream, chunks []*prefetch, start, end int64) *s3.GetObjectOutput {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	size, etag, head := s.size, s.etag, s.head
+	p.mu.Unlock()
+
+	if end >= size {
+		end = size - 1
+	}
+
+	data := make([]byte, 0, end-start+1)
+	for _, f := range chunks {
+		<-f.done
+		if f.err != nil || f.etag != etag {
+			return nil
+		}
+
+		from, to := start, end
+		if from < f.start {
+			from = f.start
+		}
+		if to > f.end {
+			to = f.end
+		}
+		data = append(data, f.data[from-f.start:to-f.start+1]...)
+	}
+
+	out := getOutputFromHead(head)
+	out.ContentLength = aws.Int64(end - start + 1)
+	out.ContentRange = aws.String(contentRange(start, end, size))
+	out.Body = io.NopCloser(bytes.NewReader(data))
+	return out
+}
+
+// prefetchLocked releases the windows ending before offset, which the
+// stream has read past, and starts fetching up to readAheadDepth windows
+// ahead of it, as far as the buffer allows
+func (p *ReadAheadProxy) prefetchLocked(s *readAheadStream, offset int64) {
+	if s.etag == "" {
+		return
+	}
+
+	kept := s.prefetches[:0]
+	for _, f := range s.prefetches {
+		if f.end < offset {
+			p.buffered -= f.size()
+		} else {
+			kept = append(kept, f)
+		}
+	}
+	s.prefetches = kept
+
+	ahead := s.next
+	if len(s.prefetches) > 0 {
+		ahead = s.prefetches[len(s.prefetches)-1].end + 1
+	}
+
+	limit := s.next + readAheadDepth*s.window
+	for ahead < s.size && ahead < limit {
+		end := ahead + s.window - 1
+		if end >= s.size {
+			end = s.size - 1
+		}
+
+		f := &prefetch{start: ahead, end: end, etag: s.etag, done: make(chan struct{})}
+		if p.buffered+f.size() > p.maxSize {
+			return
+		}
+		p.buffered += f.size()
+		s.prefetches = append(s.prefetches, f)
+		go p.fetch(s, f)
+
+		ahead = end + 1
+	}
+}
+
+// fetch reads a window from the backend, adapting the stream's window
+// size to the throughput seen
+func (p *ReadAheadProxy) fetch(s *readAheadStream, f *prefetch) {
+	defer close(f.done)
+
+	began := p.now()
+	out, err := p.S3Proxy.Get(s.key, fmt.Sprintf("bytes=%d-%d", f.start, f.end))
+	if err != nil {
+		f.err = err
+		return
+	}
+
+	p.mu.Lock()
+	cancelled := f.cancelled
+	f.body = out.Body
+	p.mu.Unlock()
+	if cancelled {
+		out.Body.Close()
+		f.err = errReadAheadCancelled
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(out.Body, f.size()+1))
+	out.Body.Close()
+	switch {
+	case err != nil:
+		f.err = err
+	case aws.StringValue(out.ETag) != f.etag:
+		f.err = fmt.Errorf("object changed during read-ahead")
+	case int64(len(data)) != f.size():
+		f.err = io.ErrUnexpectedEOF
+	}
+	if f.err != nil {
+		return
+	}
+	f.data = data
+
+	elapsed := p.now().Sub(began).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rate := float64(f.size()) / elapsed
+	if s.rate > 0 {
+		rate = (s.rate + rate) / 2
+	}
+	s.rate = rate
+	s.window = readAheadWindow(rate, p.minWindow, p.maxWindow)
+}
+
+// cancelLocked abandons a stream's prefetches, interrupting those still
+// reading from the backend
+func (p *ReadAheadProxy) cancelLocked(s *readAheadStream) {
+	for _, f := range s.prefetches {
+		f.cancelled = true
+		if f.body != nil {
+			go f.body.Close()
+		}
+		p.buffered -= f.size()
+	}
+	s.prefetches = nil
+}
+
+func (p *ReadAheadProxy) dropLocked(id string, s *readAheadStream) {
+	p.cancelLocked(s)
+	delete(p.streams, id)
+}
+
+// sweepLocked drops streams without reads for readAheadIdle
+func (p *ReadAheadProxy) sweepLocked() {
+	now := p.now()
+	if now.Sub(p.lastSweep) < readAheadIdle {
+		return
+	}
+	p.lastSweep = now
+
+	for id, s := range p.streams {
+		if now.Sub(s.used) >= readAheadIdle {
+			p.dropLocked(id, s)
+		}
+	}
+}
+
+// invalidate drops the streams reading key after a write through the proxy
+func (p *ReadAheadProxy) invalidate(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, s := range p.streams {
+		if s.key == key {
+			p.dropLocked(id, s)
+		}
+	}
+}
+
+// PurgeCache drops the windows read ahead for the keys, and purges the
+// caches behind the proxy
+func (p *ReadAheadProxy) PurgeCache(key string, prefix bool) int {
+	p.mu.Lock()
+	n := 0
+	for id, s := range p.streams {
+		if purgeMatches(s.key, key, prefix) {
+			p.dropLocked(id, s)
+			n++
+		}
+	}
+	p.mu.Unlock()
+
+	return n + purgeCache(p.S3Proxy, key, prefix)
+}
+
+// HasCache reports whether there is a cache behind the proxy. Windows read
+// ahead follow clients, so warm-ups do not fill them.
+func (p *ReadAheadProxy) HasCache() bool {
+	return hasCache(p.S3Proxy)
+}
+
+// MigrationStatus reports the migration of the backend behind the proxy
+func (p *ReadAheadProxy) MigrationStatus() (MigrationStatus, bool) {
+	return migrationStatus(p.S3Proxy)
+}
+
+func (p *ReadAheadProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	defer p.invalidate(key)
+	return p.S3Proxy.Put(key, body, contentType)
+}
+
+// PutIfAbsent passes create-only writes to the backend's atomic create, or
+// reports them not implemented when there is none
+func (p *ReadAheadProxy) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	cp, ok := p.S3Proxy.(ConditionalPutter)
+	if !ok {
+		return nil, errNotImplemented("Atomic create")
+	}
+
+	defer p.invalidate(key)
+	return cp.PutIfAbsent(key, body, contentType)
+}
+
+func (p *ReadAheadProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	defer p.invalidate(key)
+	return p.S3Proxy.Delete(key)
+}
+
+func (p *ReadAheadProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	defer p.invalidate(key)
+	return p.S3Proxy.CompleteMultipartUpload(key, uploadId, parts)
+}
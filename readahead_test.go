@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func getRange(t *testing.T, p *ReadAheadProxy, client string, key string, start, end int64) string {
+	t.Helper()
+
+	obj, err := p.GetForClient(client, key, fmt.Sprintf("bytes=%d-%d", start, end))
+	if err != nil {
+		t.Fatalf("GetForClient(%q, %d-%d) error = %v", client, start, end, err)
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return string(data)
+}
+
+func TestReadAheadProxy_Sequential(t *testing.T) {
+	type read struct {
+		client     string
+		start, end int64
+	}
+
+	// sequential returns reads of size bytes covering the first n bytes
+	sequential := func(client string, n, size int64) []read {
+		var reads []read
+		for start := int64(0); start < n; start += size {
+			reads = append(reads, read{client: client, start: start, end: start + size - 1})
+		}
+		return reads
+	}
+
+	tests := []struct {
+		name      string
+		size      int
+		reads     []read
+		wantReads int
+	}{
+		{
+			name:      "sequential",
+			size:      1000,
+			reads:     sequential("a", 1000, 50),
+			wantReads: 11, // the first two reads, then nine windows
+		},
+		{
+			name:      "past the end of the object",
+			size:      380,
+			reads:     sequential("a", 400, 50),
+			wantReads: 5,
+		},
+		{
+			name:      "not sequential",
+			size:      1000,
+			reads:     []read{{"a", 0, 49}, {"a", 100, 149}, {"a", 200, 249}, {"a", 300, 349}},
+			wantReads: 4,
+		},
+		{
+			name:      "clients followed separately",
+			size:      400,
+			reads:     append(sequential("a", 400, 50), sequential("b", 400, 50)...),
+			wantReads: 10,
+		},
+		{
+			name:      "reads larger than a window",
+			size:      1000,
+			reads:     sequential("a", 1000, 250),
+			wantReads: 2 + 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newFakeProxy()
+			content := testContent(tt.size)
+			putString(t, backend, "key", content)
+			p := NewReadAheadProxy(backend, 100, 100, 1<<20)
+
+			for _, r := range tt.reads {
+				want := content[r.start:]
+				if r.end < int64(len(content)) {
+					want = content[r.start : r.end+1]
+				}
+				if got := getRange(t, p, r.client, "key", r.start, r.end); got != want {
+					t.Errorf("%s read %d-%d = %q, want %q", r.client, r.start, r.end, got, want)
+				}
+			}
+
+			if reads := backend.reads(); len(reads) != tt.wantReads {
+				t.Errorf("backend reads = %v, want %d", reads, tt.wantReads)
+			}
+		})
+	}
+}
+
+func TestReadAheadProxy_PatternBreaks(t *testing.T) {
+	backend := newFakeProxy()
+	content := testContent(1000)
+	putString(t, backend, "key", content)
+	p := NewReadAheadProxy(backend, 100, 100, 1<<20)
+
+	getRange(t, p, "a", "key", 0, 49)
+	getRange(t, p, "a", "key", 50, 99)
+	if p.buffered != 200 {
+		t.Errorf("buffered %d bytes after two sequential reads, want 200", p.buffered)
+	}
+
+	// Seeking drops the windows read ahead
+	if got := getRange(t, p, "a", "key", 700, 749); got != content[700:750] {
+		t.Errorf("read after seeking = %q", got)
+	}
+	if p.buffered != 0 {
+		t.Errorf("buffered %d bytes after seeking, want 0", p.buffered)
+	}
+
+	// Writes through the proxy drop the streams reading the key
+	getRange(t, p, "a", "key", 750, 799)
+	updated := testContent(2000)[1000:]
+	putString(t, p, "key", updated)
+	if p.buffered != 0 {
+		t.Errorf("buffered %d bytes after a write, want 0", p.buffered)
+	}
+	if got := getRange(t, p, "a", "key", 800, 849); got != updated[800:850] {
+		t.Errorf("read after a write = %q", got)
+	}
+}
+
+func TestReadAheadProxy_MaxSize(t *testing.T) {
+	backend := newFakeProxy()
+	putString(t, backend, "key", testContent(1000))
+	p := NewReadAheadProxy(backend, 100, 100, 150)
+
+	getRange(t, p, "a", "key", 0, 49)
+	getRange(t, p, "a", "key", 50, 99)
+	getRange(t, p, "b", "key", 0, 49)
+	getRange(t, p, "b", "key", 50, 99)
+	if p.buffered != 100 {
+		t.Errorf("buffered %d bytes, want one window within maxSize", p.buffered)
+	}
+}
+
+func TestReadAheadProxy_Headers(t *testing.T) {
+	backend := newFakeProxy()
+	backend.archived = true
+	putString(t, backend, "key", testContent(1000))
+	p := NewReadAheadProxy(backend, 100, 100, 1<<20)
+
+	for start := int64(0); start < 500; start += 50 {
+		out, err := p.GetForClient("a", "key", fmt.Sprintf("bytes=%d-%d", start, start+49))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Body.Close()
+
+		if aws.StringValue(out.ContentRange) != contentRange(start, start+49, 1000) || aws.Int64Value(out.ContentLength) != 50 {
+			t.Errorf("read at %d has range %q and length %d", start, aws.StringValue(out.ContentRange), aws.Int64Value(out.ContentLength))
+		}
+		if aws.StringValue(out.CacheControl) != "max-age=60" || aws.StringValue(out.ContentEncoding) != "gzip" ||
+			aws.StringValue(out.Metadata["Owner"]) != "alice" || aws.StringValue(out.Restore) == "" ||
+			aws.StringValue(out.StorageClass) != s3.StorageClassGlacier || aws.StringValue(out.VersionId) != "v1" {
+			t.Errorf("read at %d lost the object's headers: %+v", start, out)
+		}
+	}
+
+	// Reads after the first two were served from prefetched windows
+	for _, r := range backend.reads() {
+		if start, end, ok := parseSimpleRange(r); ok && end-start == 49 && start >= 100 {
+			t.Errorf("read %s reached the backend", r)
+		}
+	}
+}
+
+func TestReadAheadProxy_PutIfAbsent(t *testing.T) {
+	backend := newFakeProxy()
+	p := NewReadAheadProxy(backend, 100, 100, 1<<20)
+
+	checkNoAtomicCreate(t, p, backend)
+}
+
+func TestReadAheadWindow(t *testing.T) {
+	tests := []struct {
+		name string
+		rate float64
+		want int64
+	}{
+		{name: "slow backend", rate: 10, want: 100},
+		{name: "in between", rate: 500, want: 500},
+		{name: "fast backend", rate: 1e9, want: 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readAheadWindow(tt.rate, 100, 1000); got != tt.want {
+				t.Errorf("readAheadWindow(%v) = %d, want %d", tt.rate, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadAheadConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ReadAheadConfig
+		wantErr bool
+	}{
+		{name: "default", config: ReadAheadConfig{}},
+		{name: "windows", config: ReadAheadConfig{MinWindow: 1 << 20, MaxWindow: 8 << 20, MaxSize: 1 << 30}},
+		{name: "negative size", config: ReadAheadConfig{MaxSize: -1}, wantErr: true},
+		{name: "min over max", config: ReadAheadConfig{MinWindow: 8 << 20, MaxWindow: 1 << 20}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
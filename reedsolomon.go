@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+)
+
+// This file implements systematic Reed-Solomon coding over GF(2^8) for the
+// erasure backend. The first k rows of the encoding matrix are the
+// identity, so data shards are stored as is and only parity is computed.
+
+// gfPoly is the field's reducing polynomial, x^8 + x^4 + x^3 + x^2 + 1
+const gfPoly = 0x11d
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	// gfMulTable[a][b] is a*b, so multiplying a block by a constant is a
+	// table lookup per byte
+	gfMulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPoly
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMulTable[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+// gfMulAdd adds c*src to dst
+func gfMulAdd(c byte, src, dst []byte) {
+	if c == 0 {
+		return
+	}
+
+	table := &gfMulTable[c]
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+type gfMatrix [][]byte
+
+func newGFMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m gfMatrix) mul(o gfMatrix) gfMatrix {
+	out := newGFMatrix(len(m), len(o[0]))
+	for r := range m {
+		for c := range o[0] {
+			var v byte
+			for i := range o {
+				v ^= gfMulTable[m[r][i]][o[i][c]]
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+var errSingularMatrix = errors.New("matrix is singular")
+
+// invert returns the inverse of a square matrix by Gauss-Jordan elimination
+func (m gfMatrix) invert() (gfMatrix, error) {
+	n := len(m)
+	work := newGFMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errSingularMatrix
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		scale := gfInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = gfMulTable[scale][work[c][i]]
+		}
+
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				gfMulAdd(work[r][c], work[c], work[r])
+			}
+		}
+	}
+
+	inv := newGFMatrix(n, n)
+	for r := range inv {
+		copy(inv[r], work[r][n:])
+	}
+	return inv, nil
+}
+
+// reedSolomon encodes k data shards into k+m shards, any k of which
+// reconstruct the data
+type reedSolomon struct {
+	k, m   int
+	matrix gfMatrix
+}
+
+func newReedSolomon(k, m int) (*reedSolomon, error) {
+	if k <= 0 || m < 0 || k+m > 256 {
+		return nil, errors.New("invalid shard counts")
+	}
+
+	// Any k rows of a Vandermonde matrix with distinct row values are
+	// independent. Multiplying by the inverse of its top square keeps that
+	// property and makes the data rows the identity.
+	v := newGFMatrix(k+m, k)
+	for r := range v {
+		for c := range v[r] {
+			v[r][c] = gfPow(byte(r), c)
+		}
+	}
+
+	top, err := v[:k].invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &reedSolomon{k: k, m: m, matrix: v.mul(top)}, nil
+}
+
+// encode fills the parity shards, shards[k:], from the data shards. All
+// shards have the same length.
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for j := rs.k; j < rs.k+rs.m; j++ {
+		parity := shards[j]
+		for i := range parity {
+			parity[i] = 0
+		}
+		for c := 0; c < rs.k; c++ {
+			gfMulAdd(rs.matrix[j][c], shards[c], parity)
+		}
+	}
+}
+
+// reconstructData fills in missing data shards, marked by nil entries,
+// from any k present shards. Missing parity shards are left nil.
+func (rs *reedSolomon) reconstructData(shards [][]byte) error {
+	missing := false
+	for c := 0; c < rs.k; c++ {
+		if shards[c] == nil {
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	var rows []int
+	size := 0
+	for i, shard := range shards {
+		if shard != nil && len(rows) < rs.k {
+			rows = append(rows, i)
+			size = len(shard)
+		}
+	}
+	if len(rows) < rs.k {
+		return errors.New("too few shards to reconstruct")
+	}
+
+	sub := newGFMatrix(rs.k, rs.k)
+	for i, r := range rows {
+		copy(sub[i], rs.matrix[r])
+	}
+	decode, err := sub.invert()
+	if err != nil {
+		return err
+	}
+
+	for c := 0; c < rs.k; c++ {
+		if shards[c] != nil {
+			continue
+		}
+
+		data := make([]byte, size)
+		for i, r := range rows {
+			gfMulAdd(decode[c][i], shards[r], data)
+		}
+		shards[c] = data
+	}
+
+	return nil
+}
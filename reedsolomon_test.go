@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestReedSolomon_Reconstruct(t *testing.T) {
+	tests := []struct {
+		name    string
+		k, m    int
+		missing []int
+	}{
+		{name: "nothing missing", k: 4, m: 2},
+		{name: "one data shard", k: 4, m: 2, missing: []int{1}},
+		{name: "data and parity", k: 4, m: 2, missing: []int{0, 5}},
+		{name: "all parity used", k: 3, m: 3, missing: []int{0, 1, 2}},
+		{name: "no parity", k: 2, m: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, err := newReedSolomon(tt.k, tt.m)
+			if err != nil {
+				t.Fatalf("newReedSolomon() error = %v", err)
+			}
+
+			rng := rand.New(rand.NewSource(1))
+			shards := make([][]byte, tt.k+tt.m)
+			for i := range shards {
+				shards[i] = make([]byte, 64)
+				if i < tt.k {
+					rng.Read(shards[i])
+				}
+			}
+			rs.encode(shards)
+
+			want := make([][]byte, tt.k)
+			for i := range want {
+				want[i] = append([]byte(nil), shards[i]...)
+			}
+
+			for _, i := range tt.missing {
+				shards[i] = nil
+			}
+			if err := rs.reconstructData(shards); err != nil {
+				t.Fatalf("reconstructData() error = %v", err)
+			}
+
+			for i := range want {
+				if !bytes.Equal(shards[i], want[i]) {
+					t.Errorf("data shard %d not reconstructed", i)
+				}
+			}
+		})
+	}
+}
+
+func TestReedSolomon_TooFewShards(t *testing.T) {
+	rs, _ := newReedSolomon(3, 1)
+
+	shards := [][]byte{make([]byte, 8), make([]byte, 8), make([]byte, 8), make([]byte, 8)}
+	rs.encode(shards)
+	shards[0], shards[2] = nil, nil
+
+	if err := rs.reconstructData(shards); err == nil {
+		t.Error("reconstructData() with two of four shards should fail")
+	}
+}
@@ -13,6 +13,7 @@ import (
 type ReloadableHandler struct {
 	mu      sync.RWMutex
 	handler http.Handler
+	workers *workerGroup
 	config  *ReloadableConfig
 }
 
@@ -67,20 +68,37 @@ func (rh *ReloadableHandler) reload() error {
 		return nil
 	}
 
-	// Create new handler
+	// Create new handler. The background workers of its backends start
+	// once every site built, taking over from the current ones.
 	handler := NewHostDispatchingHandler()
-	for _, site := range cfg {
-		if err := site.validateWithHost(); err != nil {
-			return err
+	workers, err := buildWorkers(func() error {
+		for _, site := range cfg {
+			if err := site.validateWithHost(); err != nil {
+				return err
+			}
+			siteHandler, err := createSiteHandler(site)
+			if err != nil {
+				return err
+			}
+			handler.HandleHost(site.Host, siteHandler)
 		}
-		handler.HandleHost(site.Host, createSiteHandler(site))
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	workers.start()
 
 	// Swap handler atomically
 	rh.mu.Lock()
 	rh.handler = handler
+	previous := rh.workers
+	rh.workers = workers
 	rh.mu.Unlock()
 
+	// Stop the workers of sites that were removed
+	previous.stop()
+
 	return nil
 }
 
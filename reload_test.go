@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestReloadableHandler_ConfigFile(t *testing.T) {
@@ -59,3 +60,75 @@ func TestReloadableHandler_MissingConfig(t *testing.T) {
 	}
 }
 
+
+func TestReloadableHandler_Workers(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	stagingDir := filepath.Join(dir, "staging")
+	corruptState := filepath.Join(dir, "migration.json")
+	os.WriteFile(corruptState, []byte("{"), 0644)
+
+	site := `- host: a.localhost
+  type: memory
+  awsBucket: a
+  writeBack:
+    dir: ` + stagingDir + `
+    maxSize: 1048576
+`
+	brokenSite := `- host: b.localhost
+  type: migrate
+  awsBucket: b
+  migrate:
+    source: {type: memory}
+    destination: {type: memory}
+    stateFile: ` + corruptState + `
+`
+	otherSite := `- host: c.localhost
+  type: memory
+  awsBucket: c
+`
+
+	modTime := time.Now()
+	write := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Second)
+		os.Chtimes(configFile, modTime, modTime)
+	}
+	stagingWorker := func() backgroundWorker {
+		runningWorkers.Lock()
+		defer runningWorkers.Unlock()
+		return runningWorkers.m[stagingDir]
+	}
+
+	write(site)
+	rh, err := NewReloadableHandler(configFile)
+	if err != nil {
+		t.Fatalf("NewReloadableHandler() error = %v", err)
+	}
+	staging := stagingWorker()
+	if staging == nil {
+		t.Fatal("write-back worker was not started")
+	}
+	t.Cleanup(func() { staging.Close() })
+
+	// A site failing to build keeps the running configuration and workers
+	write(site + brokenSite)
+	if err := rh.reload(); err == nil {
+		t.Fatal("reload() of a broken configuration succeeded")
+	}
+	if stagingWorker() != staging {
+		t.Error("write-back worker was replaced by a configuration that failed to build")
+	}
+
+	// Removing the site stops its worker
+	write(otherSite)
+	if err := rh.reload(); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	if w := stagingWorker(); w != nil {
+		t.Error("write-back worker of a removed site kept running")
+	}
+}
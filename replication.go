@@ -0,0 +1,519 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Replication policies, deciding which replica writes a client waits for
+const (
+	// replicateAll fails the request unless every replica was written
+	replicateAll = "all"
+	// replicateAsync returns once the primary was written and replicates
+	// from the retry queue
+	replicateAsync = "async"
+	// replicateQuorum returns once enough copies, counting the primary,
+	// were written and queues the remaining replicas
+	replicateQuorum = "quorum"
+)
+
+const defaultReplicationRetryInterval = 30 * time.Second
+
+// ReplicationConfig adds replicas to a site. Replicas are full site backend
+// configurations (without host, users or options). Writes that do not
+// reach a replica are recorded in QueueDir and retried until they do.
+type ReplicationConfig struct {
+	Replicas      []Site `json:"replicas" yaml:"replicas"`
+	Policy        string `json:"policy,omitempty" yaml:"policy,omitempty"`
+	Quorum        int    `json:"quorum,omitempty" yaml:"quorum,omitempty"`
+	QueueDir      string `json:"queueDir" yaml:"queueDir"`
+	RetryInterval string `json:"retryInterval,omitempty" yaml:"retryInterval,omitempty"`
+}
+
+func (c *ReplicationConfig) validate() error {
+	if len(c.Replicas) == 0 {
+		return errors.New("Replication replicas not specified")
+	}
+
+	for i, replica := range c.Replicas {
+		if err := replica.validate(); err != nil {
+			return fmt.Errorf("%v in replica %d", err, i)
+		}
+	}
+
+	switch c.Policy {
+	case "", replicateAll, replicateAsync, replicateQuorum:
+	default:
+		return fmt.Errorf("Unknown replication policy %q (available: all, async, quorum)", c.Policy)
+	}
+
+	if c.Quorum < 0 || c.Quorum > len(c.Replicas)+1 {
+		return fmt.Errorf("Replication quorum must be between 1 and %d", len(c.Replicas)+1)
+	}
+
+	if c.QueueDir == "" {
+		return errors.New("Replication queueDir not specified")
+	}
+
+	if c.RetryInterval != "" {
+		if d, err := time.ParseDuration(c.RetryInterval); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid replication retryInterval %q", c.RetryInterval)
+		}
+	}
+
+	return nil
+}
+
+// newReplicatedBackend wraps a site's backend with its configured replicas
+func newReplicatedBackend(primary S3Proxy, cfg ReplicationConfig) (S3Proxy, error) {
+	replicas := make([]S3Proxy, 0, len(cfg.Replicas))
+	for i, site := range cfg.Replicas {
+		replica, err := NewBackend(site)
+		if err != nil {
+			return nil, fmt.Errorf("replica %d: %v", i, err)
+		}
+		replicas = append(replicas, replica)
+	}
+
+	retryInterval := defaultReplicationRetryInterval
+	if cfg.RetryInterval != "" {
+		retryInterval, _ = time.ParseDuration(cfg.RetryInterval)
+	}
+
+	p, err := NewReplicatedProxy(primary, replicas, cfg.Policy, cfg.Quorum, cfg.QueueDir, retryInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	startWorker(p)
+	return p, nil
+}
+
+// ReplicatedProxy applies the writes made to a primary backend to its
+// replicas. Reads are served by the primary. Multipart uploads are staged
+// on the primary and the completed object is copied to the replicas.
+//
+// Replicas that miss a write are queued for the key rather than the write
+// itself: retrying copies the primary's current object, or deletes the key
+// if the primary no longer has it, so retries are idempotent and never
+// reorder writes.
+type ReplicatedProxy struct {
+	primary       S3Proxy
+	replicas      []S3Proxy
+	policy        string
+	quorum        int
+	queueDir      string
+	retryInterval time.Duration
+
+	locks keyLocks
+	// wake prompts the retry worker to drain the queue before its next
+	// scheduled pass
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// replicationEntry is the queue file recording that a replica needs a key
+// brought up to date with the primary
+type replicationEntry struct {
+	Replica   int       `json:"replica"`
+	Key       string    `json:"key"`
+	Queued    time.Time `json:"queued"`
+	Attempts  int       `json:"attempts"`
+	Attempted time.Time `json:"attempted,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// NewReplicatedProxy creates a replicated backend. A quorum of 0 means a
+// majority of the primary and replicas. Queued writes are retried once
+// Start has been called.
+func NewReplicatedProxy(primary S3Proxy, replicas []S3Proxy, policy string, quorum int, queueDir string, retryInterval time.Duration) (*ReplicatedProxy, error) {
+	if policy == "" {
+		policy = replicateAll
+	}
+	if quorum == 0 {
+		quorum = (len(replicas)+1)/2 + 1
+	}
+
+	if err := os.MkdirAll(queueDir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &ReplicatedProxy{
+		primary:       primary,
+		replicas:      replicas,
+		policy:        policy,
+		quorum:        quorum,
+		queueDir:      queueDir,
+		retryInterval: retryInterval,
+		wake:          make(chan struct{}, 1),
+	}, nil
+}
+
+func (p *ReplicatedProxy) statePath() string {
+	return p.queueDir
+}
+
+// load has nothing to read ahead of time: the worker scans the queue
+// directory on every pass
+func (p *ReplicatedProxy) load() error {
+	return nil
+}
+
+// Start runs the worker retrying queued replica writes until Close
+func (p *ReplicatedProxy) Start() {
+	if p.stop != nil {
+		return
+	}
+
+	p.stop = make(chan struct{})
+	p.wg.Add(1)
+	go p.run(p.stop)
+}
+
+// Close stops the retry worker. Queued writes stay on disk.
+func (p *ReplicatedProxy) Close() error {
+	if p.stop != nil {
+		close(p.stop)
+		p.wg.Wait()
+		p.stop = nil
+	}
+	return nil
+}
+
+func (p *ReplicatedProxy) run(stop chan struct{}) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		p.drain(stop)
+
+		select {
+		case <-stop:
+			return
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *ReplicatedProxy) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// entryPath names queue files after the replica and key, so a key written
+// repeatedly while a replica is down is queued once
+func (p *ReplicatedProxy) entryPath(replica int, key string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s", replica, key)))
+	return filepath.Join(p.queueDir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (p *ReplicatedProxy) saveEntry(e *replicationEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	path := p.entryPath(e.Replica, e.Key)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// enqueue records that a replica needs key synced from the primary
+func (p *ReplicatedProxy) enqueue(replica int, key string, cause error) error {
+	e := &replicationEntry{Replica: replica, Key: key, Queued: time.Now().UTC()}
+	if cause != nil {
+		e.Attempts = 1
+		e.Attempted = e.Queued
+		e.LastError = cause.Error()
+	}
+
+	if err := p.saveEntry(e); err != nil {
+		return err
+	}
+
+	p.notify()
+	return nil
+}
+
+// drain retries every queued entry once, except failed ones attempted
+// within the retry interval
+func (p *ReplicatedProxy) drain(stop chan struct{}) {
+	paths, err := filepath.Glob(filepath.Join(p.queueDir, "*.json"))
+	if err != nil {
+		return
+	}
+
+	for _, path := range paths {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		var e replicationEntry
+		if err := json.Unmarshal(data, &e); err != nil || e.Replica < 0 || e.Replica >= len(p.replicas) {
+			log.Printf("replication: dropping invalid queue entry %s", path)
+			os.Remove(path)
+			continue
+		}
+
+		if e.Attempts > 0 && time.Since(e.Attempted) < p.retryInterval {
+			continue
+		}
+
+		p.retry(path, &e)
+	}
+}
+
+func (p *ReplicatedProxy) retry(path string, e *replicationEntry) {
+	unlock := p.locks.lock(e.Key)
+	defer unlock()
+
+	// The entry may have been rewritten by a newer failed write, in which
+	// case syncing below still brings the replica up to date
+	err := p.sync(e.Replica, e.Key)
+	if err == nil {
+		os.Remove(path)
+		return
+	}
+
+	e.Attempts++
+	e.Attempted = time.Now().UTC()
+	e.LastError = err.Error()
+	if err := p.saveEntry(e); err != nil {
+		log.Printf("replication: saving queue entry for %s: %v", e.Key, err)
+	}
+}
+
+// sync makes a replica's copy of key match the primary. The caller holds
+// the key's lock.
+func (p *ReplicatedProxy) sync(replica int, key string) error {
+	obj, err := p.primary.Get(key, "")
+	if isNotFound(err) {
+		_, err := p.replicas[replica].Delete(key)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	spool, err := spoolBody(obj.Body)
+	if err != nil {
+		return err
+	}
+	defer removeSpool(spool)
+
+	contentType := aws.StringValue(obj.ContentType)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	_, err = p.replicas[replica].Put(key, spool, contentType)
+	return err
+}
+
+// errReplicationFailed is returned when a write reached the primary but not
+// the replicas its policy requires
+func errReplicationFailed(written, required int, cause error) error {
+	return awserr.NewRequestFailure(
+		awserr.New("ServiceUnavailable", fmt.Sprintf("Write reached %d of %d required copies: %v", written, required, cause), nil),
+		http.StatusServiceUnavailable, "")
+}
+
+// replicate applies a write that succeeded on the primary to the replicas
+// according to the policy. write performs it on one replica. Replicas that
+// are not written are queued. The caller holds the key's lock.
+func (p *ReplicatedProxy) replicate(key string, write func(i int, replica S3Proxy) error) error {
+	required := 1
+	switch p.policy {
+	case replicateAll:
+		required = len(p.replicas) + 1
+	case replicateQuorum:
+		required = p.quorum
+	}
+
+	written := 1
+	var lastErr error
+	var failed []string
+	for i, replica := range p.replicas {
+		if written >= required {
+			if err := p.enqueue(i, key, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := write(i, replica); err != nil {
+			lastErr = err
+			failed = append(failed, fmt.Sprint(i))
+			if err := p.enqueue(i, key, err); err != nil {
+				return err
+			}
+			continue
+		}
+		written++
+	}
+
+	if len(failed) > 0 {
+		log.Printf("replication: %s queued for replicas %s: %v", key, strings.Join(failed, ", "), lastErr)
+	}
+
+	if written < required {
+		return errReplicationFailed(written, required, lastErr)
+	}
+	return nil
+}
+
+func (p *ReplicatedProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	return p.primary.Get(key, rangeHeader)
+}
+
+func (p *ReplicatedProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	return p.primary.Head(key)
+}
+
+func (p *ReplicatedProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	return p.put(key, body, contentType, p.primary.Put)
+}
+
+// PutIfAbsent creates the object on the primary atomically, and is not
+// implemented on primaries without an atomic create. Replicas are written
+// unconditionally, as the primary decides whether the key exists.
+func (p *ReplicatedProxy) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	cp, ok := p.primary.(ConditionalPutter)
+	if !ok {
+		return nil, errNotImplemented("Atomic create")
+	}
+	return p.put(key, body, contentType, cp.PutIfAbsent)
+}
+
+func (p *ReplicatedProxy) put(key string, body io.ReadSeeker, contentType string, putPrimary func(string, io.ReadSeeker, string) (*s3.PutObjectOutput, error)) (*s3.PutObjectOutput, error) {
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	out, err := putPrimary(key, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.replicate(key, func(i int, replica S3Proxy) error {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := replica.Put(key, body, contentType)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (p *ReplicatedProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	out, err := p.primary.Delete(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.replicate(key, func(i int, replica S3Proxy) error {
+		_, err := replica.Delete(key)
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (p *ReplicatedProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	return p.primary.ListObjects(prefix, delimiter, maxKeys, continuationToken)
+}
+
+func (p *ReplicatedProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	return p.primary.CreateMultipartUpload(key, contentType)
+}
+
+func (p *ReplicatedProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	return p.primary.UploadPart(key, uploadId, partNumber, body)
+}
+
+func (p *ReplicatedProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	out, err := p.primary.CompleteMultipartUpload(key, uploadId, parts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parts only exist on the primary, so copy the assembled object
+	err = p.replicate(key, func(i int, replica S3Proxy) error {
+		return p.sync(i, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (p *ReplicatedProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	return p.primary.AbortMultipartUpload(key, uploadId)
+}
+
+func (p *ReplicatedProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	return p.primary.ListMultipartUploads(prefix, delimiter, maxUploads)
+}
+
+func (p *ReplicatedProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	return p.primary.GetWebsiteConfig()
+}
+
+func (p *ReplicatedProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	return p.primary.RestoreObject(key, days, tier)
+}
+
+// MigrationStatus reports the migration of the primary
+func (p *ReplicatedProxy) MigrationStatus() (MigrationStatus, bool) {
+	return migrationStatus(p.primary)
+}
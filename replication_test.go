@@ -0,0 +1,171 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func newTestReplicatedProxy(t *testing.T, policy string, replicas ...S3Proxy) (*ReplicatedProxy, *MemoryProxy) {
+	t.Helper()
+
+	primary := NewMemoryProxy(0, 0, nil)
+	p, err := NewReplicatedProxy(primary, replicas, policy, 0, filepath.Join(t.TempDir(), "queue"), 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewReplicatedProxy() error = %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return p, primary
+}
+
+func queued(t *testing.T, p *ReplicatedProxy) int {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join(p.queueDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(paths)
+}
+
+func TestReplicatedProxy_Policies(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		wantErr    bool
+		wantQueued int
+	}{
+		// The primary and the first replica are written, the second is down
+		{name: "all", policy: replicateAll, wantErr: true, wantQueued: 1},
+		{name: "quorum", policy: replicateQuorum, wantQueued: 1},
+		{name: "async", policy: replicateAsync, wantQueued: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up, down := newFakeProxy(), newFakeProxy()
+			down.setDown(true)
+			p, primary := newTestReplicatedProxy(t, tt.policy, up, down)
+
+			_, err := p.Put("key", strings.NewReader("value"), "text/plain")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Put() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := getString(t, primary, "key", ""); got != "value" {
+				t.Errorf("primary has %q", got)
+			}
+			if n := queued(t, p); n != tt.wantQueued {
+				t.Errorf("queued = %d, want %d", n, tt.wantQueued)
+			}
+
+			// The queue brings every replica up to date once it is back
+			down.setDown(false)
+			p.Start()
+			waitFor(t, "replication queue to drain", func() bool { return queued(t, p) == 0 })
+
+			for i, replica := range []S3Proxy{up, down} {
+				if got := getString(t, replica, "key", ""); got != "value" {
+					t.Errorf("replica %d has %q", i, got)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicatedProxy_Delete(t *testing.T) {
+	replica := newFakeProxy()
+	p, _ := newTestReplicatedProxy(t, replicateAll, replica)
+
+	putString(t, p, "key", "value")
+	if got := getString(t, replica, "key", ""); got != "value" {
+		t.Fatalf("replica has %q", got)
+	}
+
+	if _, err := p.Delete("key"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := replica.Head("key"); !isNotFound(err) {
+		t.Errorf("replica Head() after delete error = %v, want not found", err)
+	}
+
+	// A queued write for a key deleted since is replayed as a delete
+	replica.setDown(true)
+	if _, err := p.Put("later", strings.NewReader("v"), "text/plain"); err == nil {
+		t.Fatal("Put() with the replica down should fail under policy all")
+	}
+	replica.setDown(false)
+	if _, err := p.Delete("later"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	p.Start()
+	waitFor(t, "replication queue to drain", func() bool { return queued(t, p) == 0 })
+	if _, err := replica.Head("later"); !isNotFound(err) {
+		t.Errorf("replica Head() error = %v, want not found", err)
+	}
+}
+
+func TestReplicatedProxy_Multipart(t *testing.T) {
+	replica := newFakeProxy()
+	p, _ := newTestReplicatedProxy(t, replicateAll, replica)
+
+	created, err := p.CreateMultipartUpload("multi", "text/plain")
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload() error = %v", err)
+	}
+	uploadId := aws.StringValue(created.UploadId)
+
+	part, err := p.UploadPart("multi", uploadId, 1, strings.NewReader("assembled"))
+	if err != nil {
+		t.Fatalf("UploadPart() error = %v", err)
+	}
+	if uploads, _ := replica.ListMultipartUploads("", "", 0); len(uploads.Uploads) != 0 {
+		t.Errorf("parts were staged on the replica: %v", uploads.Uploads)
+	}
+
+	parts := []*s3.CompletedPart{{PartNumber: aws.Int64(1), ETag: part.ETag}}
+	if _, err := p.CompleteMultipartUpload("multi", uploadId, parts); err != nil {
+		t.Fatalf("CompleteMultipartUpload() error = %v", err)
+	}
+	if got := getString(t, replica, "multi", ""); got != "assembled" {
+		t.Errorf("replica has %q", got)
+	}
+}
+
+func TestReplicatedProxy_PutIfAbsent(t *testing.T) {
+	replica := newFakeProxy()
+	p, primary := newTestReplicatedProxy(t, replicateAll, replica)
+
+	checkNoAtomicCreate(t, p, primary, replica)
+}
+
+func TestReplicationConfig_Validate(t *testing.T) {
+	replicas := []Site{{Type: "memory"}, {Type: "memory"}}
+
+	tests := []struct {
+		name    string
+		cfg     ReplicationConfig
+		wantErr bool
+	}{
+		{name: "defaults", cfg: ReplicationConfig{Replicas: replicas, QueueDir: "/tmp/q"}},
+		{name: "quorum", cfg: ReplicationConfig{Replicas: replicas, Policy: "quorum", Quorum: 3, QueueDir: "/tmp/q"}},
+		{name: "no replicas", cfg: ReplicationConfig{QueueDir: "/tmp/q"}, wantErr: true},
+		{name: "no queue", cfg: ReplicationConfig{Replicas: replicas}, wantErr: true},
+		{name: "unknown policy", cfg: ReplicationConfig{Replicas: replicas, Policy: "most", QueueDir: "/tmp/q"}, wantErr: true},
+		{name: "quorum too large", cfg: ReplicationConfig{Replicas: replicas, Quorum: 4, QueueDir: "/tmp/q"}, wantErr: true},
+		{name: "bad interval", cfg: ReplicationConfig{Replicas: replicas, QueueDir: "/tmp/q", RetryInterval: "soon"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site := Site{Type: "memory", Replication: &tt.cfg}
+			if err := site.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
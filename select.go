@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// selectRecordsChunkSize bounds the payload of a single Records event
+const selectRecordsChunkSize = 64 * 1024
+
+// selectRequest is the SelectObjectContentRequest XML body
+type selectRequest struct {
+	XMLName            xml.Name `xml:"SelectObjectContentRequest"`
+	Expression         string   `xml:"Expression"`
+	ExpressionType     string   `xml:"ExpressionType"`
+	InputSerialization struct {
+		CompressionType string `xml:"CompressionType"`
+		CSV             *struct {
+			FileHeaderInfo       string `xml:"FileHeaderInfo"`
+			Comments             string `xml:"Comments"`
+			FieldDelimiter       string `xml:"FieldDelimiter"`
+			QuoteCharacter       string `xml:"QuoteCharacter"`
+			RecordDelimiter      string `xml:"RecordDelimiter"`
+			AllowQuotedDelimiter bool   `xml:"AllowQuotedRecordDelimiter"`
+		} `xml:"CSV"`
+		JSON *struct {
+			Type string `xml:"Type"`
+		} `xml:"JSON"`
+	} `xml:"InputSerialization"`
+	OutputSerialization struct {
+		CSV *struct {
+			QuoteFields     string `xml:"QuoteFields"`
+			FieldDelimiter  string `xml:"FieldDelimiter"`
+			QuoteCharacter  string `xml:"QuoteCharacter"`
+			RecordDelimiter string `xml:"RecordDelimiter"`
+		} `xml:"CSV"`
+		JSON *struct {
+			RecordDelimiter string `xml:"RecordDelimiter"`
+		} `xml:"JSON"`
+	} `xml:"OutputSerialization"`
+	RequestProgress struct {
+		Enabled bool `xml:"Enabled"`
+	} `xml:"RequestProgress"`
+}
+
+// selectStats mirrors the Stats and Progress event payloads
+type selectStats struct {
+	BytesScanned   int64 `xml:"BytesScanned"`
+	BytesProcessed int64 `xml:"BytesProcessed"`
+	BytesReturned  int64 `xml:"BytesReturned"`
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// handleSelect emulates SelectObjectContent by fetching the object through
+// the proxy and evaluating the SQL expression locally
+func handleSelect(proxy S3Proxy, key string, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var req selectRequest
+	if err := xml.Unmarshal(body, &req); err != nil {
+		writeS3Error(w, "MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest)
+		return
+	}
+
+	if req.ExpressionType != "" && !strings.EqualFold(req.ExpressionType, "SQL") {
+		writeS3Error(w, "InvalidExpressionType", "The ExpressionType is invalid. Only SQL expressions are supported", http.StatusBadRequest)
+		return
+	}
+
+	if (req.InputSerialization.CSV == nil) == (req.InputSerialization.JSON == nil) {
+		writeS3Error(w, "InvalidRequestParameter", "Exactly one of CSV or JSON input serialization must be specified", http.StatusBadRequest)
+		return
+	}
+
+	if (req.OutputSerialization.CSV == nil) == (req.OutputSerialization.JSON == nil) {
+		writeS3Error(w, "InvalidRequestParameter", "Exactly one of CSV or JSON output serialization must be specified", http.StatusBadRequest)
+		return
+	}
+
+	query, err := parseSelect(req.Expression)
+	if err != nil {
+		writeSelectError(w, err)
+		return
+	}
+
+	obj, err := proxy.Get(key, "")
+	if err != nil {
+		handleS3Error(w, err)
+		return
+	}
+	defer obj.Body.Close()
+
+	scanned := &countingReader{r: obj.Body}
+	var input io.Reader = scanned
+
+	switch strings.ToUpper(req.InputSerialization.CompressionType) {
+	case "", "NONE":
+	case "GZIP":
+		gz, err := gzip.NewReader(scanned)
+		if err != nil {
+			writeS3Error(w, "InvalidCompressionFormat", "The file is not in a supported compression format. Only GZIP and BZIP2 are supported", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		input = gz
+	case "BZIP2":
+		input = bzip2.NewReader(scanned)
+	default:
+		writeS3Error(w, "InvalidCompressionFormat", "The file is not in a supported compression format. Only GZIP and BZIP2 are supported", http.StatusBadRequest)
+		return
+	}
+
+	processed := &countingReader{r: input}
+
+	next, err := newSelectRecordReader(&req, processed)
+	if err != nil {
+		writeSelectError(w, err)
+		return
+	}
+
+	out := newSelectWriter(&req, query)
+	stream := &selectStream{w: w}
+	if f, ok := w.(http.Flusher); ok {
+		stream.flusher = f
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+
+	// Errors past this point are reported in-band as error events
+	var returned int64
+	flush := func(force bool) error {
+		if out.buf.Len() == 0 || (!force && out.buf.Len() < selectRecordsChunkSize) {
+			return nil
+		}
+		returned += int64(out.buf.Len())
+		err := stream.event("Records", "application/octet-stream", out.buf.Bytes())
+		out.buf.Reset()
+		return err
+	}
+
+	var emitted int64
+	for query.limit < 0 || emitted < query.limit || len(query.aggregates) > 0 {
+		rec, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stream.error(err)
+			return
+		}
+
+		if query.where != nil {
+			ok, err := query.where.eval(rec)
+			if err != nil {
+				stream.error(err)
+				return
+			}
+			if match, _ := ok.(bool); !match {
+				continue
+			}
+		}
+
+		if len(query.aggregates) > 0 {
+			for _, agg := range query.aggregates {
+				if err := agg.accumulate(rec); err != nil {
+					stream.error(err)
+					return
+				}
+			}
+			continue
+		}
+
+		if err := out.write(rec); err != nil {
+			stream.error(err)
+			return
+		}
+		emitted++
+
+		if err := flush(false); err != nil {
+			return
+		}
+	}
+
+	// Aggregate queries produce a single row once the input is exhausted
+	if len(query.aggregates) > 0 && query.limit != 0 {
+		if err := out.write(nil); err != nil {
+			stream.error(err)
+			return
+		}
+	}
+
+	if err := flush(true); err != nil {
+		return
+	}
+
+	stats := selectStats{
+		BytesScanned:   scanned.n,
+		BytesProcessed: processed.n,
+		BytesReturned:  returned,
+	}
+
+	if req.RequestProgress.Enabled {
+		payload, _ := xml.Marshal(struct {
+			XMLName xml.Name `xml:"Progress"`
+			selectStats
+		}{selectStats: stats})
+		if err := stream.event("Progress", "text/xml", payload); err != nil {
+			return
+		}
+	}
+
+	payload, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Stats"`
+		selectStats
+	}{selectStats: stats})
+	if err := stream.event("Stats", "text/xml", payload); err != nil {
+		return
+	}
+
+	stream.event("End", "", nil)
+}
+
+// newSelectRecordReader returns a function yielding input records until io.EOF
+func newSelectRecordReader(req *selectRequest, input io.Reader) (func() (selectRecord, error), error) {
+	if cfg := req.InputSerialization.JSON; cfg != nil {
+		typ := strings.ToUpper(cfg.Type)
+		if typ != "" && typ != "DOCUMENT" && typ != "LINES" {
+			return nil, &selectError{code: "InvalidJsonType", message: "The JsonType is invalid. Only DOCUMENT and LINES are supported"}
+		}
+
+		dec := json.NewDecoder(bufio.NewReader(input))
+		dec.UseNumber()
+
+		// A top-level array is read element by element
+		var pending []interface{}
+		return func() (selectRecord, error) {
+			for len(pending) == 0 {
+				var doc interface{}
+				if err := dec.Decode(&doc); err != nil {
+					if err == io.EOF {
+						return nil, io.EOF
+					}
+					return nil, &selectError{code: "JSONParsingError", message: "Error parsing JSON file: " + err.Error()}
+				}
+				if arr, ok := doc.([]interface{}); ok {
+					pending = arr
+					continue
+				}
+				return &jsonRecord{doc: doc}, nil
+			}
+			doc := pending[0]
+			pending = pending[1:]
+			return &jsonRecord{doc: doc}, nil
+		}, nil
+	}
+
+	cfg := req.InputSerialization.CSV
+	reader := csv.NewReader(bufio.NewReader(input))
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = false
+	reader.LazyQuotes = true
+
+	if cfg.FieldDelimiter != "" {
+		reader.Comma = []rune(cfg.FieldDelimiter)[0]
+	}
+	if cfg.Comments != "" {
+		reader.Comment = []rune(cfg.Comments)[0]
+	}
+	if cfg.QuoteCharacter != "" && cfg.QuoteCharacter != `"` {
+		return nil, &selectError{code: "UnsupportedCsvQuoteCharacter", message: `Only " is supported as the CSV quote character`}
+	}
+	if d := cfg.RecordDelimiter; d != "" && d != "\n" && d != "\r\n" {
+		return nil, &selectError{code: "UnsupportedCsvRecordDelimiter", message: "Only newline record delimiters are supported"}
+	}
+
+	var names []string
+	header := strings.ToUpper(cfg.FileHeaderInfo)
+	first := true
+
+	return func() (selectRecord, error) {
+		for {
+			fields, err := reader.Read()
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			if err != nil {
+				return nil, &selectError{code: "CSVParsingError", message: "Error parsing CSV file: " + err.Error()}
+			}
+
+			if first {
+				first = false
+				switch header {
+				case "USE":
+					names = fields
+					continue
+				case "IGNORE":
+					continue
+				}
+			}
+
+			return &csvRecord{names: names, fields: fields}, nil
+		}
+	}, nil
+}
+
+// selectWriter serializes projected records into buf
+type selectWriter struct {
+	query *selectQuery
+	buf   bytes.Buffer
+
+	json            bool
+	recordDelimiter string
+	fieldDelimiter  string
+	quote           string
+	quoteAlways     bool
+}
+
+func newSelectWriter(req *selectRequest, query *selectQuery) *selectWriter {
+	sw := &selectWriter{query: query, recordDelimiter: "\n", fieldDelimiter: ",", quote: `"`}
+
+	if cfg := req.OutputSerialization.JSON; cfg != nil {
+		sw.json = true
+		if cfg.RecordDelimiter != "" {
+			sw.recordDelimiter = cfg.RecordDelimiter
+		}
+		return sw
+	}
+
+	cfg := req.OutputSerialization.CSV
+	if cfg.RecordDelimiter != "" {
+		sw.recordDelimiter = cfg.RecordDelimiter
+	}
+	if cfg.FieldDelimiter != "" {
+		sw.fieldDelimiter = cfg.FieldDelimiter
+	}
+	if cfg.QuoteCharacter != "" {
+		sw.quote = cfg.QuoteCharacter
+	}
+	sw.quoteAlways = strings.EqualFold(cfg.QuoteFields, "ALWAYS")
+	return sw
+}
+
+// write projects rec and appends it to the buffer. A nil record evaluates
+// the projections against the aggregate results.
+func (sw *selectWriter) write(rec selectRecord) error {
+	var names []string
+	var values []interface{}
+
+	if sw.query.star {
+		names, values = rec.columns()
+		if sw.json {
+			// JSON documents are returned as they were read
+			if jr, ok := rec.(*jsonRecord); ok {
+				return sw.writeJSONValue(jr.doc)
+			}
+		}
+	} else {
+		for i, proj := range sw.query.projections {
+			v, err := proj.expr.eval(rec)
+			if err != nil {
+				return err
+			}
+			name := proj.name
+			if name == "" {
+				name = "_" + strconv.Itoa(i+1)
+			}
+			names = append(names, name)
+			values = append(values, v)
+		}
+	}
+
+	if sw.json {
+		var sb strings.Builder
+		sb.WriteString("{")
+		for i, name := range names {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			k, _ := json.Marshal(name)
+			v, err := json.Marshal(values[i])
+			if err != nil {
+				return selectEvalError("cannot serialize %v", values[i])
+			}
+			sb.Write(k)
+			sb.WriteString(":")
+			sb.Write(v)
+		}
+		sb.WriteString("}")
+		sw.buf.WriteString(sb.String())
+		sw.buf.WriteString(sw.recordDelimiter)
+		return nil
+	}
+
+	for i, v := range values {
+		if i > 0 {
+			sw.buf.WriteString(sw.fieldDelimiter)
+		}
+		s := selectString(v)
+		if sw.quoteAlways || strings.Contains(s, sw.fieldDelimiter) || strings.Contains(s, sw.quote) ||
+			strings.Contains(s, sw.recordDelimiter) || strings.ContainsAny(s, "\r\n") {
+			s = sw.quote + strings.ReplaceAll(s, sw.quote, sw.quote+sw.quote) + sw.quote
+		}
+		sw.buf.WriteString(s)
+	}
+	sw.buf.WriteString(sw.recordDelimiter)
+	return nil
+}
+
+func (sw *selectWriter) writeJSONValue(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return selectEvalError("cannot serialize record")
+	}
+	sw.buf.Write(b)
+	sw.buf.WriteString(sw.recordDelimiter)
+	return nil
+}
+
+// selectStream writes event stream messages to the response
+type selectStream struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (s *selectStream) event(eventType string, contentType string, payload []byte) error {
+	headers := []eventStreamHeader{
+		{":message-type", "event"},
+		{":event-type", eventType},
+	}
+	if contentType != "" {
+		headers = append(headers, eventStreamHeader{":content-type", contentType})
+	}
+
+	if err := writeEventStreamMessage(s.w, headers, payload); err != nil {
+		return err
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+func (s *selectStream) error(err error) {
+	code, message := "InternalError", err.Error()
+	var serr *selectError
+	if errors.As(err, &serr) {
+		code, message = serr.code, serr.message
+	}
+
+	writeEventStreamMessage(s.w, []eventStreamHeader{
+		{":message-type", "error"},
+		{":error-code", code},
+		{":error-message", message},
+	}, nil)
+}
+
+// eventStreamString is the type tag of string header values
+const eventStreamString = 7
+
+// eventStreamHeader is a string valued event stream message header
+type eventStreamHeader struct {
+	name  string
+	value string
+}
+
+// writeEventStreamMessage frames a message in the event stream encoding:
+// a prelude holding the total and header lengths followed by its CRC32,
+// then the headers, the payload and a CRC32 of everything before it
+func writeEventStreamMessage(w io.Writer, headers []eventStreamHeader, payload []byte) error {
+	var encoded bytes.Buffer
+	for _, h := range headers {
+		value := h.value
+		if len(value) > math.MaxInt16 {
+			value = value[:math.MaxInt16]
+		}
+
+		encoded.WriteByte(byte(len(h.name)))
+		encoded.WriteString(h.name)
+		encoded.WriteByte(eventStreamString)
+		binary.Write(&encoded, binary.BigEndian, uint16(len(value)))
+		encoded.WriteString(value)
+	}
+
+	total := 12 + encoded.Len() + len(payload) + 4
+	msg := make([]byte, 0, total)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(total))
+	msg = binary.BigEndian.AppendUint32(msg, uint32(encoded.Len()))
+	msg = binary.BigEndian.AppendUint32(msg, crc32.ChecksumIEEE(msg))
+	msg = append(msg, encoded.Bytes()...)
+	msg = append(msg, payload...)
+	msg = binary.BigEndian.AppendUint32(msg, crc32.ChecksumIEEE(msg))
+
+	_, err := w.Write(msg)
+	return err
+}
+
+// writeSelectError reports errors detected before the event stream starts
+func writeSelectError(w http.ResponseWriter, err error) {
+	var serr *selectError
+	if errors.As(err, &serr) {
+		writeS3Error(w, serr.code, serr.message, http.StatusBadRequest)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
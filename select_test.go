@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type getStub struct {
+	S3Proxy
+	objects map[string][]byte
+}
+
+func (p *getStub) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	data, ok := p.objects[key]
+	if !ok {
+		return nil, errNoSuchKey(key)
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+	}, nil
+}
+
+func selectRequestBody(expression string, input string, output string) string {
+	return `<SelectObjectContentRequest>
+  <Expression>` + expression + `</Expression>
+  <ExpressionType>SQL</ExpressionType>
+  <InputSerialization>` + input + `</InputSerialization>
+  <OutputSerialization>` + output + `</OutputSerialization>
+</SelectObjectContentRequest>`
+}
+
+// decodeEventStreamMessage reads one event stream message, checking its
+// framing and both checksums
+func decodeEventStreamMessage(t *testing.T, r *bytes.Reader) (map[string]string, []byte) {
+	t.Helper()
+
+	prelude := make([]byte, 12)
+	if _, err := io.ReadFull(r, prelude); err != nil {
+		t.Fatalf("reading prelude: %v", err)
+	}
+	total := binary.BigEndian.Uint32(prelude[0:4])
+	headersLen := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		t.Fatal("prelude CRC mismatch")
+	}
+
+	msg := make([]byte, total)
+	copy(msg, prelude)
+	if _, err := io.ReadFull(r, msg[12:]); err != nil {
+		t.Fatalf("reading message: %v", err)
+	}
+	if crc32.ChecksumIEEE(msg[:total-4]) != binary.BigEndian.Uint32(msg[total-4:]) {
+		t.Fatal("message CRC mismatch")
+	}
+
+	headers := make(map[string]string)
+	raw := msg[12 : 12+headersLen]
+	for len(raw) > 0 {
+		nameLen := int(raw[0])
+		name := string(raw[1 : 1+nameLen])
+		if raw[1+nameLen] != eventStreamString {
+			t.Fatalf("header %s has type %d, want string", name, raw[1+nameLen])
+		}
+		valueLen := int(binary.BigEndian.Uint16(raw[2+nameLen:]))
+		headers[name] = string(raw[4+nameLen : 4+nameLen+valueLen])
+		raw = raw[4+nameLen+valueLen:]
+	}
+	return headers, msg[12+headersLen : total-4]
+}
+
+// decodeSelectEvents returns the concatenated Records payloads and the event types seen
+func decodeSelectEvents(t *testing.T, body []byte) (string, []string) {
+	t.Helper()
+
+	var records strings.Builder
+	var events []string
+	r := bytes.NewReader(body)
+	for r.Len() > 0 {
+		headers, payload := decodeEventStreamMessage(t, r)
+		if headers[":message-type"] == "error" {
+			t.Fatalf("select returned error event %s: %s", headers[":error-code"], headers[":error-message"])
+		}
+
+		typ := headers[":event-type"]
+		events = append(events, typ)
+		if typ == "Records" {
+			records.Write(payload)
+		}
+	}
+	return records.String(), events
+}
+
+func TestHandleSelect(t *testing.T) {
+	csvData := "name,age,city\nalice,34,Paris\nbob,19,London\ncarol,52,Paris\n"
+	jsonLines := `{"name":"alice","age":34}` + "\n" + `{"name":"bob","age":19}` + "\n"
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(csvData))
+	zw.Close()
+
+	proxy := &getStub{objects: map[string][]byte{
+		"people.csv":    []byte(csvData),
+		"people.csv.gz": gz.Bytes(),
+		"people.json":   []byte(jsonLines),
+	}}
+
+	csvIn := `<CSV><FileHeaderInfo>USE</FileHeaderInfo></CSV>`
+	csvOut := `<CSV/>`
+	jsonOut := `<JSON/>`
+
+	tests := []struct {
+		name   string
+		key    string
+		body   string
+		want   string
+		status int
+	}{
+		{
+			name:   "csv where",
+			key:    "people.csv",
+			body:   selectRequestBody("SELECT s.name FROM S3Object s WHERE s.city = 'Paris'", csvIn, csvOut),
+			want:   "alice\ncarol\n",
+			status: http.StatusOK,
+		},
+		{
+			name:   "csv limit",
+			key:    "people.csv",
+			body:   selectRequestBody("SELECT * FROM S3Object LIMIT 1", csvIn, csvOut),
+			want:   "alice,34,Paris\n",
+			status: http.StatusOK,
+		},
+		{
+			name:   "gzip csv to json",
+			key:    "people.csv.gz",
+			body:   selectRequestBody("SELECT s.name, s.age FROM S3Object s WHERE CAST(s.age AS INT) &gt; 30", `<CompressionType>GZIP</CompressionType>`+csvIn, jsonOut),
+			want:   `{"name":"alice","age":"34"}` + "\n" + `{"name":"carol","age":"52"}` + "\n",
+			status: http.StatusOK,
+		},
+		{
+			name:   "json lines aggregate",
+			key:    "people.json",
+			body:   selectRequestBody("SELECT COUNT(*) AS n, AVG(s.age) AS mean FROM S3Object s", `<JSON><Type>LINES</Type></JSON>`, jsonOut),
+			want:   `{"n":2,"mean":26.5}` + "\n",
+			status: http.StatusOK,
+		},
+		{
+			name:   "parse error",
+			key:    "people.csv",
+			body:   selectRequestBody("SELECT FROM", csvIn, csvOut),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "missing object",
+			key:    "missing.csv",
+			body:   selectRequestBody("SELECT * FROM S3Object", csvIn, csvOut),
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewProxyHandler(proxy, "", "bucket")
+			req := httptest.NewRequest("POST", "/bucket/"+tt.key+"?select&select-type=2", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Fatalf("handler returned status %v, want %v: %s", rr.Code, tt.status, rr.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			records, events := decodeSelectEvents(t, rr.Body.Bytes())
+			if records != tt.want {
+				t.Errorf("records = %q, want %q", records, tt.want)
+			}
+			if len(events) < 2 || events[len(events)-2] != "Stats" || events[len(events)-1] != "End" {
+				t.Errorf("events = %v, want Stats then End last", events)
+			}
+		})
+	}
+}
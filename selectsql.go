@@ -0,0 +1,1263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This file implements the subset of the S3 Select SQL dialect the proxy
+// emulates: SELECT <projection> FROM S3Object [alias] [WHERE <expr>] [LIMIT n]
+// with comparison, logical, arithmetic, LIKE, IN, BETWEEN and IS NULL
+// operators, CAST, a few string functions and the COUNT, SUM, AVG, MIN and
+// MAX aggregates. Values are nil (NULL), bool, float64, json.Number, string,
+// map[string]interface{} or []interface{}.
+
+// selectError is reported to the client with an S3 Select error code
+type selectError struct {
+	code    string
+	message string
+}
+
+func (e *selectError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func selectParseError(format string, args ...interface{}) error {
+	return &selectError{code: "ParseUnexpectedToken", message: fmt.Sprintf(format, args...)}
+}
+
+func selectEvalError(format string, args ...interface{}) error {
+	return &selectError{code: "EvaluatorInvalidArguments", message: fmt.Sprintf(format, args...)}
+}
+
+// selectRecord is a single input row
+type selectRecord interface {
+	// lookup resolves a column path such as _1, name or a.b[0]
+	lookup(path []string) interface{}
+	// columns returns all column names and values for SELECT *
+	columns() ([]string, []interface{})
+	// value returns the whole record for projections of the table alias
+	value() interface{}
+}
+
+// csvRecord is a row of a CSV object; names is nil without a header row
+type csvRecord struct {
+	names  []string
+	fields []string
+}
+
+func (r *csvRecord) lookup(path []string) interface{} {
+	if len(path) != 1 {
+		return nil
+	}
+
+	name := path[0]
+	if strings.HasPrefix(name, "_") {
+		if n, err := strconv.Atoi(name[1:]); err == nil {
+			if n >= 1 && n <= len(r.fields) {
+				return r.fields[n-1]
+			}
+			return nil
+		}
+	}
+
+	for i, header := range r.names {
+		if strings.EqualFold(header, name) && i < len(r.fields) {
+			return r.fields[i]
+		}
+	}
+
+	return nil
+}
+
+func (r *csvRecord) columns() ([]string, []interface{}) {
+	names := make([]string, len(r.fields))
+	values := make([]interface{}, len(r.fields))
+	for i, f := range r.fields {
+		if i < len(r.names) {
+			names[i] = r.names[i]
+		} else {
+			names[i] = "_" + strconv.Itoa(i+1)
+		}
+		values[i] = f
+	}
+	return names, values
+}
+
+func (r *csvRecord) value() interface{} {
+	names, values := r.columns()
+	m := make(map[string]interface{}, len(names))
+	for i, name := range names {
+		m[name] = values[i]
+	}
+	return m
+}
+
+// jsonRecord is a single JSON value of a JSON object
+type jsonRecord struct {
+	doc interface{}
+}
+
+func (r *jsonRecord) lookup(path []string) interface{} {
+	current := r.doc
+	for _, elem := range path {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			next, ok := v[elem]
+			if !ok {
+				// Unquoted identifiers are case-insensitive
+				for k, val := range v {
+					if strings.EqualFold(k, elem) {
+						next, ok = val, true
+						break
+					}
+				}
+			}
+			if !ok {
+				return nil
+			}
+			current = next
+		case []interface{}:
+			idx, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(elem, "["), "]"))
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil
+			}
+			current = v[idx]
+		default:
+			return nil
+		}
+	}
+	return current
+}
+
+func (r *jsonRecord) columns() ([]string, []interface{}) {
+	m, ok := r.doc.(map[string]interface{})
+	if !ok {
+		return []string{"_1"}, []interface{}{r.doc}
+	}
+
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	values := make([]interface{}, len(names))
+	for i, k := range names {
+		values[i] = m[k]
+	}
+	return names, values
+}
+
+func (r *jsonRecord) value() interface{} {
+	return r.doc
+}
+
+// selectQuery is a parsed SELECT statement
+type selectQuery struct {
+	star        bool
+	projections []selectProjection
+	alias       string
+	where       selectExpr
+	limit       int64
+	aggregates  []*selectAggregate
+}
+
+type selectProjection struct {
+	expr selectExpr
+	name string
+}
+
+// selectExpr is a node of a parsed expression
+type selectExpr interface {
+	eval(rec selectRecord) (interface{}, error)
+}
+
+type selectLiteral struct {
+	v interface{}
+}
+
+func (e *selectLiteral) eval(rec selectRecord) (interface{}, error) {
+	return e.v, nil
+}
+
+type selectColumn struct {
+	path  []string
+	whole bool
+}
+
+func (e *selectColumn) eval(rec selectRecord) (interface{}, error) {
+	if rec == nil {
+		return nil, selectEvalError("column references cannot be mixed with aggregate functions")
+	}
+	if e.whole {
+		return rec.value(), nil
+	}
+	return rec.lookup(e.path), nil
+}
+
+type selectUnary struct {
+	op string
+	x  selectExpr
+}
+
+func (e *selectUnary) eval(rec selectRecord) (interface{}, error) {
+	v, err := e.x.eval(rec)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "NOT":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, selectEvalError("NOT requires a boolean operand")
+		}
+		return !b, nil
+	default:
+		n, ok := selectNumber(v)
+		if !ok {
+			return nil, selectEvalError("unary minus requires a numeric operand")
+		}
+		return -n, nil
+	}
+}
+
+type selectBinary struct {
+	op   string
+	l, r selectExpr
+}
+
+func (e *selectBinary) eval(rec selectRecord) (interface{}, error) {
+	l, err := e.l.eval(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	// AND and OR follow SQL three-valued logic and short-circuit
+	switch e.op {
+	case "AND", "OR":
+		lb, lok := l.(bool)
+		if l != nil && !lok {
+			return nil, selectEvalError("%s requires boolean operands", e.op)
+		}
+		if lok && e.op == "AND" && !lb {
+			return false, nil
+		}
+		if lok && e.op == "OR" && lb {
+			return true, nil
+		}
+
+		r, err := e.r.eval(rec)
+		if err != nil {
+			return nil, err
+		}
+		rb, rok := r.(bool)
+		if r != nil && !rok {
+			return nil, selectEvalError("%s requires boolean operands", e.op)
+		}
+		if rok && e.op == "AND" && !rb {
+			return false, nil
+		}
+		if rok && e.op == "OR" && rb {
+			return true, nil
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		return e.op == "AND", nil
+	}
+
+	r, err := e.r.eval(rec)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil || r == nil {
+		return nil, nil
+	}
+
+	switch e.op {
+	case "=", "!=", "<", "<=", ">", ">=":
+		cmp, ok := selectCompare(l, r)
+		if !ok {
+			if e.op == "=" {
+				return false, nil
+			}
+			if e.op == "!=" {
+				return true, nil
+			}
+			return nil, selectEvalError("cannot compare %v and %v", l, r)
+		}
+		switch e.op {
+		case "=":
+			return cmp == 0, nil
+		case "!=":
+			return cmp != 0, nil
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	case "||":
+		return selectString(l) + selectString(r), nil
+	}
+
+	ln, lok := selectNumber(l)
+	rn, rok := selectNumber(r)
+	if !lok || !rok {
+		return nil, selectEvalError("operator %s requires numeric operands", e.op)
+	}
+
+	switch e.op {
+	case "+":
+		return ln + rn, nil
+	case "-":
+		return ln - rn, nil
+	case "*":
+		return ln * rn, nil
+	case "/":
+		if rn == 0 {
+			return nil, &selectError{code: "DivisionByZero", message: "division by zero"}
+		}
+		return ln / rn, nil
+	default:
+		if rn == 0 {
+			return nil, &selectError{code: "DivisionByZero", message: "division by zero"}
+		}
+		return math.Mod(ln, rn), nil
+	}
+}
+
+type selectLike struct {
+	x       selectExpr
+	pattern selectExpr
+	not     bool
+	cache   map[string]*regexp.Regexp
+}
+
+func (e *selectLike) eval(rec selectRecord) (interface{}, error) {
+	v, err := e.x.eval(rec)
+	if err != nil {
+		return nil, err
+	}
+	p, err := e.pattern.eval(rec)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil || p == nil {
+		return nil, nil
+	}
+
+	pattern := selectString(p)
+	re, ok := e.cache[pattern]
+	if !ok {
+		var sb strings.Builder
+		sb.WriteString("(?s)^")
+		for _, c := range pattern {
+			switch c {
+			case '%':
+				sb.WriteString(".*")
+			case '_':
+				sb.WriteString(".")
+			default:
+				sb.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		}
+		sb.WriteString("$")
+		re = regexp.MustCompile(sb.String())
+		e.cache[pattern] = re
+	}
+
+	return re.MatchString(selectString(v)) != e.not, nil
+}
+
+type selectIsNull struct {
+	x   selectExpr
+	not bool
+}
+
+func (e *selectIsNull) eval(rec selectRecord) (interface{}, error) {
+	v, err := e.x.eval(rec)
+	if err != nil {
+		return nil, err
+	}
+	return (v == nil) != e.not, nil
+}
+
+type selectIn struct {
+	x    selectExpr
+	list []selectExpr
+	not  bool
+}
+
+func (e *selectIn) eval(rec selectRecord) (interface{}, error) {
+	v, err := e.x.eval(rec)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	for _, item := range e.list {
+		iv, err := item.eval(rec)
+		if err != nil {
+			return nil, err
+		}
+		if cmp, ok := selectCompare(v, iv); ok && cmp == 0 {
+			return !e.not, nil
+		}
+	}
+	return e.not, nil
+}
+
+type selectBetween struct {
+	x, lo, hi selectExpr
+	not       bool
+}
+
+func (e *selectBetween) eval(rec selectRecord) (interface{}, error) {
+	ge, err := (&selectBinary{op: ">=", l: e.x, r: e.lo}).eval(rec)
+	if err != nil || ge == nil {
+		return nil, err
+	}
+	le, err := (&selectBinary{op: "<=", l: e.x, r: e.hi}).eval(rec)
+	if err != nil || le == nil {
+		return nil, err
+	}
+	return (ge.(bool) && le.(bool)) != e.not, nil
+}
+
+type selectCall struct {
+	name string
+	args []selectExpr
+	cast string
+}
+
+func (e *selectCall) eval(rec selectRecord) (interface{}, error) {
+	args := make([]interface{}, len(e.args))
+	for i, a := range e.args {
+		v, err := a.eval(rec)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	switch e.name {
+	case "CAST":
+		return selectCast(args[0], e.cast)
+	case "COALESCE":
+		for _, a := range args {
+			if a != nil {
+				return a, nil
+			}
+		}
+		return nil, nil
+	}
+
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	s := selectString(args[0])
+	switch e.name {
+	case "LOWER":
+		return strings.ToLower(s), nil
+	case "UPPER":
+		return strings.ToUpper(s), nil
+	case "TRIM":
+		return strings.TrimSpace(s), nil
+	default: // CHAR_LENGTH, CHARACTER_LENGTH
+		return float64(len([]rune(s))), nil
+	}
+}
+
+// selectAggregate accumulates over all matching records. Evaluating it
+// returns the final value, so it can be combined with other expressions.
+type selectAggregate struct {
+	name  string
+	arg   selectExpr
+	count int64
+	sum   float64
+	best  interface{}
+}
+
+func (e *selectAggregate) accumulate(rec selectRecord) error {
+	if e.arg == nil {
+		e.count++ // COUNT(*)
+		return nil
+	}
+
+	v, err := e.arg.eval(rec)
+	if err != nil || v == nil {
+		return err
+	}
+	e.count++
+
+	switch e.name {
+	case "SUM", "AVG":
+		n, ok := selectNumber(v)
+		if !ok {
+			return selectEvalError("%s requires numeric values, got %q", e.name, selectString(v))
+		}
+		e.sum += n
+	case "MIN", "MAX":
+		if e.best == nil {
+			e.best = v
+			return nil
+		}
+		cmp, ok := selectCompare(v, e.best)
+		if !ok {
+			return selectEvalError("%s cannot compare %v and %v", e.name, v, e.best)
+		}
+		if (e.name == "MIN" && cmp < 0) || (e.name == "MAX" && cmp > 0) {
+			e.best = v
+		}
+	}
+	return nil
+}
+
+func (e *selectAggregate) eval(rec selectRecord) (interface{}, error) {
+	switch e.name {
+	case "COUNT":
+		return float64(e.count), nil
+	case "SUM":
+		if e.count == 0 {
+			return nil, nil
+		}
+		return e.sum, nil
+	case "AVG":
+		if e.count == 0 {
+			return nil, nil
+		}
+		return e.sum / float64(e.count), nil
+	default:
+		return e.best, nil
+	}
+}
+
+// selectNumber converts a value to a number, parsing numeric strings
+func selectNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// selectCompare orders two non-NULL values. Numbers are compared numerically
+// when both sides can be read as numbers, since CSV fields are always strings.
+func selectCompare(a, b interface{}) (int, bool) {
+	_, aStr := a.(string)
+	_, bStr := b.(string)
+	if !(aStr && bStr) {
+		an, aok := selectNumber(a)
+		bn, bok := selectNumber(b)
+		if aok && bok {
+			switch {
+			case an < bn:
+				return -1, true
+			case an > bn:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	if ab, ok := a.(bool); ok {
+		bb, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if ab == bb {
+			return 0, true
+		}
+		if !ab {
+			return -1, true
+		}
+		return 1, true
+	}
+
+	if aStr && bStr {
+		return strings.Compare(a.(string), b.(string)), true
+	}
+	return 0, false
+}
+
+func selectString(v interface{}) string {
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	case bool:
+		return strconv.FormatBool(s)
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	case json.Number:
+		return s.String()
+	default:
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+}
+
+func selectCast(v interface{}, typ string) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch typ {
+	case "INT", "INTEGER":
+		n, ok := selectNumber(v)
+		if !ok {
+			return nil, &selectError{code: "CastFailed", message: fmt.Sprintf("cannot cast %q to %s", selectString(v), typ)}
+		}
+		return math.Trunc(n), nil
+	case "FLOAT", "DECIMAL", "NUMERIC":
+		n, ok := selectNumber(v)
+		if !ok {
+			return nil, &selectError{code: "CastFailed", message: fmt.Sprintf("cannot cast %q to %s", selectString(v), typ)}
+		}
+		return n, nil
+	case "BOOL", "BOOLEAN":
+		b, err := strconv.ParseBool(strings.TrimSpace(selectString(v)))
+		if err != nil {
+			return nil, &selectError{code: "CastFailed", message: fmt.Sprintf("cannot cast %q to %s", selectString(v), typ)}
+		}
+		return b, nil
+	default: // STRING, VARCHAR, CHAR
+		return selectString(v), nil
+	}
+}
+
+// Lexer
+
+type selectToken struct {
+	kind string // ident, quoted, string, number, op, eof
+	text string
+}
+
+func lexSelect(sql string) ([]selectToken, error) {
+	var tokens []selectToken
+	runes := []rune(sql)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, selectToken{kind: "ident", text: string(runes[start:i])})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E') {
+				i++
+			}
+			tokens = append(tokens, selectToken{kind: "number", text: string(runes[start:i])})
+		case c == '\'' || c == '"':
+			// Doubling the quote character escapes it
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, selectParseError("unterminated quoted literal")
+				}
+				if runes[i] == c {
+					if i+1 < len(runes) && runes[i+1] == c {
+						sb.WriteRune(c)
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			kind := "string"
+			if c == '"' {
+				kind = "quoted"
+			}
+			tokens = append(tokens, selectToken{kind: kind, text: sb.String()})
+		default:
+			two := ""
+			if i+1 < len(runes) {
+				two = string(runes[i : i+2])
+			}
+			switch two {
+			case "<=", ">=", "!=", "<>", "||":
+				if two == "<>" {
+					two = "!="
+				}
+				tokens = append(tokens, selectToken{kind: "op", text: two})
+				i += 2
+				continue
+			}
+			if !strings.ContainsRune("=<>+-*/%(),.[]", c) {
+				return nil, selectParseError("unexpected character %q", c)
+			}
+			tokens = append(tokens, selectToken{kind: "op", text: string(c)})
+			i++
+		}
+	}
+
+	return append(tokens, selectToken{kind: "eof"}), nil
+}
+
+// Parser
+
+type selectParser struct {
+	tokens     []selectToken
+	pos        int
+	aggregates []*selectAggregate
+}
+
+func parseSelect(sql string) (*selectQuery, error) {
+	tokens, err := lexSelect(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &selectParser{tokens: tokens}
+	return p.parseQuery()
+}
+
+func (p *selectParser) peek() selectToken {
+	return p.tokens[p.pos]
+}
+
+func (p *selectParser) next() selectToken {
+	t := p.tokens[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+// keyword reports whether the next token is the given keyword and consumes it
+func (p *selectParser) keyword(kw string) bool {
+	t := p.peek()
+	if t.kind == "ident" && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *selectParser) op(op string) bool {
+	t := p.peek()
+	if t.kind == "op" && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *selectParser) expectKeyword(kw string) error {
+	if !p.keyword(kw) {
+		return selectParseError("expected %s but found %q", kw, p.peek().text)
+	}
+	return nil
+}
+
+func (p *selectParser) expectOp(op string) error {
+	if !p.op(op) {
+		return selectParseError("expected %q but found %q", op, p.peek().text)
+	}
+	return nil
+}
+
+var selectReserved = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "LIMIT": true, "AS": true,
+	"AND": true, "OR": true, "NOT": true, "LIKE": true, "IS": true, "IN": true,
+	"BETWEEN": true, "NULL": true, "TRUE": true, "FALSE": true,
+}
+
+func (p *selectParser) parseQuery() (*selectQuery, error) {
+	q := &selectQuery{limit: -1}
+
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+
+	if p.op("*") {
+		q.star = true
+	} else {
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+
+			proj := selectProjection{expr: expr}
+			if p.keyword("AS") {
+				t := p.next()
+				if t.kind != "ident" && t.kind != "quoted" {
+					return nil, selectParseError("expected alias after AS")
+				}
+				proj.name = t.text
+			} else if t := p.peek(); t.kind == "quoted" || (t.kind == "ident" && !selectReserved[strings.ToUpper(t.text)]) {
+				proj.name = p.next().text
+			}
+			q.projections = append(q.projections, proj)
+
+			if !p.op(",") {
+				break
+			}
+		}
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if t := p.next(); t.kind != "ident" || !strings.EqualFold(t.text, "S3Object") {
+		return nil, selectParseError("expected S3Object but found %q", t.text)
+	}
+	if p.op("[") {
+		if err := p.expectOp("*"); err != nil {
+			return nil, err
+		}
+		if err := p.expectOp("]"); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("AS") || (p.peek().kind == "ident" && !selectReserved[strings.ToUpper(p.peek().text)]) {
+		t := p.next()
+		if t.kind != "ident" {
+			return nil, selectParseError("expected table alias")
+		}
+		q.alias = t.text
+	}
+
+	if p.keyword("WHERE") {
+		// Aggregates are not allowed in WHERE
+		n := len(p.aggregates)
+		where, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if len(p.aggregates) != n {
+			return nil, selectParseError("aggregate functions are not allowed in WHERE")
+		}
+		q.where = where
+	}
+
+	if p.keyword("LIMIT") {
+		t := p.next()
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if t.kind != "number" || err != nil || n < 0 {
+			return nil, selectParseError("invalid LIMIT %q", t.text)
+		}
+		q.limit = n
+	}
+
+	if t := p.peek(); t.kind != "eof" {
+		return nil, selectParseError("unexpected %q at end of query", t.text)
+	}
+
+	// Resolve the table alias now that it is known
+	for i := range q.projections {
+		selectResolveAlias(q.projections[i].expr, q.alias)
+		if q.projections[i].name == "" {
+			if col, ok := q.projections[i].expr.(*selectColumn); ok && len(col.path) > 0 && !col.whole {
+				q.projections[i].name = col.path[len(col.path)-1]
+			}
+		}
+	}
+	if q.where != nil {
+		selectResolveAlias(q.where, q.alias)
+	}
+
+	// s.* is equivalent to *
+	if len(q.projections) == 1 {
+		if col, ok := q.projections[0].expr.(*selectColumn); ok && col.whole && q.projections[0].name == "" {
+			q.star = true
+			q.projections = nil
+		}
+	}
+
+	q.aggregates = p.aggregates
+	if len(q.aggregates) > 0 && q.star {
+		return nil, selectParseError("SELECT * cannot be combined with aggregate functions")
+	}
+
+	return q, nil
+}
+
+// selectResolveAlias strips the table alias from column paths
+func selectResolveAlias(expr selectExpr, alias string) {
+	switch e := expr.(type) {
+	case *selectColumn:
+		if len(e.path) > 0 && (strings.EqualFold(e.path[0], alias) || strings.EqualFold(e.path[0], "S3Object")) {
+			e.path = e.path[1:]
+			if len(e.path) == 0 || (len(e.path) == 1 && e.path[0] == "*") {
+				e.whole = true
+			}
+		}
+	case *selectUnary:
+		selectResolveAlias(e.x, alias)
+	case *selectBinary:
+		selectResolveAlias(e.l, alias)
+		selectResolveAlias(e.r, alias)
+	case *selectLike:
+		selectResolveAlias(e.x, alias)
+		selectResolveAlias(e.pattern, alias)
+	case *selectIsNull:
+		selectResolveAlias(e.x, alias)
+	case *selectIn:
+		selectResolveAlias(e.x, alias)
+		for _, item := range e.list {
+			selectResolveAlias(item, alias)
+		}
+	case *selectBetween:
+		selectResolveAlias(e.x, alias)
+		selectResolveAlias(e.lo, alias)
+		selectResolveAlias(e.hi, alias)
+	case *selectCall:
+		for _, a := range e.args {
+			selectResolveAlias(a, alias)
+		}
+	case *selectAggregate:
+		if e.arg != nil {
+			selectResolveAlias(e.arg, alias)
+		}
+	}
+}
+
+func (p *selectParser) parseExpr() (selectExpr, error) {
+	return p.parseOr()
+}
+
+func (p *selectParser) parseOr() (selectExpr, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &selectBinary{op: "OR", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *selectParser) parseAnd() (selectExpr, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = &selectBinary{op: "AND", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *selectParser) parseNot() (selectExpr, error) {
+	if p.keyword("NOT") {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &selectUnary{op: "NOT", x: x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *selectParser) parseComparison() (selectExpr, error) {
+	l, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range []string{"=", "!=", "<=", ">=", "<", ">"} {
+		if p.op(op) {
+			r, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			return &selectBinary{op: op, l: l, r: r}, nil
+		}
+	}
+
+	if p.keyword("IS") {
+		not := p.keyword("NOT")
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return &selectIsNull{x: l, not: not}, nil
+	}
+
+	not := p.keyword("NOT")
+	switch {
+	case p.keyword("LIKE"):
+		pattern, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &selectLike{x: l, pattern: pattern, not: not, cache: make(map[string]*regexp.Regexp)}, nil
+	case p.keyword("IN"):
+		if err := p.expectOp("("); err != nil {
+			return nil, err
+		}
+		in := &selectIn{x: l, not: not}
+		for {
+			item, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			in.list = append(in.list, item)
+			if !p.op(",") {
+				break
+			}
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		return in, nil
+	case p.keyword("BETWEEN"):
+		lo, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		hi, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &selectBetween{x: l, lo: lo, hi: hi, not: not}, nil
+	}
+
+	if not {
+		return nil, selectParseError("expected LIKE, IN or BETWEEN after NOT")
+	}
+	return l, nil
+}
+
+func (p *selectParser) parseAdditive() (selectExpr, error) {
+	l, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		switch {
+		case p.op("+"):
+			op = "+"
+		case p.op("-"):
+			op = "-"
+		case p.op("||"):
+			op = "||"
+		default:
+			return l, nil
+		}
+		r, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		l = &selectBinary{op: op, l: l, r: r}
+	}
+}
+
+func (p *selectParser) parseMultiplicative() (selectExpr, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		switch {
+		case p.op("*"):
+			op = "*"
+		case p.op("/"):
+			op = "/"
+		case p.op("%"):
+			op = "%"
+		default:
+			return l, nil
+		}
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = &selectBinary{op: op, l: l, r: r}
+	}
+}
+
+func (p *selectParser) parseUnary() (selectExpr, error) {
+	if p.op("-") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &selectUnary{op: "-", x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *selectParser) parsePrimary() (selectExpr, error) {
+	t := p.next()
+
+	switch t.kind {
+	case "number":
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, selectParseError("invalid number %q", t.text)
+		}
+		return &selectLiteral{v: n}, nil
+	case "string":
+		return &selectLiteral{v: t.text}, nil
+	case "quoted":
+		return p.parsePath(t.text)
+	case "op":
+		if t.text == "(" {
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp(")"); err != nil {
+				return nil, err
+			}
+			return x, nil
+		}
+		return nil, selectParseError("unexpected %q", t.text)
+	case "eof":
+		return nil, selectParseError("unexpected end of query")
+	}
+
+	upper := strings.ToUpper(t.text)
+	switch upper {
+	case "NULL":
+		return &selectLiteral{v: nil}, nil
+	case "TRUE":
+		return &selectLiteral{v: true}, nil
+	case "FALSE":
+		return &selectLiteral{v: false}, nil
+	}
+
+	if !p.op("(") {
+		if selectReserved[upper] {
+			return nil, selectParseError("unexpected keyword %s", upper)
+		}
+		return p.parsePath(t.text)
+	}
+
+	switch upper {
+	case "COUNT", "SUM", "AVG", "MIN", "MAX":
+		agg := &selectAggregate{name: upper}
+		if upper == "COUNT" && p.op("*") {
+			// COUNT(*) counts every matching record
+		} else {
+			n := len(p.aggregates)
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if len(p.aggregates) != n {
+				return nil, selectParseError("aggregate functions cannot be nested")
+			}
+			agg.arg = arg
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		p.aggregates = append(p.aggregates, agg)
+		return agg, nil
+	case "CAST":
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AS"); err != nil {
+			return nil, err
+		}
+		typ := strings.ToUpper(p.next().text)
+		switch typ {
+		case "INT", "INTEGER", "FLOAT", "DECIMAL", "NUMERIC", "BOOL", "BOOLEAN", "STRING", "VARCHAR", "CHAR":
+		default:
+			return nil, selectParseError("unsupported CAST type %s", typ)
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		return &selectCall{name: "CAST", args: []selectExpr{x}, cast: typ}, nil
+	case "LOWER", "UPPER", "TRIM", "CHAR_LENGTH", "CHARACTER_LENGTH", "COALESCE":
+		call := &selectCall{name: upper}
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if !p.op(",") {
+				break
+			}
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		if upper != "COALESCE" && len(call.args) != 1 {
+			return nil, selectParseError("%s takes exactly one argument", upper)
+		}
+		return call, nil
+	}
+
+	return nil, &selectError{code: "UnsupportedFunction", message: "unsupported function " + upper}
+}
+
+// parsePath parses a column reference such as s._1, s.name or s.a.b[0]
+func (p *selectParser) parsePath(first string) (selectExpr, error) {
+	col := &selectColumn{path: []string{first}}
+
+	for {
+		switch {
+		case p.op("."):
+			t := p.next()
+			switch {
+			case t.kind == "ident" || t.kind == "quoted":
+				col.path = append(col.path, t.text)
+			case t.kind == "op" && t.text == "*":
+				col.path = append(col.path, "*")
+			default:
+				return nil, selectParseError("expected name after '.'")
+			}
+		case p.op("["):
+			t := p.next()
+			if t.kind != "number" {
+				return nil, selectParseError("expected array index")
+			}
+			if err := p.expectOp("]"); err != nil {
+				return nil, err
+			}
+			col.path = append(col.path, "["+t.text+"]")
+		default:
+			return col, nil
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseSelect(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		wantErr bool
+	}{
+		{name: "star", sql: "SELECT * FROM S3Object"},
+		{name: "alias projection", sql: "SELECT s._1, s.name AS n FROM S3Object s WHERE s._2 > 10 LIMIT 5"},
+		{name: "json array source", sql: "SELECT s.a.b[0] FROM S3Object[*] s"},
+		{name: "aggregates", sql: "SELECT COUNT(*), AVG(CAST(s.price AS FLOAT)) FROM S3Object s"},
+		{name: "operators", sql: "SELECT * FROM S3Object WHERE a LIKE 'x%' AND b IN (1, 2) OR c BETWEEN 1 AND 3 OR d IS NOT NULL"},
+		{name: "missing from", sql: "SELECT *", wantErr: true},
+		{name: "wrong table", sql: "SELECT * FROM other", wantErr: true},
+		{name: "aggregate in where", sql: "SELECT * FROM S3Object WHERE COUNT(*) > 1", wantErr: true},
+		{name: "star with aggregate", sql: "SELECT *, COUNT(*) FROM S3Object", wantErr: true},
+		{name: "unterminated string", sql: "SELECT * FROM S3Object WHERE a = 'x", wantErr: true},
+		{name: "trailing tokens", sql: "SELECT * FROM S3Object LIMIT 1 2", wantErr: true},
+		{name: "unknown function", sql: "SELECT FOO(a) FROM S3Object", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseSelect(tt.sql)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSelect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSelectWhere(t *testing.T) {
+	csvRec := &csvRecord{
+		names:  []string{"name", "age", "city"},
+		fields: []string{"alice", "34", "Paris"},
+	}
+
+	var doc interface{}
+	json.Unmarshal([]byte(`{"user": {"name": "bob", "tags": ["a", "b"]}, "score": 7.5, "active": true}`), &doc)
+	jsonRec := &jsonRecord{doc: doc}
+
+	tests := []struct {
+		name  string
+		rec   selectRecord
+		where string
+		want  interface{}
+	}{
+		{name: "csv positional numeric", rec: csvRec, where: "s._2 > 30", want: true},
+		{name: "csv header name", rec: csvRec, where: "s.city = 'Paris'", want: true},
+		{name: "csv case-insensitive header", rec: csvRec, where: "s.NAME = 'alice'", want: true},
+		{name: "csv string compare", rec: csvRec, where: "s.name < 'bob'", want: true},
+		{name: "csv cast", rec: csvRec, where: "CAST(s.age AS INT) + 1 = 35", want: true},
+		{name: "like", rec: csvRec, where: "s.name LIKE 'al_c%'", want: true},
+		{name: "not like", rec: csvRec, where: "s.name NOT LIKE 'b%'", want: true},
+		{name: "in", rec: csvRec, where: "s.city IN ('London', 'Paris')", want: true},
+		{name: "between", rec: csvRec, where: "s.age BETWEEN 30 AND 40", want: true},
+		{name: "missing column is null", rec: csvRec, where: "s.zip IS NULL", want: true},
+		{name: "null comparison", rec: csvRec, where: "s.zip = 'x'", want: nil},
+		{name: "null and false", rec: csvRec, where: "s.zip = 'x' AND FALSE", want: false},
+		{name: "null or true", rec: csvRec, where: "s.zip = 'x' OR TRUE", want: true},
+		{name: "not", rec: csvRec, where: "NOT (s.age < 18)", want: true},
+		{name: "json nested path", rec: jsonRec, where: "s.user.name = 'bob'", want: true},
+		{name: "json array index", rec: jsonRec, where: "s.user.tags[1] = 'b'", want: true},
+		{name: "json number", rec: jsonRec, where: "s.score * 2 = 15", want: true},
+		{name: "json bool", rec: jsonRec, where: "s.active = TRUE", want: true},
+		{name: "upper", rec: jsonRec, where: "UPPER(s.user.name) = 'BOB'", want: true},
+		{name: "char length", rec: jsonRec, where: "CHAR_LENGTH(s.user.name) = 3", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseSelect("SELECT * FROM S3Object s WHERE " + tt.where)
+			if err != nil {
+				t.Fatalf("parseSelect() error = %v", err)
+			}
+
+			got, err := q.where.eval(tt.rec)
+			if err != nil {
+				t.Fatalf("eval() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectAggregates(t *testing.T) {
+	q, err := parseSelect("SELECT COUNT(*), SUM(s._2), AVG(s._2), MIN(s._1), MAX(CAST(s._2 AS INT)) FROM S3Object s")
+	if err != nil {
+		t.Fatalf("parseSelect() error = %v", err)
+	}
+
+	rows := [][]string{{"b", "10"}, {"a", "20"}, {"c", ""}, {"d", "30"}}
+	for _, row := range rows {
+		rec := &csvRecord{fields: row}
+		if row[1] == "" {
+			// Empty strings are not numbers, so feed a row with a missing column instead
+			rec = &csvRecord{fields: row[:1]}
+		}
+		for _, agg := range q.aggregates {
+			if err := agg.accumulate(rec); err != nil {
+				t.Fatalf("accumulate() error = %v", err)
+			}
+		}
+	}
+
+	want := []string{"4", "60", "20", "a", "30"}
+	for i, proj := range q.projections {
+		v, err := proj.expr.eval(nil)
+		if err != nil {
+			t.Fatalf("eval() error = %v", err)
+		}
+		if got := selectString(v); got != want[i] {
+			t.Errorf("projection %d = %q, want %q", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Objects are stored as plain files below the remote root, one directory
+// per "/" separated key component, so the drop zone looks the way its
+// owners expect. Unlike the filesystem backend this means a key cannot be
+// both an object and a prefix ("a" and "a/b"), and nothing but the data is
+// stored: ETags are derived from size and modification time and content
+// types from the file extension.
+//
+// Temporary files and staged multipart uploads live in .s3proxy below the
+// root, which is therefore not available as a key.
+const sftpInternalDir = ".s3proxy"
+
+func init() {
+	RegisterBackend("sftp", validateSFTPSite, func(s Site) (S3Proxy, error) {
+		return NewSFTPProxy(*s.SFTP)
+	})
+}
+
+// SFTPConfig configures the SFTP backend. Host is "host" or "host:port".
+// Password and/or PrivateKeyFile authenticate the user, and the server's
+// host key must be listed in KnownHostsFile.
+type SFTPConfig struct {
+	Host                 string         `json:"host" yaml:"host"`
+	User                 string         `json:"user" yaml:"user"`
+	Password             string         `json:"password,omitempty" yaml:"password,omitempty"`
+	PrivateKeyFile       string         `json:"privateKeyFile,omitempty" yaml:"privateKeyFile,omitempty"`
+	PrivateKeyPassphrase string         `json:"privateKeyPassphrase,omitempty" yaml:"privateKeyPassphrase,omitempty"`
+	KnownHostsFile       string         `json:"knownHostsFile" yaml:"knownHostsFile"`
+	Root                 string         `json:"root,omitempty" yaml:"root,omitempty"`
+	Website              *WebsiteConfig `json:"website,omitempty" yaml:"website,omitempty"`
+}
+
+func validateSFTPSite(s Site) error {
+	if s.SFTP == nil || s.SFTP.Host == "" {
+		return errors.New("SFTP host not specified")
+	}
+
+	if s.SFTP.User == "" {
+		return errors.New("SFTP user not specified")
+	}
+
+	if s.SFTP.Password == "" && s.SFTP.PrivateKeyFile == "" {
+		return errors.New("SFTP password or privateKeyFile not specified")
+	}
+
+	if s.SFTP.KnownHostsFile == "" {
+		return errors.New("SFTP knownHostsFile not specified")
+	}
+
+	return nil
+}
+
+// SFTPProxy is an S3Proxy storing objects on a remote host over SFTP. The
+// connection is established on first use and re-established after it drops.
+type SFTPProxy struct {
+	addr    string
+	config  *ssh.ClientConfig
+	root    string
+	website *WebsiteConfig
+
+	mu     sync.Mutex
+	ssh    *ssh.Client
+	client *sftp.Client
+}
+
+func NewSFTPProxy(cfg SFTPConfig) (*SFTPProxy, error) {
+	hostKeys, err := knownhosts.New(cfg.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SFTP knownHostsFile: %v", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if cfg.PrivateKeyFile != "" {
+		pemBytes, err := os.ReadFile(cfg.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var signer ssh.Signer
+		if cfg.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(cfg.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pemBytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SFTP privateKeyFile: %v", err)
+		}
+
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+
+	addr := cfg.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	root := cfg.Root
+	if root == "" {
+		root = "."
+	}
+
+	return &SFTPProxy{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeys,
+			Timeout:         30 * time.Second,
+		},
+		root:    path.Clean(root),
+		website: cfg.Website,
+	}, nil
+}
+
+// conn returns the SFTP session, dialing the host if there is none
+func (p *SFTPProxy) conn() (*sftp.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != nil {
+		return p.client, nil
+	}
+
+	sshClient, err := ssh.Dial("tcp", p.addr, p.config)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+
+	p.ssh, p.client = sshClient, client
+
+	// Forget the session once the connection drops so the next request
+	// dials again instead of failing forever
+	go func() {
+		sshClient.Wait()
+
+		p.mu.Lock()
+		if p.ssh == sshClient {
+			p.ssh, p.client = nil, nil
+		}
+		p.mu.Unlock()
+	}()
+
+	return client, nil
+}
+
+// Close ends the SFTP session
+func (p *SFTPProxy) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ssh == nil {
+		return nil
+	}
+
+	p.client.Close()
+	err := p.ssh.Close()
+	p.ssh, p.client = nil, nil
+	return err
+}
+
+// objectPath validates a key and returns the remote path of its file
+func (p *SFTPProxy) objectPath(key string) (string, error) {
+	components := strings.Split(key, "/")
+	for _, c := range components {
+		if c == "" || c == "." || c == ".." {
+			return "", errInvalidArgument("Object key is not supported by the SFTP backend: " + key)
+		}
+	}
+
+	if components[0] == sftpInternalDir {
+		return "", errInvalidArgument("Keys under " + sftpInternalDir + "/ are reserved")
+	}
+
+	return path.Join(p.root, key), nil
+}
+
+func (p *SFTPProxy) internalPath(elem ...string) string {
+	return path.Join(append([]string{p.root, sftpInternalDir}, elem...)...)
+}
+
+// sftpETag derives an ETag from the size and modification time of a file
+func sftpETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().Unix(), info.Size())
+}
+
+func sftpContentType(key string) string {
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// sftpError maps remote file errors to the errors S3 would return
+func sftpError(err error, key string) error {
+	if os.IsNotExist(err) {
+		return errNoSuchKey(key)
+	}
+	return err
+}
+
+func (p *SFTPProxy) stat(client *sftp.Client, key string) (string, os.FileInfo, error) {
+	file, err := p.objectPath(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	info, err := client.Stat(file)
+	if err != nil {
+		return "", nil, sftpError(err, key)
+	}
+	if info.IsDir() {
+		return "", nil, errNoSuchKey(key)
+	}
+
+	return file, info, nil
+}
+
+func (p *SFTPProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	client, err := p.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	file, info, err := p.stat(client, key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := client.Open(file)
+	if err != nil {
+		return nil, sftpError(err, key)
+	}
+
+	size := info.Size()
+	out := &s3.GetObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(sftpContentType(key)),
+		ETag:          aws.String(sftpETag(info)),
+		LastModified:  aws.Time(info.ModTime()),
+		Body:          f,
+	}
+
+	if rangeHeader != "" {
+		start, end, err := parseByteRange(rangeHeader, size)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		out.ContentLength = aws.Int64(end - start + 1)
+		out.ContentRange = aws.String(contentRange(start, end, size))
+		out.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(f, end-start+1), f}
+	}
+
+	return out, nil
+}
+
+func (p *SFTPProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	client, err := p.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	_, info, err := p.stat(client, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.HeadObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: aws.Int64(info.Size()),
+		ContentType:   aws.String(sftpContentType(key)),
+		ETag:          aws.String(sftpETag(info)),
+		LastModified:  aws.Time(info.ModTime()),
+	}, nil
+}
+
+// writeTemp copies r into a new temporary file, returning its path and the
+// MD5 of the data
+func (p *SFTPProxy) writeTemp(client *sftp.Client, r io.Reader) (string, []byte, error) {
+	dir := p.internalPath("tmp")
+	if err := client.MkdirAll(dir); err != nil {
+		return "", nil, err
+	}
+
+	name := path.Join(dir, newUploadID())
+	f, err := client.Create(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	hash := md5.New()
+	_, err = io.Copy(f, io.TeeReader(r, hash))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		client.Remove(name)
+		return "", nil, err
+	}
+
+	return name, hash.Sum(nil), nil
+}
+
+// publish moves a temporary file into place, replacing any existing file
+func (p *SFTPProxy) publish(client *sftp.Client, tmp string, file string) error {
+	if err := client.MkdirAll(path.Dir(file)); err != nil {
+		client.Remove(tmp)
+		return errInvalidArgument("Object key conflicts with an existing object: " + err.Error())
+	}
+
+	// Plain SFTP renames fail if the target exists; the OpenSSH extension
+	// replaces it atomically
+	var err error
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		err = client.PosixRename(tmp, file)
+	} else {
+		client.Remove(file)
+		err = client.Rename(tmp, file)
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func (p *SFTPProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	file, err := p.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := p.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, _, err := p.writeTemp(client, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.publish(client, tmp, file); err != nil {
+		return nil, err
+	}
+
+	info, err := client.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.PutObjectOutput{ETag: aws.String(sftpETag(info))}, nil
+}
+
+func (p *SFTPProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	client, err := p.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	file, _, err := p.stat(client, key)
+	if err != nil {
+		// S3 deletes are idempotent
+		if isNotFound(err) {
+			return &s3.DeleteObjectOutput{}, nil
+		}
+		return nil, err
+	}
+
+	if err := client.Remove(file); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Remove directories left empty, stopping at the first that is not
+	for dir := path.Dir(file); dir != p.root && strings.HasPrefix(dir, p.root+"/"); dir = path.Dir(dir) {
+		if client.RemoveDirectory(dir) != nil {
+			break
+		}
+	}
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+type sftpEntry struct {
+	file    string
+	info    os.FileInfo
+	sortKey string
+}
+
+// readDir returns the files and directories of dir in key order. A
+// directory "a" sorts as "a/" so that the walk visits keys lexicographically.
+func (p *SFTPProxy) readDir(client *sftp.Client, dir string) ([]sftpEntry, error) {
+	infos, err := client.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []sftpEntry
+	for _, info := range infos {
+		name := info.Name()
+		if dir == p.root && name == sftpInternalDir {
+			continue
+		}
+
+		entry := sftpEntry{file: path.Join(dir, name), info: info, sortKey: name}
+		if info.IsDir() {
+			entry.sortKey += "/"
+		} else if !info.Mode().IsRegular() {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].sortKey < entries[j].sortKey
+	})
+
+	return entries, nil
+}
+
+func (p *SFTPProxy) walk(client *sftp.Client, dir string, keyPrefix string, lister *keyLister) error {
+	entries, err := p.readDir(client, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if lister.full() {
+			return nil
+		}
+
+		key := keyPrefix + e.sortKey
+		if e.info.IsDir() {
+			skip, commonPrefix := lister.pruneDir(key)
+			if commonPrefix != "" {
+				if p.hasFiles(client, e.file) && !lister.addCommonPrefix(commonPrefix) {
+					return nil
+				}
+				continue
+			}
+			if skip {
+				continue
+			}
+			if err := p.walk(client, e.file, key, lister); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(key, lister.prefix) || lister.skip(key) {
+			continue
+		}
+
+		if !lister.add(&s3.Object{
+			Key:          aws.String(key),
+			ETag:         aws.String(sftpETag(e.info)),
+			Size:         aws.Int64(e.info.Size()),
+			LastModified: aws.Time(e.info.ModTime()),
+			StorageClass: aws.String(s3.StorageClassStandard),
+		}) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// hasFiles reports whether any regular file is stored below dir
+func (p *SFTPProxy) hasFiles(client *sftp.Client, dir string) bool {
+	entries, err := p.readDir(client, dir)
+	if err != nil {
+		return false
+	}
+
+	for _, e := range entries {
+		if !e.info.IsDir() || p.hasFiles(client, e.file) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *SFTPProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	lister, err := newKeyLister(prefix, delimiter, maxKeys, continuationToken)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := p.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.walk(client, p.root, "", lister); err != nil {
+		return nil, err
+	}
+
+	out := lister.result()
+	out.Prefix = aws.String(prefix)
+	return out, nil
+}
+
+// uploadDir returns the staging directory of an upload
+func (p *SFTPProxy) uploadDir(uploadId string) (string, error) {
+	if _, err := hex.DecodeString(uploadId); err != nil || uploadId == "" {
+		return "", errNoSuchUpload(uploadId)
+	}
+	return p.internalPath("uploads", uploadId), nil
+}
+
+func (p *SFTPProxy) readUpload(client *sftp.Client, key string, uploadId string) (string, fsUpload, error) {
+	var upload fsUpload
+
+	dir, err := p.uploadDir(uploadId)
+	if err != nil {
+		return "", upload, err
+	}
+
+	f, err := client.Open(path.Join(dir, "upload.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", upload, errNoSuchUpload(uploadId)
+		}
+		return "", upload, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&upload); err != nil || upload.Key != key {
+		return "", upload, errNoSuchUpload(uploadId)
+	}
+
+	return dir, upload, nil
+}
+
+func (p *SFTPProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	if _, err := p.objectPath(key); err != nil {
+		return nil, err
+	}
+
+	client, err := p.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	uploadId := newUploadID()
+	dir, _ := p.uploadDir(uploadId)
+	if err := client.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(fsUpload{Key: key, ContentType: contentType, Initiated: time.Now().UTC()})
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := client.Create(path.Join(dir, "upload.json"))
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		client.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &s3.CreateMultipartUploadOutput{
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}, nil
+}
+
+func (p *SFTPProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	if partNumber < 1 || partNumber > 10000 {
+		return nil, errInvalidArgument("Part number must be an integer between 1 and 10000, inclusive")
+	}
+
+	client, err := p.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, _, err := p.readUpload(client, key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, sum, err := p.writeTemp(client, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// The part's MD5 is kept in its file name so completion can check the
+	// ETags without reading the parts twice
+	partPrefix := path.Join(dir, fmt.Sprintf("part.%05d.", partNumber))
+	if old, err := client.Glob(partPrefix + "*"); err == nil {
+		for _, name := range old {
+			client.Remove(name)
+		}
+	}
+
+	if err := p.publish(client, tmp, partPrefix+hex.EncodeToString(sum)); err != nil {
+		return nil, err
+	}
+
+	return &s3.UploadPartOutput{ETag: aws.String(quoteETag(sum))}, nil
+}
+
+func (p *SFTPProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	client, err := p.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, _, err := p.readUpload(client, key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := client.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[int64]string)
+	uploaded := make(map[int64]string)
+	for _, info := range infos {
+		var n int64
+		var sum string
+		if _, err := fmt.Sscanf(info.Name(), "part.%05d.%32s", &n, &sum); err != nil {
+			continue
+		}
+		files[n] = path.Join(dir, info.Name())
+		uploaded[n] = `"` + sum + `"`
+	}
+
+	if err := checkCompletedParts(parts, uploaded); err != nil {
+		return nil, err
+	}
+
+	// SFTP has no server-side concatenation, so the parts are streamed
+	// through the proxy into a temporary file
+	pr, pw := io.Pipe()
+	go func() {
+		for _, part := range parts {
+			src, err := client.Open(files[aws.Int64Value(part.PartNumber)])
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(pw, src)
+			src.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	tmp, _, err := p.writeTemp(client, pr)
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	file, _ := p.objectPath(key)
+	if err := p.publish(client, tmp, file); err != nil {
+		return nil, err
+	}
+
+	client.RemoveAll(dir)
+
+	info, err := client.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.CompleteMultipartUploadOutput{
+		Key:  aws.String(key),
+		ETag: aws.String(sftpETag(info)),
+	}, nil
+}
+
+func (p *SFTPProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	client, err := p.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, _, err := p.readUpload(client, key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (p *SFTPProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	client, err := p.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := client.ReadDir(p.internalPath("uploads"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var uploads []*s3.MultipartUpload
+	for _, info := range infos {
+		f, err := client.Open(p.internalPath("uploads", info.Name(), "upload.json"))
+		if err != nil {
+			continue
+		}
+
+		var upload fsUpload
+		err = json.NewDecoder(f).Decode(&upload)
+		f.Close()
+		if err != nil {
+			continue
+		}
+
+		uploads = append(uploads, &s3.MultipartUpload{
+			Key:          aws.String(upload.Key),
+			UploadId:     aws.String(info.Name()),
+			Initiated:    aws.Time(upload.Initiated),
+			StorageClass: aws.String(s3.StorageClassStandard),
+		})
+	}
+
+	out := listUploads(uploads, prefix, delimiter, maxUploads)
+	out.Prefix = aws.String(prefix)
+	return out, nil
+}
+
+func (p *SFTPProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	return p.website.output()
+}
+
+func (p *SFTPProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	if _, err := p.Head(key); err != nil {
+		return nil, err
+	}
+
+	return nil, errObjectAlreadyInActiveTier()
+}
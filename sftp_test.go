@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSFTPServer is an in-process SSH server offering the sftp subsystem
+// over the local filesystem
+type testSFTPServer struct {
+	addr      string
+	hostKey   ssh.Signer
+	clientKey ssh.Signer
+	keyFile   string
+}
+
+func newTestSFTPServer(t *testing.T) *testSFTPServer {
+	t.Helper()
+
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, _ := ssh.NewSignerFromKey(hostPriv)
+
+	_, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+	clientKey, _ := ssh.NewSignerFromKey(clientPriv)
+
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "proxy" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "proxy" && string(key.Marshal()) == string(clientKey.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTPConn(conn, config)
+		}
+	}()
+
+	return &testSFTPServer{
+		addr:      listener.Addr().String(),
+		hostKey:   hostKey,
+		clientKey: clientKey,
+		keyFile:   keyFile,
+	}
+}
+
+func serveSFTPConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					channel.Close()
+					return
+				}
+				server.Serve()
+				server.Close()
+				return
+			}
+		}()
+	}
+}
+
+// knownHosts writes a known_hosts file trusting key for the server
+func (s *testSFTPServer) knownHosts(t *testing.T, key ssh.PublicKey) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, key)
+	if err := os.WriteFile(file, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func newTestSFTPProxy(t *testing.T, s *testSFTPServer) (*SFTPProxy, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	p, err := NewSFTPProxy(SFTPConfig{
+		Host:           s.addr,
+		User:           "proxy",
+		Password:       "secret",
+		KnownHostsFile: s.knownHosts(t, s.hostKey.PublicKey()),
+		Root:           root,
+	})
+	if err != nil {
+		t.Fatalf("NewSFTPProxy() error = %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return p, root
+}
+
+func TestSFTPProxy_PutGetDelete(t *testing.T) {
+	p, root := newTestSFTPProxy(t, newTestSFTPServer(t))
+
+	putString(t, p, "drop/in/report.csv", "a,b\n1,2\n")
+
+	// Objects are plain files in the drop zone
+	data, err := os.ReadFile(filepath.Join(root, "drop", "in", "report.csv"))
+	if err != nil || string(data) != "a,b\n1,2\n" {
+		t.Fatalf("remote file = %q, %v", data, err)
+	}
+
+	if got := getString(t, p, "drop/in/report.csv", "bytes=4-"); got != "1,2\n" {
+		t.Errorf("Get() with range = %q, want %q", got, "1,2\n")
+	}
+
+	head, err := p.Head("drop/in/report.csv")
+	if err != nil {
+		t.Fatalf("Head() error = %v", err)
+	}
+	if aws.Int64Value(head.ContentLength) != 8 || aws.StringValue(head.ContentType) != "text/csv; charset=utf-8" {
+		t.Errorf("Head() = %v", head)
+	}
+
+	for _, key := range []string{"drop", "../escape", "a//b", ".s3proxy/tmp/x"} {
+		if _, err := p.Head(key); err == nil {
+			t.Errorf("Head(%q) should fail", key)
+		}
+	}
+
+	if _, err := p.Delete("drop/in/report.csv"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := p.Head("drop/in/report.csv"); !isNotFound(err) {
+		t.Errorf("Head() after delete error = %v, want not found", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "drop")); !os.IsNotExist(err) {
+		t.Errorf("empty directories were not removed: %v", err)
+	}
+	if _, err := p.Delete("drop/in/report.csv"); err != nil {
+		t.Errorf("Delete() of missing key error = %v, want nil", err)
+	}
+}
+
+func TestSFTPProxy_ListObjects(t *testing.T) {
+	p, root := newTestSFTPProxy(t, newTestSFTPServer(t))
+
+	for _, key := range []string{"a/b", "a-c", "a/d/e", "b", "c/x y"} {
+		putString(t, p, key, key)
+	}
+	// Empty directories are not prefixes
+	os.MkdirAll(filepath.Join(root, "empty", "nested"), 0755)
+
+	tests := []struct {
+		name         string
+		prefix       string
+		delimiter    string
+		maxKeys      int64
+		wantKeys     []string
+		wantPrefixes []string
+	}{
+		{
+			name:     "all keys in lexicographic order",
+			maxKeys:  2,
+			wantKeys: []string{"a-c", "a/b", "a/d/e", "b", "c/x y"},
+		},
+		{
+			name:         "delimiter paged",
+			delimiter:    "/",
+			maxKeys:      1,
+			wantKeys:     []string{"a-c", "b"},
+			wantPrefixes: []string{"a/", "c/"},
+		},
+		{
+			name:         "prefix and delimiter",
+			prefix:       "a/",
+			delimiter:    "/",
+			wantKeys:     []string{"a/b"},
+			wantPrefixes: []string{"a/d/"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, prefixes := listAll(t, p, tt.prefix, tt.delimiter, tt.maxKeys)
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("keys = %v, want %v", keys, tt.wantKeys)
+			}
+			if !reflect.DeepEqual(prefixes, tt.wantPrefixes) {
+				t.Errorf("prefixes = %v, want %v", prefixes, tt.wantPrefixes)
+			}
+		})
+	}
+}
+
+func TestSFTPProxy_Multipart(t *testing.T) {
+	p, root := newTestSFTPProxy(t, newTestSFTPServer(t))
+
+	created, err := p.CreateMultipartUpload("big/object.zip", "application/zip")
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload() error = %v", err)
+	}
+	uploadId := aws.StringValue(created.UploadId)
+
+	var parts []*s3.CompletedPart
+	for i, body := range []string{"part one ", "part two"} {
+		out, err := p.UploadPart("big/object.zip", uploadId, int64(i+1), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("UploadPart() error = %v", err)
+		}
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(int64(i + 1)), ETag: out.ETag})
+	}
+
+	// Re-uploading a part replaces it
+	out, err := p.UploadPart("big/object.zip", uploadId, 1, strings.NewReader("PART ONE "))
+	if err != nil {
+		t.Fatalf("UploadPart() error = %v", err)
+	}
+	if _, err := p.CompleteMultipartUpload("big/object.zip", uploadId, parts); err == nil {
+		t.Error("CompleteMultipartUpload() with a replaced part's ETag should fail")
+	}
+	parts[0].ETag = out.ETag
+
+	uploads, err := p.ListMultipartUploads("big/", "", 0)
+	if err != nil || len(uploads.Uploads) != 1 {
+		t.Fatalf("ListMultipartUploads() = %v, %v, want one upload", uploads, err)
+	}
+
+	if _, err := p.CompleteMultipartUpload("big/object.zip", uploadId, parts); err != nil {
+		t.Fatalf("CompleteMultipartUpload() error = %v", err)
+	}
+	if got := getString(t, p, "big/object.zip", ""); got != "PART ONE part two" {
+		t.Errorf("Get() = %q", got)
+	}
+
+	if entries, _ := os.ReadDir(filepath.Join(root, ".s3proxy", "uploads")); len(entries) != 0 {
+		t.Errorf("staged uploads left behind: %v", entries)
+	}
+	if _, err := p.AbortMultipartUpload("big/object.zip", uploadId); !isNotFound(err) {
+		t.Errorf("AbortMultipartUpload() after completion error = %v, want NoSuchUpload", err)
+	}
+}
+
+func TestSFTPProxy_Auth(t *testing.T) {
+	s := newTestSFTPServer(t)
+
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ssh.NewSignerFromKey(otherPriv)
+
+	tests := []struct {
+		name    string
+		cfg     SFTPConfig
+		wantErr bool
+	}{
+		{
+			name: "private key",
+			cfg:  SFTPConfig{PrivateKeyFile: s.keyFile, KnownHostsFile: s.knownHosts(t, s.hostKey.PublicKey())},
+		},
+		{
+			name:    "wrong password",
+			cfg:     SFTPConfig{Password: "guess", KnownHostsFile: s.knownHosts(t, s.hostKey.PublicKey())},
+			wantErr: true,
+		},
+		{
+			name:    "unknown host key",
+			cfg:     SFTPConfig{Password: "secret", KnownHostsFile: s.knownHosts(t, otherKey.PublicKey())},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Host, tt.cfg.User, tt.cfg.Root = s.addr, "proxy", t.TempDir()
+
+			p, err := NewSFTPProxy(tt.cfg)
+			if err != nil {
+				t.Fatalf("NewSFTPProxy() error = %v", err)
+			}
+			defer p.Close()
+
+			_, err = p.ListObjects("", "", 0, "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ListObjects() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSFTPProxy_Reconnect(t *testing.T) {
+	p, _ := newTestSFTPProxy(t, newTestSFTPServer(t))
+
+	putString(t, p, "key", "value")
+	p.Close()
+
+	if got := getString(t, p, "key", ""); got != "value" {
+		t.Errorf("Get() after reconnect = %q, want %q", got, "value")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// shardVirtualNodes is how many points each shard has on the hash ring.
+// More points spread keys more evenly between shards.
+const shardVirtualNodes = 160
+
+func init() {
+	RegisterBackend("shard", validateShardSite, func(s Site) (S3Proxy, error) {
+		shards := make([]S3Proxy, 0, len(s.Shard.Shards))
+		for i, site := range s.Shard.Shards {
+			proxy, err := NewBackend(site)
+			if err != nil {
+				return nil, fmt.Errorf("shard %d: %v", i, err)
+			}
+			shards = append(shards, proxy)
+		}
+
+		return NewShardedProxy(shards, s.Shard.PrefixDepth), nil
+	})
+}
+
+// ShardConfig configures the shard backend. Shards are full site backend
+// configurations (without host, users or options). Keys are assigned to
+// shards by consistent hashing, on the whole key or, with PrefixDepth, on
+// its first PrefixDepth "/"-separated segments so related keys share a
+// shard.
+//
+// Shards are identified by their position, so new shards must be appended.
+// Keys hashed onto a new shard are not moved there automatically.
+type ShardConfig struct {
+	Shards      []Site `json:"shards" yaml:"shards"`
+	PrefixDepth int    `json:"prefixDepth,omitempty" yaml:"prefixDepth,omitempty"`
+}
+
+func validateShardSite(s Site) error {
+	if s.Shard == nil || len(s.Shard.Shards) == 0 {
+		return errors.New("Shard shards not specified")
+	}
+
+	for i, shard := range s.Shard.Shards {
+		if err := shard.validate(); err != nil {
+			return fmt.Errorf("%v in shard %d", err, i)
+		}
+	}
+
+	if s.Shard.PrefixDepth < 0 {
+		return errors.New("Shard prefixDepth must not be negative")
+	}
+
+	return nil
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+// ShardedProxy spreads keys over several backends. Every operation on a key
+// goes to the shard owning it, and listings merge all shards.
+type ShardedProxy struct {
+	shards      []S3Proxy
+	prefixDepth int
+	ring        []ringPoint
+}
+
+func NewShardedProxy(shards []S3Proxy, prefixDepth int) *ShardedProxy {
+	p := &ShardedProxy{shards: shards, prefixDepth: prefixDepth}
+
+	for i := range shards {
+		for v := 0; v < shardVirtualNodes; v++ {
+			p.ring = append(p.ring, ringPoint{hash: shardHash(fmt.Sprintf("shard-%d#%d", i, v)), shard: i})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+
+	return p
+}
+
+func shardHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum(nil)
+
+	// FNV mixes the low bits poorly for short, similar inputs, so finish
+	// with a murmur3 style avalanche
+	x := binary.BigEndian.Uint64(sum)
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// hashKey returns the part of key that decides its shard
+func (p *ShardedProxy) hashKey(key string) string {
+	if p.prefixDepth <= 0 {
+		return key
+	}
+
+	segments := strings.SplitN(key, "/", p.prefixDepth+1)
+	if len(segments) <= p.prefixDepth {
+		// Keys with fewer segments hash whole
+		return key
+	}
+	return strings.Join(segments[:p.prefixDepth], "/")
+}
+
+// shardIndex returns the shard owning key
+func (p *ShardedProxy) shardIndex(key string) int {
+	h := shardHash(p.hashKey(key))
+	i := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+	if i == len(p.ring) {
+		i = 0
+	}
+	return p.ring[i].shard
+}
+
+func (p *ShardedProxy) shard(key string) S3Proxy {
+	return p.shards[p.shardIndex(key)]
+}
+
+func (p *ShardedProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	return p.shard(key).Get(key, rangeHeader)
+}
+
+func (p *ShardedProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	return p.shard(key).Put(key, body, contentType)
+}
+
+// PutIfAbsent uses the owning shard's atomic create, and is not implemented
+// for keys on shards without one
+func (p *ShardedProxy) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	if cp, ok := p.shard(key).(ConditionalPutter); ok {
+		return cp.PutIfAbsent(key, body, contentType)
+	}
+	return nil, errNotImplemented("Atomic create")
+}
+
+func (p *ShardedProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	return p.shard(key).Head(key)
+}
+
+func (p *ShardedProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	return p.shard(key).Delete(key)
+}
+
+// ListObjects merge-sorts the listings of every shard. The continuation
+// token records each shard's own position.
+func (p *ShardedProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	if maxKeys <= 0 || maxKeys > defaultMaxKeys {
+		maxKeys = defaultMaxKeys
+	}
+
+	iters := make([]*listIterator, 0, len(p.shards))
+	for _, shard := range p.shards {
+		iters = append(iters, &listIterator{proxy: shard, prefix: prefix, delimiter: delimiter, pageSize: maxKeys})
+	}
+
+	m, err := newMergeLister(iters, continuationToken)
+	if err != nil {
+		return nil, err
+	}
+
+	page := newMergedPage(prefix, maxKeys)
+	for page.count() < maxKeys {
+		e, _, err := m.next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		page.add(e)
+	}
+
+	return page.result(m)
+}
+
+func (p *ShardedProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	return p.shard(key).CreateMultipartUpload(key, contentType)
+}
+
+func (p *ShardedProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	return p.shard(key).UploadPart(key, uploadId, partNumber, body)
+}
+
+func (p *ShardedProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	return p.shard(key).CompleteMultipartUpload(key, uploadId, parts)
+}
+
+func (p *ShardedProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	return p.shard(key).AbortMultipartUpload(key, uploadId)
+}
+
+// ListMultipartUploads combines the uploads in progress on every shard. It
+// is truncated if any shard's own listing was.
+func (p *ShardedProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	var uploads []*s3.MultipartUpload
+	truncated := false
+	for _, shard := range p.shards {
+		out, err := shard.ListMultipartUploads(prefix, "", maxUploads)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, out.Uploads...)
+		truncated = truncated || aws.BoolValue(out.IsTruncated)
+	}
+
+	out := listUploads(uploads, prefix, delimiter, maxUploads)
+	out.Prefix = aws.String(prefix)
+	if truncated {
+		out.IsTruncated = aws.Bool(true)
+	}
+	return out, nil
+}
+
+// GetWebsiteConfig returns the first shard's website configuration
+func (p *ShardedProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	return p.shards[0].GetWebsiteConfig()
+}
+
+func (p *ShardedProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	return p.shard(key).RestoreObject(key, days, tier)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func newTestShardedProxy(n int, prefixDepth int) (*ShardedProxy, []*MemoryProxy) {
+	var shards []S3Proxy
+	var memory []*MemoryProxy
+	for i := 0; i < n; i++ {
+		m := NewMemoryProxy(0, 0, nil)
+		shards = append(shards, m)
+		memory = append(memory, m)
+	}
+	return NewShardedProxy(shards, prefixDepth), memory
+}
+
+func TestShardedProxy_Distribution(t *testing.T) {
+	p, shards := newTestShardedProxy(3, 0)
+
+	var want []string
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("objects/%04d", i)
+		putString(t, p, key, key)
+		want = append(want, key)
+	}
+
+	total := 0
+	for i, shard := range shards {
+		keys, _ := listAll(t, shard, "", "", 0)
+		if len(keys) < 50 {
+			t.Errorf("shard %d holds %d of 300 keys", i, len(keys))
+		}
+		total += len(keys)
+	}
+	if total != 300 {
+		t.Errorf("shards hold %d keys, want each key once", total)
+	}
+
+	if got := getString(t, p, "objects/0042", ""); got != "objects/0042" {
+		t.Errorf("Get() = %q", got)
+	}
+
+	// Appending a shard only moves keys onto the new shard
+	grown := NewShardedProxy([]S3Proxy{shards[0], shards[1], shards[2], NewMemoryProxy(0, 0, nil)}, 0)
+	moved := 0
+	for _, key := range want {
+		before, after := p.shardIndex(key), grown.shardIndex(key)
+		if before != after {
+			moved++
+			if after != 3 {
+				t.Errorf("%s moved from shard %d to %d", key, before, after)
+			}
+		}
+	}
+	if moved == 0 || moved > 150 {
+		t.Errorf("%d of 300 keys moved to the new shard", moved)
+	}
+}
+
+func TestShardedProxy_PrefixDepth(t *testing.T) {
+	p, _ := newTestShardedProxy(4, 1)
+
+	for i := 0; i < 20; i++ {
+		user := fmt.Sprintf("user%d", i)
+		shard := p.shardIndex(user + "/profile")
+		for _, key := range []string{user + "/a", user + "/b/c", user + "/" + strings.Repeat("x", i)} {
+			if got := p.shardIndex(key); got != shard {
+				t.Errorf("%s on shard %d, want %d with the rest of %s", key, got, shard, user)
+			}
+		}
+	}
+}
+
+func TestShardedProxy_ListObjects(t *testing.T) {
+	p, _ := newTestShardedProxy(3, 0)
+
+	var all []string
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("dir%d/file%02d", i%4, i)
+		putString(t, p, key, key)
+		all = append(all, key)
+	}
+	putString(t, p, "top", "top")
+	all = append(all, "top")
+	sort.Strings(all)
+
+	tests := []struct {
+		name         string
+		prefix       string
+		delimiter    string
+		maxKeys      int64
+		wantKeys     []string
+		wantPrefixes []string
+	}{
+		{name: "merged in order", maxKeys: 7, wantKeys: all},
+		{
+			name:         "common prefixes once",
+			delimiter:    "/",
+			maxKeys:      2,
+			wantKeys:     []string{"top"},
+			wantPrefixes: []string{"dir0/", "dir1/", "dir2/", "dir3/"},
+		},
+		{
+			name:     "prefix",
+			prefix:   "dir1/",
+			wantKeys: []string{"dir1/file01", "dir1/file05", "dir1/file09", "dir1/file13", "dir1/file17", "dir1/file21", "dir1/file25", "dir1/file29", "dir1/file33", "dir1/file37"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, prefixes := listAll(t, p, tt.prefix, tt.delimiter, tt.maxKeys)
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("keys = %v, want %v", keys, tt.wantKeys)
+			}
+			if !reflect.DeepEqual(prefixes, tt.wantPrefixes) {
+				t.Errorf("prefixes = %v, want %v", prefixes, tt.wantPrefixes)
+			}
+		})
+	}
+}
+
+func TestShardedProxy_Multipart(t *testing.T) {
+	p, shards := newTestShardedProxy(3, 0)
+
+	var uploadIds []string
+	for _, key := range []string{"a", "b", "c", "d"} {
+		created, err := p.CreateMultipartUpload(key, "text/plain")
+		if err != nil {
+			t.Fatalf("CreateMultipartUpload() error = %v", err)
+		}
+		uploadIds = append(uploadIds, aws.StringValue(created.UploadId))
+	}
+
+	uploads, err := p.ListMultipartUploads("", "", 0)
+	if err != nil || len(uploads.Uploads) != 4 || aws.StringValue(uploads.Uploads[0].Key) != "a" {
+		t.Fatalf("ListMultipartUploads() = %v, %v", uploads, err)
+	}
+
+	part, err := p.UploadPart("c", uploadIds[2], 1, strings.NewReader("parts"))
+	if err != nil {
+		t.Fatalf("UploadPart() error = %v", err)
+	}
+	parts := []*s3.CompletedPart{{PartNumber: aws.Int64(1), ETag: part.ETag}}
+	if _, err := p.CompleteMultipartUpload("c", uploadIds[2], parts); err != nil {
+		t.Fatalf("CompleteMultipartUpload() error = %v", err)
+	}
+
+	if _, err := shards[p.shardIndex("c")].Head("c"); err != nil {
+		t.Errorf("completed object is not on its shard: %v", err)
+	}
+}
+
+func TestShardedProxy_PutIfAbsent(t *testing.T) {
+	p, shards := newTestShardedProxy(3, 0)
+
+	checkNoAtomicCreate(t, p, shards[p.shardIndex("created")])
+}
+
+func TestValidateShardSite(t *testing.T) {
+	tests := []struct {
+		name    string
+		site    Site
+		wantErr bool
+	}{
+		{name: "memory shards", site: Site{Type: "shard", Shard: &ShardConfig{Shards: []Site{{Type: "memory"}, {Type: "memory"}}, PrefixDepth: 1}}},
+		{name: "no shards", site: Site{Type: "shard", Shard: &ShardConfig{}}, wantErr: true},
+		{name: "invalid shard", site: Site{Type: "shard", Shard: &ShardConfig{Shards: []Site{{Type: "s3"}}}}, wantErr: true},
+		{name: "negative depth", site: Site{Type: "shard", Shard: &ShardConfig{Shards: []Site{{Type: "memory"}}, PrefixDepth: -1}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.site.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	tierPageSize = 1000
+	// tierDefaultInterval is how often the tierer looks for objects to
+	// move to the cold tier
+	tierDefaultInterval = time.Hour
+)
+
+func init() {
+	RegisterBackend("tier", validateTierSite, func(s Site) (S3Proxy, error) {
+		cfg := s.Tier
+		hot, err := NewBackend(cfg.Hot)
+		if err != nil {
+			return nil, fmt.Errorf("hot tier: %v", err)
+		}
+		cold, err := NewBackend(cfg.Cold)
+		if err != nil {
+			return nil, fmt.Errorf("cold tier: %v", err)
+		}
+
+		var maxAge, idleAge, interval time.Duration
+		if cfg.MaxAge != "" {
+			maxAge, _ = time.ParseDuration(cfg.MaxAge)
+		}
+		if cfg.IdleAge != "" {
+			idleAge, _ = time.ParseDuration(cfg.IdleAge)
+		}
+		if cfg.Interval != "" {
+			interval, _ = time.ParseDuration(cfg.Interval)
+		}
+
+		p, err := NewTierProxy(hot, cold, maxAge, idleAge, interval, cfg.Promote, cfg.StateFile)
+		if err != nil {
+			return nil, err
+		}
+
+		startWorker(p)
+		return p, nil
+	})
+}
+
+// TierConfig configures the tiering backend. Hot and Cold are full site
+// backend configurations (without host, users or options). Objects are
+// written to the hot tier and moved to the cold tier once they are older
+// than MaxAge or have not been read for IdleAge, both durations such as
+// "720h". Interval is how often the tierer runs (default "1h"). With
+// Promote, objects read from the cold tier move back to the hot tier.
+// StateFile records read times and the tierer's progress.
+type TierConfig struct {
+	Hot       Site   `json:"hot" yaml:"hot"`
+	Cold      Site   `json:"cold" yaml:"cold"`
+	MaxAge    string `json:"maxAge,omitempty" yaml:"maxAge,omitempty"`
+	IdleAge   string `json:"idleAge,omitempty" yaml:"idleAge,omitempty"`
+	Interval  string `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Promote   bool   `json:"promote,omitempty" yaml:"promote,omitempty"`
+	StateFile string `json:"stateFile" yaml:"stateFile"`
+}
+
+func validateTierSite(s Site) error {
+	cfg := s.Tier
+	if cfg == nil {
+		return errors.New("Tier settings not specified")
+	}
+
+	if err := cfg.Hot.validate(); err != nil {
+		return fmt.Errorf("%v in hot tier", err)
+	}
+	if err := cfg.Cold.validate(); err != nil {
+		return fmt.Errorf("%v in cold tier", err)
+	}
+
+	if cfg.MaxAge == "" && cfg.IdleAge == "" {
+		return errors.New("Tier maxAge or idleAge must be specified")
+	}
+	for name, value := range map[string]string{"maxAge": cfg.MaxAge, "idleAge": cfg.IdleAge, "interval": cfg.Interval} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid tier %s %q", name, value)
+		}
+	}
+
+	if cfg.StateFile == "" {
+		return errors.New("Tier stateFile not specified")
+	}
+
+	return nil
+}
+
+// TierStatus reports what the tierer has done
+type TierStatus struct {
+	Running   bool      `json:"running"`
+	Demoted   int64     `json:"demoted"`
+	Promoted  int64     `json:"promoted"`
+	Failed    int64     `json:"failed"`
+	Bytes     int64     `json:"bytes"`
+	LastRun   time.Time `json:"lastRun,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// tierState is persisted to the state file after every pass of the tierer
+type tierState struct {
+	TierStatus
+
+	// Read holds when keys in the hot tier were last read, in Unix seconds
+	Read map[string]int64 `json:"read,omitempty"`
+}
+
+// TierProxy keeps recently written and read objects in a fast hot tier and
+// the rest in a cheaper cold tier, presenting them as one bucket. Every key
+// lives in one tier: writes go to the hot tier, a background tierer moves
+// objects that aged out to the cold tier, and reads try the hot tier first.
+type TierProxy struct {
+	hot       S3Proxy
+	cold      S3Proxy
+	maxAge    time.Duration
+	idleAge   time.Duration
+	interval  time.Duration
+	promote   bool
+	stateFile string
+	now       func() time.Time
+
+	mu    sync.Mutex
+	state tierState
+	locks keyLocks
+	// promoting holds keys being moved to the hot tier, so concurrent reads
+	// of a cold key start one move
+	promoting map[string]bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewTierProxy creates a tiering backend, loading read times from stateFile
+// if it exists. The tierer starts with Start.
+func NewTierProxy(hot, cold S3Proxy, maxAge, idleAge, interval time.Duration, promote bool, stateFile string) (*TierProxy, error) {
+	if interval <= 0 {
+		interval = tierDefaultInterval
+	}
+
+	p := &TierProxy{
+		hot:       hot,
+		cold:      cold,
+		maxAge:    maxAge,
+		idleAge:   idleAge,
+		interval:  interval,
+		promote:   promote,
+		stateFile: stateFile,
+		now:       time.Now,
+		promoting: make(map[string]bool),
+	}
+
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// load reads the state file, starting afresh if there is none
+func (p *TierProxy) load() error {
+	var state tierState
+
+	data, err := os.ReadFile(p.stateFile)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("Invalid tier state file %s: %v", p.stateFile, err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	if state.Read == nil {
+		state.Read = make(map[string]int64)
+	}
+	state.Running = false
+
+	p.mu.Lock()
+	p.state = state
+	p.mu.Unlock()
+
+	return nil
+}
+
+func (p *TierProxy) statePath() string {
+	return p.stateFile
+}
+
+// Start runs the tierer every interval until Close is called
+func (p *TierProxy) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stop != nil {
+		return
+	}
+
+	p.stop = make(chan struct{})
+	p.state.Running = true
+	p.wg.Add(1)
+	go p.run(p.stop)
+}
+
+// Close stops the tierer and saves the state
+func (p *TierProxy) Close() error {
+	p.mu.Lock()
+	stop := p.stop
+	p.stop = nil
+	p.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		p.wg.Wait()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.Running = false
+	return p.saveLocked()
+}
+
+// TierStatus returns what the tierer has done so far
+func (p *TierProxy) TierStatus() TierStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.state.TierStatus
+}
+
+// saveLocked writes the state file atomically. p.mu must be held.
+func (p *TierProxy) saveLocked() error {
+	data, err := json.Marshal(&p.state)
+	if err != nil {
+		return err
+	}
+
+	tmp := p.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.stateFile)
+}
+
+func (p *TierProxy) run(stop chan struct{}) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.pass(stop)
+		}
+	}
+}
+
+func (p *TierProxy) recordError(err error) {
+	log.Printf("tiering: %v", err)
+
+	p.mu.Lock()
+	p.state.Failed++
+	p.state.LastError = err.Error()
+	p.mu.Unlock()
+}
+
+// pass walks the hot tier once, moving objects that aged out to the cold
+// tier. It returns early if stop is closed.
+func (p *TierProxy) pass(stop chan struct{}) {
+	token := ""
+	for {
+		out, err := p.hot.ListObjects("", "", tierPageSize, token)
+		if err != nil {
+			p.recordError(err)
+			break
+		}
+
+		for _, obj := range out.Contents {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if p.due(obj) {
+				if err := p.demote(aws.StringValue(obj.Key)); err != nil {
+					p.recordError(fmt.Errorf("moving %s to the cold tier: %v", aws.StringValue(obj.Key), err))
+				}
+			}
+		}
+
+		if !aws.BoolValue(out.IsTruncated) {
+			break
+		}
+		token = aws.StringValue(out.NextContinuationToken)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.LastRun = p.now().UTC()
+	if err := p.saveLocked(); err != nil {
+		log.Printf("tiering: saving state: %v", err)
+	}
+}
+
+// due reports whether a hot object should move to the cold tier
+func (p *TierProxy) due(obj *s3.Object) bool {
+	now := p.now()
+	modified := aws.TimeValue(obj.LastModified)
+
+	if p.maxAge > 0 && now.Sub(modified) >= p.maxAge {
+		return true
+	}
+
+	if p.idleAge > 0 {
+		p.mu.Lock()
+		read, ok := p.state.Read[aws.StringValue(obj.Key)]
+		p.mu.Unlock()
+
+		lastUsed := modified
+		if ok && time.Unix(read, 0).After(lastUsed) {
+			lastUsed = time.Unix(read, 0)
+		}
+		return now.Sub(lastUsed) >= p.idleAge
+	}
+
+	return false
+}
+
+// move copies key from one tier to the other, then deletes it from the
+// first. It returns the bytes moved, or 0 if from no longer has the key.
+func (p *TierProxy) move(key string, from, to S3Proxy) (int64, error) {
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	obj, err := from.Get(key, "")
+	if isNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Body.Close()
+
+	spool, err := spoolBody(obj.Body)
+	if err != nil {
+		return 0, err
+	}
+	defer removeSpool(spool)
+
+	n, err := spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	contentType := aws.StringValue(obj.ContentType)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if _, err := to.Put(key, spool, contentType); err != nil {
+		return 0, err
+	}
+
+	// A failed delete leaves the key in both tiers, which reads and
+	// listings tolerate, and the next pass retries it
+	if _, err := from.Delete(key); err != nil && !isNotFound(err) {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (p *TierProxy) demote(key string) error {
+	n, err := p.move(key, p.hot, p.cold)
+	if err != nil || n == 0 {
+		return err
+	}
+
+	p.mu.Lock()
+	p.state.Demoted++
+	p.state.Bytes += n
+	delete(p.state.Read, key)
+	p.mu.Unlock()
+	return nil
+}
+
+// promoteInBackground moves a key read from the cold tier to the hot tier
+func (p *TierProxy) promoteInBackground(key string) {
+	p.mu.Lock()
+	if p.promoting[key] {
+		p.mu.Unlock()
+		return
+	}
+	p.promoting[key] = true
+	p.mu.Unlock()
+
+	go func() {
+		n, err := p.move(key, p.cold, p.hot)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.promoting, key)
+		switch {
+		case err != nil:
+			log.Printf("tiering: moving %s to the hot tier: %v", key, err)
+			p.state.Failed++
+			p.state.LastError = err.Error()
+		case n > 0:
+			p.state.Promoted++
+			p.state.Read[key] = p.now().Unix()
+		}
+	}()
+}
+
+// recordRead notes a read of a hot key, for idleAge
+func (p *TierProxy) recordRead(key string) {
+	if p.idleAge <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	p.state.Read[key] = p.now().Unix()
+	p.mu.Unlock()
+}
+
+func (p *TierProxy) forget(key string) {
+	p.mu.Lock()
+	delete(p.state.Read, key)
+	p.mu.Unlock()
+}
+
+func (p *TierProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	out, err := p.hot.Get(key, rangeHeader)
+	if err == nil {
+		p.recordRead(key)
+		return out, nil
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+
+	out, err = p.cold.Get(key, rangeHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.promote {
+		p.promoteInBackground(key)
+	}
+	return out, nil
+}
+
+func (p *TierProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	out, err := p.hot.Head(key)
+	if err == nil || !isNotFound(err) {
+		return out, err
+	}
+
+	return p.cold.Head(key)
+}
+
+// deleteCold removes a cold copy replaced by a write to the hot tier
+func (p *TierProxy) deleteCold(key string) error {
+	_, err := p.cold.Delete(key)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (p *TierProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	out, err := p.hot.Put(key, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.deleteCold(key); err != nil {
+		return nil, err
+	}
+	p.forget(key)
+	return out, nil
+}
+
+func (p *TierProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	out, err := p.hot.Delete(key)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+
+	if err := p.deleteCold(key); err != nil {
+		return nil, err
+	}
+	p.forget(key)
+
+	if out == nil {
+		out = &s3.DeleteObjectOutput{}
+	}
+	return out, nil
+}
+
+// ListObjects merges both tiers. A key caught in both during a move is
+// listed once, with its hot tier details.
+func (p *TierProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	if maxKeys <= 0 || maxKeys > defaultMaxKeys {
+		maxKeys = defaultMaxKeys
+	}
+
+	m, err := newMergeLister([]*listIterator{
+		{proxy: p.hot, prefix: prefix, delimiter: delimiter, pageSize: maxKeys},
+		{proxy: p.cold, prefix: prefix, delimiter: delimiter, pageSize: maxKeys},
+	}, continuationToken)
+	if err != nil {
+		return nil, err
+	}
+
+	page := newMergedPage(prefix, maxKeys)
+	for page.count() < maxKeys {
+		e, _, err := m.next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		page.add(e)
+	}
+
+	return page.result(m)
+}
+
+func (p *TierProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	return p.hot.CreateMultipartUpload(key, contentType)
+}
+
+func (p *TierProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	return p.hot.UploadPart(key, uploadId, partNumber, body)
+}
+
+func (p *TierProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	out, err := p.hot.CompleteMultipartUpload(key, uploadId, parts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.deleteCold(key); err != nil {
+		return nil, err
+	}
+	p.forget(key)
+	return out, nil
+}
+
+func (p *TierProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	return p.hot.AbortMultipartUpload(key, uploadId)
+}
+
+func (p *TierProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	return p.hot.ListMultipartUploads(prefix, delimiter, maxUploads)
+}
+
+func (p *TierProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	return p.hot.GetWebsiteConfig()
+}
+
+// RestoreObject restores from whichever tier holds the key, so a cold tier
+// with archive storage classes can be restored through the proxy
+func (p *TierProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	_, err := p.hot.Head(key)
+	if err == nil {
+		return p.hot.RestoreObject(key, days, tier)
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+
+	return p.cold.RestoreObject(key, days, tier)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock the tests move forward
+type testClock struct {
+	mu     sync.Mutex
+	offset time.Duration
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Add(c.offset)
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.offset += d
+	c.mu.Unlock()
+}
+
+func newTestTierProxy(t *testing.T, maxAge, idleAge time.Duration, promote bool) (*TierProxy, *MemoryProxy, *MemoryProxy, *testClock) {
+	t.Helper()
+
+	hot, cold := NewMemoryProxy(0, 0, nil), NewMemoryProxy(0, 0, nil)
+	p, err := NewTierProxy(hot, cold, maxAge, idleAge, 0, promote, filepath.Join(t.TempDir(), "tier.json"))
+	if err != nil {
+		t.Fatalf("NewTierProxy() error = %v", err)
+	}
+
+	clock := &testClock{}
+	p.now = clock.now
+	hot.now = clock.now
+	return p, hot, cold, clock
+}
+
+func TestTierProxy_DemotesByAge(t *testing.T) {
+	p, hot, cold, clock := newTestTierProxy(t, time.Hour, 0, false)
+	putString(t, p, "old", "old")
+	putString(t, p, "dir/older", "older")
+
+	p.pass(nil)
+	if _, err := cold.Head("old"); !isNotFound(err) {
+		t.Fatalf("new object moved to the cold tier: %v", err)
+	}
+
+	clock.advance(2 * time.Hour)
+	putString(t, hot, "new", "new")
+	p.pass(nil)
+
+	for _, key := range []string{"old", "dir/older"} {
+		if _, err := hot.Head(key); !isNotFound(err) {
+			t.Errorf("%s still in the hot tier: %v", key, err)
+		}
+		if _, err := cold.Head(key); err != nil {
+			t.Errorf("%s not in the cold tier: %v", key, err)
+		}
+	}
+	if got := getString(t, p, "old", ""); got != "old" {
+		t.Errorf("Get() from the cold tier = %q", got)
+	}
+
+	keys, _ := listAll(t, p, "", "", 1)
+	if want := []string{"dir/older", "new", "old"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+
+	if status := p.TierStatus(); status.Demoted != 2 || status.Bytes != 8 {
+		t.Errorf("TierStatus() = %+v", status)
+	}
+}
+
+func TestTierProxy_DemotesIdle(t *testing.T) {
+	p, hot, cold, clock := newTestTierProxy(t, 0, time.Hour, false)
+	putString(t, p, "read", "read")
+	putString(t, p, "unread", "unread")
+
+	clock.advance(50 * time.Minute)
+	getString(t, p, "read", "")
+
+	clock.advance(40 * time.Minute)
+	p.pass(nil)
+
+	if _, err := hot.Head("read"); err != nil {
+		t.Errorf("recently read object left the hot tier: %v", err)
+	}
+	if _, err := cold.Head("unread"); err != nil {
+		t.Errorf("idle object not in the cold tier: %v", err)
+	}
+
+	// Read times survive a restart
+	p.Close()
+	reloaded, err := NewTierProxy(hot, cold, 0, time.Hour, 0, false, p.stateFile)
+	if err != nil {
+		t.Fatalf("NewTierProxy() error = %v", err)
+	}
+	reloaded.now = clock.now
+	reloaded.pass(nil)
+	if _, err := hot.Head("read"); err != nil {
+		t.Errorf("read time lost on reload: %v", err)
+	}
+}
+
+func TestTierProxy_Promote(t *testing.T) {
+	p, hot, cold, _ := newTestTierProxy(t, time.Hour, 0, true)
+	putString(t, cold, "cold", "cold")
+
+	if got := getString(t, p, "cold", "bytes=1-2"); got != "ol" {
+		t.Errorf("Get() = %q", got)
+	}
+	waitFor(t, "promotion", inProxy(hot, "cold"))
+	waitFor(t, "cold copy removal", func() bool {
+		_, err := cold.Head("cold")
+		return isNotFound(err)
+	})
+
+	if status := p.TierStatus(); status.Promoted != 1 {
+		t.Errorf("TierStatus() = %+v", status)
+	}
+}
+
+func TestTierProxy_Writes(t *testing.T) {
+	p, hot, cold, _ := newTestTierProxy(t, time.Hour, 0, false)
+	putString(t, cold, "key", "stale")
+
+	putString(t, p, "key", "fresh")
+	if _, err := cold.Head("key"); !isNotFound(err) {
+		t.Errorf("overwritten cold copy kept: %v", err)
+	}
+
+	putString(t, cold, "gone", "cold")
+	if _, err := p.Delete("gone"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := p.Delete("key"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	for _, tier := range []*MemoryProxy{hot, cold} {
+		if keys, _ := listAll(t, tier, "", "", 0); len(keys) != 0 {
+			t.Errorf("keys left after deletes: %v", keys)
+		}
+	}
+}
+
+func TestValidateTierSite(t *testing.T) {
+	memory := Site{Type: "memory"}
+
+	tests := []struct {
+		name    string
+		tier    *TierConfig
+		wantErr bool
+	}{
+		{name: "valid", tier: &TierConfig{Hot: memory, Cold: memory, MaxAge: "720h", IdleAge: "168h", Interval: "10m", StateFile: "tier.json"}},
+		{name: "missing", wantErr: true},
+		{name: "no age", tier: &TierConfig{Hot: memory, Cold: memory, StateFile: "tier.json"}, wantErr: true},
+		{name: "bad age", tier: &TierConfig{Hot: memory, Cold: memory, MaxAge: "30 days", StateFile: "tier.json"}, wantErr: true},
+		{name: "no state file", tier: &TierConfig{Hot: memory, Cold: memory, MaxAge: "1h"}, wantErr: true},
+		{name: "invalid cold tier", tier: &TierConfig{Hot: memory, Cold: Site{Type: "nope"}, MaxAge: "1h", StateFile: "tier.json"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site := Site{Type: "tier", Tier: tt.tier}
+			if err := site.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// unionWhiteoutPrefix is where the top layer records keys deleted from the
+// union while a lower layer still has them. A whiteout is an empty object
+// named after the deleted key. It is kept apart from .s3proxy/, which some
+// backends reserve for themselves.
+const unionWhiteoutPrefix = ".s3proxy-whiteouts/"
+
+func init() {
+	RegisterBackend("union", validateUnionSite, func(s Site) (S3Proxy, error) {
+		layers := make([]S3Proxy, 0, len(s.Union.Layers))
+		for i, layer := range s.Union.Layers {
+			proxy, err := NewBackend(layer)
+			if err != nil {
+				return nil, fmt.Errorf("union layer %d: %v", i, err)
+			}
+			layers = append(layers, proxy)
+		}
+
+		return NewUnionProxy(layers), nil
+	})
+}
+
+// UnionConfig configures the union backend. Layers are full site backend
+// configurations (without host, users or options), listed top first. Only
+// the top layer is written to.
+type UnionConfig struct {
+	Layers []Site `json:"layers" yaml:"layers"`
+}
+
+func validateUnionSite(s Site) error {
+	if s.Union == nil || len(s.Union.Layers) == 0 {
+		return errors.New("Union layers not specified")
+	}
+
+	for i, layer := range s.Union.Layers {
+		if err := layer.validate(); err != nil {
+			return fmt.Errorf("%v in union layer %d", err, i)
+		}
+	}
+
+	return nil
+}
+
+// UnionProxy layers several backends. Writes go to the top layer, reads
+// fall through the layers in order, deletes of keys that a lower layer
+// still has leave a whiteout in the top layer, and listings merge all
+// layers.
+type UnionProxy struct {
+	layers []S3Proxy
+}
+
+func NewUnionProxy(layers []S3Proxy) *UnionProxy {
+	return &UnionProxy{layers: layers}
+}
+
+func (p *UnionProxy) top() S3Proxy {
+	return p.layers[0]
+}
+
+func checkUnionKey(key string) error {
+	if strings.HasPrefix(key, unionWhiteoutPrefix) {
+		return errInvalidArgument("Keys under " + unionWhiteoutPrefix + " are reserved")
+	}
+	return nil
+}
+
+// whitedOut reports whether the top layer has a whiteout for key
+func (p *UnionProxy) whitedOut(key string) (bool, error) {
+	_, err := p.top().Head(unionWhiteoutPrefix + key)
+	if err == nil {
+		return true, nil
+	}
+	if isNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// lookup calls fn on each layer in order until one has the key, honouring
+// whiteouts once the top layer has been tried
+func (p *UnionProxy) lookup(key string, fn func(layer S3Proxy) error) error {
+	if err := checkUnionKey(key); err != nil {
+		return errNoSuchKey(key)
+	}
+
+	for i, layer := range p.layers {
+		if i == 1 {
+			hidden, err := p.whitedOut(key)
+			if err != nil {
+				return err
+			}
+			if hidden {
+				break
+			}
+		}
+
+		err := fn(layer)
+		if err == nil || !isNotFound(err) {
+			return err
+		}
+	}
+
+	return errNoSuchKey(key)
+}
+
+func (p *UnionProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	var out *s3.GetObjectOutput
+	err := p.lookup(key, func(layer S3Proxy) (err error) {
+		out, err = layer.Get(key, rangeHeader)
+		return err
+	})
+	return out, err
+}
+
+func (p *UnionProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	var out *s3.HeadObjectOutput
+	err := p.lookup(key, func(layer S3Proxy) (err error) {
+		out, err = layer.Head(key)
+		return err
+	})
+	return out, err
+}
+
+// clearWhiteout removes the whiteout of a key written to the top layer
+func (p *UnionProxy) clearWhiteout(key string) error {
+	if len(p.layers) == 1 {
+		return nil
+	}
+
+	_, err := p.top().Delete(unionWhiteoutPrefix + key)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (p *UnionProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	if err := checkUnionKey(key); err != nil {
+		return nil, err
+	}
+
+	out, err := p.top().Put(key, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.clearWhiteout(key); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (p *UnionProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	if err := checkUnionKey(key); err != nil {
+		return nil, err
+	}
+
+	out, err := p.top().Delete(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lower layers are read-only, so hide the key if one still has it
+	for _, layer := range p.layers[1:] {
+		_, err := layer.Head(key)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := p.top().Put(unionWhiteoutPrefix+key, bytes.NewReader(nil), "application/octet-stream"); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	return out, nil
+}
+
+func (p *UnionProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	if maxKeys <= 0 || maxKeys > defaultMaxKeys {
+		maxKeys = defaultMaxKeys
+	}
+
+	// One iterator per layer, followed by one over the whiteouts that
+	// apply to the listed prefix
+	iters := make([]*listIterator, 0, len(p.layers)+1)
+	for _, layer := range p.layers {
+		iters = append(iters, &listIterator{proxy: layer, prefix: prefix, delimiter: delimiter, pageSize: maxKeys})
+	}
+	whiteouts := &listIterator{proxy: p.top(), prefix: unionWhiteoutPrefix + prefix, strip: unionWhiteoutPrefix, pageSize: maxKeys}
+	iters = append(iters, whiteouts)
+	whiteoutIndex := len(iters) - 1
+
+	m, err := newMergeLister(iters, continuationToken)
+	if err != nil {
+		return nil, err
+	}
+
+	page := newMergedPage(prefix, maxKeys)
+	for page.count() < maxKeys {
+		e, sources, err := m.next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+
+		switch {
+		case strings.HasPrefix(e.key, unionWhiteoutPrefix):
+			// The whiteouts themselves, listed by the top layer
+
+		case sources[0] == 0:
+			page.add(e)
+
+		case sources[0] == whiteoutIndex:
+			// A whiteout with nothing left below it
+
+		case sources[len(sources)-1] == whiteoutIndex && !e.isPrefix:
+			// Deleted from the union
+
+		case e.isPrefix:
+			// A lower layer prefix is only visible if some key below it
+			// has not been deleted
+			next, err := whiteouts.peek()
+			if err != nil {
+				return nil, err
+			}
+			visible := next == nil || !strings.HasPrefix(next.key, e.key)
+			if !visible {
+				if visible, err = p.prefixVisible(e.key, sources); err != nil {
+					return nil, err
+				}
+			}
+			if visible {
+				page.add(e)
+			}
+
+		default:
+			page.add(e)
+		}
+	}
+
+	return page.result(m)
+}
+
+// prefixVisible reports whether a lower layer has a key below prefix that
+// is not whited out
+func (p *UnionProxy) prefixVisible(prefix string, sources []int) (bool, error) {
+	for _, i := range sources {
+		if i == 0 || i >= len(p.layers) {
+			continue
+		}
+
+		keys := &listIterator{proxy: p.layers[i], prefix: prefix, pageSize: defaultMaxKeys}
+		whiteouts := &listIterator{proxy: p.top(), prefix: unionWhiteoutPrefix + prefix, strip: unionWhiteoutPrefix, pageSize: defaultMaxKeys}
+
+		m, _ := newMergeLister([]*listIterator{keys, whiteouts}, "")
+		for {
+			e, from, err := m.next()
+			if err != nil {
+				return false, err
+			}
+			if e == nil {
+				break
+			}
+			if len(from) == 1 && from[0] == 0 {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (p *UnionProxy) CreateMultipartUpload(key string, contentType string) (*s3.CreateMultipartUploadOutput, error) {
+	if err := checkUnionKey(key); err != nil {
+		return nil, err
+	}
+
+	return p.top().CreateMultipartUpload(key, contentType)
+}
+
+func (p *UnionProxy) UploadPart(key string, uploadId string, partNumber int64, body io.ReadSeeker) (*s3.UploadPartOutput, error) {
+	return p.top().UploadPart(key, uploadId, partNumber, body)
+}
+
+func (p *UnionProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	out, err := p.top().CompleteMultipartUpload(key, uploadId, parts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.clearWhiteout(key); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (p *UnionProxy) AbortMultipartUpload(key string, uploadId string) (*s3.AbortMultipartUploadOutput, error) {
+	return p.top().AbortMultipartUpload(key, uploadId)
+}
+
+func (p *UnionProxy) ListMultipartUploads(prefix string, delimiter string, maxUploads int64) (*s3.ListMultipartUploadsOutput, error) {
+	return p.top().ListMultipartUploads(prefix, delimiter, maxUploads)
+}
+
+// GetWebsiteConfig returns the website configuration of the first layer
+// that has one
+func (p *UnionProxy) GetWebsiteConfig() (*s3.GetBucketWebsiteOutput, error) {
+	var err error
+	for _, layer := range p.layers {
+		var out *s3.GetBucketWebsiteOutput
+		if out, err = layer.GetWebsiteConfig(); err == nil {
+			return out, nil
+		}
+	}
+	return nil, err
+}
+
+func (p *UnionProxy) RestoreObject(key string, days int64, tier string) (*s3.RestoreObjectOutput, error) {
+	var out *s3.RestoreObjectOutput
+	err := p.lookup(key, func(layer S3Proxy) error {
+		// Find the layer first so a missing key falls through rather than
+		// failing with the restore error of an earlier layer
+		if _, err := layer.Head(key); err != nil {
+			return err
+		}
+
+		var err error
+		out, err = layer.RestoreObject(key, days, tier)
+		return err
+	})
+	return out, err
+}
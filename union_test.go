@@ -0,0 +1,208 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// newTestUnionProxy layers two memory backends, returning the union and
+// its top and base layers
+func newTestUnionProxy() (*UnionProxy, *MemoryProxy, *MemoryProxy) {
+	top := NewMemoryProxy(0, 0, nil)
+	base := NewMemoryProxy(0, 0, nil)
+	return NewUnionProxy([]S3Proxy{top, base}), top, base
+}
+
+func TestUnionProxy_ReadFallthrough(t *testing.T) {
+	p, top, base := newTestUnionProxy()
+
+	putString(t, base, "shared", "base")
+	putString(t, base, "base-only", "base")
+	putString(t, top, "shared", "top")
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "shared", want: "top"},
+		{key: "base-only", want: "base"},
+	}
+
+	for _, tt := range tests {
+		if got := getString(t, p, tt.key, ""); got != tt.want {
+			t.Errorf("Get(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+
+	if _, err := p.Head("missing"); !isNotFound(err) {
+		t.Errorf("Head() of missing key error = %v, want not found", err)
+	}
+}
+
+func TestUnionProxy_WritesGoToTop(t *testing.T) {
+	p, top, base := newTestUnionProxy()
+
+	putString(t, base, "key", "base")
+	putString(t, p, "key", "union")
+
+	if got := getString(t, top, "key", ""); got != "union" {
+		t.Errorf("top layer has %q, want %q", got, "union")
+	}
+	if got := getString(t, base, "key", ""); got != "base" {
+		t.Errorf("base layer was modified: %q", got)
+	}
+
+	created, err := p.CreateMultipartUpload("multi", "text/plain")
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload() error = %v", err)
+	}
+	part, err := p.UploadPart("multi", aws.StringValue(created.UploadId), 1, strings.NewReader("parts"))
+	if err != nil {
+		t.Fatalf("UploadPart() error = %v", err)
+	}
+	parts := []*s3.CompletedPart{{PartNumber: aws.Int64(1), ETag: part.ETag}}
+	if _, err := p.CompleteMultipartUpload("multi", aws.StringValue(created.UploadId), parts); err != nil {
+		t.Fatalf("CompleteMultipartUpload() error = %v", err)
+	}
+	if _, err := top.Head("multi"); err != nil {
+		t.Errorf("completed upload is not in the top layer: %v", err)
+	}
+
+	if _, err := p.Put(unionWhiteoutPrefix+"key", strings.NewReader(""), "text/plain"); err == nil {
+		t.Error("Put() under the whiteout prefix should fail")
+	}
+}
+
+func TestUnionProxy_DeleteWhiteout(t *testing.T) {
+	p, top, base := newTestUnionProxy()
+
+	putString(t, base, "key", "base")
+	putString(t, p, "key", "top")
+
+	if _, err := p.Delete("key"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := p.Get("key", ""); !isNotFound(err) {
+		t.Errorf("Get() after delete error = %v, want not found", err)
+	}
+	if _, err := base.Head("key"); err != nil {
+		t.Errorf("base layer lost the key: %v", err)
+	}
+	if keys, _ := listAll(t, p, "", "", 0); len(keys) != 0 {
+		t.Errorf("deleted key is still listed: %v", keys)
+	}
+
+	// Writing the key again removes the whiteout
+	putString(t, p, "key", "again")
+	if got := getString(t, p, "key", ""); got != "again" {
+		t.Errorf("Get() after rewrite = %q, want %q", got, "again")
+	}
+	if _, err := top.Head(unionWhiteoutPrefix + "key"); !isNotFound(err) {
+		t.Errorf("whiteout left behind: %v", err)
+	}
+
+	// Keys only in the top layer need no whiteout
+	putString(t, p, "top-only", "top")
+	p.Delete("top-only")
+	if _, err := top.Head(unionWhiteoutPrefix + "top-only"); !isNotFound(err) {
+		t.Errorf("unneeded whiteout written: %v", err)
+	}
+}
+
+func TestUnionProxy_ListObjects(t *testing.T) {
+	p, top, base := newTestUnionProxy()
+
+	for _, key := range []string{"a", "c", "dir/x", "gone/1", "gone/2", "mixed/1", "mixed/2"} {
+		putString(t, base, key, key)
+	}
+	for _, key := range []string{"b", "c", "dir/y", "e"} {
+		putString(t, top, key, key)
+	}
+	for _, key := range []string{"a", "gone/1", "gone/2", "mixed/1"} {
+		if _, err := p.Delete(key); err != nil {
+			t.Fatalf("Delete(%q) error = %v", key, err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		prefix       string
+		delimiter    string
+		maxKeys      int64
+		wantKeys     []string
+		wantPrefixes []string
+	}{
+		{
+			name:     "merged without duplicates",
+			wantKeys: []string{"b", "c", "dir/x", "dir/y", "e", "mixed/2"},
+		},
+		{
+			name:     "merged across small pages",
+			maxKeys:  1,
+			wantKeys: []string{"b", "c", "dir/x", "dir/y", "e", "mixed/2"},
+		},
+		{
+			name:         "fully deleted prefixes are hidden",
+			delimiter:    "/",
+			maxKeys:      2,
+			wantKeys:     []string{"b", "c", "e"},
+			wantPrefixes: []string{"dir/", "mixed/"},
+		},
+		{
+			name:     "prefix",
+			prefix:   "mixed/",
+			wantKeys: []string{"mixed/2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, prefixes := listAll(t, p, tt.prefix, tt.delimiter, tt.maxKeys)
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("keys = %v, want %v", keys, tt.wantKeys)
+			}
+			if !reflect.DeepEqual(prefixes, tt.wantPrefixes) {
+				t.Errorf("prefixes = %v, want %v", prefixes, tt.wantPrefixes)
+			}
+		})
+	}
+
+	if _, err := p.ListObjects("", "", 0, "not-a-token"); err == nil {
+		t.Error("ListObjects() with an invalid token should fail")
+	}
+}
+
+func TestValidateUnionSite(t *testing.T) {
+	tests := []struct {
+		name    string
+		site    Site
+		wantErr bool
+	}{
+		{
+			name: "memory layers",
+			site: Site{Type: "union", Union: &UnionConfig{Layers: []Site{{Type: "memory"}, {Type: "memory"}}}},
+		},
+		{
+			name:    "no layers",
+			site:    Site{Type: "union", Union: &UnionConfig{}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid layer",
+			site:    Site{Type: "union", Union: &UnionConfig{Layers: []Site{{Type: "memory"}, {Type: "filesystem"}}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.site.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
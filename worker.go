@@ -0,0 +1,228 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// backgroundWorker is implemented by proxies running a worker on state kept
+// in a local file or directory, such as replication queues, migration and
+// tiering progress, and write-back staging. Only one worker may use a state
+// at a time, so a configuration reload hands the state over from the
+// previous configuration's worker instead of running two.
+//
+// The workers of a configuration are collected while it is built and start
+// only once every site built, so a configuration that fails to build leaves
+// the running one untouched.
+type backgroundWorker interface {
+	// statePath names the file or directory holding the worker's state
+	statePath() string
+	// load reads the state, including what the previous worker saved
+	load() error
+	Start()
+	Close() error
+}
+
+// workerHandover is implemented by workers whose proxy keeps using the
+// state after Close, as requests to the replaced configuration finish.
+// handOver stops the worker and loads next, to which the proxy then passes
+// those requests.
+type workerHandover interface {
+	handOver(next backgroundWorker) error
+}
+
+// workerDrainer is implemented by workers with work to finish on shutdown
+type workerDrainer interface {
+	drain()
+}
+
+// runningWorkers maps the state of each running worker to it
+var runningWorkers = struct {
+	sync.Mutex
+	m map[string]backgroundWorker
+}{m: make(map[string]backgroundWorker)}
+
+func workerKey(w backgroundWorker) string {
+	key, err := filepath.Abs(w.statePath())
+	if err != nil {
+		return w.statePath()
+	}
+	return key
+}
+
+// workerGroup holds the workers of the backends built for a configuration,
+// and the functions to call once it starts and once it is replaced
+type workerGroup struct {
+	workers []backgroundWorker
+	started []func()
+	stopped []func()
+}
+
+// building collects the workers of the backends created by buildWorkers
+var building struct {
+	sync.Mutex
+	group *workerGroup
+}
+
+// buildMu serializes configuration builds, so each collects its own workers
+var buildMu sync.Mutex
+
+// buildWorkers calls build, collecting the workers of the backends it
+// creates into a group. None of them runs until the group is started.
+func buildWorkers(build func() error) (*workerGroup, error) {
+	buildMu.Lock()
+	defer buildMu.Unlock()
+
+	g := &workerGroup{}
+	building.Lock()
+	building.group = g
+	building.Unlock()
+
+	defer func() {
+		building.Lock()
+		building.group = nil
+		building.Unlock()
+	}()
+
+	if err := build(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// startWorker adds w to the configuration being built, or starts it right
+// away for backends created outside of buildWorkers
+func startWorker(w backgroundWorker) {
+	building.Lock()
+	g := building.group
+	if g != nil {
+		g.workers = append(g.workers, w)
+	}
+	building.Unlock()
+
+	if g == nil {
+		(&workerGroup{workers: []backgroundWorker{w}}).start()
+	}
+}
+
+// onStart calls f once the configuration being built starts, or right away
+// outside of buildWorkers. Sites use it to hand what outlives a
+// configuration, such as a running cache warm-up, to their new backends.
+func onStart(f func()) {
+	building.Lock()
+	g := building.group
+	if g != nil {
+		g.started = append(g.started, f)
+	}
+	building.Unlock()
+
+	if g == nil {
+		f()
+	}
+}
+
+// onStop calls f once the configuration being built is replaced. Outside of
+// buildWorkers, where nothing replaces the configuration, f is never called.
+func onStop(f func()) {
+	building.Lock()
+	defer building.Unlock()
+
+	if g := building.group; g != nil {
+		g.stopped = append(g.stopped, f)
+	}
+}
+
+// start starts the group's workers, each taking its state over from the
+// worker using it. A worker whose state fails to load stays stopped.
+func (g *workerGroup) start() {
+	g.startWorkers()
+	for _, f := range g.started {
+		f()
+	}
+}
+
+func (g *workerGroup) startWorkers() {
+	runningWorkers.Lock()
+	defer runningWorkers.Unlock()
+
+	for _, w := range g.workers {
+		key := workerKey(w)
+		prev := runningWorkers.m[key]
+		if prev == w {
+			continue
+		}
+
+		var err error
+		if h, ok := prev.(workerHandover); ok {
+			err = h.handOver(w)
+		} else {
+			if prev != nil {
+				prev.Close()
+			}
+			err = w.load()
+		}
+		delete(runningWorkers.m, key)
+		if err != nil {
+			log.Printf("loading worker state from %s: %v", key, err)
+			continue
+		}
+
+		runningWorkers.m[key] = w
+		w.Start()
+	}
+}
+
+// stop stops the group's workers once its configuration was replaced.
+// Workers whose state the new configuration took over are already stopped;
+// the others belong to sites that were removed.
+func (g *workerGroup) stop() {
+	if g == nil {
+		return
+	}
+
+	g.stopWorkers()
+	for _, f := range g.stopped {
+		f()
+	}
+}
+
+func (g *workerGroup) stopWorkers() {
+	runningWorkers.Lock()
+	defer runningWorkers.Unlock()
+
+	for _, w := range g.workers {
+		key := workerKey(w)
+		if runningWorkers.m[key] != w {
+			continue
+		}
+		if err := w.Close(); err != nil {
+			log.Printf("stopping worker for %s: %v", key, err)
+		}
+		delete(runningWorkers.m, key)
+	}
+}
+
+// stopWorkers stops every running worker, giving those with work left time
+// to finish it. It is called on shutdown, once no more requests are being
+// served.
+func stopWorkers() {
+	runningWorkers.Lock()
+	defer runningWorkers.Unlock()
+
+	var wg sync.WaitGroup
+	for key, w := range runningWorkers.m {
+		wg.Add(1)
+		go func(w backgroundWorker) {
+			defer wg.Done()
+			if d, ok := w.(workerDrainer); ok {
+				d.drain()
+			}
+			if err := w.Close(); err != nil {
+				log.Printf("stopping worker for %s: %v", workerKey(w), err)
+			}
+		}(w)
+		delete(runningWorkers.m, key)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// recordingWorker counts the lifecycle calls a worker gets
+type recordingWorker struct {
+	path    string
+	loads   int
+	running bool
+	closes  int
+}
+
+func (w *recordingWorker) statePath() string { return w.path }
+func (w *recordingWorker) load() error       { w.loads++; return nil }
+func (w *recordingWorker) Start()            { w.running = true }
+
+func (w *recordingWorker) Close() error {
+	w.running = false
+	w.closes++
+	return nil
+}
+
+func TestStartWorker_TakesOverState(t *testing.T) {
+	dir := t.TempDir()
+	first := &recordingWorker{path: filepath.Join(dir, "state")}
+	other := &recordingWorker{path: filepath.Join(dir, "other")}
+	second := &recordingWorker{path: filepath.Join(dir, ".", "state")}
+
+	for _, w := range []*recordingWorker{first, other, second} {
+		startWorker(w)
+	}
+	t.Cleanup(func() {
+		second.Close()
+		other.Close()
+	})
+
+	if first.running || first.closes != 1 {
+		t.Errorf("first worker running = %v after %d closes, want stopped", first.running, first.closes)
+	}
+	if !second.running || second.loads != 1 {
+		t.Errorf("second worker running = %v after %d loads, want started", second.running, second.loads)
+	}
+	if !other.running {
+		t.Error("worker on another state was stopped")
+	}
+
+	// Starting a running worker again leaves it alone
+	if startWorker(second); second.loads != 1 || second.closes != 0 {
+		t.Errorf("restarting a running worker loaded it %d times and closed it %d times", second.loads, second.closes)
+	}
+}
+
+func TestBuildWorkers(t *testing.T) {
+	dir := t.TempDir()
+	running := &recordingWorker{path: filepath.Join(dir, "state")}
+	startWorker(running)
+	t.Cleanup(func() { running.Close() })
+
+	// A configuration failing to build leaves the running workers alone
+	broken := &recordingWorker{path: running.path}
+	if _, err := buildWorkers(func() error {
+		startWorker(broken)
+		return errors.New("broken site")
+	}); err == nil {
+		t.Fatal("buildWorkers() succeeded")
+	}
+	if !running.running || running.closes != 0 || broken.loads != 0 || broken.running {
+		t.Errorf("running worker closed %d times, broken worker loaded %d times", running.closes, broken.loads)
+	}
+
+	next := &recordingWorker{path: running.path}
+	added := &recordingWorker{path: filepath.Join(dir, "added")}
+	group, err := buildWorkers(func() error {
+		startWorker(next)
+		startWorker(added)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.running || added.running || !running.running {
+		t.Fatal("workers started before the group")
+	}
+
+	group.start()
+	if running.running || !next.running || !added.running {
+		t.Errorf("after start: previous running = %v, next running = %v, added running = %v", running.running, next.running, added.running)
+	}
+
+	// Replacing the configuration with one without the sites stops them
+	empty, _ := buildWorkers(func() error { return nil })
+	empty.start()
+	group.stop()
+	if next.running || added.running {
+		t.Error("workers of removed sites kept running")
+	}
+}
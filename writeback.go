@@ -0,0 +1,1173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultWriteBackRetryInterval = 10 * time.Second
+	defaultWriteBackUploaders     = 4
+	defaultWriteBackDrainTimeout  = time.Minute
+
+	// writeBackCompactRecords is the journal length past which it is
+	// rewritten, once it is mostly records of finished uploads
+	writeBackCompactRecords = 1000
+
+	writeBackPut    = "put"
+	writeBackDelete = "delete"
+	writeBackDone   = "done"
+)
+
+// WriteBackConfig acknowledges PUTs and DELETEs once they are staged in Dir
+// and applies them to the backend in the background, with Uploaders (default
+// 4) uploads at once, retrying failed ones every RetryInterval (default
+// "10s"). Staged keys are read from Dir until their upload completes.
+//
+// Writes that would take the staged data past MaxSize bytes go straight to
+// the backend. On shutdown the proxy waits up to DrainTimeout (default "1m")
+// for staged writes to upload; the rest are uploaded on the next start. Each
+// site needs a Dir of its own.
+type WriteBackConfig struct {
+	Dir           string `json:"dir" yaml:"dir"`
+	MaxSize       int64  `json:"maxSize" yaml:"maxSize"`
+	RetryInterval string `json:"retryInterval,omitempty" yaml:"retryInterval,omitempty"`
+	Uploaders     int    `json:"uploaders,omitempty" yaml:"uploaders,omitempty"`
+	DrainTimeout  string `json:"drainTimeout,omitempty" yaml:"drainTimeout,omitempty"`
+}
+
+func (c *WriteBackConfig) validate() error {
+	if c.Dir == "" {
+		return errors.New("Write-back dir not specified")
+	}
+	if c.MaxSize <= 0 {
+		return errors.New("Write-back maxSize must be positive")
+	}
+	if c.Uploaders < 0 {
+		return errors.New("Write-back uploaders must not be negative")
+	}
+
+	if c.RetryInterval != "" {
+		if d, err := time.ParseDuration(c.RetryInterval); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid write-back retryInterval %q", c.RetryInterval)
+		}
+	}
+	if c.DrainTimeout != "" {
+		if d, err := time.ParseDuration(c.DrainTimeout); err != nil || d < 0 {
+			return fmt.Errorf("Invalid write-back drainTimeout %q", c.DrainTimeout)
+		}
+	}
+
+	return nil
+}
+
+// newWriteBackBackend stages a site's writes in its write-back directory
+func newWriteBackBackend(backend S3Proxy, cfg WriteBackConfig) (S3Proxy, error) {
+	retryInterval := defaultWriteBackRetryInterval
+	if cfg.RetryInterval != "" {
+		retryInterval, _ = time.ParseDuration(cfg.RetryInterval)
+	}
+	drainTimeout := defaultWriteBackDrainTimeout
+	if cfg.DrainTimeout != "" {
+		drainTimeout, _ = time.ParseDuration(cfg.DrainTimeout)
+	}
+
+	p, err := NewWriteBackProxy(backend, cfg.Dir, cfg.MaxSize, retryInterval, cfg.Uploaders)
+	if err != nil {
+		return nil, err
+	}
+	p.drainTimeout = drainTimeout
+
+	startWorker(p)
+	return p, nil
+}
+
+// writeBackRecord is a line of the journal. Put and delete records stage a
+// write of Key, and a done record marks the write with the same Seq as
+// applied to the backend. The latest staged write of a key wins.
+type writeBackRecord struct {
+	Seq         int64     `json:"seq"`
+	Op          string    `json:"op"`
+	Key         string    `json:"key"`
+	File        string    `json:"file,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	ETag        string    `json:"etag,omitempty"`
+	Staged      time.Time `json:"staged,omitempty"`
+}
+
+// WriteBackProxy stages writes on local disk and uploads them to the
+// backend asynchronously. A write is acknowledged once its body and its
+// journal record are synced to disk, so it survives a crash and is uploaded
+// after a restart.
+//
+// Only the latest write of a key is uploaded, and uploads of a key never
+// run concurrently, so the backend sees writes in order. Multipart uploads
+// and create-only PUTs go to the backend directly.
+type WriteBackProxy struct {
+	S3Proxy
+	dir           string
+	maxSize       int64
+	retryInterval time.Duration
+	uploaders     int
+	drainTimeout  time.Duration
+
+	// locks serializes uploads with writes going straight to the backend.
+	// It is shared with the proxy the staging directory is handed over to.
+	locks *keyLocks
+
+	mu        sync.Mutex
+	journal   *os.File // nil until load and after Close
+	records   int      // lines in the journal
+	length    int64    // bytes in the journal
+	seq       int64
+	staged    map[string]*writeBackRecord
+	uploading map[string]*writeBackRecord
+	size      int64 // bytes staged or reserved for writes being staged
+	// next is the proxy of a reloaded configuration the staging directory
+	// was handed over to; requests still reaching this proxy go to it
+	next *WriteBackProxy
+
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewWriteBackProxy creates a write-back proxy staging writes in dir. It
+// stages nothing until load has replayed the journal, and uploads once
+// Start has been called.
+func NewWriteBackProxy(backend S3Proxy, dir string, maxSize int64, retryInterval time.Duration, uploaders int) (*WriteBackProxy, error) {
+	if retryInterval <= 0 {
+		retryInterval = defaultWriteBackRetryInterval
+	}
+	if uploaders <= 0 {
+		uploaders = defaultWriteBackUploaders
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "data"), 0755); err != nil {
+		return nil, err
+	}
+
+	return &WriteBackProxy{
+		S3Proxy:       backend,
+		dir:           dir,
+		maxSize:       maxSize,
+		retryInterval: retryInterval,
+		uploaders:     uploaders,
+		drainTimeout:  defaultWriteBackDrainTimeout,
+		locks:         &keyLocks{},
+		staged:        make(map[string]*writeBackRecord),
+		uploading:     make(map[string]*writeBackRecord),
+		wake:          make(chan struct{}, 1),
+	}, nil
+}
+
+func (p *WriteBackProxy) statePath() string {
+	return p.dir
+}
+
+func (p *WriteBackProxy) journalPath() string {
+	return filepath.Join(p.dir, "journal")
+}
+
+func (p *WriteBackProxy) dataPath(file string) string {
+	return filepath.Join(p.dir, "data", file)
+}
+
+// load replays the journal, drops staged writes whose body is missing and
+// files no staged write refers to, and opens the journal for appending
+func (p *WriteBackProxy) load() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	staged := make(map[string]*writeBackRecord)
+	var seq int64
+
+	f, err := os.Open(p.journalPath())
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var rec writeBackRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				// A record torn by a crash while it was being appended,
+				// which was never acknowledged
+				log.Printf("write-back: skipping invalid journal record in %s: %v", p.dir, err)
+				continue
+			}
+			if rec.Seq > seq {
+				seq = rec.Seq
+			}
+
+			current := staged[rec.Key]
+			switch rec.Op {
+			case writeBackPut, writeBackDelete:
+				if current == nil || rec.Seq > current.Seq {
+					r := rec
+					staged[rec.Key] = &r
+				}
+			case writeBackDone:
+				if current != nil && current.Seq == rec.Seq {
+					delete(staged, rec.Key)
+				}
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	files := make(map[string]bool)
+	var size int64
+	for key, rec := range staged {
+		if rec.Op != writeBackPut {
+			continue
+		}
+		info, err := os.Stat(p.dataPath(rec.File))
+		if err != nil || info.Size() != rec.Size {
+			log.Printf("write-back: dropping staged write of %s: body missing from %s", key, p.dir)
+			delete(staged, key)
+			continue
+		}
+		files[rec.File] = true
+		size += rec.Size
+	}
+
+	entries, err := os.ReadDir(filepath.Join(p.dir, "data"))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !files[e.Name()] {
+			os.Remove(p.dataPath(e.Name()))
+		}
+	}
+
+	p.staged = staged
+	p.seq = seq
+	p.size = size
+	return p.compactLocked()
+}
+
+// compactLocked rewrites the journal with the records of the staged writes
+// only, and reopens it for appending
+func (p *WriteBackProxy) compactLocked() error {
+	var buf bytes.Buffer
+	for _, rec := range p.staged {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	tmp, err := os.CreateTemp(p.dir, ".journal-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p.journalPath()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := syncDir(p.dir); err != nil {
+		return err
+	}
+
+	journal, err := os.OpenFile(p.journalPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if p.journal != nil {
+		p.journal.Close()
+	}
+	p.journal = journal
+	p.records = len(p.staged)
+	p.length = int64(buf.Len())
+	return nil
+}
+
+// appendLocked adds a record to the journal and syncs it
+func (p *WriteBackProxy) appendLocked(rec *writeBackRecord) error {
+	if p.journal == nil {
+		return errWriteBackClosed
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := p.journal.Write(data); err == nil {
+		err = p.journal.Sync()
+	}
+	if err != nil {
+		// Cut off a partly written record, so it cannot run into the next
+		p.journal.Truncate(p.length)
+		return err
+	}
+
+	p.records++
+	p.length += int64(len(data))
+	return nil
+}
+
+var errWriteBackClosed = errors.New("write-back staging is closed")
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Start runs the worker uploading staged writes until Close
+func (p *WriteBackProxy) Start() {
+	if p.stop != nil {
+		return
+	}
+
+	p.stop = make(chan struct{})
+	p.wg.Add(1)
+	go p.run(p.stop)
+}
+
+// Close stops the upload worker and closes the journal. Staged writes stay
+// on disk; writes made through the proxy afterwards go to the backend.
+func (p *WriteBackProxy) Close() error {
+	p.stopWorker()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.journal != nil {
+		p.journal.Close()
+		p.journal = nil
+	}
+	return nil
+}
+
+func (p *WriteBackProxy) stopWorker() {
+	if p.stop != nil {
+		close(p.stop)
+		p.wg.Wait()
+		p.stop = nil
+	}
+}
+
+// handOver passes the staging directory to the proxy of a reloaded
+// configuration. Writes are held while it replays the journal, so it sees
+// every write staged here, and go to it afterwards.
+func (p *WriteBackProxy) handOver(w backgroundWorker) error {
+	next, ok := w.(*WriteBackProxy)
+	if !ok {
+		p.Close()
+		return w.load()
+	}
+
+	p.stopWorker()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.journal != nil {
+		p.journal.Close()
+		p.journal = nil
+	}
+
+	// Writes sent to the backend directly from here keep excluding uploads
+	// of the same key, and stay ordered after the writes staged here
+	next.locks = p.locks
+	if err := next.load(); err != nil {
+		return err
+	}
+	next.mu.Lock()
+	if next.seq < p.seq {
+		next.seq = p.seq
+	}
+	next.mu.Unlock()
+
+	p.next = next
+	return nil
+}
+
+// successor returns the proxy the staging directory was handed over to
+func (p *WriteBackProxy) successor() *WriteBackProxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.next
+}
+
+func (p *WriteBackProxy) run(stop chan struct{}) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		p.upload(stop)
+
+		select {
+		case <-stop:
+			return
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *WriteBackProxy) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// drain gives the staged writes the drain timeout to upload on shutdown
+func (p *WriteBackProxy) drain() {
+	if n := p.Drain(p.drainTimeout); n > 0 {
+		log.Printf("write-back: %d writes still staged in %s, uploading them on the next start", n, p.dir)
+	}
+}
+
+// pending returns the number of staged writes not uploaded yet
+func (p *WriteBackProxy) pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.staged)
+}
+
+// Drain waits up to timeout for the staged writes to be uploaded, and
+// returns the number still staged
+func (p *WriteBackProxy) Drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		n := p.pending()
+		if n == 0 || !time.Now().Before(deadline) {
+			return n
+		}
+
+		// Retry failed uploads without waiting for the next interval
+		p.notify()
+
+		wait := time.Until(deadline)
+		if wait > 100*time.Millisecond {
+			wait = 100 * time.Millisecond
+		}
+		time.Sleep(wait)
+	}
+}
+
+// upload applies the staged writes to the backend, oldest first
+func (p *WriteBackProxy) upload(stop chan struct{}) {
+	p.mu.Lock()
+	recs := make([]*writeBackRecord, 0, len(p.staged))
+	for key, rec := range p.staged {
+		if p.uploading[key] == nil {
+			recs = append(recs, rec)
+		}
+	}
+	p.mu.Unlock()
+
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Seq < recs[j].Seq
+	})
+
+	queue := make(chan *writeBackRecord)
+	var wg sync.WaitGroup
+	for i := 0; i < p.uploaders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rec := range queue {
+				if err := p.uploadOne(rec); err != nil {
+					log.Printf("write-back: uploading %s: %v", rec.Key, err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, rec := range recs {
+		select {
+		case <-stop:
+			break feed
+		case queue <- rec:
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// uploadOne applies a staged write to the backend, unless a newer write of
+// the key replaced it in the meantime
+func (p *WriteBackProxy) uploadOne(rec *writeBackRecord) error {
+	unlock := p.locks.lock(rec.Key)
+	defer unlock()
+
+	p.mu.Lock()
+	if p.staged[rec.Key] != rec || p.uploading[rec.Key] != nil {
+		p.mu.Unlock()
+		return nil
+	}
+	p.uploading[rec.Key] = rec
+	p.mu.Unlock()
+
+	err := p.apply(rec)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.uploading, rec.Key)
+	if p.staged[rec.Key] != rec {
+		// Replaced while uploading; the newer write is uploaded next
+		p.releaseLocked(rec)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	delete(p.staged, rec.Key)
+	p.releaseLocked(rec)
+	if err := p.appendLocked(&writeBackRecord{Seq: rec.Seq, Op: writeBackDone, Key: rec.Key}); err != nil {
+		log.Printf("write-back: recording upload of %s: %v", rec.Key, err)
+	}
+
+	if p.journal != nil && p.records > writeBackCompactRecords && p.records > 4*len(p.staged) {
+		if err := p.compactLocked(); err != nil {
+			log.Printf("write-back: compacting journal in %s: %v", p.dir, err)
+		}
+	}
+	return nil
+}
+
+// apply performs a staged write on the backend
+func (p *WriteBackProxy) apply(rec *writeBackRecord) error {
+	if rec.Op == writeBackDelete {
+		_, err := p.S3Proxy.Delete(rec.Key)
+		if isNotFound(err) {
+			err = nil
+		}
+		return err
+	}
+
+	f, err := os.Open(p.dataPath(rec.File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if sp, ok := p.S3Proxy.(StreamPutter); ok {
+		_, err = sp.PutStream(rec.Key, f, rec.Size, rec.ContentType)
+	} else {
+		_, err = p.S3Proxy.Put(rec.Key, f, rec.ContentType)
+	}
+	return err
+}
+
+// releaseLocked frees the space of a staged write that is no longer needed
+func (p *WriteBackProxy) releaseLocked(rec *writeBackRecord) {
+	if rec.Op == writeBackPut {
+		os.Remove(p.dataPath(rec.File))
+		p.size -= rec.Size
+	}
+}
+
+// reserve claims n bytes of staging space, reporting false if they do not fit
+func (p *WriteBackProxy) reserve(n int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.journal == nil || p.size+n > p.maxSize {
+		return false
+	}
+	p.size += n
+	return true
+}
+
+func (p *WriteBackProxy) unreserve(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.size -= n
+}
+
+// nextSeq orders a write among the staged writes
+func (p *WriteBackProxy) nextSeq() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.next != nil {
+		return p.next.nextSeq()
+	}
+	p.seq++
+	return p.seq
+}
+
+// commit journals a staged write and makes it the key's current one, unless
+// a newer write was staged meanwhile
+func (p *WriteBackProxy) commit(rec *writeBackRecord) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.appendLocked(rec); err != nil {
+		return err
+	}
+
+	current := p.staged[rec.Key]
+	if current != nil && current.Seq > rec.Seq {
+		p.releaseLocked(rec)
+		return nil
+	}
+	if current != nil && p.uploading[rec.Key] != current {
+		p.releaseLocked(current)
+	}
+	p.staged[rec.Key] = rec
+
+	p.notify()
+	return nil
+}
+
+// superseded drops the staged writes of key older than seq, once a write
+// with that seq went to the backend directly. The caller holds the key's
+// lock, so none of them is uploading.
+func (p *WriteBackProxy) superseded(key string, seq int64) {
+	if next := p.successor(); next != nil {
+		next.superseded(key, seq)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := p.staged[key]
+	if current == nil || current.Seq > seq {
+		return
+	}
+
+	delete(p.staged, key)
+	p.releaseLocked(current)
+	if err := p.appendLocked(&writeBackRecord{Seq: current.Seq, Op: writeBackDone, Key: key}); err != nil {
+		log.Printf("write-back: recording write of %s: %v", key, err)
+	}
+}
+
+// writeThrough stores a body on the backend directly, for writes that do
+// not fit in the staging space
+func (p *WriteBackProxy) writeThrough(key string, body io.Reader, size int64, contentType string) (*s3.PutObjectOutput, error) {
+	seq := p.nextSeq()
+
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	var out *s3.PutObjectOutput
+	var err error
+	if sp, ok := p.S3Proxy.(StreamPutter); ok {
+		out, err = sp.PutStream(key, body, size, contentType)
+	} else {
+		var spool *os.File
+		if spool, err = spoolBody(body); err != nil {
+			return nil, errIncompleteBody()
+		}
+		defer removeSpool(spool)
+		out, err = p.S3Proxy.Put(key, spool, contentType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.superseded(key, seq)
+	return out, nil
+}
+
+// PutStream stages a body of size bytes, or of unknown size if it is -1
+func (p *WriteBackProxy) PutStream(key string, body io.Reader, size int64, contentType string) (*s3.PutObjectOutput, error) {
+	if next := p.successor(); next != nil {
+		return next.PutStream(key, body, size, contentType)
+	}
+
+	if size >= 0 && !p.reserve(size) {
+		return p.writeThrough(key, body, size, contentType)
+	}
+	reserved := size
+	if size < 0 {
+		reserved = 0
+	}
+
+	f, err := os.CreateTemp(filepath.Join(p.dir, "data"), "obj-*")
+	if err != nil {
+		p.unreserve(reserved)
+		return nil, err
+	}
+	discard := func() {
+		f.Close()
+		os.Remove(f.Name())
+		p.unreserve(reserved)
+	}
+
+	h := md5.New()
+	buf := make([]byte, 256<<10)
+	var written int64
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if size < 0 && !p.reserve(int64(n)) {
+				// The body outgrew the staging space; send what was staged
+				// so far and the rest to the backend
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					discard()
+					return nil, err
+				}
+				defer discard()
+				return p.writeThrough(key, io.MultiReader(f, bytes.NewReader(buf[:n]), body), -1, contentType)
+			}
+			if size < 0 {
+				reserved += int64(n)
+			}
+
+			written += int64(n)
+			if size >= 0 && written > size {
+				discard()
+				return nil, errIncompleteBody()
+			}
+			if _, err := f.Write(buf[:n]); err != nil {
+				discard()
+				return nil, err
+			}
+			h.Write(buf[:n])
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			discard()
+			return nil, errIncompleteBody()
+		}
+	}
+	if size >= 0 && written != size {
+		discard()
+		return nil, errIncompleteBody()
+	}
+
+	if err := f.Sync(); err != nil {
+		discard()
+		return nil, err
+	}
+	if err := syncDir(filepath.Join(p.dir, "data")); err != nil {
+		discard()
+		return nil, err
+	}
+
+	etag := quoteETag(h.Sum(nil))
+	rec := &writeBackRecord{
+		Seq:         p.nextSeq(),
+		Op:          writeBackPut,
+		Key:         key,
+		File:        filepath.Base(f.Name()),
+		Size:        written,
+		ContentType: contentType,
+		ETag:        etag,
+		Staged:      time.Now().UTC(),
+	}
+	if err := p.commit(rec); err != nil {
+		if err != errWriteBackClosed {
+			discard()
+			return nil, err
+		}
+
+		// Handed over or closed by a configuration reload while the body
+		// was staged
+		defer discard()
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if next := p.successor(); next != nil {
+			return next.PutStream(key, f, written, contentType)
+		}
+		return p.writeThrough(key, f, written, contentType)
+	}
+	f.Close()
+
+	return &s3.PutObjectOutput{ETag: aws.String(etag)}, nil
+}
+
+func (p *WriteBackProxy) Put(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return p.PutStream(key, body, size, contentType)
+}
+
+func (p *WriteBackProxy) Delete(key string) (*s3.DeleteObjectOutput, error) {
+	rec := &writeBackRecord{Seq: p.nextSeq(), Op: writeBackDelete, Key: key, Staged: time.Now().UTC()}
+	if err := p.commit(rec); err != nil {
+		if err != errWriteBackClosed {
+			return nil, err
+		}
+		if next := p.successor(); next != nil {
+			return next.Delete(key)
+		}
+
+		unlock := p.locks.lock(key)
+		defer unlock()
+		return p.S3Proxy.Delete(key)
+	}
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// open returns the staged write of key, with its body opened for puts. It
+// returns nil if key has no staged write.
+func (p *WriteBackProxy) open(key string) (*writeBackRecord, *os.File, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rec := p.staged[key]
+	if rec == nil || p.journal == nil {
+		return nil, nil, nil
+	}
+	if rec.Op == writeBackDelete {
+		return nil, nil, errNoSuchKey(key)
+	}
+
+	f, err := os.Open(p.dataPath(rec.File))
+	if err != nil {
+		return nil, nil, err
+	}
+	return rec, f, nil
+}
+
+func (p *WriteBackProxy) Get(key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	rec, f, err := p.open(key)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		if next := p.successor(); next != nil {
+			return next.Get(key, rangeHeader)
+		}
+		return p.S3Proxy.Get(key, rangeHeader)
+	}
+
+	out := &s3.GetObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: aws.Int64(rec.Size),
+		ContentType:   aws.String(rec.ContentType),
+		ETag:          aws.String(rec.ETag),
+		LastModified:  aws.Time(rec.Staged),
+		Body:          f,
+	}
+
+	if rangeHeader != "" {
+		start, end, err := parseByteRange(rangeHeader, rec.Size)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		out.ContentLength = aws.Int64(end - start + 1)
+		out.ContentRange = aws.String(contentRange(start, end, rec.Size))
+		out.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(f, start, end-start+1), f}
+	}
+
+	return out, nil
+}
+
+// GetForClient keeps the backend's per-client reads, such as read-ahead,
+// for keys that are not staged
+func (p *WriteBackProxy) GetForClient(client string, key string, rangeHeader string) (*s3.GetObjectOutput, error) {
+	rec, f, err := p.open(key)
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil {
+		f.Close()
+		return p.Get(key, rangeHeader)
+	}
+	if next := p.successor(); next != nil {
+		return next.GetForClient(client, key, rangeHeader)
+	}
+
+	if cg, ok := p.S3Proxy.(ClientGetter); ok {
+		return cg.GetForClient(client, key, rangeHeader)
+	}
+	return p.S3Proxy.Get(key, rangeHeader)
+}
+
+func (p *WriteBackProxy) Head(key string) (*s3.HeadObjectOutput, error) {
+	rec, f, err := p.open(key)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		if next := p.successor(); next != nil {
+			return next.Head(key)
+		}
+		return p.S3Proxy.Head(key)
+	}
+	f.Close()
+
+	return &s3.HeadObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: aws.Int64(rec.Size),
+		ContentType:   aws.String(rec.ContentType),
+		ETag:          aws.String(rec.ETag),
+		LastModified:  aws.Time(rec.Staged),
+	}, nil
+}
+
+// writeBackListing lists the staged writes of one kind, so they can be
+// merged with the backend's listing
+type writeBackListing struct {
+	S3Proxy
+	p  *WriteBackProxy
+	op string
+}
+
+func (l writeBackListing) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	lister, err := newKeyLister(prefix, delimiter, maxKeys, continuationToken)
+	if err != nil {
+		return nil, err
+	}
+
+	l.p.mu.Lock()
+	var recs []*writeBackRecord
+	if l.p.journal != nil {
+		for key, rec := range l.p.staged {
+			if rec.Op == l.op && strings.HasPrefix(key, prefix) {
+				recs = append(recs, rec)
+			}
+		}
+	}
+	l.p.mu.Unlock()
+
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Key < recs[j].Key
+	})
+
+	for _, rec := range recs {
+		if !lister.add(&s3.Object{
+			Key:          aws.String(rec.Key),
+			ETag:         aws.String(rec.ETag),
+			Size:         aws.Int64(rec.Size),
+			LastModified: aws.Time(rec.Staged),
+			StorageClass: aws.String(s3.StorageClassStandard),
+		}) {
+			break
+		}
+	}
+
+	out := lister.result()
+	out.Prefix = aws.String(prefix)
+	return out, nil
+}
+
+// ListObjects merges the staged writes into the backend's listing: staged
+// objects replace the backend's, and staged deletes hide them
+func (p *WriteBackProxy) ListObjects(prefix string, delimiter string, maxKeys int64, continuationToken string) (*s3.ListObjectsV2Output, error) {
+	if next := p.successor(); next != nil {
+		return next.ListObjects(prefix, delimiter, maxKeys, continuationToken)
+	}
+
+	if maxKeys <= 0 || maxKeys > defaultMaxKeys {
+		maxKeys = defaultMaxKeys
+	}
+
+	staged := &listIterator{proxy: writeBackListing{p: p, op: writeBackPut}, prefix: prefix, delimiter: delimiter, pageSize: maxKeys}
+	backend := &listIterator{proxy: p.S3Proxy, prefix: prefix, delimiter: delimiter, pageSize: maxKeys}
+	deletes := &listIterator{proxy: writeBackListing{p: p, op: writeBackDelete}, prefix: prefix, pageSize: maxKeys}
+
+	m, err := newMergeLister([]*listIterator{staged, backend, deletes}, continuationToken)
+	if err != nil {
+		return nil, err
+	}
+
+	page := newMergedPage(prefix, maxKeys)
+	for page.count() < maxKeys {
+		e, sources, err := m.next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+
+		switch {
+		case sources[0] == 0:
+			// Staged, or a prefix with staged keys below it
+			page.add(e)
+
+		case sources[0] == 2:
+			// A staged delete of a key the backend does not have
+
+		case sources[len(sources)-1] == 2 && !e.isPrefix:
+			// Deleted, but not from the backend yet
+
+		case e.isPrefix:
+			// A backend prefix is only visible if some key below it has not
+			// been deleted
+			next, err := deletes.peek()
+			if err != nil {
+				return nil, err
+			}
+			visible := next == nil || !strings.HasPrefix(next.key, e.key)
+			if !visible {
+				if visible, err = p.prefixVisible(e.key); err != nil {
+					return nil, err
+				}
+			}
+			if visible {
+				page.add(e)
+			}
+
+		default:
+			page.add(e)
+		}
+	}
+
+	return page.result(m)
+}
+
+// prefixVisible reports whether the backend has a key below prefix without
+// a staged delete
+func (p *WriteBackProxy) prefixVisible(prefix string) (bool, error) {
+	keys := &listIterator{proxy: p.S3Proxy, prefix: prefix, pageSize: defaultMaxKeys}
+	deletes := &listIterator{proxy: writeBackListing{p: p, op: writeBackDelete}, prefix: prefix, pageSize: defaultMaxKeys}
+
+	m, _ := newMergeLister([]*listIterator{keys, deletes}, "")
+	for {
+		e, from, err := m.next()
+		if err != nil {
+			return false, err
+		}
+		if e == nil {
+			return false, nil
+		}
+		if len(from) == 1 && from[0] == 0 {
+			return true, nil
+		}
+	}
+}
+
+// CompleteMultipartUpload writes the object to the backend directly, so it
+// replaces any staged write of the key
+func (p *WriteBackProxy) CompleteMultipartUpload(key string, uploadId string, parts []*s3.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	if next := p.successor(); next != nil {
+		return next.CompleteMultipartUpload(key, uploadId, parts)
+	}
+
+	seq := p.nextSeq()
+
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	out, err := p.S3Proxy.CompleteMultipartUpload(key, uploadId, parts)
+	if err != nil {
+		return nil, err
+	}
+
+	p.superseded(key, seq)
+	return out, nil
+}
+
+// PutIfAbsent creates the object on the backend directly, so the backend's
+// atomic create decides between concurrent writers. Keys with a staged
+// object already exist.
+func (p *WriteBackProxy) PutIfAbsent(key string, body io.ReadSeeker, contentType string) (*s3.PutObjectOutput, error) {
+	if next := p.successor(); next != nil {
+		return next.PutIfAbsent(key, body, contentType)
+	}
+
+	seq := p.nextSeq()
+
+	unlock := p.locks.lock(key)
+	defer unlock()
+
+	p.mu.Lock()
+	rec := p.staged[key]
+	p.mu.Unlock()
+
+	if rec != nil && rec.Op == writeBackPut {
+		return nil, errPreconditionFailed()
+	}
+	if rec != nil {
+		// Apply the staged delete first, so the create sees the key gone
+		if _, err := p.S3Proxy.Delete(key); err != nil && !isNotFound(err) {
+			return nil, err
+		}
+	}
+
+	var out *s3.PutObjectOutput
+	var err error
+	if cp, ok := p.S3Proxy.(ConditionalPutter); ok {
+		out, err = cp.PutIfAbsent(key, body, contentType)
+	} else {
+		out, err = p.S3Proxy.Put(key, body, contentType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.superseded(key, seq)
+	return out, nil
+}
+
+// PurgeCache purges the caches behind the proxy. Staged writes are not
+// copies of backend objects, so they stay.
+func (p *WriteBackProxy) PurgeCache(key string, prefix bool) int {
+	return purgeCache(p.S3Proxy, key, prefix)
+}
+
+// HasCache reports whether there is a cache behind the proxy
+func (p *WriteBackProxy) HasCache() bool {
+	return hasCache(p.S3Proxy)
+}
+
+// MigrationStatus reports the migration of the backend behind the proxy
+func (p *WriteBackProxy) MigrationStatus() (MigrationStatus, bool) {
+	return migrationStatus(p.S3Proxy)
+}
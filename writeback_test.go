@@ -0,0 +1,253 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestWriteBackProxy stages writes for backend in a temporary directory,
+// with the upload worker running when start is set
+func newTestWriteBackProxy(t *testing.T, backend S3Proxy, dir string, maxSize int64, start bool) *WriteBackProxy {
+	t.Helper()
+
+	p, err := NewWriteBackProxy(backend, dir, maxSize, 20*time.Millisecond, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	if start {
+		p.Start()
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestWriteBackProxy_ServesStagedWrites(t *testing.T) {
+	backend := newFakeProxy()
+	putString(t, backend, "dir/old", "old")
+	putString(t, backend, "dir/gone", "gone")
+	putString(t, backend, "other/gone", "gone")
+
+	// Without the upload worker the writes stay staged
+	p := newTestWriteBackProxy(t, backend, t.TempDir(), 1<<20, false)
+
+	putString(t, p, "dir/new", "new content")
+	putString(t, p, "dir/old", "replaced")
+	if _, err := p.Delete("dir/gone"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Delete("other/gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := getString(t, p, "dir/new", ""); got != "new content" {
+		t.Errorf("Get(dir/new) = %q", got)
+	}
+	if got := getString(t, p, "dir/new", "bytes=4-"); got != "content" {
+		t.Errorf("Get(dir/new, bytes=4-) = %q", got)
+	}
+	if got := getString(t, p, "dir/old", ""); got != "replaced" {
+		t.Errorf("Get(dir/old) = %q", got)
+	}
+	if _, err := p.Head("dir/gone"); !isNotFound(err) {
+		t.Errorf("Head(dir/gone) error = %v, want not found", err)
+	}
+
+	keys, _ := listAll(t, p, "", "", 1)
+	if want := []string{"dir/new", "dir/old"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+	_, prefixes := listAll(t, p, "", "/", 0)
+	if want := []string{"dir/"}; !reflect.DeepEqual(prefixes, want) {
+		t.Errorf("prefixes = %v, want %v", prefixes, want)
+	}
+
+	if got := getString(t, backend, "dir/old", ""); got != "old" {
+		t.Errorf("backend has dir/old = %q before the upload", got)
+	}
+}
+
+func TestWriteBackProxy_UploadsWhenBackendRecovers(t *testing.T) {
+	backend := newFakeProxy()
+	putString(t, backend, "gone", "gone")
+	backend.setDown(true)
+
+	p := newTestWriteBackProxy(t, backend, t.TempDir(), 1<<20, true)
+	putString(t, p, "key", "first")
+	putString(t, p, "key", "second")
+	if _, err := p.Delete("gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.setDown(false)
+	waitFor(t, "staged writes to upload", func() bool { return p.pending() == 0 })
+
+	if got := getString(t, backend, "key", ""); got != "second" {
+		t.Errorf("backend has key = %q", got)
+	}
+	if _, err := backend.Head("gone"); !isNotFound(err) {
+		t.Errorf("Head(gone) error = %v, want not found", err)
+	}
+
+	files, _ := os.ReadDir(filepath.Join(p.dir, "data"))
+	if len(files) != 0 || p.size != 0 {
+		t.Errorf("%d files and %d bytes left staged", len(files), p.size)
+	}
+}
+
+func TestWriteBackProxy_ReplaysJournal(t *testing.T) {
+	backend := newFakeProxy()
+	backend.setDown(true)
+	dir := t.TempDir()
+
+	p := newTestWriteBackProxy(t, backend, dir, 1<<20, false)
+	putString(t, p, "a", "first")
+	putString(t, p, "a", "second")
+	putString(t, p, "b", "staged")
+	if _, err := p.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	// A crash while appending leaves a torn record, and one while staging
+	// leaves a body no record refers to
+	journal, err := os.OpenFile(filepath.Join(dir, "journal"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.WriteString(`{"seq":9,"op":"put","key":"c","fi`)
+	journal.Close()
+	os.WriteFile(filepath.Join(dir, "data", "obj-orphan"), []byte("orphan"), 0644)
+
+	backend.setDown(false)
+	p = newTestWriteBackProxy(t, backend, dir, 1<<20, false)
+	if got := getString(t, p, "a", ""); got != "second" {
+		t.Errorf("Get(a) = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data", "obj-orphan")); !os.IsNotExist(err) {
+		t.Errorf("orphaned body was kept: %v", err)
+	}
+
+	if n := p.Drain(0); n != 2 {
+		t.Errorf("%d writes staged, want 2", n)
+	}
+	p.Start()
+	if n := p.Drain(5 * time.Second); n != 0 {
+		t.Fatalf("%d writes left after draining", n)
+	}
+	if got := getString(t, backend, "a", ""); got != "second" {
+		t.Errorf("backend has a = %q", got)
+	}
+}
+
+func TestWriteBackProxy_WritesThroughWhenFull(t *testing.T) {
+	backend := newFakeProxy()
+	p := newTestWriteBackProxy(t, backend, t.TempDir(), 10, false)
+
+	putString(t, p, "small", "staged")
+	putString(t, p, "large", "too large to stage")
+	putString(t, p, "small", "also too large")
+
+	if got := getString(t, backend, "large", ""); got != "too large to stage" {
+		t.Errorf("backend has large = %q", got)
+	}
+	// The write going to the backend replaces the staged one
+	if got := getString(t, p, "small", ""); got != "also too large" {
+		t.Errorf("Get(small) = %q", got)
+	}
+	if n := p.pending(); n != 0 || p.size != 0 {
+		t.Errorf("%d writes and %d bytes staged, want none", n, p.size)
+	}
+
+	backend.setDown(true)
+	if _, err := p.PutStream("large", strings.NewReader("too large to stage"), -1, "text/plain"); err == nil {
+		t.Error("PutStream() of a body too large to stage succeeded with the backend down")
+	}
+}
+
+func TestWriteBackProxy_PutIfAbsent(t *testing.T) {
+	backend := newFakeProxy()
+	p := newTestWriteBackProxy(t, backend, t.TempDir(), 1<<20, false)
+
+	putString(t, p, "staged", "content")
+	if _, err := p.PutIfAbsent("staged", strings.NewReader("other"), "text/plain"); err == nil {
+		t.Error("PutIfAbsent() of a staged key succeeded")
+	}
+
+	putString(t, backend, "deleted", "content")
+	if _, err := p.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.PutIfAbsent("deleted", strings.NewReader("created"), "text/plain"); err != nil {
+		t.Fatalf("PutIfAbsent() of a deleted key error = %v", err)
+	}
+	if got := getString(t, p, "deleted", ""); got != "created" || p.pending() != 1 {
+		t.Errorf("Get(deleted) = %q with %d writes staged", got, p.pending())
+	}
+}
+
+func TestWriteBackProxy_HandOver(t *testing.T) {
+	backend := newFakeProxy()
+	dir := t.TempDir()
+	previous := newTestWriteBackProxy(t, backend, dir, 1<<20, false)
+	putString(t, previous, "a", "staged before")
+
+	next, err := NewWriteBackProxy(backend, dir, 1<<20, 20*time.Millisecond, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { next.Close() })
+	if err := previous.handOver(next); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests still reaching the replaced configuration see and stage
+	// writes in the new one
+	putString(t, previous, "b", "staged after")
+	if got := getString(t, previous, "a", ""); got != "staged before" {
+		t.Errorf("Get(a) = %q", got)
+	}
+	if n := next.pending(); n != 2 {
+		t.Errorf("%d writes staged in the new proxy, want 2", n)
+	}
+	if _, err := backend.Head("a"); !isNotFound(err) {
+		t.Errorf("a reached the backend before the upload: %v", err)
+	}
+
+	next.Start()
+	if n := next.Drain(5 * time.Second); n != 0 {
+		t.Fatalf("%d writes left after draining", n)
+	}
+	if got := getString(t, backend, "b", ""); got != "staged after" {
+		t.Errorf("backend has b = %q", got)
+	}
+}
+
+func TestWriteBackConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  WriteBackConfig
+		wantErr bool
+	}{
+		{name: "minimal", config: WriteBackConfig{Dir: "/tmp/staging", MaxSize: 1 << 30}},
+		{name: "full", config: WriteBackConfig{Dir: "/tmp/staging", MaxSize: 1 << 30, RetryInterval: "30s", Uploaders: 8, DrainTimeout: "5m"}},
+		{name: "no dir", config: WriteBackConfig{MaxSize: 1 << 30}, wantErr: true},
+		{name: "no max size", config: WriteBackConfig{Dir: "/tmp/staging"}, wantErr: true},
+		{name: "bad retry interval", config: WriteBackConfig{Dir: "/tmp/staging", MaxSize: 1, RetryInterval: "soon"}, wantErr: true},
+		{name: "negative drain timeout", config: WriteBackConfig{Dir: "/tmp/staging", MaxSize: 1, DrainTimeout: "-1s"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}